@@ -0,0 +1,253 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- アクセスユニット ---
+
+// accessUnit は1ピクチャ分のNALユニット (スタートコードなし) です
+type accessUnit struct {
+	codec string    // "h264" または "h265"
+	nals  [][]byte  // キーフレームの場合はパラメータセットを含む
+	time  time.Time // 最初のNALユニットを受け取った時刻
+	key   bool      // IRAPピクチャ (IDR/CRA など) か
+	gap   bool      // 購読者のキューが満杯のため、直前のアクセスユニットが欠落した
+}
+
+// --- アクセスユニットの配信 ---
+
+// auHub はストリームのNALユニットをアクセスユニットにまとめ、録画やクリップなどの購読者に配信します。
+// 購読者がいない間はNALユニットをコピーせずに破棄します。
+type auHub struct {
+	ch      chan nalBatch
+	drops   *atomic.Uint64
+	active  atomic.Int32 // 購読者数
+	dropped atomic.Bool  // 入力キューが満杯のためNALユニットを破棄した
+
+	mutex       sync.Mutex
+	subscribers map[*auSubscriber]bool
+	closed      bool
+
+	asm auAssembler // run のゴルーチンのみで使用
+}
+
+type nalBatch struct {
+	codec string
+	nals  [][]byte
+	at    time.Time
+	gap   bool
+}
+
+// auSubscriber はアクセスユニットの購読者です。
+// キューが満杯の間のアクセスユニットは破棄され、次に届くアクセスユニットの gap が true になります。
+type auSubscriber struct {
+	ch    chan accessUnit
+	drops *atomic.Uint64
+	gap   bool
+}
+
+func newAUHub(name string) *auHub {
+	h := &auHub{
+		ch:          make(chan nalBatch, 1024),
+		drops:       channelDrops.with(name, "access-unit"),
+		subscribers: make(map[*auSubscriber]bool),
+	}
+	go h.run()
+	return h
+}
+
+// write はNALユニット (スタートコードなし) を配信キューに追加します。
+// s.mutex を保持したホットパスから呼び出されるため待機せず、キューが満杯の場合は破棄します。
+func (h *auHub) write(codec string, nals [][]byte) {
+	if h.active.Load() == 0 {
+		// 購読者が現れたときに古いアクセスユニットを組み立てないよう、次のデータで組み立てをやり直す
+		h.dropped.Store(true)
+		return
+	}
+	if len(nals) == 0 {
+		return
+	}
+	copied := make([][]byte, len(nals))
+	for i, nal := range nals {
+		copied[i] = append([]byte(nil), nal...)
+	}
+	select {
+	case h.ch <- nalBatch{codec: codec, nals: copied, at: time.Now(), gap: h.dropped.Swap(false)}:
+	default:
+		h.dropped.Store(true)
+		h.drops.Add(1)
+	}
+}
+
+func (h *auHub) run() {
+	for batch := range h.ch {
+		if batch.gap {
+			h.asm.reset()
+		}
+		aus := h.asm.push(batch.codec, batch.nals, batch.at)
+		h.mutex.Lock()
+		for sub := range h.subscribers {
+			sub.gap = sub.gap || batch.gap
+			for _, au := range aus {
+				au.gap = sub.gap
+				select {
+				case sub.ch <- au:
+					sub.gap = false
+				default:
+					sub.gap = true
+					sub.drops.Add(1)
+				}
+			}
+		}
+		h.mutex.Unlock()
+	}
+}
+
+// subscribe はアクセスユニットの購読を開始します。最初のアクセスユニットの gap は true です。
+func (h *auHub) subscribe(queue int, drops *atomic.Uint64) *auSubscriber {
+	sub := &auSubscriber{ch: make(chan accessUnit, queue), drops: drops, gap: true}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		close(sub.ch)
+		return sub
+	}
+	h.subscribers[sub] = true
+	h.active.Add(1)
+	return sub
+}
+
+// unsubscribe は購読を終了し、購読者のチャネルを閉じます
+func (h *auHub) unsubscribe(sub *auSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.subscribers[sub] {
+		return
+	}
+	delete(h.subscribers, sub)
+	h.active.Add(-1)
+	close(sub.ch)
+}
+
+// close は配信を終了し、すべての購読者のチャネルを閉じます (ストリームの削除時に使用)
+func (h *auHub) close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.ch)
+	for sub := range h.subscribers {
+		delete(h.subscribers, sub)
+		close(sub.ch)
+	}
+	h.active.Store(0)
+}
+
+// --- アクセスユニットの組み立て ---
+
+// auAssembler は入力ごとに異なる単位 (1NALずつ、またはアクセスユニット単位) で渡される
+// NALユニットをアクセスユニットにまとめます。境界はスライスヘッダーの先頭スライスフラグと、
+// スライスの後に現れるパラメータセット・AUD・SEIで判定します。
+// キーフレームにパラメータセットが含まれない場合は、直近のパラメータセットを先頭に付加します。
+type auAssembler struct {
+	codec  string
+	params map[byte][]byte // NALタイプごとの最新パラメータセット
+	au     [][]byte
+	start  time.Time
+}
+
+// push はNALユニットを追加し、完成したアクセスユニットを返します。
+// コーデックが変わった場合は組み立て中のアクセスユニットとパラメータセットを破棄します。
+func (a *auAssembler) push(codec string, nals [][]byte, at time.Time) []accessUnit {
+	if codec != a.codec || a.params == nil {
+		a.codec = codec
+		a.params = make(map[byte][]byte)
+		a.au = nil
+	}
+	var out []accessUnit
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		nalType, _, param, _ := classifyNAL(codec, nal)
+		if param {
+			a.params[nalType] = nal
+		}
+		if a.hasSlice() && (isFirstSlice(codec, nal) || startsAccessUnit(codec, nal)) {
+			out = append(out, a.finish())
+		}
+		if len(a.au) == 0 {
+			a.start = at
+		}
+		a.au = append(a.au, nal)
+	}
+	return out
+}
+
+// reset は組み立て中のアクセスユニットを破棄します (データが欠落した場合など)
+func (a *auAssembler) reset() {
+	a.au = nil
+}
+
+// parameterSets は最新のパラメータセットをNALタイプ順 (VPS, SPS, PPS) に返します
+func (a *auAssembler) parameterSets() [][]byte {
+	var out [][]byte
+	for t := 0; t < 256; t++ {
+		if ps, ok := a.params[byte(t)]; ok {
+			out = append(out, ps)
+		}
+	}
+	return out
+}
+
+// hasParameterSets はデコードに必要なパラメータセット (H.264: SPS/PPS、H.265: VPS/SPS/PPS) が揃っているかを返します
+func (a *auAssembler) hasParameterSets() bool {
+	if a.codec == "h265" {
+		return a.params[32] != nil && a.params[33] != nil && a.params[34] != nil
+	}
+	return a.params[7] != nil && a.params[8] != nil
+}
+
+func (a *auAssembler) hasSlice() bool {
+	for _, nal := range a.au {
+		if isSlice(a.codec, nal) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *auAssembler) finish() accessUnit {
+	au := accessUnit{codec: a.codec, nals: a.au, time: a.start}
+	a.au = nil
+	hasParams := false
+	for _, nal := range au.nals {
+		_, key, param, _ := classifyNAL(au.codec, nal)
+		if param {
+			hasParams = true
+		} else if key {
+			au.key = true
+		}
+	}
+	if au.key && !hasParams {
+		au.nals = append(a.parameterSets(), au.nals...)
+	}
+	return au
+}
+
+// startsAccessUnit はスライスの後に現れた場合に新しいアクセスユニットを開始するNALユニットかを返します
+func startsAccessUnit(codec string, nal []byte) bool {
+	nalType, _, param, _ := classifyNAL(codec, nal)
+	if param {
+		return true
+	}
+	if codec == "h265" {
+		return nalType == 35 || nalType == 39 // AUD, prefix SEI
+	}
+	return nalType == 9 || nalType == 6 // AUD, SEI
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// テスト用のNALユニット (スタートコードなし)
+var (
+	h264SPS      = []byte{0x67, 0x42, 0x00, 0x1f}
+	h264PPS      = []byte{0x68, 0xce, 0x3c, 0x80}
+	h264AUD      = []byte{0x09, 0xf0}
+	h264SEI      = []byte{0x06, 0x05, 0x01}
+	h264IDR      = []byte{0x65, 0x88, 0x84}
+	h264IDRNext  = []byte{0x65, 0x00, 0x84} // 2番目以降のスライス (first_mb_in_slice != 0)
+	h264P        = []byte{0x41, 0x9a, 0x01}
+	h264P2       = []byte{0x41, 0x9a, 0x02}
+	h265VPS      = []byte{0x40, 0x01, 0x0c}
+	h265SPS      = []byte{0x42, 0x01, 0x01}
+	h265PPS      = []byte{0x44, 0x01, 0xc1}
+	h265IDR      = []byte{0x26, 0x01, 0xaf}
+	h265Trail    = []byte{0x02, 0x01, 0xd0}
+	h265TrailCut = []byte{0x02, 0x01, 0x50} // 2番目以降のスライスセグメント
+)
+
+func TestAUAssemblerPush(t *testing.T) {
+	type batch struct {
+		codec string
+		nals  [][]byte
+	}
+	tests := []struct {
+		name    string
+		batches []batch
+		want    []accessUnit
+	}{
+		{
+			name: "1NALずつ",
+			batches: []batch{
+				{"h264", [][]byte{h264SPS}},
+				{"h264", [][]byte{h264PPS}},
+				{"h264", [][]byte{h264IDR}},
+				{"h264", [][]byte{h264P}},
+				{"h264", [][]byte{h264P2}},
+			},
+			want: []accessUnit{
+				{codec: "h264", nals: [][]byte{h264SPS, h264PPS, h264IDR}, key: true},
+				{codec: "h264", nals: [][]byte{h264P}},
+			},
+		},
+		{
+			name: "アクセスユニット単位",
+			batches: []batch{
+				{"h264", [][]byte{h264AUD, h264SPS, h264PPS, h264IDR}},
+				{"h264", [][]byte{h264AUD, h264P}},
+				{"h264", [][]byte{h264AUD, h264P2}},
+			},
+			want: []accessUnit{
+				{codec: "h264", nals: [][]byte{h264AUD, h264SPS, h264PPS, h264IDR}, key: true},
+				{codec: "h264", nals: [][]byte{h264AUD, h264P}},
+			},
+		},
+		{
+			name: "複数スライス",
+			batches: []batch{
+				{"h264", [][]byte{h264SPS, h264PPS, h264IDR, h264IDRNext, h264P}},
+			},
+			want: []accessUnit{
+				{codec: "h264", nals: [][]byte{h264SPS, h264PPS, h264IDR, h264IDRNext}, key: true},
+			},
+		},
+		{
+			name: "SEIで区切る",
+			batches: []batch{
+				{"h264", [][]byte{h264P, h264SEI, h264P2, h264P}},
+			},
+			want: []accessUnit{
+				{codec: "h264", nals: [][]byte{h264P}},
+				{codec: "h264", nals: [][]byte{h264SEI, h264P2}},
+			},
+		},
+		{
+			name: "パラメータセットのないキーフレームに付加",
+			batches: []batch{
+				{"h264", [][]byte{h264SPS, h264PPS, h264IDR}},
+				{"h264", [][]byte{h264P}},
+				{"h264", [][]byte{h264IDR}},
+				{"h264", [][]byte{h264P2}},
+			},
+			want: []accessUnit{
+				{codec: "h264", nals: [][]byte{h264SPS, h264PPS, h264IDR}, key: true},
+				{codec: "h264", nals: [][]byte{h264P}},
+				{codec: "h264", nals: [][]byte{h264SPS, h264PPS, h264IDR}, key: true},
+			},
+		},
+		{
+			name: "H.265",
+			batches: []batch{
+				{"h265", [][]byte{h265VPS, h265SPS, h265PPS, h265IDR}},
+				{"h265", [][]byte{h265Trail, h265TrailCut}},
+				{"h265", [][]byte{h265Trail}},
+			},
+			want: []accessUnit{
+				{codec: "h265", nals: [][]byte{h265VPS, h265SPS, h265PPS, h265IDR}, key: true},
+				{codec: "h265", nals: [][]byte{h265Trail, h265TrailCut}},
+			},
+		},
+		{
+			name: "空のNALは無視",
+			batches: []batch{
+				{"h264", [][]byte{{}, h264P, {}, h264P2}},
+			},
+			want: []accessUnit{
+				{codec: "h264", nals: [][]byte{h264P}},
+			},
+		},
+		{
+			name: "途中で切れたNAL",
+			batches: []batch{
+				{"h264", [][]byte{{0x65}, h264P}},
+				{"h265", [][]byte{{0x26}, h265Trail, h265Trail}},
+			},
+			want: []accessUnit{
+				{codec: "h264", nals: [][]byte{{0x65}}, key: true},
+				{codec: "h265", nals: [][]byte{{0x26}, h265Trail}},
+			},
+		},
+		{
+			name: "コーデックの変更で組み立て中のデータを破棄",
+			batches: []batch{
+				{"h264", [][]byte{h264SPS, h264PPS, h264IDR}},
+				{"h265", [][]byte{h265IDR, h265Trail}},
+			},
+			want: []accessUnit{
+				// H.264のパラメータセットは引き継がない
+				{codec: "h265", nals: [][]byte{h265IDR}, key: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a auAssembler
+			var got []accessUnit
+			for _, b := range tt.batches {
+				got = append(got, a.push(b.codec, b.nals, time.Time{})...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAUAssemblerTime(t *testing.T) {
+	var a auAssembler
+	t0 := time.Unix(100, 0)
+	t1 := t0.Add(10 * time.Millisecond)
+	t2 := t0.Add(40 * time.Millisecond)
+
+	a.push("h264", [][]byte{h264IDR}, t0)
+	a.push("h264", [][]byte{h264IDRNext}, t1)
+	aus := a.push("h264", [][]byte{h264P}, t2)
+	if len(aus) != 1 {
+		t.Fatalf("got %d access units, want 1", len(aus))
+	}
+	if !aus[0].time.Equal(t0) {
+		t.Errorf("time = %v, want %v (最初のNALの時刻)", aus[0].time, t0)
+	}
+}
+
+func TestAUAssemblerReset(t *testing.T) {
+	var a auAssembler
+	a.push("h264", [][]byte{h264SPS, h264PPS, h264IDR}, time.Time{})
+	a.reset()
+	if aus := a.push("h264", [][]byte{h264P, h264P2}, time.Time{}); len(aus) != 1 || !reflect.DeepEqual(aus[0].nals, [][]byte{h264P}) {
+		t.Errorf("reset 後のアクセスユニット = %v, want [[P]]", aus)
+	}
+	if !a.hasParameterSets() {
+		t.Error("reset でパラメータセットが破棄された")
+	}
+}
+
+func TestAUAssemblerHasParameterSets(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec string
+		nals  [][]byte
+		want  bool
+	}{
+		{"H.264 SPS/PPS", "h264", [][]byte{h264SPS, h264PPS}, true},
+		{"H.264 SPSのみ", "h264", [][]byte{h264SPS}, false},
+		{"H.265 VPS/SPS/PPS", "h265", [][]byte{h265VPS, h265SPS, h265PPS}, true},
+		{"H.265 VPSなし", "h265", [][]byte{h265SPS, h265PPS}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a auAssembler
+			a.push(tt.codec, tt.nals, time.Time{})
+			if got := a.hasParameterSets(); got != tt.want {
+				t.Errorf("hasParameterSets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h265"
+)
+
+// --- 管理API (/api/v1) ---
+
+// adminAPI はストリーム・視聴者・入力パイプラインを実行時に参照・操作するREST APIです。
+// すべてのリクエストに Authorization: Bearer <-admin-token> が必要です。
+type adminAPI struct {
+	token    string
+	defaults props // 実行時に追加するストリームで省略した項目の既定値
+}
+
+// ingestInfo は入力パイプラインの状態です
+type ingestInfo struct {
+	State         string `json:"state"` // "idle", "connecting", "connected", "reconnecting", "finished"
+	PID           int    `json:"pid,omitempty"`
+	TranscoderPID int    `json:"transcoder-pid,omitempty"` // H.264視聴者向けフォールバック用トランスコーダー
+	Restarts      int    `json:"restarts"`
+	Stalled       bool   `json:"stalled"` // 映像が -stall-timeout を超えて届いていない
+	Codec         string `json:"codec"`
+	Width         int    `json:"width,omitempty"`
+	Height        int    `json:"height,omitempty"`
+	FPS           int    `json:"fps"`
+	BitrateKbps   int    `json:"bitrate-kbps"`
+}
+
+// streamInfo は GET /api/v1/streams で返すストリームの情報です
+type streamInfo struct {
+	Name        string     `json:"name"`
+	InputType   string     `json:"input-type,omitempty"` // RTSPサーバーへのPUSHの場合は空
+	InputURL    string     `json:"input-url,omitempty"`
+	OnDemand    bool       `json:"on-demand"`
+	MaxViewers  int        `json:"max-viewers,omitempty"`
+	Viewers     int        `json:"viewers"`
+	RTSPReaders int        `json:"rtsp-readers"`
+	Ingest      ingestInfo `json:"ingest"`
+	Recording   string     `json:"recording,omitempty"` // 書き込み中の録画セグメント
+	HLS         string     `json:"hls,omitempty"`       // HLSのプレイリストのパス
+	DASH        string     `json:"dash,omitempty"`      // DASHのマニフェストのパス (HLSとセグメントを共有)
+}
+
+// viewerInfo は GET /api/v1/streams/{name}/viewers で返す視聴者の情報です
+type viewerInfo struct {
+	ID            uint64    `json:"id"`
+	Subject       string    `json:"subject,omitempty"`
+	RemoteAddr    string    `json:"remote-addr"`               // シグナリングの接続元
+	ICERemoteAddr string    `json:"ice-remote-addr,omitempty"` // 選択されたICE候補ペアのリモートアドレス
+	ICEState      string    `json:"ice-state,omitempty"`       // WebRTCの視聴者のみ
+	Transport     string    `json:"transport"`                 // "webrtc"、"mse" または "playback" (録画の再生)
+	Codec         string    `json:"codec,omitempty"`
+	ConnectedAt   time.Time `json:"connected-at"`
+}
+
+// newAdminAPI は管理APIのハンドラーを作成します
+func newAdminAPI(token string, defaults props) http.Handler {
+	a := &adminAPI{token: token, defaults: defaults}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/streams", a.listStreams)
+	mux.HandleFunc("POST /api/v1/streams", a.addStream)
+	mux.HandleFunc("GET /api/v1/streams/{name}", a.getStream)
+	mux.HandleFunc("DELETE /api/v1/streams/{name}", a.removeStream)
+	mux.HandleFunc("POST /api/v1/streams/{name}/restart", a.restartStream)
+	mux.HandleFunc("GET /api/v1/streams/{name}/viewers", a.listViewers)
+	mux.HandleFunc("DELETE /api/v1/streams/{name}/viewers/{id}", a.kickViewer)
+	mux.HandleFunc("GET /api/v1/streams/{name}/clips", a.listClips)
+	mux.HandleFunc("POST /api/v1/streams/{name}/clips", a.triggerClip)
+	mux.HandleFunc("POST /api/v1/streams/{name}/clips/{id}/stop", a.stopClip)
+	mux.HandleFunc("GET /api/v1/events", a.streamEvents)
+	mux.HandleFunc("GET /api/v1/log-level", a.getLogLevel)
+	mux.HandleFunc("PUT /api/v1/log-level", a.setLogLevel)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hmac.Equal([]byte(token), []byte(a.token)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("管理API: レスポンスの書き込みエラー", "error", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
+
+// streamFromPath はパスの {name} からストリームを検索し、存在しない場合は404を返します
+func streamFromPath(w http.ResponseWriter, r *http.Request) *stream {
+	s := lookupStream(r.PathValue("name"))
+	if s == nil {
+		writeAdminError(w, http.StatusNotFound, "stream not found")
+	}
+	return s
+}
+
+func (a *adminAPI) listStreams(w http.ResponseWriter, r *http.Request) {
+	list := allStreams()
+	result := make([]streamInfo, 0, len(list))
+	for _, s := range list {
+		result = append(result, describeStream(s))
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func (a *adminAPI) getStream(w http.ResponseWriter, r *http.Request) {
+	if s := streamFromPath(w, r); s != nil {
+		writeAdminJSON(w, http.StatusOK, describeStream(s))
+	}
+}
+
+// addStream は -streams のJSON設定ファイルと同じ形式の1ストリーム分の設定からストリームを追加します
+func (a *adminAPI) addStream(w http.ResponseWriter, r *http.Request) {
+	var c streamConfig
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "JSONの解析エラー: "+err.Error())
+		return
+	}
+	if lookupStream(c.Name) != nil {
+		writeAdminError(w, http.StatusConflict, "stream already exists")
+		return
+	}
+	p, err := c.toProps(a.defaults)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s, err := startPipeline(p)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.logger.Info("管理API: ストリームを追加しました", "input_url", s.inputURL, "input_type", s.inputType)
+	events.publish(event{Type: eventStreamAdded, Stream: s.name})
+	writeAdminJSON(w, http.StatusCreated, describeStream(s))
+}
+
+// removeStream は入力パイプラインを停止し、視聴者とRTSPリーダーを切断してストリームを削除します
+func (a *adminAPI) removeStream(w http.ResponseWriter, r *http.Request) {
+	s := streamFromPath(w, r)
+	if s == nil {
+		return
+	}
+	unregisterStream(s)
+	s.close()
+	s.logger.Info("管理API: ストリームを削除しました")
+	events.publish(event{Type: eventStreamRemoved, Stream: s.name})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) restartStream(w http.ResponseWriter, r *http.Request) {
+	s := streamFromPath(w, r)
+	if s == nil {
+		return
+	}
+	if err := s.restartIngest(); err != nil {
+		writeAdminError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusAccepted, describeStream(s))
+}
+
+func (a *adminAPI) listViewers(w http.ResponseWriter, r *http.Request) {
+	s := streamFromPath(w, r)
+	if s == nil {
+		return
+	}
+	sessions := s.viewerSessions()
+	result := make([]viewerInfo, 0, len(sessions))
+	for _, v := range sessions {
+		result = append(result, describeViewer(v))
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func (a *adminAPI) kickViewer(w http.ResponseWriter, r *http.Request) {
+	s := streamFromPath(w, r)
+	if s == nil {
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid viewer id")
+		return
+	}
+	for _, v := range s.viewerSessions() {
+		if v.id == id {
+			s.logger.Info("管理API: 視聴者を切断します", "viewer", v.id, "remote", v.remoteAddr)
+			v.kick("kicked by operator")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeAdminError(w, http.StatusNotFound, "viewer not found")
+}
+
+// clipperFromPath はパスの {name} のストリームの clipper を返します。
+// ストリームが存在しない場合は404、クリップ録画が無効の場合は409を返します。
+func clipperFromPath(w http.ResponseWriter, r *http.Request) *clipper {
+	s := streamFromPath(w, r)
+	if s == nil {
+		return nil
+	}
+	c := s.clipperOf()
+	if c == nil {
+		writeAdminError(w, http.StatusConflict, "clips are not enabled for this stream")
+	}
+	return c
+}
+
+func (a *adminAPI) listClips(w http.ResponseWriter, r *http.Request) {
+	if c := clipperFromPath(w, r); c != nil {
+		writeAdminJSON(w, http.StatusOK, c.activeClips())
+	}
+}
+
+// triggerClip はクリップの書き込みを開始します (ドアセンサーなどからの呼び出しを想定し、本文は省略可能)。
+// 書き込み中のクリップがある場合は終了時刻を延長して 200 を返します。
+func (a *adminAPI) triggerClip(w http.ResponseWriter, r *http.Request) {
+	c := clipperFromPath(w, r)
+	if c == nil {
+		return
+	}
+	var req struct {
+		Label    string `json:"label"`
+		Duration string `json:"duration"` // 例: "30s" (省略時は stop または -clip-max-duration まで)
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeAdminError(w, http.StatusBadRequest, "JSONの解析エラー: "+err.Error())
+		return
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "duration の解析エラー: "+err.Error())
+			return
+		}
+		duration = d
+	}
+	info, created, err := c.trigger(req.Label, duration)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeAdminJSON(w, status, info)
+}
+
+func (a *adminAPI) stopClip(w http.ResponseWriter, r *http.Request) {
+	c := clipperFromPath(w, r)
+	if c == nil {
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid clip id")
+		return
+	}
+	info, err := c.stopClip(id)
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, "clip not found")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, info)
+}
+
+// streamEvents はイベントを Server-Sent Events で配信します。
+// クエリ types ("viewer.*,publisher.connected" など) と stream で絞り込めます。
+// 再接続時は Last-Event-ID ヘッダーにより、保持している直近のイベントから再送します。
+func (a *adminAPI) streamEvents(w http.ResponseWriter, r *http.Request) {
+	var types []string
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	streamName := r.URL.Query().Get("stream")
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	logger := slog.With("remote", r.RemoteAddr)
+	sub := events.subscribe(types, 256, lastID, func() {
+		warnRateLimited(logger, "sse", "管理API: SSEの送信が追いつかないためイベントを破棄しました")
+	})
+	defer events.unsubscribe(sub)
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e := <-sub.ch:
+			if streamName != "" && e.Stream != streamName {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// logLevelInfo は GET/PUT /api/v1/log-level で扱うログレベルです
+type logLevelInfo struct {
+	Level string `json:"level"`
+}
+
+func (a *adminAPI) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, logLevelInfo{Level: strings.ToLower(logLevel.Level().String())})
+}
+
+// setLogLevel は再起動せずにログレベルを変更します (例: {"level":"debug"})
+func (a *adminAPI) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelInfo
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, "JSONの解析エラー: "+err.Error())
+		return
+	}
+	if err := setLogLevel(req.Level); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	slog.Info("管理API: ログレベルを変更しました", "level", logLevel.Level())
+	a.getLogLevel(w, r)
+}
+
+// describeStream はストリームの現在の状態を streamInfo にまとめます
+func describeStream(s *stream) streamInfo {
+	state, pid, restarts := s.ingestStatus()
+	info := streamInfo{
+		Name:       s.name,
+		InputType:  s.inputType,
+		InputURL:   s.inputURL,
+		MaxViewers: s.maxViewers,
+		Ingest: ingestInfo{
+			State:       state,
+			PID:         pid,
+			Restarts:    restarts,
+			FPS:         int(s.fps.Load()),
+			BitrateKbps: s.bitrateKbps(),
+		},
+	}
+	s.ingestMutex.Lock()
+	info.OnDemand = s.onDemand
+	info.Ingest.Stalled = s.stalled
+	s.ingestMutex.Unlock()
+
+	s.mutex.RLock()
+	info.Ingest.Codec = s.codec
+	info.Viewers = len(s.viewers)
+	info.RTSPReaders = s.rtspReaders
+	if s.transcoder != nil && s.transcoder.cmd.Process != nil {
+		info.Ingest.TranscoderPID = s.transcoder.cmd.Process.Pid
+	}
+	s.mutex.RUnlock()
+
+	info.Ingest.Width, info.Ingest.Height = streamResolution(s, info.Ingest.Codec)
+	info.Recording = s.recordingFile()
+	if s.hlsMuxerOf() != nil {
+		info.HLS = "/hls/" + s.name + "/index.m3u8"
+		info.DASH = "/dash/" + s.name + "/manifest.mpd"
+	}
+	return info
+}
+
+// streamResolution はGOPキャッシュのSPSから入力映像の解像度を返します (不明な場合は0)
+func streamResolution(s *stream, codec string) (width, height int) {
+	if codec == "h265" {
+		for _, nal := range s.gopH265.parameterSets() {
+			if len(nal) >= 2 && (nal[0]>>1)&0x3F == 33 {
+				var sps h265.SPS
+				if err := sps.Unmarshal(nal); err == nil {
+					return sps.Width(), sps.Height()
+				}
+			}
+		}
+		return 0, 0
+	}
+	for _, nal := range s.gopH264.parameterSets() {
+		if len(nal) >= 1 && nal[0]&0x1F == 7 {
+			var sps h264.SPS
+			if err := sps.Unmarshal(nal); err == nil {
+				return sps.Width(), sps.Height()
+			}
+		}
+	}
+	return 0, 0
+}
+
+// describeViewer は視聴者のICE接続状態と選択された候補ペアを viewerInfo にまとめます
+func describeViewer(v *viewerSession) viewerInfo {
+	info := viewerInfo{
+		ID:          v.id,
+		Subject:     v.subject,
+		RemoteAddr:  v.remoteAddr,
+		Transport:   v.transport,
+		ConnectedAt: v.connectedAt,
+	}
+	pc, codec := v.peerConnection()
+	info.Codec = codec
+	if v.transport != "mse" {
+		info.ICEState = "new"
+	}
+	if pc == nil {
+		return info
+	}
+	info.ICEState = pc.ICEConnectionState().String()
+	for _, sender := range pc.GetSenders() {
+		transport := sender.Transport()
+		if transport == nil {
+			continue
+		}
+		pair, err := transport.ICETransport().GetSelectedCandidatePair()
+		if err == nil && pair != nil && pair.Remote != nil {
+			info.ICERemoteAddr = net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port)))
+			break
+		}
+	}
+	return info
+}
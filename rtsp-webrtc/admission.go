@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --- 視聴者数・帯域のアドミッション制御 ---
+
+// capacityError は視聴者の受け入れ上限を超えた場合のエラーです。
+// シグナリングでは {"type":"error","code":"capacity_exceeded",...} として視聴者に通知します。
+type capacityError struct {
+	Scope string `json:"scope"` // "stream" または "global"
+	Limit string `json:"limit"` // "viewers" または "bitrate"
+	Max   int    `json:"max"`   // 上限 (視聴者数またはkbps)
+}
+
+func (e *capacityError) Error() string {
+	scope := "全体"
+	if e.Scope == "stream" {
+		scope = "ストリーム"
+	}
+	if e.Limit == "bitrate" {
+		return fmt.Sprintf("%sの送信帯域の上限 (%d kbps) を超えています", scope, e.Max)
+	}
+	return fmt.Sprintf("%sの視聴者数の上限 (%d) に達しています", scope, e.Max)
+}
+
+// admissionWaiter は空きを待っている視聴者です
+type admissionWaiter struct {
+	stream    *stream
+	admitted  chan struct{} // 受け入れられた時にクローズ
+	positions chan int      // 待ち順が変わった時に最新の待ち順を送信 (容量1)
+	position  int
+}
+
+// admissionController は視聴者数と推定送信帯域に基づいて新しい視聴者の受け入れを判定します。
+// 送信帯域は各ストリームの入力ビットレート × 視聴者数で推定します。
+type admissionController struct {
+	maxViewers          int             // 全体の同時視聴者数の上限 (0は無制限)
+	maxViewersPerStream int             // ストリームごとの既定の上限 (ストリーム設定で上書き可能)
+	maxEgressKbps       int             // 全体の推定送信帯域の上限
+	maxStreamEgressKbps int             // ストリームごとの推定送信帯域の上限
+	priority            map[string]bool // 上限を無視して受け入れる視聴者の subject
+
+	mutex   sync.Mutex
+	viewers map[*stream]int
+	total   int
+	queue   []*admissionWaiter
+}
+
+// admission はシグナリングで使用するアドミッション制御です (main で初期化)
+var admission = newAdmissionController(0, 0, 0, 0, nil)
+
+func newAdmissionController(maxViewers, maxViewersPerStream, maxEgressKbps, maxStreamEgressKbps int, priority []string) *admissionController {
+	a := &admissionController{
+		maxViewers:          maxViewers,
+		maxViewersPerStream: maxViewersPerStream,
+		maxEgressKbps:       maxEgressKbps,
+		maxStreamEgressKbps: maxStreamEgressKbps,
+		priority:            make(map[string]bool),
+		viewers:             make(map[*stream]int),
+	}
+	for _, p := range priority {
+		if p != "" {
+			a.priority[p] = true
+		}
+	}
+	return a
+}
+
+// checkLocked は s に視聴者を1人追加できるかを判定します
+func (a *admissionController) checkLocked(s *stream) *capacityError {
+	maxPerStream := a.maxViewersPerStream
+	if s.maxViewers > 0 {
+		maxPerStream = s.maxViewers
+	}
+	if maxPerStream > 0 && a.viewers[s] >= maxPerStream {
+		return &capacityError{Scope: "stream", Limit: "viewers", Max: maxPerStream}
+	}
+	if a.maxViewers > 0 && a.total >= a.maxViewers {
+		return &capacityError{Scope: "global", Limit: "viewers", Max: a.maxViewers}
+	}
+	kbps := s.bitrateKbps()
+	if kbps == 0 {
+		// 入力のビットレートが不明 (オンデマンドで未接続など) の場合は視聴者数のみで判定
+		return nil
+	}
+	if a.maxStreamEgressKbps > 0 && kbps*(a.viewers[s]+1) > a.maxStreamEgressKbps {
+		return &capacityError{Scope: "stream", Limit: "bitrate", Max: a.maxStreamEgressKbps}
+	}
+	if a.maxEgressKbps > 0 {
+		egress := kbps
+		for other, n := range a.viewers {
+			egress += other.bitrateKbps() * n
+		}
+		if egress > a.maxEgressKbps {
+			return &capacityError{Scope: "global", Limit: "bitrate", Max: a.maxEgressKbps}
+		}
+	}
+	return nil
+}
+
+func (a *admissionController) addLocked(s *stream) {
+	a.viewers[s]++
+	a.total++
+}
+
+// admit は視聴者の受け入れを試みます。
+// 上限を超えている場合、queueTimeout が0なら即座に capacityError を返し、
+// そうでなければ空きが出るまで (最大 queueTimeout) 待機します。待機中は onQueued に待ち順が通知されます。
+// ctx がキャンセルされた場合 (待機中の視聴者の切断など) は待機をやめてキューから削除します。
+// 受け入れられた場合は、視聴終了時に呼び出す解放関数を返します。
+func (a *admissionController) admit(ctx context.Context, s *stream, subject string, queueTimeout time.Duration, onQueued func(position int)) (func(), error) {
+	a.mutex.Lock()
+	err := a.checkLocked(s)
+	if err == nil || a.priority[subject] {
+		if err != nil {
+			s.logger.Info("優先視聴者を上限を超えて受け入れます", "subject", subject, "reason", err)
+		}
+		a.addLocked(s)
+		a.mutex.Unlock()
+		return func() { a.release(s) }, nil
+	}
+	if queueTimeout <= 0 {
+		a.mutex.Unlock()
+		return nil, err
+	}
+
+	w := &admissionWaiter{stream: s, admitted: make(chan struct{}), positions: make(chan int, 1)}
+	a.queue = append(a.queue, w)
+	w.position = len(a.queue)
+	position := w.position
+	a.mutex.Unlock()
+
+	s.logger.Info("視聴者を待機キューに追加しました", "position", position, "reason", err)
+	if onQueued != nil {
+		onQueued(position)
+	}
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	for done := false; !done; {
+		select {
+		case <-w.admitted:
+			return func() { a.release(s) }, nil
+		case position := <-w.positions:
+			if onQueued != nil {
+				onQueued(position)
+			}
+		case <-ctx.Done():
+			s.logger.Info("待機中の視聴者が切断しました")
+			done = true
+		case <-timer.C:
+			done = true
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	select {
+	case <-w.admitted:
+		// タイムアウト・切断と同時に受け入れられた
+		return func() { a.release(s) }, nil
+	default:
+	}
+	a.removeWaiterLocked(w)
+	return nil, err
+}
+
+// release は視聴者の枠を解放し、待機中の視聴者を順に受け入れます
+func (a *admissionController) release(s *stream) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.viewers[s] > 0 {
+		a.viewers[s]--
+		a.total--
+		if a.viewers[s] == 0 {
+			delete(a.viewers, s)
+		}
+	}
+	a.processQueueLocked()
+}
+
+// processQueueLocked は待機キューを先頭から確認し、受け入れ可能な視聴者を受け入れます
+func (a *admissionController) processQueueLocked() {
+	remaining := a.queue[:0]
+	for _, w := range a.queue {
+		if a.checkLocked(w.stream) == nil {
+			a.addLocked(w.stream)
+			close(w.admitted)
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	a.queue = remaining
+	a.notifyPositionsLocked()
+}
+
+func (a *admissionController) removeWaiterLocked(w *admissionWaiter) {
+	for i, q := range a.queue {
+		if q == w {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			a.notifyPositionsLocked()
+			return
+		}
+	}
+}
+
+// notifyPositionsLocked は待ち順が変わった視聴者に新しい待ち順を通知します。
+// 通知が読み取られる前に再び変わった場合は最新の待ち順のみを残します。
+func (a *admissionController) notifyPositionsLocked() {
+	for i, w := range a.queue {
+		if w.position == i+1 {
+			continue
+		}
+		w.position = i + 1
+		select {
+		case <-w.positions:
+		default:
+		}
+		w.positions <- w.position
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestWaiter は待ち順 position でキューに入っている視聴者を作成します
+func newTestWaiter(s *stream, position int) *admissionWaiter {
+	return &admissionWaiter{stream: s, admitted: make(chan struct{}), positions: make(chan int, 1), position: position}
+}
+
+func isAdmitted(w *admissionWaiter) bool {
+	select {
+	case <-w.admitted:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestAdmissionAdmit(t *testing.T) {
+	tests := []struct {
+		name       string
+		a          *admissionController
+		maxViewers int   // ストリーム設定の上限
+		bitrates   []int // ストリームごとの入力ビットレート (kbps)
+		viewers    []int // ストリームごとの既存の視聴者数
+		subject    string
+		wantScope  string // 空の場合は受け入れられる
+		wantLimit  string
+		wantMax    int
+	}{
+		{
+			name:    "上限なし",
+			a:       newAdmissionController(0, 0, 0, 0, nil),
+			viewers: []int{10},
+		},
+		{
+			name:      "ストリームの視聴者数の上限",
+			a:         newAdmissionController(0, 1, 0, 0, nil),
+			viewers:   []int{1},
+			wantScope: "stream", wantLimit: "viewers", wantMax: 1,
+		},
+		{
+			name:       "ストリーム設定の上限で上書き",
+			a:          newAdmissionController(0, 5, 0, 0, nil),
+			maxViewers: 2,
+			viewers:    []int{2},
+			wantScope:  "stream", wantLimit: "viewers", wantMax: 2,
+		},
+		{
+			name:      "全体の視聴者数の上限",
+			a:         newAdmissionController(2, 0, 0, 0, nil),
+			viewers:   []int{1, 1},
+			wantScope: "global", wantLimit: "viewers", wantMax: 2,
+		},
+		{
+			name:     "ストリームの送信帯域の上限ちょうど",
+			a:        newAdmissionController(0, 0, 0, 3000, nil),
+			bitrates: []int{1000},
+			viewers:  []int{2},
+		},
+		{
+			name:      "ストリームの送信帯域の上限",
+			a:         newAdmissionController(0, 0, 0, 3000, nil),
+			bitrates:  []int{1000},
+			viewers:   []int{3},
+			wantScope: "stream", wantLimit: "bitrate", wantMax: 3000,
+		},
+		{
+			name:      "全体の送信帯域の上限",
+			a:         newAdmissionController(0, 0, 2500, 0, nil),
+			bitrates:  []int{1000, 1000},
+			viewers:   []int{1, 1},
+			wantScope: "global", wantLimit: "bitrate", wantMax: 2500,
+		},
+		{
+			name:    "ビットレートが不明な場合は視聴者数のみで判定",
+			a:       newAdmissionController(0, 0, 1, 1, nil),
+			viewers: []int{5},
+		},
+		{
+			name:    "優先視聴者は上限を超えて受け入れる",
+			a:       newAdmissionController(1, 1, 0, 0, []string{"operator"}),
+			viewers: []int{1},
+			subject: "operator",
+		},
+		{
+			name:      "優先視聴者以外",
+			a:         newAdmissionController(0, 1, 0, 0, []string{"operator"}),
+			viewers:   []int{1},
+			subject:   "guest",
+			wantScope: "stream", wantLimit: "viewers", wantMax: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var streams []*stream
+			for i, n := range tt.viewers {
+				s := newStream("admission-test", "")
+				if i < len(tt.bitrates) {
+					s.bitrate.Store(int64(tt.bitrates[i]))
+				}
+				for k := 0; k < n; k++ {
+					tt.a.mutex.Lock()
+					tt.a.addLocked(s)
+					tt.a.mutex.Unlock()
+				}
+				streams = append(streams, s)
+			}
+			s := streams[0]
+			s.maxViewers = tt.maxViewers
+			before := tt.a.viewers[s]
+
+			release, err := tt.a.admit(context.Background(), s, tt.subject, 0, nil)
+			if tt.wantScope == "" {
+				if err != nil {
+					t.Fatalf("err = %v", err)
+				}
+				if tt.a.viewers[s] != before+1 {
+					t.Errorf("viewers = %d, want %d", tt.a.viewers[s], before+1)
+				}
+				release()
+				if tt.a.viewers[s] != before {
+					t.Errorf("解放後の viewers = %d, want %d", tt.a.viewers[s], before)
+				}
+				return
+			}
+			var capErr *capacityError
+			if !errors.As(err, &capErr) {
+				t.Fatalf("err = %v, want capacityError", err)
+			}
+			if capErr.Scope != tt.wantScope || capErr.Limit != tt.wantLimit || capErr.Max != tt.wantMax {
+				t.Errorf("got %+v, want %s/%s/%d", capErr, tt.wantScope, tt.wantLimit, tt.wantMax)
+			}
+			if tt.a.viewers[s] != before {
+				t.Errorf("viewers = %d, want %d", tt.a.viewers[s], before)
+			}
+		})
+	}
+}
+
+func TestAdmissionProcessQueue(t *testing.T) {
+	tests := []struct {
+		name          string
+		viewers       []int // ストリームごとの視聴者数 (ストリームごとの上限は1)
+		queue         []int // 待機中の視聴者のストリーム
+		wantAdmitted  []bool
+		wantPositions []int // 残った視聴者の待ち順
+		wantNotified  []int // 待ち順の通知 (通知がない場合は0)
+	}{
+		{
+			name:          "空きがない",
+			viewers:       []int{1},
+			queue:         []int{0, 0},
+			wantAdmitted:  []bool{false, false},
+			wantPositions: []int{1, 2},
+			wantNotified:  []int{0, 0},
+		},
+		{
+			name:          "先頭から受け入れる",
+			viewers:       []int{0},
+			queue:         []int{0, 0},
+			wantAdmitted:  []bool{true, false},
+			wantPositions: []int{1},
+			wantNotified:  []int{1},
+		},
+		{
+			name:          "空きのある他のストリームの視聴者は先に受け入れる",
+			viewers:       []int{1, 0},
+			queue:         []int{0, 1, 0},
+			wantAdmitted:  []bool{false, true, false},
+			wantPositions: []int{1, 2},
+			wantNotified:  []int{0, 2},
+		},
+		{
+			name:         "空のキュー",
+			viewers:      []int{0},
+			queue:        nil,
+			wantAdmitted: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdmissionController(0, 1, 0, 0, nil)
+			var streams []*stream
+			for _, n := range tt.viewers {
+				s := newStream("admission-test", "")
+				for k := 0; k < n; k++ {
+					a.addLocked(s)
+				}
+				streams = append(streams, s)
+			}
+			var waiters []*admissionWaiter
+			for i, idx := range tt.queue {
+				w := newTestWaiter(streams[idx], i+1)
+				waiters = append(waiters, w)
+				a.queue = append(a.queue, w)
+			}
+
+			a.mutex.Lock()
+			a.processQueueLocked()
+			a.mutex.Unlock()
+
+			var admitted []bool
+			for _, w := range waiters {
+				admitted = append(admitted, isAdmitted(w))
+			}
+			if !reflect.DeepEqual(admitted, tt.wantAdmitted) {
+				t.Errorf("admitted = %v, want %v", admitted, tt.wantAdmitted)
+			}
+			var positions, notified []int
+			for _, w := range a.queue {
+				positions = append(positions, w.position)
+				select {
+				case p := <-w.positions:
+					notified = append(notified, p)
+				default:
+					notified = append(notified, 0)
+				}
+			}
+			if !reflect.DeepEqual(positions, tt.wantPositions) {
+				t.Errorf("positions = %v, want %v", positions, tt.wantPositions)
+			}
+			if !reflect.DeepEqual(notified, tt.wantNotified) {
+				t.Errorf("notified = %v, want %v", notified, tt.wantNotified)
+			}
+		})
+	}
+}
+
+// admitResult は別の goroutine で待機した admit の結果です
+type admitResult struct {
+	release func()
+	err     error
+}
+
+// admitAsync は admit を別の goroutine で実行し、待ち順の通知を positions に送ります
+func admitAsync(ctx context.Context, a *admissionController, s *stream, timeout time.Duration, positions chan<- int) <-chan admitResult {
+	result := make(chan admitResult, 1)
+	go func() {
+		release, err := a.admit(ctx, s, "", timeout, func(position int) { positions <- position })
+		result <- admitResult{release, err}
+	}()
+	return result
+}
+
+func receivePosition(t *testing.T, positions <-chan int) int {
+	t.Helper()
+	select {
+	case p := <-positions:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("待ち順が通知されない")
+		return 0
+	}
+}
+
+func receiveResult(t *testing.T, result <-chan admitResult) admitResult {
+	t.Helper()
+	select {
+	case r := <-result:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("admit が終了しない")
+		return admitResult{}
+	}
+}
+
+func TestAdmissionQueue(t *testing.T) {
+	a := newAdmissionController(0, 1, 0, 0, nil)
+	s := newStream("admission-test", "")
+	release, err := a.admit(context.Background(), s, "", time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions := make(chan int, 10)
+	result := admitAsync(context.Background(), a, s, time.Minute, positions)
+	if p := receivePosition(t, positions); p != 1 {
+		t.Fatalf("position = %d, want 1", p)
+	}
+
+	// 視聴者が退出すると待機中の視聴者が受け入れられる
+	release()
+	r := receiveResult(t, result)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if a.viewers[s] != 1 || len(a.queue) != 0 {
+		t.Errorf("viewers = %d, queue = %d; want 1, 0", a.viewers[s], len(a.queue))
+	}
+	r.release()
+	if a.viewers[s] != 0 || a.total != 0 {
+		t.Errorf("解放後の viewers = %d, total = %d", a.viewers[s], a.total)
+	}
+}
+
+func TestAdmissionQueueTimeout(t *testing.T) {
+	a := newAdmissionController(0, 1, 0, 0, nil)
+	s := newStream("admission-test", "")
+	if _, err := a.admit(context.Background(), s, "", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := a.admit(context.Background(), s, "", 10*time.Millisecond, nil)
+	var capErr *capacityError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("err = %v, want capacityError", err)
+	}
+	if len(a.queue) != 0 {
+		t.Errorf("タイムアウトした視聴者がキューに残っている (%d)", len(a.queue))
+	}
+}
+
+func TestAdmissionQueueCancel(t *testing.T) {
+	a := newAdmissionController(0, 1, 0, 0, nil)
+	s := newStream("admission-test", "")
+	release, err := a.admit(context.Background(), s, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstPositions := make(chan int, 10)
+	first := admitAsync(ctx, a, s, time.Minute, firstPositions)
+	receivePosition(t, firstPositions)
+	secondPositions := make(chan int, 10)
+	second := admitAsync(context.Background(), a, s, time.Minute, secondPositions)
+	if p := receivePosition(t, secondPositions); p != 2 {
+		t.Fatalf("position = %d, want 2", p)
+	}
+
+	// 先頭の視聴者が切断すると、キューから削除されて後ろの視聴者の待ち順が繰り上がる
+	cancel()
+	r := receiveResult(t, first)
+	var capErr *capacityError
+	if !errors.As(r.err, &capErr) {
+		t.Fatalf("err = %v, want capacityError", r.err)
+	}
+	if p := receivePosition(t, secondPositions); p != 1 {
+		t.Errorf("position = %d, want 1", p)
+	}
+
+	// 切断した視聴者は枠を消費しない
+	release()
+	r = receiveResult(t, second)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	r.release()
+	if a.total != 0 || len(a.queue) != 0 {
+		t.Errorf("total = %d, queue = %d; want 0, 0", a.total, len(a.queue))
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// --- AMF0 (RTMPのコマンドメッセージ) ---
+
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0ECMAArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0Date        = 0x0B
+	amf0LongString  = 0x0C
+
+	// amf0MaxDepth はオブジェクト・配列の入れ子の上限です。
+	// 入れ子を再帰でデコードするため、不正なデータでスタックを使い果たさないよう制限します。
+	amf0MaxDepth = 32
+)
+
+// amf0Property はAMF0オブジェクトのプロパティです (エンコード時に順序を保つために使用)
+type amf0Property struct {
+	key   string
+	value interface{}
+}
+
+// amf0Properties は順序を保ったAMF0オブジェクトです
+type amf0Properties []amf0Property
+
+// amf0Encode は値を順にAMF0でエンコードします。
+// 使用できる型は nil、float64、int、bool、string、amf0Properties です。
+func amf0Encode(values ...interface{}) []byte {
+	var b []byte
+	for _, v := range values {
+		b = amf0Append(b, v)
+	}
+	return b
+}
+
+func amf0Append(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, amf0Null)
+	case int:
+		return amf0Append(b, float64(v))
+	case float64:
+		b = append(b, amf0Number)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case bool:
+		if v {
+			return append(b, amf0Boolean, 1)
+		}
+		return append(b, amf0Boolean, 0)
+	case string:
+		b = append(b, amf0String)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+		return append(b, v...)
+	case amf0Properties:
+		b = append(b, amf0Object)
+		for _, p := range v {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(p.key)))
+			b = append(b, p.key...)
+			b = amf0Append(b, p.value)
+		}
+		return append(b, 0, 0, amf0ObjectEnd)
+	}
+	panic(fmt.Sprintf("amf0: サポートされていない型 %T", v))
+}
+
+// amf0Decode はAMF0の値をすべてデコードします。
+// オブジェクトとECMA配列は map[string]interface{}、strict array は []interface{} になります。
+func amf0Decode(b []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(b) > 0 {
+		v, rest, err := amf0ReadValue(b, 0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		b = rest
+	}
+	return values, nil
+}
+
+// amf0ReadValue は1つの値をデコードします。depth は値を含むオブジェクト・配列の入れ子の深さです。
+func amf0ReadValue(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > amf0MaxDepth {
+		return nil, nil, fmt.Errorf("amf0: 入れ子が深すぎます")
+	}
+	if len(b) < 1 {
+		return nil, nil, fmt.Errorf("amf0: データが不足しています")
+	}
+	marker, b := b[0], b[1:]
+	switch marker {
+	case amf0Number:
+		if len(b) < 8 {
+			return nil, nil, fmt.Errorf("amf0: 数値が不完全です")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	case amf0Boolean:
+		if len(b) < 1 {
+			return nil, nil, fmt.Errorf("amf0: 真偽値が不完全です")
+		}
+		return b[0] != 0, b[1:], nil
+	case amf0String:
+		return amf0ReadString(b)
+	case amf0LongString:
+		if len(b) < 4 {
+			return nil, nil, fmt.Errorf("amf0: 文字列が不完全です")
+		}
+		n := binary.BigEndian.Uint32(b)
+		if uint32(len(b)-4) < n {
+			return nil, nil, fmt.Errorf("amf0: 文字列が不完全です")
+		}
+		return string(b[4 : 4+n]), b[4+n:], nil
+	case amf0Null, amf0Undefined:
+		return nil, b, nil
+	case amf0Object:
+		return amf0ReadObject(b, depth+1)
+	case amf0ECMAArray:
+		if len(b) < 4 {
+			return nil, nil, fmt.Errorf("amf0: 配列が不完全です")
+		}
+		return amf0ReadObject(b[4:], depth+1)
+	case amf0StrictArray:
+		if len(b) < 4 {
+			return nil, nil, fmt.Errorf("amf0: 配列が不完全です")
+		}
+		n := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		var arr []interface{}
+		for i := uint32(0); i < n; i++ {
+			v, rest, err := amf0ReadValue(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+			b = rest
+		}
+		return arr, b, nil
+	case amf0Date:
+		if len(b) < 10 {
+			return nil, nil, fmt.Errorf("amf0: 日時が不完全です")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[10:], nil
+	}
+	return nil, nil, fmt.Errorf("amf0: サポートされていない型 0x%02x", marker)
+}
+
+func amf0ReadString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, fmt.Errorf("amf0: 文字列が不完全です")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b)-2 < n {
+		return "", nil, fmt.Errorf("amf0: 文字列が不完全です")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func amf0ReadObject(b []byte, depth int) (interface{}, []byte, error) {
+	obj := make(map[string]interface{})
+	for {
+		if len(b) >= 3 && b[0] == 0 && b[1] == 0 && b[2] == amf0ObjectEnd {
+			return obj, b[3:], nil
+		}
+		key, rest, err := amf0ReadString(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, rest, err := amf0ReadValue(rest, depth)
+		if err != nil {
+			return nil, nil, err
+		}
+		obj[key] = v
+		b = rest
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAMF0RoundTrip(t *testing.T) {
+	b := amf0Encode("connect", 1, nil, true,
+		amf0Properties{{"app", "live"}, {"nested", amf0Properties{{"n", 2.5}}}})
+	got, err := amf0Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"connect", 1.0, nil, true,
+		map[string]interface{}{"app": "live", "nested": map[string]interface{}{"n": 2.5}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v\nwant %#v", got, want)
+	}
+}
+
+func TestAMF0Decode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []interface{}
+		wantErr bool
+	}{
+		{name: "空", data: nil, want: nil},
+		{name: "数値", data: []byte{amf0Number, 0x40, 0x08, 0, 0, 0, 0, 0, 0}, want: []interface{}{3.0}},
+		{name: "数値が途中で切れた", data: []byte{amf0Number, 0x40, 0x08, 0}, wantErr: true},
+		{name: "真偽値が途中で切れた", data: []byte{amf0Boolean}, wantErr: true},
+		{name: "文字列", data: []byte{amf0String, 0, 2, 'o', 'k'}, want: []interface{}{"ok"}},
+		{name: "文字列の長さが途中で切れた", data: []byte{amf0String, 0}, wantErr: true},
+		{name: "文字列が途中で切れた", data: []byte{amf0String, 0, 5, 'a', 'b'}, wantErr: true},
+		{name: "長い文字列", data: []byte{amf0LongString, 0, 0, 0, 1, 'x'}, want: []interface{}{"x"}},
+		{name: "長い文字列が途中で切れた", data: []byte{amf0LongString, 0xff, 0xff, 0xff, 0xff, 'x'}, wantErr: true},
+		{name: "長い文字列の長さが途中で切れた", data: []byte{amf0LongString, 0, 0}, wantErr: true},
+		{name: "null と undefined", data: []byte{amf0Null, amf0Undefined}, want: []interface{}{nil, nil}},
+		{name: "空のオブジェクト", data: []byte{amf0Object, 0, 0, amf0ObjectEnd}, want: []interface{}{map[string]interface{}{}}},
+		{name: "終端のないオブジェクト", data: []byte{amf0Object, 0, 1, 'k', amf0Null}, wantErr: true},
+		{name: "オブジェクトの値がない", data: []byte{amf0Object, 0, 1, 'k'}, wantErr: true},
+		{
+			name: "ECMA配列",
+			data: []byte{amf0ECMAArray, 0, 0, 0, 1, 0, 1, 'k', amf0Boolean, 1, 0, 0, amf0ObjectEnd},
+			want: []interface{}{map[string]interface{}{"k": true}},
+		},
+		{name: "ECMA配列の要素数が途中で切れた", data: []byte{amf0ECMAArray, 0, 0}, wantErr: true},
+		{
+			name: "strict array",
+			data: []byte{amf0StrictArray, 0, 0, 0, 2, amf0Null, amf0Boolean, 0},
+			want: []interface{}{[]interface{}{nil, false}},
+		},
+		{name: "strict array の要素が不足", data: []byte{amf0StrictArray, 0xff, 0xff, 0xff, 0xff, amf0Null}, wantErr: true},
+		{name: "strict array の要素数が途中で切れた", data: []byte{amf0StrictArray, 0}, wantErr: true},
+		{name: "日時", data: []byte{amf0Date, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, want: []interface{}{0.0}},
+		{name: "日時が途中で切れた", data: []byte{amf0Date, 0, 0, 0, 0, 0, 0, 0, 0, 0}, wantErr: true},
+		{name: "サポートされていない型", data: []byte{0x11}, wantErr: true},
+		{name: "入れ子の上限", data: nestedAMF0Objects(amf0MaxDepth), want: []interface{}{nestedMaps(amf0MaxDepth)}},
+		{name: "入れ子が深すぎる", data: nestedAMF0Objects(2 * amf0MaxDepth), wantErr: true},
+		{name: "strict array の入れ子が深すぎる", data: nestedAMF0Arrays(100000), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := amf0Decode(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v\nwant %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// nestedAMF0Objects は depth 段に入れ子になったオブジェクトを返します
+func nestedAMF0Objects(depth int) []byte {
+	var b []byte
+	for i := 0; i < depth; i++ {
+		b = append(b, amf0Object)
+		if i < depth-1 {
+			b = append(b, 0, 1, 'k')
+		}
+	}
+	for i := 0; i < depth; i++ {
+		b = append(b, 0, 0, amf0ObjectEnd)
+	}
+	return b
+}
+
+func nestedMaps(depth int) map[string]interface{} {
+	m := map[string]interface{}{}
+	for i := 1; i < depth; i++ {
+		m = map[string]interface{}{"k": m}
+	}
+	return m
+}
+
+// nestedAMF0Arrays は要素を1つ持つ strict array を depth 段に入れ子にします (終端なし)
+func nestedAMF0Arrays(depth int) []byte {
+	return bytes.Repeat([]byte{amf0StrictArray, 0, 0, 0, 1}, depth)
+}
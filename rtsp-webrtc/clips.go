@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- イベントトリガーのクリップ録画 ---
+
+// clipConfig はクリップ録画の設定です
+type clipConfig struct {
+	dir         string        // クリップのルートディレクトリ (<dir>/<ストリーム名>/<日付>/<時刻>_<ID>.mp4)
+	preRoll     time.Duration // トリガーより前に遡って含める時間
+	maxDuration time.Duration // トリガーからクリップを終了するまでの最大時間
+}
+
+// clipping はクリップ録画の設定です (main でフラグから設定)
+var clipping = clipConfig{dir: "clips", preRoll: 10 * time.Second, maxDuration: 5 * time.Minute}
+
+const (
+	clipQueueSize       = 1024
+	clipPreRollMaxBytes = 64 * 1024 * 1024 // pre-roll バッファの上限 (高ビットレート時のメモリ使用量を抑える)
+)
+
+var (
+	clipsCompleted = newCounterVec("rtsp2webrtc_clips_total",
+		"書き込みを完了したクリップ数", "stream")
+	nextClipID atomic.Uint64
+)
+
+// clipInfo は管理APIで返すクリップの情報です
+type clipInfo struct {
+	ID          uint64     `json:"id"`
+	Stream      string     `json:"stream"`
+	File        string     `json:"file"`
+	Label       string     `json:"label,omitempty"`
+	TriggeredAt time.Time  `json:"triggered-at"`
+	StartsAt    *time.Time `json:"starts-at,omitempty"` // 最初のフレームの時刻 (pre-roll を含む)
+	EndsAt      time.Time  `json:"ends-at"`             // この時刻にクリップを終了
+	Completed   bool       `json:"completed"`
+}
+
+// clip は書き込み中のクリップです
+type clip struct {
+	info     clipInfo
+	duration time.Duration // トリガー時に指定された長さ (0の場合は stop または最大時間まで)
+	file     *os.File
+	seg      *fmp4Segment
+	start    time.Time // 最初のフレームの時刻
+	codec    string
+	waitKey  bool
+}
+
+// clipper はストリームの直近のアクセスユニットを pre-roll としてキーフレーム単位で保持し、
+// トリガーを受けると pre-roll とそれ以降の映像を1つのMP4ファイルに書き込みます。
+type clipper struct {
+	name   string
+	cfg    clipConfig
+	logger *slog.Logger
+	hub    *auHub
+	sub    *auSubscriber
+	done   chan struct{}
+
+	mutex        sync.Mutex
+	preRoll      []accessUnit // キーフレームから始まる直近のアクセスユニット
+	preRollBytes int
+	active       *clip
+}
+
+// startClipper はストリームの pre-roll の保持を開始し、クリップのトリガーを受け付けます
+func (s *stream) startClipper(cfg clipConfig) error {
+	s.mutex.RLock()
+	aus := s.aus
+	s.mutex.RUnlock()
+	if aus == nil {
+		return fmt.Errorf("ストリーム %s は削除されています", s.name)
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.dir, url.PathEscape(s.name)), 0o755); err != nil {
+		return err
+	}
+	c := &clipper{
+		name:   s.name,
+		cfg:    cfg,
+		logger: s.logger.With("component", "clipper"),
+		hub:    aus,
+		sub:    aus.subscribe(clipQueueSize, channelDrops.with(s.name, "clipper")),
+		done:   make(chan struct{}),
+	}
+	go c.run()
+
+	s.mutex.Lock()
+	prev := s.clipper
+	s.clipper = c
+	s.mutex.Unlock()
+	if prev != nil {
+		prev.stop()
+	}
+	s.logger.Info("クリップ録画を有効にしました", "dir", cfg.dir, "pre_roll", cfg.preRoll, "max_duration", cfg.maxDuration)
+	return nil
+}
+
+// stopClipper は書き込み中のクリップを確定し、pre-roll の保持を終了します
+func (s *stream) stopClipper() {
+	s.mutex.Lock()
+	c := s.clipper
+	s.clipper = nil
+	s.mutex.Unlock()
+	if c != nil {
+		c.stop()
+	}
+}
+
+// clipperOf はストリームの clipper を返します (クリップ録画が無効の場合はnil)
+func (s *stream) clipperOf() *clipper {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.clipper
+}
+
+func (c *clipper) stop() {
+	c.hub.unsubscribe(c.sub)
+	<-c.done
+}
+
+func (c *clipper) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case au, ok := <-c.sub.ch:
+			c.mutex.Lock()
+			if !ok {
+				c.finishLocked("stream-removed")
+				c.mutex.Unlock()
+				return
+			}
+			c.handleLocked(au)
+			c.mutex.Unlock()
+		case now := <-ticker.C:
+			// 映像が届かない間もクリップを終了させる
+			c.mutex.Lock()
+			if c.active != nil && now.After(c.active.info.EndsAt) {
+				c.finishLocked(c.active.endReason())
+			}
+			c.mutex.Unlock()
+		}
+	}
+}
+
+// handleLocked はアクセスユニットを pre-roll に追加し、書き込み中のクリップがあれば書き込みます
+func (c *clipper) handleLocked(au accessUnit) {
+	c.addPreRollLocked(au)
+	if c.active == nil {
+		return
+	}
+	if au.time.After(c.active.info.EndsAt) {
+		c.finishLocked(c.active.endReason())
+		return
+	}
+	c.writeLocked(c.active, au)
+}
+
+// addPreRollLocked は pre-roll を更新します。
+// 先頭が cfg.preRoll 以上前の最新のキーフレームになるよう、古いGOPを破棄します。
+func (c *clipper) addPreRollLocked(au accessUnit) {
+	if c.cfg.preRoll <= 0 {
+		return
+	}
+	if au.gap || (len(c.preRoll) > 0 && c.preRoll[0].codec != au.codec) {
+		c.preRoll = nil
+		c.preRollBytes = 0
+	}
+	if len(c.preRoll) == 0 && !au.key {
+		return
+	}
+	c.preRoll = append(c.preRoll, au)
+	c.preRollBytes += accessUnitSize(au)
+
+	cut := 0
+	for i, p := range c.preRoll {
+		if i > 0 && p.key && (au.time.Sub(p.time) >= c.cfg.preRoll || c.preRollBytes > clipPreRollMaxBytes) {
+			cut = i
+			for _, dropped := range c.preRoll[:i] {
+				c.preRollBytes -= accessUnitSize(dropped)
+			}
+			break
+		}
+	}
+	if cut > 0 {
+		c.preRoll = append([]accessUnit(nil), c.preRoll[cut:]...)
+	}
+	if c.preRollBytes > clipPreRollMaxBytes && len(c.preRoll) > 1 && cut == 0 {
+		// 1つのGOPが上限を超える場合は次のキーフレームまで保持しない
+		c.preRoll = nil
+		c.preRollBytes = 0
+	}
+}
+
+func accessUnitSize(au accessUnit) int {
+	n := 0
+	for _, nal := range au.nals {
+		n += len(nal)
+	}
+	return n
+}
+
+// trigger はクリップの書き込みを開始します。duration が0の場合は stop または最大時間まで書き込みます。
+// 書き込み中のクリップがある場合は新しいクリップを作成せず、終了時刻を延長します (created=false)。
+func (c *clipper) trigger(label string, duration time.Duration) (info clipInfo, created bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if duration <= 0 || duration > c.cfg.maxDuration {
+		duration = 0
+	}
+
+	if cl := c.active; cl != nil {
+		end := cl.info.TriggeredAt.Add(c.cfg.maxDuration)
+		if duration > 0 && now.Add(duration).Before(end) {
+			end = now.Add(duration)
+		}
+		if end.After(cl.info.EndsAt) {
+			cl.info.EndsAt = end
+		}
+		c.logger.Info("クリップ: 書き込み中のクリップの終了時刻を延長しました", "clip", cl.info.ID, "ends_at", cl.info.EndsAt)
+		return cl.info, false, nil
+	}
+
+	id := nextClipID.Add(1)
+	dir := filepath.Join(c.cfg.dir, url.PathEscape(c.name), now.Format("2006-01-02"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return clipInfo{}, false, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s_%d.mp4", now.Format("15-04-05"), id))
+	f, err := os.OpenFile(path+recordPartSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return clipInfo{}, false, err
+	}
+	cl := &clip{
+		info: clipInfo{
+			ID:          id,
+			Stream:      c.name,
+			File:        path,
+			Label:       label,
+			TriggeredAt: now,
+			EndsAt:      now.Add(c.cfg.maxDuration),
+		},
+		duration: duration,
+		file:     f,
+	}
+	if duration > 0 {
+		cl.info.EndsAt = now.Add(duration)
+	}
+	c.active = cl
+	c.logger.Info("クリップ: 書き込みを開始しました", "clip", id, "label", label, "file", path, "pre_roll_frames", len(c.preRoll))
+	events.publish(event{Type: eventClipStarted, Stream: c.name, ClipID: id, Label: label, File: path})
+	for _, au := range c.preRoll {
+		if c.active != cl {
+			break // 書き込みエラーで終了した
+		}
+		c.writeLocked(cl, au)
+	}
+	return cl.info, true, nil
+}
+
+// stopClip は書き込み中のクリップ id を終了します
+func (c *clipper) stopClip(id uint64) (clipInfo, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.active == nil || c.active.info.ID != id {
+		return clipInfo{}, fmt.Errorf("クリップ %d は書き込み中ではありません", id)
+	}
+	return c.finishLocked("stopped"), nil
+}
+
+// activeClips は書き込み中のクリップを返します
+func (c *clipper) activeClips() []clipInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.active == nil {
+		return []clipInfo{}
+	}
+	return []clipInfo{c.active.info}
+}
+
+// writeLocked はアクセスユニットをクリップに書き込みます。クリップはキーフレームから開始します。
+func (c *clipper) writeLocked(cl *clip, au accessUnit) {
+	if cl.seg != nil && au.codec != cl.codec {
+		c.finishLocked("codec-changed")
+		return
+	}
+	if au.gap {
+		cl.waitKey = true
+	}
+	if cl.waitKey || cl.seg == nil {
+		if !au.key {
+			return
+		}
+		cl.waitKey = false
+	}
+	if cl.seg == nil {
+		seg, err := newFMP4Segment(cl.file, au)
+		if err != nil {
+			c.logger.Warn("クリップ: 初期化セグメントの書き込みに失敗", "clip", cl.info.ID, "error", err)
+			c.finishLocked("write-error")
+			return
+		}
+		cl.seg = seg
+		cl.codec = au.codec
+		cl.start = au.time
+		cl.info.StartsAt = &cl.start
+	}
+	if err := cl.seg.writeAU(au, au.time.Sub(cl.start)); err != nil {
+		c.logger.Warn("クリップ: 書き込みに失敗", "clip", cl.info.ID, "error", err)
+		c.finishLocked("write-error")
+	}
+}
+
+// endReason は終了時刻に達したクリップの終了理由を返します
+func (cl *clip) endReason() string {
+	if cl.duration > 0 {
+		return "duration"
+	}
+	return "max-duration"
+}
+
+// finishLocked は書き込み中のクリップを確定し、イベントで通知します
+func (c *clipper) finishLocked(reason string) clipInfo {
+	cl := c.active
+	if cl == nil {
+		return clipInfo{}
+	}
+	c.active = nil
+	part := cl.info.File + recordPartSuffix
+	if cl.seg == nil {
+		// キーフレームを受信する前に終了した
+		cl.file.Close()
+		os.Remove(part)
+		c.logger.Warn("クリップ: 映像を受信できなかったためクリップを破棄しました", "clip", cl.info.ID, "reason", reason)
+		events.publish(event{Type: eventClipFailed, Stream: c.name, ClipID: cl.info.ID, Label: cl.info.Label, Reason: "no-video"})
+		return cl.info
+	}
+
+	err := cl.seg.close()
+	if cerr := cl.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.logger.Warn("クリップ: 書き込みに失敗したため、書き込み済みの範囲で確定します", "clip", cl.info.ID, "error", err)
+		if !recoverSegment(part) {
+			events.publish(event{Type: eventClipFailed, Stream: c.name, ClipID: cl.info.ID, Label: cl.info.Label, Reason: err.Error()})
+			return cl.info
+		}
+	} else if err := os.Rename(part, cl.info.File); err != nil {
+		c.logger.Warn("クリップ: ファイルの確定に失敗", "clip", cl.info.ID, "error", err)
+		events.publish(event{Type: eventClipFailed, Stream: c.name, ClipID: cl.info.ID, Label: cl.info.Label, Reason: err.Error()})
+		return cl.info
+	}
+	cl.info.Completed = true
+	clipsCompleted.with(c.name).Add(1)
+	c.logger.Info("クリップ: 書き込みを完了しました", "clip", cl.info.ID, "file", cl.info.File, "reason", reason,
+		"duration", time.Since(cl.start).Round(time.Second))
+	events.publish(event{Type: eventClipCompleted, Stream: c.name, ClipID: cl.info.ID, Label: cl.info.Label, File: cl.info.File, Reason: reason})
+	return cl.info
+}
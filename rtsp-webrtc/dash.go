@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h265"
+)
+
+// --- MPEG-DASH ---
+//
+// DASHのマニフェストはHLSの出力 (hlsMuxer) が作成したCMAFのセグメントをそのまま参照します。
+// パッケージングは1回だけで、HLSとDASHのどちらのクライアントにも同じ init.mp4 / seg<N>.mp4 を返します。
+
+// codecParameters はパラメータセットからRFC 6381の codecs と解像度を返します (不明な場合は空と0)
+func codecParameters(codec string, params [][]byte) (codecs string, width, height int) {
+	for _, ps := range params {
+		nalType, _, _, _ := classifyNAL(codec, ps)
+		if codec == "h265" && nalType == 33 {
+			var sps h265.SPS
+			if err := sps.Unmarshal(ps); err == nil {
+				width, height = sps.Width(), sps.Height()
+			}
+			return hevcCodecs(h264.EmulationPreventionRemove(ps)), width, height
+		}
+		if codec != "h265" && nalType == 7 && len(ps) >= 4 {
+			var sps h264.SPS
+			if err := sps.Unmarshal(ps); err == nil {
+				width, height = sps.Width(), sps.Height()
+			}
+			return fmt.Sprintf("avc1.%02x%02x%02x", ps[1], ps[2], ps[3]), width, height
+		}
+	}
+	return "", 0, 0
+}
+
+// hevcCodecs はH.265のSPS (エミュレーション防止バイトを除去済み) の profile_tier_level から
+// hev1.<プロファイル>.<互換フラグ>.<ティア><レベル>.<制約フラグ> を作成します (ISO/IEC 14496-15 Annex E)
+func hevcCodecs(sps []byte) string {
+	// NALヘッダー (2バイト) と sps_video_parameter_set_id などの1バイトの後に profile_tier_level が続く
+	if len(sps) < 15 {
+		return ""
+	}
+	ptl := sps[3:]
+	var b strings.Builder
+	b.WriteString("hev1.")
+	if space := ptl[0] >> 6; space > 0 {
+		b.WriteByte('A' + space - 1)
+	}
+	fmt.Fprintf(&b, "%d.%X.", ptl[0]&0x1F, bits.Reverse32(binary.BigEndian.Uint32(ptl[1:5])))
+	if ptl[0]&0x20 != 0 {
+		b.WriteByte('H')
+	} else {
+		b.WriteByte('L')
+	}
+	fmt.Fprintf(&b, "%d", ptl[11])
+	constraints := ptl[5:11]
+	for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+		constraints = constraints[:len(constraints)-1]
+	}
+	for _, c := range constraints {
+		fmt.Fprintf(&b, ".%X", c)
+	}
+	return b.String()
+}
+
+// dashDuration は xs:duration 形式の長さを返します
+func dashDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// dashTime はMPDの日時の形式 (UTC) を返します
+func dashTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// xmlAttr は属性値をXMLエスケープします
+func xmlAttr(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// manifestLocked はライブ (dynamic) のMPDを作成します (mutex を保持して呼び出す)。
+// 完了したセグメントのみを SegmentTimeline に載せます。query は各URIに付加するクエリです。
+func (m *hlsMuxer) manifestLocked(query string, now time.Time) []byte {
+	if len(m.segments) == 0 {
+		return nil
+	}
+	var window, maxDuration time.Duration
+	var size int
+	for _, seg := range m.segments {
+		window += seg.duration
+		maxDuration = max(maxDuration, seg.duration)
+		size += len(seg.data)
+	}
+	bandwidth := 1
+	if window > 0 {
+		bandwidth = max(int(float64(size*8)/window.Seconds()), 1)
+	}
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011,urn:mpeg:dash:profile:cmaf:2019" type="dynamic"`+
+		` availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="%s" minBufferTime="%s"`+
+		` timeShiftBufferDepth="%s" suggestedPresentationDelay="%s" maxSegmentDuration="%s">`+"\n",
+		dashTime(m.start), dashTime(now), dashDuration(m.cfg.segment), dashDuration(m.cfg.segment),
+		dashDuration(window), dashDuration(3*m.cfg.segment), dashDuration(maxDuration))
+	// 初期化セグメントを作り直した場合 (コーデックの変更など) は期間のIDも変わる
+	fmt.Fprintf(&b, `  <Period id="%d" start="PT0S">`+"\n", m.start.UnixMilli())
+	b.WriteString(`    <AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">` + "\n")
+	fmt.Fprintf(&b, `      <SegmentTemplate timescale="%d" initialization="%s" media="%s" startNumber="%d">`+"\n",
+		fmp4Timescale, xmlAttr("init.mp4"+query), xmlAttr("seg$Number$.mp4"+query), m.segments[0].msn)
+	b.WriteString("        <SegmentTimeline>\n")
+	for _, seg := range m.segments {
+		// 入力の欠落でDTSが飛ぶことがあるため、各セグメントの開始時刻を明示する
+		fmt.Fprintf(&b, `          <S t="%d" d="%d"/>`+"\n", seg.dts, seg.ticks)
+	}
+	b.WriteString("        </SegmentTimeline>\n      </SegmentTemplate>\n")
+	fmt.Fprintf(&b, `      <Representation id="video" bandwidth="%d"`, bandwidth)
+	if m.codecs != "" {
+		fmt.Fprintf(&b, ` codecs="%s"`, m.codecs)
+	}
+	if m.width > 0 && m.height > 0 {
+		fmt.Fprintf(&b, ` width="%d" height="%d"`, m.width, m.height)
+	}
+	b.WriteString("/>\n    </AdaptationSet>\n  </Period>\n")
+	// クライアントの時計のずれを補正するためにサーバーの時刻を伝える
+	fmt.Fprintf(&b, `  <UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="%s"/>`+"\n", dashTime(now))
+	b.WriteString("</MPD>\n")
+	return []byte(b.String())
+}
+
+// serveManifest はDASHのマニフェストを返します。最初のセグメントが完了するまでは待機します。
+func (m *hlsMuxer) serveManifest(w http.ResponseWriter, r *http.Request) {
+	if !m.wait(r, 3*m.cfg.segment, func() bool { return len(m.segments) > 0 }) {
+		http.Error(w, "manifest is not ready", http.StatusServiceUnavailable)
+		return
+	}
+	m.mutex.Lock()
+	manifest := m.manifestLocked(hlsAuthQuery(r), time.Now())
+	m.mutex.Unlock()
+	if manifest == nil {
+		http.Error(w, "manifest is not ready", http.StatusServiceUnavailable)
+		return
+	}
+	hlsRequests.with(m.name, "manifest").Add(1)
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(manifest)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- イベントバス ---
+
+// eventType はストリームのライフサイクルイベントの種類です
+type eventType string
+
+const (
+	eventPublisherConnected    eventType = "publisher.connected"    // RTSPサーバーへのPUSH (ANNOUNCE) またはRTMPのPUBLISHを開始
+	eventPublisherDisconnected eventType = "publisher.disconnected" // PUSHのセッションが終了
+	eventIngestFailed          eventType = "ingest.failed"          // 入力 (プル) が終了し、再接続を待機
+	eventStreamStalled         eventType = "stream.stalled"         // 映像が -stall-timeout を超えて届いていない
+	eventStreamLive            eventType = "stream.live"            // ストール後に映像が復旧
+	eventStreamAdded           eventType = "stream.added"           // 管理APIでストリームを追加
+	eventStreamRemoved         eventType = "stream.removed"         // 管理APIでストリームを削除
+	eventViewerJoined          eventType = "viewer.joined"          // WebRTC視聴者が接続
+	eventViewerLeft            eventType = "viewer.left"            // WebRTC視聴者が切断
+	eventViewerRejected        eventType = "viewer.rejected"        // 上限により視聴者を受け入れられなかった
+	eventRecordingSegment      eventType = "recording.segment"      // 録画セグメントが完了
+	eventClipStarted           eventType = "clip.started"           // クリップの書き込みを開始
+	eventClipCompleted         eventType = "clip.completed"         // クリップの書き込みが完了
+	eventClipFailed            eventType = "clip.failed"            // クリップを書き込めなかった
+)
+
+// event はイベントバスで配信するイベントです。Webhook と SSE ではこのままJSONで送信します。
+type event struct {
+	ID       uint64    `json:"id"`
+	Type     eventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Stream   string    `json:"stream,omitempty"`
+	Path     string    `json:"path,omitempty"`        // RTSPサーバーのパス
+	Remote   string    `json:"remote-addr,omitempty"` // パブリッシャーまたは視聴者の接続元
+	ViewerID uint64    `json:"viewer-id,omitempty"`
+	Subject  string    `json:"subject,omitempty"`
+	Codec    string    `json:"codec,omitempty"`
+	Reason   string    `json:"reason,omitempty"` // 切断・失敗の理由
+	File     string    `json:"file,omitempty"`   // 録画ファイル・クリップのパス
+	ClipID   uint64    `json:"clip-id,omitempty"`
+	Label    string    `json:"label,omitempty"` // クリップのトリガー時に指定したラベル
+}
+
+// matchEventType は "viewer.joined"、"viewer.*"、"*" のようなパターンに type が一致するかを返します
+func matchEventType(patterns []string, t eventType) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if p == "*" || p == string(t) || (strings.HasSuffix(p, ".*") && strings.HasPrefix(string(t), strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventSubscriber はイベントの購読者 (Webhook や SSE の接続) です。
+// 購読者の処理が追いつかない場合、キューが満杯の間のイベントは破棄されます。
+type eventSubscriber struct {
+	ch      chan event
+	types   []string // 購読するイベントの種類 (空の場合はすべて)
+	dropped func()   // イベントを破棄したときに呼び出される
+}
+
+// eventBus はイベントを購読者に配信します。直近のイベントは SSE の再接続時の再送用に保持します。
+type eventBus struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	recent      []event // 直近のイベント (古い順)
+	maxRecent   int
+	subscribers map[*eventSubscriber]bool
+}
+
+// events はアプリケーション全体のイベントバスです
+var events = &eventBus{maxRecent: 256, subscribers: make(map[*eventSubscriber]bool)}
+
+// publish はイベントに ID と時刻を付けて購読者に配信します (購読者を待たずに戻ります)
+func (b *eventBus) publish(e event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lastID++
+	e.ID = b.lastID
+	e.Time = time.Now()
+	b.recent = append(b.recent, e)
+	if len(b.recent) > b.maxRecent {
+		b.recent = b.recent[len(b.recent)-b.maxRecent:]
+	}
+	for sub := range b.subscribers {
+		if !matchEventType(sub.types, e.Type) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			if sub.dropped != nil {
+				sub.dropped()
+			}
+		}
+	}
+}
+
+// subscribe はイベントの購読を開始します。
+// afterID が0より大きい場合は、保持している afterID より後のイベントを先にキューへ入れます。
+func (b *eventBus) subscribe(types []string, queue int, afterID uint64, dropped func()) *eventSubscriber {
+	sub := &eventSubscriber{ch: make(chan event, queue), types: types, dropped: dropped}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if afterID > 0 {
+		for _, e := range b.recent {
+			if e.ID > afterID && matchEventType(types, e.Type) && len(sub.ch) < cap(sub.ch) {
+				sub.ch <- e
+			}
+		}
+	}
+	b.subscribers[sub] = true
+	return sub
+}
+
+// unsubscribe は購読を終了します
+func (b *eventBus) unsubscribe(sub *eventSubscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers, sub)
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/url"
 	"os/exec"
@@ -15,8 +16,8 @@ import (
 )
 
 // --- H.264 RTSP パススルー ---
-func startFFmpegH264RTSP(inputURL string) {
-	cmd := exec.Command("ffmpeg",
+func startFFmpegH264RTSP(ctx context.Context, s *stream, inputURL string) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
 		"-loglevel", "error", // FFmpegのログ出力をエラーのみに抑制
 		"-rtsp_transport", "udp", "-max_delay", "0",
 		"-analyzeduration", "0", "-avioflags", "direct",
@@ -29,18 +30,22 @@ func startFFmpegH264RTSP(inputURL string) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	go logFFmpegStderr(stderr)
-	_ = cmd.Start()
-	log.Println("FFmpeg (H264 RTSP パススルー) 開始")
+	go logFFmpegStderr(s.logger, stderr)
+	if err := cmd.Start(); err != nil {
+		s.logger.Error("Failed to start FFmpeg (H264 RTSP パススルー)", "error", err)
+		return
+	}
+	s.setIngestProcess(cmd)
+	s.logger.Info("FFmpeg (H264 RTSP パススルー) 開始", "pid", cmd.Process.Pid)
 
 	go func() { _ = cmd.Wait() }()
 	h264r, _ := h264reader.NewReader(bufio.NewReader(stdout))
 	dur := time.Second / 30
-	streamNAL(h264r, dur)
+	s.streamNAL(h264r, dur)
 }
 
 // --- H.264 RTP パススルー ---
-func startFFmpegH264RTP(inputURL string) {
+func startFFmpegH264RTP(ctx context.Context, s *stream, inputURL string) {
 	cmdArgs, sdpContent, err := buildRTPCommand(inputURL, "H264",
 		[]string{}, // preInputArgs
 		[]string{ // postInputArgs
@@ -49,23 +54,23 @@ func startFFmpegH264RTP(inputURL string) {
 			"-f", "h264", "pipe:1",
 		})
 	if err != nil {
-		log.Printf("Error building H264 RTP command: %v", err)
+		s.logger.Error("RTPコマンドの構築に失敗", "error", err)
 		return
 	}
 
-	log.Printf("FFmpeg H264 RTP コマンド: ffmpeg %s", strings.Join(cmdArgs, " "))
-	cmd := exec.Command("ffmpeg", cmdArgs...)
+	s.logger.Debug("FFmpeg H264 RTP コマンド", "args", cmdArgs)
+	cmd := exec.CommandContext(ctx, "ffmpeg", cmdArgs...)
 
 	if sdpContent != "" {
 		stdin, pipeErr := cmd.StdinPipe()
 		if pipeErr != nil {
-			log.Printf("Failed to get stdin pipe for FFmpeg: %v", pipeErr)
+			s.logger.Error("Failed to get stdin pipe for FFmpeg", "error", pipeErr)
 			return
 		}
 		go func() {
 			defer stdin.Close()
 			if _, writeErr := io.WriteString(stdin, sdpContent); writeErr != nil {
-				log.Printf("Error writing SDP to FFmpeg stdin: %v", writeErr)
+				s.logger.Error("Error writing SDP to FFmpeg stdin", "error", writeErr)
 			}
 		}()
 	}
@@ -73,26 +78,27 @@ func startFFmpegH264RTP(inputURL string) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	go logFFmpegStderr(stderr)
+	go logFFmpegStderr(s.logger, stderr)
 	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start FFmpeg (H264 RTP パススルー): %v", err)
+		s.logger.Error("Failed to start FFmpeg (H264 RTP パススルー)", "error", err)
 		return
 	}
-	log.Println("FFmpeg (H264 RTP パススルー) 開始")
+	s.setIngestProcess(cmd)
+	s.logger.Info("FFmpeg (H264 RTP パススルー) 開始", "pid", cmd.Process.Pid)
 
 	go func() {
 		if err := cmd.Wait(); err != nil {
-			log.Printf("FFmpeg (H264 RTP パススルー) exited with error: %v", err)
+			s.logger.Warn("FFmpeg (H264 RTP パススルー) exited with error", "error", err)
 		}
 	}()
 	h264r, _ := h264reader.NewReader(bufio.NewReader(stdout))
 	dur := time.Second / 30
-	streamNAL(h264r, dur)
+	s.streamNAL(h264r, dur)
 }
 
 // --- H.265 から H.264 へのトランスコーディング (GPU, RTSP) ---
-func startFFmpegH265ToH264NALGPURTSP(inputURL string) {
-	cmd := exec.Command("ffmpeg",
+func startFFmpegH265ToH264NALGPURTSP(ctx context.Context, s *stream, inputURL string) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
 		"-loglevel", "error", // FFmpegのログ出力をエラーのみに抑制
 		"-rtsp_transport", "tcp", "-probesize", "250000", "-analyzeduration", "0",
 		"-fflags", "nobuffer+flush_packets+genpts", "-flags", "low_delay", "-max_delay", "0",
@@ -106,18 +112,22 @@ func startFFmpegH265ToH264NALGPURTSP(inputURL string) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	go logFFmpegStderr(stderr)
-	_ = cmd.Start()
-	log.Println("FFmpeg (H265 から H264 NAL - GPU, RTSP) 開始")
+	go logFFmpegStderr(s.logger, stderr)
+	if err := cmd.Start(); err != nil {
+		s.logger.Error("Failed to start FFmpeg (H265 から H264 NAL - GPU, RTSP)", "error", err)
+		return
+	}
+	s.setIngestProcess(cmd)
+	s.logger.Info("FFmpeg (H265 から H264 NAL - GPU, RTSP) 開始", "pid", cmd.Process.Pid)
 
 	go func() { _ = cmd.Wait() }()
 	h264r, _ := h264reader.NewReader(bufio.NewReader(stdout))
 	dur := time.Second / 30
-	streamNAL(h264r, dur)
+	s.streamNAL(h264r, dur)
 }
 
 // --- H.265 から H.264 へのトランスコーディング (GPU, RTP) ---
-func startFFmpegH265ToH264NALGPURTP(inputURL string) {
+func startFFmpegH265ToH264NALGPURTP(ctx context.Context, s *stream, inputURL string) {
 	cmdArgs, sdpContent, err := buildRTPCommand(inputURL, "H265",
 		[]string{ // preInputArgs
 			"-fflags", "genpts",
@@ -131,23 +141,23 @@ func startFFmpegH265ToH264NALGPURTP(inputURL string) {
 			"-map", "0:v:0", "-f", "h264", "pipe:1",
 		})
 	if err != nil {
-		log.Printf("Error building H265 to H264 GPU RTP command: %v", err)
+		s.logger.Error("RTPコマンドの構築に失敗", "error", err)
 		return
 	}
 
-	log.Printf("FFmpeg H265 から H264 GPU RTP コマンド: ffmpeg %s", strings.Join(cmdArgs, " "))
-	cmd := exec.Command("ffmpeg", cmdArgs...)
+	s.logger.Debug("FFmpeg H265 から H264 GPU RTP コマンド", "args", cmdArgs)
+	cmd := exec.CommandContext(ctx, "ffmpeg", cmdArgs...)
 
 	if sdpContent != "" {
 		stdin, pipeErr := cmd.StdinPipe()
 		if pipeErr != nil {
-			log.Printf("Failed to get stdin pipe for FFmpeg: %v", pipeErr)
+			s.logger.Error("Failed to get stdin pipe for FFmpeg", "error", pipeErr)
 			return
 		}
 		go func() {
 			defer stdin.Close()
 			if _, writeErr := io.WriteString(stdin, sdpContent); writeErr != nil {
-				log.Printf("Error writing SDP to FFmpeg stdin: %v", writeErr)
+				s.logger.Error("Error writing SDP to FFmpeg stdin", "error", writeErr)
 			}
 		}()
 	}
@@ -155,26 +165,27 @@ func startFFmpegH265ToH264NALGPURTP(inputURL string) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	go logFFmpegStderr(stderr)
+	go logFFmpegStderr(s.logger, stderr)
 	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start FFmpeg (H265 to H264 NAL - GPU, RTP): %v", err)
+		s.logger.Error("Failed to start FFmpeg (H265 to H264 NAL - GPU, RTP)", "error", err)
 		return
 	}
-	log.Println("FFmpeg (H265 to H264 NAL - GPU, RTP) 開始")
+	s.setIngestProcess(cmd)
+	s.logger.Info("FFmpeg (H265 to H264 NAL - GPU, RTP) 開始", "pid", cmd.Process.Pid)
 
 	go func() {
 		if err := cmd.Wait(); err != nil {
-			log.Printf("FFmpeg (H265 to H264 NAL - GPU, RTP) exited with error: %v", err)
+			s.logger.Warn("FFmpeg (H265 to H264 NAL - GPU, RTP) exited with error", "error", err)
 		}
 	}()
 	h264r, _ := h264reader.NewReader(bufio.NewReader(stdout))
 	dur := time.Second / 30
-	streamNAL(h264r, dur)
+	s.streamNAL(h264r, dur)
 }
 
 // --- H.265 から H.264 へのトランスコーディング (CPU, RTSP) ---
-func startFFmpegH265ToH264NALCPURTSP(inputURL string) {
-	cmd := exec.Command("ffmpeg",
+func startFFmpegH265ToH264NALCPURTSP(ctx context.Context, s *stream, inputURL string) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
 		"-loglevel", "error", // FFmpegのログ出力をエラーのみに抑制
 		// 入力設定
 		"-rtsp_transport", "udp",
@@ -209,18 +220,22 @@ func startFFmpegH265ToH264NALCPURTSP(inputURL string) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	go logFFmpegStderr(stderr)
-	_ = cmd.Start()
-	log.Println("FFmpeg (H265 to H264 NAL - CPU, RTSP) 開始")
+	go logFFmpegStderr(s.logger, stderr)
+	if err := cmd.Start(); err != nil {
+		s.logger.Error("Failed to start FFmpeg (H265 to H264 NAL - CPU, RTSP)", "error", err)
+		return
+	}
+	s.setIngestProcess(cmd)
+	s.logger.Info("FFmpeg (H265 to H264 NAL - CPU, RTSP) 開始", "pid", cmd.Process.Pid)
 
 	go func() { _ = cmd.Wait() }()
 	h264r, _ := h264reader.NewReader(bufio.NewReader(stdout))
 	dur := time.Second / 30 // フレームレートに応じて調整
-	streamNAL(h264r, dur)
+	s.streamNAL(h264r, dur)
 }
 
 // --- H.265 から H.264 へのトランスコーディング (CPU, RTP) ---
-func startFFmpegH265ToH264NALCPURTP(inputURL string) {
+func startFFmpegH265ToH264NALCPURTP(ctx context.Context, s *stream, inputURL string) {
 	// H.265デコーディング用の強化されたパラメータ（RTP専用）	cmdArgs, sdpContent, err := buildRTPCommand(inputURL, "H265",
 		cmdArgs, sdpContent, err := buildRTPCommand(inputURL, "H265",
 			[]string{ // preInputArgs
@@ -250,23 +265,23 @@ func startFFmpegH265ToH264NALCPURTP(inputURL string) {
 				"pipe:1",
 			})
 		if err != nil {
-			log.Printf("Error building H265 to H264 CPU RTP command: %v", err)
+			s.logger.Error("RTPコマンドの構築に失敗", "error", err)
 			return
 		}
 
-		log.Printf("FFmpeg H265 to H264 CPU RTP command: ffmpeg %s", strings.Join(cmdArgs, " "))
-		cmd := exec.Command("ffmpeg", cmdArgs...)
+		s.logger.Debug("FFmpeg H265 to H264 CPU RTP command", "args", cmdArgs)
+		cmd := exec.CommandContext(ctx, "ffmpeg", cmdArgs...)
 
 	if sdpContent != "" {
 		stdin, pipeErr := cmd.StdinPipe()
 		if pipeErr != nil {
-			log.Printf("Failed to get stdin pipe for FFmpeg: %v", pipeErr)
+			s.logger.Error("Failed to get stdin pipe for FFmpeg", "error", pipeErr)
 			return
 		}
 		go func() {
 			defer stdin.Close()
 			if _, writeErr := io.WriteString(stdin, sdpContent); writeErr != nil {
-				log.Printf("Error writing SDP to FFmpeg stdin: %v", writeErr)
+				s.logger.Error("Error writing SDP to FFmpeg stdin", "error", writeErr)
 			}
 		}()
 	}
@@ -274,25 +289,26 @@ func startFFmpegH265ToH264NALCPURTP(inputURL string) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	go logFFmpegStderr(stderr)
+	go logFFmpegStderr(s.logger, stderr)
 	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start FFmpeg (H265 to H264 NAL - CPU, RTP): %v", err)
+		s.logger.Error("Failed to start FFmpeg (H265 to H264 NAL - CPU, RTP)", "error", err)
 		return
 	}
-	log.Println("FFmpeg (H265 to H264 NAL - CPU, RTP) 開始")
+	s.setIngestProcess(cmd)
+	s.logger.Info("FFmpeg (H265 to H264 NAL - CPU, RTP) 開始", "pid", cmd.Process.Pid)
 
 	go func() {
 		if err := cmd.Wait(); err != nil {
-			log.Printf("FFmpeg (H265 to H264 NAL - CPU, RTP) exited with error: %v", err)
+			s.logger.Warn("FFmpeg (H265 to H264 NAL - CPU, RTP) exited with error", "error", err)
 		}
 	}()
 	h264r, _ := h264reader.NewReader(bufio.NewReader(stdout))
 	dur := time.Second / 30 // フレームレートに応じて調整
-	streamNAL(h264r, dur)
+	s.streamNAL(h264r, dur)
 }
 
 // --- H.265 RTP パススルー ---
-func startFFmpegH265RTP(inputURL string) {
+func startFFmpegH265RTP(ctx context.Context, s *stream, inputURL string) {
 	cmdArgs, sdpContent, err := buildRTPCommand(inputURL, "H265",
 		[]string{}, // preInputArgs
 		[]string{ // postInputArgs
@@ -301,23 +317,23 @@ func startFFmpegH265RTP(inputURL string) {
 			"-f", "hevc", "pipe:1", // H.265の場合はhevcフォーマットを使用
 		})
 	if err != nil {
-		log.Printf("Error building H265 RTP command: %v", err)
+		s.logger.Error("RTPコマンドの構築に失敗", "error", err)
 		return
 	}
 
-	log.Printf("FFmpeg H265 RTP コマンド: ffmpeg %s", strings.Join(cmdArgs, " "))
-	cmd := exec.Command("ffmpeg", cmdArgs...)
+	s.logger.Debug("FFmpeg H265 RTP コマンド", "args", cmdArgs)
+	cmd := exec.CommandContext(ctx, "ffmpeg", cmdArgs...)
 
 	if sdpContent != "" {
 		stdin, pipeErr := cmd.StdinPipe()
 		if pipeErr != nil {
-			log.Printf("Failed to get stdin pipe for FFmpeg: %v", pipeErr)
+			s.logger.Error("Failed to get stdin pipe for FFmpeg", "error", pipeErr)
 			return
 		}
 		go func() {
 			defer stdin.Close()
 			if _, writeErr := io.WriteString(stdin, sdpContent); writeErr != nil {
-				log.Printf("Error writing SDP to FFmpeg stdin: %v", writeErr)
+				s.logger.Error("Error writing SDP to FFmpeg stdin", "error", writeErr)
 			}
 		}()
 	}
@@ -325,25 +341,26 @@ func startFFmpegH265RTP(inputURL string) {
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
-	go logFFmpegStderr(stderr)
+	go logFFmpegStderr(s.logger, stderr)
 	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start FFmpeg (H265 RTP パススルー): %v", err)
+		s.logger.Error("Failed to start FFmpeg (H265 RTP パススルー)", "error", err)
 		return
 	}
-	log.Println("FFmpeg (H265 RTP パススルー) 開始")
+	s.setIngestProcess(cmd)
+	s.logger.Info("FFmpeg (H265 RTP パススルー) 開始", "pid", cmd.Process.Pid)
 
 	go func() {
 		if err := cmd.Wait(); err != nil {
-			log.Printf("FFmpeg (H265 RTP パススルー) exited with error: %v", err)
+			s.logger.Warn("FFmpeg (H265 RTP パススルー) exited with error", "error", err)
 		}
 	}()
 	
 	// H.265ストリームの処理
-	streamH265NAL(bufio.NewReader(stdout), time.Second/30)
+	s.streamH265NAL(bufio.NewReader(stdout), time.Second/30)
 }
 
 // streamH265NAL はH.265 NALユニットを処理してWebRTCに送信する関数
-func streamH265NAL(reader *bufio.Reader, duration time.Duration) {
+func (s *stream) streamH265NAL(reader *bufio.Reader, duration time.Duration) {
 	buffer := make([]byte, 4096)
 	nalBuffer := make([]byte, 0, 1024*1024) // 1MBのバッファ
 	
@@ -351,7 +368,7 @@ func streamH265NAL(reader *bufio.Reader, duration time.Duration) {
 		n, err := reader.Read(buffer)
 		if err != nil {
 			if err != io.EOF {
-				log.Printf("H.265 NAL読み込みエラー: %v", err)
+				s.logger.Warn("H.265 NAL読み込みエラー", "error", err)
 			}
 			break
 		}
@@ -376,7 +393,7 @@ func streamH265NAL(reader *bufio.Reader, duration time.Duration) {
 				nalUnit := nalBuffer[nalStart:nextNALStart]
 				
 				// NALユニットをWebRTCトラックに送信
-				writeNALsToTracksH265([][]byte{nalUnit}, duration)
+				s.writeNALsToTracksH265([][]byte{nalUnit}, duration)
 				
 				// バッファから処理済みのデータを削除
 				nalBuffer = nalBuffer[nextNALStart:]
@@ -409,7 +426,12 @@ func buildRTPCommand(inputURL, sdpCodecName string, preInputArgs []string, postI
 	protocolWhitelist := "file,udp,rtp"
 	
 	var cmdArgs []string
-	cmdArgs = append(cmdArgs, "-loglevel", "debug") // より詳細なデバッグ情報
+	// FFmpegの標準エラー出力はログに出力するため、詳細なデバッグ情報は -log-level debug の場合のみ出力する
+	ffmpegLogLevel := "warning"
+	if logLevel.Level() <= slog.LevelDebug {
+		ffmpegLogLevel = "debug"
+	}
+	cmdArgs = append(cmdArgs, "-loglevel", ffmpegLogLevel)
 
 	if isRTP {
 		var err error
@@ -438,7 +460,7 @@ func buildRTPCommand(inputURL, sdpCodecName string, preInputArgs []string, postI
 				"-analyzeduration", "5000000",
 			)
 		}
-		log.Printf("Generated SDP content for %s, using pipe:0 as input.", inputURL)
+		slog.Debug("Generated SDP content, using pipe:0 as input.", "input", inputURL)
 	} else {
 		cmdArgs = append(cmdArgs, "-protocol_whitelist", protocolWhitelist)
 	}
@@ -451,10 +473,34 @@ func buildRTPCommand(inputURL, sdpCodecName string, preInputArgs []string, postI
 }
 
 // --- FFmpeg stderr ロガー ---
-func logFFmpegStderr(stderr io.ReadCloser) {
+// 同じ行が続く場合は warnLimiter と同じ間隔でまとめ、繰り返し回数を repeated フィールドに出力します。
+func logFFmpegStderr(logger *slog.Logger, stderr io.ReadCloser) {
+	logger = logger.With("process", "ffmpeg")
 	scanner := bufio.NewScanner(stderr)
+	var last string
+	var lastLogged time.Time
+	repeated := 0
 	for scanner.Scan() {
-		log.Printf("FFmpeg: %s", scanner.Text())
+		line := scanner.Text()
+		if line == last {
+			repeated++
+			if time.Since(lastLogged) >= warnLimiter.interval {
+				logger.Info(line, "repeated", repeated)
+				repeated = 0
+				lastLogged = time.Now()
+			}
+			continue
+		}
+		if repeated > 0 {
+			logger.Info(last, "repeated", repeated)
+			repeated = 0
+		}
+		logger.Info(line)
+		last = line
+		lastLogged = time.Now()
+	}
+	if repeated > 0 {
+		logger.Info(last, "repeated", repeated)
 	}
 }
 
@@ -516,7 +562,7 @@ func generateSDPContent(rtpURL, sdpCodecName string) (string, error) {
 	// 正しいCRLF行末文字を使用
 	sdpContent := strings.Join(sdpLines, "\r\n") + "\r\n"
 
-	log.Printf("Generated SDP content:\n%s", sdpContent)
+	slog.Debug("Generated SDP content", "sdp", sdpContent)
 	return sdpContent, nil
 } // H265は特定のfmtp行が必要な場合があります（例：profile-tier-level-id）が、FFmpegがデマックスするために厳密に必要とされることは多くありません。
 
@@ -530,7 +576,7 @@ func testRTPConnection(rtpURL string) error {
 	host := u.Hostname()
 	port := u.Port()
 	
-	log.Printf("RTP接続テスト: %s:%s に接続を試行中...", host, port)
+	slog.Info("RTP接続テスト: 接続を試行中...", "host", host, "port", port)
 	
 	// UDP接続テスト
 	conn, err := net.DialTimeout("udp", net.JoinHostPort(host, port), 5*time.Second)
@@ -539,6 +585,6 @@ func testRTPConnection(rtpURL string) error {
 	}
 	defer conn.Close()
 	
-	log.Printf("RTP接続テスト成功: %s:%s", host, port)
+	slog.Info("RTP接続テスト成功", "host", host, "port", port)
 	return nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// --- ファイル入力 (file) ---
+//
+// -input-url にメディアファイルのパスを指定し、アクセスユニットをタイムスタンプに従って実時間で配信します。
+// カメラなしでのデモ・負荷試験・CIに使用します。-loop を指定すると末尾から先頭に戻って繰り返します。
+
+// fileLagLimit は配信が遅れた場合に追いつこうとせず時刻の基準を合わせ直す遅れの上限です
+const fileLagLimit = time.Second
+
+// validateFileInput はファイルが存在し、通常のファイルであるかを検証します
+func validateFileInput(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("入力ファイルを開けません: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("入力ファイルが通常のファイルではありません: %s", path)
+	}
+	return nil
+}
+
+// filePacer はファイル内のデコード時刻を実時間に対応付けます。
+// ループ時は前回の最後のフレームの直後から次の周回を始めます。
+type filePacer struct {
+	base  time.Time     // 周回の最初のフレームを配信する時刻
+	first time.Duration // 周回の最初のフレームのデコード時刻
+	last  time.Time     // 直前のフレームを配信した時刻
+	frame time.Duration // 直前のフレームの期間
+	fresh bool          // 周回の最初のフレームを待っている
+}
+
+// startPass は新しい周回 (ファイルの先頭) を開始します
+func (p *filePacer) startPass() {
+	p.fresh = true
+}
+
+// wait は dts のフレームを配信する時刻まで待ち、フレームの期間を返します
+func (p *filePacer) wait(ctx context.Context, dts time.Duration) (time.Duration, error) {
+	now := time.Now()
+	if p.fresh {
+		p.fresh = false
+		p.first = dts
+		p.base = now
+		if !p.last.IsZero() {
+			p.base = p.last.Add(p.frame)
+		}
+	}
+	target := p.base.Add(dts - p.first)
+	if now.Sub(target) > fileLagLimit {
+		// 読み込みが遅れた場合は一気に送らず、現在時刻を基準にし直す
+		p.base = p.base.Add(now.Sub(target))
+		target = now
+	}
+	if d := time.Until(target); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if !p.last.IsZero() {
+		if d := target.Sub(p.last); d > 0 && d <= time.Second {
+			p.frame = d
+		}
+	}
+	if p.frame == 0 {
+		p.frame = defaultFrameDuration
+	}
+	p.last = target
+	return p.frame, nil
+}
+
+// startFileInput はファイルを読み込んで配信し、コンテキストがキャンセルされるまでブロックします。
+// ループしない場合、末尾に達した後は最後のフレームのまま待機します (映像の停止として扱われます)。
+func startFileInput(ctx context.Context, s *stream, p props) {
+	pacer := &filePacer{}
+	for pass := 1; ; pass++ {
+		err := playMediaFile(ctx, s, p, pacer)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Error("ファイル入力: 読み込みエラー", "file", p.inputURL, "error", err)
+			return
+		}
+		if !p.loop {
+			s.logger.Info("ファイル入力: 末尾に達しました", "file", p.inputURL)
+			s.setIngestState(ctx, "finished")
+			<-ctx.Done()
+			return
+		}
+		s.logger.Debug("ファイル入力: 先頭から繰り返します", "file", p.inputURL, "pass", pass+1)
+	}
+}
+
+// playMediaFile はファイルを先頭から末尾まで配信します
+func playMediaFile(ctx context.Context, s *stream, p props, pacer *filePacer) error {
+	r, err := openMediaFile(p.inputURL, p.codec, p.fps)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+	codec := r.codec()
+	if s.currentCodec() != codec {
+		s.setCodec(codec)
+	}
+	s.logger.Info("ファイル入力: 配信を開始します", "file", p.inputURL, "codec", codec, "loop", p.loop)
+
+	pacer.startPass()
+	frames := 0
+	for {
+		frame, err := r.next()
+		if errors.Is(err, io.EOF) {
+			if frames == 0 {
+				return fmt.Errorf("映像のフレームがありません")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		duration, err := pacer.wait(ctx, frame.dts)
+		if err != nil {
+			return err
+		}
+		if codec == "h265" {
+			s.writeNALsToTracksH265(frame.nals, duration)
+		} else {
+			s.writeNALsToTracks(frame.nals, duration)
+		}
+		frames++
+	}
+}
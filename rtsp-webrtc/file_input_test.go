@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPlayMediaFileRTPTimestamp(t *testing.T) {
+	// 2番目のキーフレームにはパラメータセットが付加される
+	data := annexB(h264SPS, h264PPS, h264IDR, h264P, h264IDR, h264P2, h264P)
+	p := props{inputURL: writeTempFile(t, "test.h264", data), codec: "h264", fps: 50}
+	s := newStream("file-test", "")
+	capture := addCapturedTrack(t, s)
+
+	if err := playMediaFile(context.Background(), s, p, &filePacer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// パラメータセットは別のパケットになるため、同じタイムスタンプのパケットをまとめて数える。
+	// 最初のフレームの期間は defaultFrameDuration、以降は 20ms
+	var frames []uint32
+	for _, ts := range capture.take() {
+		if len(frames) == 0 || frames[len(frames)-1] != ts {
+			frames = append(frames, ts)
+		}
+	}
+	want := []uint32{uint32(defaultFrameDuration.Seconds() * 90000), 1800, 1800, 1800}
+	if len(frames) != len(want)+1 {
+		t.Fatalf("got %d frames, want %d: %v", len(frames), len(want)+1, frames)
+	}
+	for i, step := range want {
+		if d := frames[i+1] - frames[i]; d != step {
+			t.Errorf("フレーム %d のタイムスタンプの差 = %d, want %d", i+1, d, step)
+		}
+	}
+}
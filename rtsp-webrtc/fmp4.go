@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4/seekablebuffer"
+)
+
+// --- fragmented MP4 の生成 ---
+
+// fmp4Timescale は映像トラックのタイムスケール (90kHz) です
+const fmp4Timescale = 90000
+
+// fmp4InitSegment はパラメータセットから初期化セグメント (ftyp + moov) を生成します
+func fmp4InitSegment(codec string, params [][]byte) ([]byte, error) {
+	byType := make(map[byte][]byte)
+	for _, ps := range params {
+		nalType, _, _, _ := classifyNAL(codec, ps)
+		byType[nalType] = ps
+	}
+	var c fmp4.Codec
+	if codec == "h265" {
+		if byType[32] == nil || byType[33] == nil || byType[34] == nil {
+			return nil, fmt.Errorf("H.265のVPS/SPS/PPSがありません")
+		}
+		c = &fmp4.CodecH265{VPS: byType[32], SPS: byType[33], PPS: byType[34]}
+	} else {
+		if byType[7] == nil || byType[8] == nil {
+			return nil, fmt.Errorf("H.264のSPS/PPSがありません")
+		}
+		c = &fmp4.CodecH264{SPS: byType[7], PPS: byType[8]}
+	}
+	init := fmp4.Init{Tracks: []*fmp4.InitTrack{{ID: 1, TimeScale: fmp4Timescale, Codec: c}}}
+	var buf seekablebuffer.Buffer
+	if err := init.Marshal(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fmp4Sample はアクセスユニットをfMP4のサンプル (AVCC形式) に変換します
+func fmp4Sample(au accessUnit) (*fmp4.PartSample, error) {
+	sample := &fmp4.PartSample{}
+	var err error
+	if au.codec == "h265" {
+		err = sample.FillH265(0, au.nals)
+	} else {
+		err = sample.FillH264(0, au.nals)
+	}
+	return sample, err
+}
+
+// fmp4Fragment はサンプル列からフラグメント (moof + mdat) を生成します。baseTime は最初のサンプルのDTSです。
+func fmp4Fragment(seq uint32, baseTime uint64, samples []*fmp4.PartSample) ([]byte, error) {
+	part := fmp4.Part{
+		SequenceNumber: seq,
+		Tracks:         []*fmp4.PartTrack{{ID: 1, BaseTime: baseTime, Samples: samples}},
+	}
+	var buf seekablebuffer.Buffer
+	if err := part.Marshal(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
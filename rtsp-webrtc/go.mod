@@ -4,20 +4,22 @@ go 1.24.3
 
 require (
 	github.com/bluenviron/gortsplib/v4 v4.14.0
+	github.com/bluenviron/mediacommon/v2 v2.1.1
 	github.com/gorilla/websocket v1.5.3
+	github.com/pion/interceptor v0.1.29
 	github.com/pion/rtp v1.8.15
 	github.com/pion/webrtc/v3 v3.3.5
-
 )
 
 require (
-	github.com/bluenviron/mediacommon/v2 v2.1.1 // indirect
+	github.com/abema/go-mp4 v1.4.1 // indirect
+	github.com/asticode/go-astikit v0.30.0 // indirect
+	github.com/asticode/go-astits v1.13.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/pion/datachannel v1.5.8 // indirect
 	github.com/pion/dtls/v2 v2.2.12 // indirect
 	github.com/pion/ice/v2 v2.3.36 // indirect
-	github.com/pion/interceptor v0.1.29 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.12 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
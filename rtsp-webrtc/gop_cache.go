@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	gopCacheMaxNALs  = 1000             // これを超えるGOPはキャッシュしない
+	gopCacheMaxBytes = 16 * 1024 * 1024 // 同上 (バイト数)
+	gopPrimeDuration = time.Millisecond // キャッシュ送信時のサンプル期間 (早送りで最新フレームに追いつく)
+)
+
+// gopCache は直近のキーフレームから現在までのサンプルを保持します。
+// 新しい視聴者にはまずこのキャッシュを送信し、次のキーフレームを待たずに映像を表示させます。
+type gopCache struct {
+	codec string // "h264" または "h265"
+
+	mutex     sync.Mutex
+	samples   []media.Sample
+	bytes     int
+	valid     bool            // キーフレームから始まるGOPを保持しているか
+	seq       uint64          // これまでに追加したサンプルの数 (次のサンプルの通番)
+	start     uint64          // samples[0] の通番
+	lastKey   bool            // 直前のNALがパラメータセットまたはキーフレームだったか
+	paramSets map[byte][]byte // NALタイプごとの最新パラメータセット (SPS/PPS/VPS)
+}
+
+func newGOPCache(codec string) *gopCache {
+	return &gopCache{
+		codec:     codec,
+		paramSets: make(map[byte][]byte),
+	}
+}
+
+// add はNALユニット (スタートコードなし) とそのサンプルをキャッシュに追加します
+func (g *gopCache) add(nal []byte, sample media.Sample) {
+	nalType, key, param, neutral := classifyNAL(g.codec, nal)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if param {
+		g.paramSets[nalType] = append([]byte(nil), nal...)
+	}
+	if neutral {
+		// AUD/SEI はGOP境界の判定に影響させない
+		if g.valid {
+			g.append(sample)
+		}
+		return
+	}
+	if key && !g.lastKey {
+		// 新しいGOPの開始
+		g.samples = g.samples[:0]
+		g.bytes = 0
+		g.valid = true
+		g.start = g.seq
+	}
+	g.lastKey = key
+	if g.valid {
+		g.append(sample)
+	}
+}
+
+func (g *gopCache) append(sample media.Sample) {
+	g.samples = append(g.samples, sample)
+	g.bytes += len(sample.Data)
+	g.seq++
+	if len(g.samples) > gopCacheMaxNALs || g.bytes > gopCacheMaxBytes {
+		// GOPが長すぎる場合は次のキーフレームまでキャッシュを無効化
+		g.samples = nil
+		g.bytes = 0
+		g.valid = false
+		g.start = g.seq
+	}
+}
+
+// reset はキャッシュを破棄します (入力の停止時など)
+func (g *gopCache) reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.samples = nil
+	g.bytes = 0
+	g.valid = false
+	g.lastKey = false
+	g.start = g.seq
+	g.paramSets = make(map[byte][]byte)
+}
+
+// snapshot は新規視聴者へ送信するサンプル列を返します。
+// パラメータセットを先頭に付加し、各サンプルの期間は短縮されます。
+func (g *gopCache) snapshot() []media.Sample {
+	samples, _ := g.snapshotSince(0)
+	return samples
+}
+
+// snapshotSince は通番 seq 以降に追加されたサンプルと次の通番を返します。
+// seq が 0 の場合、または seq 以降に新しいGOPが始まった場合は snapshot と同じくGOP全体を返します。
+func (g *gopCache) snapshotSince(seq uint64) ([]media.Sample, uint64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.valid || len(g.samples) == 0 {
+		return nil, g.seq
+	}
+	samples := g.samples
+	var out []media.Sample
+	if seq > 0 && seq >= g.start {
+		samples = samples[seq-g.start:]
+		out = make([]media.Sample, 0, len(samples))
+	} else {
+		out = make([]media.Sample, 0, len(g.paramSets)+len(samples))
+		for _, ps := range g.parameterSetsLocked() {
+			out = append(out, media.Sample{Data: append([]byte{0x00, 0x00, 0x00, 0x01}, ps...), Duration: gopPrimeDuration})
+		}
+	}
+	for _, sample := range samples {
+		sample.Duration = gopPrimeDuration
+		out = append(out, sample)
+	}
+	return out, g.seq
+}
+
+// parameterSets は最新のパラメータセットをNALタイプ順 (VPS, SPS, PPS) に返します
+func (g *gopCache) parameterSets() [][]byte {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.parameterSetsLocked()
+}
+
+func (g *gopCache) parameterSetsLocked() [][]byte {
+	types := make([]int, 0, len(g.paramSets))
+	for t := range g.paramSets {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	out := make([][]byte, 0, len(types))
+	for _, t := range types {
+		out = append(out, g.paramSets[byte(t)])
+	}
+	return out
+}
+
+// classifyNAL はNALユニットのタイプと、キーフレーム/パラメータセット/中立 (AUD・SEI) かを返します
+func classifyNAL(codec string, nal []byte) (nalType byte, key, param, neutral bool) {
+	if len(nal) == 0 {
+		return 0, false, false, true
+	}
+	if codec == "h265" {
+		if len(nal) < 2 {
+			return 0, false, false, true
+		}
+		nalType = (nal[0] >> 1) & 0x3F
+		switch {
+		case nalType >= 32 && nalType <= 34: // VPS, SPS, PPS
+			return nalType, true, true, false
+		case nalType >= 16 && nalType <= 21: // IRAP (BLA, IDR, CRA)
+			return nalType, true, false, false
+		case nalType == 35 || nalType == 39 || nalType == 40: // AUD, SEI
+			return nalType, false, false, true
+		}
+		return nalType, false, false, false
+	}
+	nalType = nal[0] & 0x1F
+	switch nalType {
+	case 7, 8: // SPS, PPS
+		return nalType, true, true, false
+	case 5: // IDR
+		return nalType, true, false, false
+	case 6, 9: // SEI, AUD
+		return nalType, false, false, true
+	}
+	return nalType, false, false, false
+}
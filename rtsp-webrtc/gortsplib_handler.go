@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"context"
 	"net/url"
 	"os/exec" // 追加
 	"strconv" // strconv をインポートに追加
@@ -34,8 +34,8 @@ func sanitizeContentBase(res *base.Response) {
 
 // --- H.264 RTSP パススルー (gortsplib 版・超低遅延) ---
 // startGortsplibH264RTSP は、指定されたRTSP URLからH.264ストリームを取得し、
-// WebRTCハンドラー (webrtc_handler.go の writeNALsToTracks) にNALユニットを渡します。
-func startGortsplibH264RTSP(props props) {
+// ストリーム (stream.go の writeNALsToTracks) にNALユニットを渡します。
+func startGortsplibH264RTSP(ctx context.Context, s *stream, props props) {
 	c := gortsplib.Client{
 		// OnResponse は、サーバーからのレスポンス受信時に呼び出されます。
 		// ここでは、Content-Base ヘッダーを正規化するために使用しています。
@@ -44,28 +44,43 @@ func startGortsplibH264RTSP(props props) {
 				sanitizeContentBase(res)
 			}
 		},
+		// 欠落したRTPパケットをメトリクスに記録
+		OnPacketsLost: func(lost uint64) {
+			rtpPacketsLost.with(sourceRTSPClient, s.name).Add(lost)
+			warnRateLimited(s.logger, "rtsp-client", "gortsplib: RTPパケットが欠落しました", "lost", lost)
+		},
+	}
+
+	u, err := inputRTSPURL(props)
+	if err != nil {
+		s.logger.Error("入力URLの解析エラー", "error", err)
+		return
 	}
+	s.logger.Debug("gortsplib: 入力URLを解析中", "host", u.Host) // 初期化時のログはパフォーマンスに影響小
 
-	u, err := base.ParseURL(props.inputURL)
-	log.Println("gortsplib: 入力URLを解析中:", u.Host) // 初期化時のログはパフォーマンスに影響小
+	// RTSPS入力のTLS設定 (証明書の検証は -input-tls-insecure / -input-tls-ca で指定)
+	c.TLSConfig, err = inputTLSConfig(props)
 	if err != nil {
-		log.Printf("入力URLの解析エラー: %v", err)
+		s.logger.Error("gortsplib: TLS設定エラー", "error", err)
 		return
 	}
 
 	// サーバーに接続
 	err = c.Start(u.Scheme, u.Host)
 	if err != nil {
-		log.Printf("RTSPサーバーへの接続エラー: %v", err)
+		s.logger.Error("RTSPサーバーへの接続エラー", "error", err)
 		return
 	}
 	defer c.Close()
-	log.Println("gortsplib: RTSPサーバーに接続しました") // 初期化時のログ
+	// コンテキスト終了時 (オンデマンド入力の停止時) にクライアントを閉じる
+	stop := context.AfterFunc(ctx, c.Close)
+	defer stop()
+	s.logger.Info("gortsplib: RTSPサーバーに接続しました") // 初期化時のログ
 
 	// 利用可能なメディアを検索 (DESCRIBEリクエスト)
 	desc, _, err := c.Describe(u)
 	if err != nil {
-		log.Printf("RTSPストリームの記述エラー: %v", err)
+		s.logger.Error("RTSPストリームの記述エラー", "error", err)
 		return
 	}
 
@@ -73,15 +88,15 @@ func startGortsplibH264RTSP(props props) {
 	var forma *format.H264
 	medi := desc.FindFormat(&forma)
 	if medi == nil {
-		log.Println("gortsplib: H.264メディアが見つかりません")
+		s.logger.Error("gortsplib: H.264メディアが見つかりません")
 		return
 	}
-	log.Println("gortsplib: H.264メディアが見つかりました") // 初期化時のログ
+	s.logger.Info("gortsplib: H.264メディアが見つかりました") // 初期化時のログ
 
 	// RTP -> H264デコーダーをセットアップ (gortsplibの場合、これはNALユニットエクストラクタとして機能)
 	rtpDec, err := forma.CreateDecoder()
 	if err != nil {
-		log.Printf("H.264 RTPデコーダーの作成エラー: %v", err)
+		s.logger.Error("H.264 RTPデコーダーの作成エラー", "error", err)
 		return
 	}
 
@@ -90,31 +105,31 @@ func startGortsplibH264RTSP(props props) {
 	initialNALs := [][]byte{}
 	if forma.SPS != nil {
 		initialNALs = append(initialNALs, forma.SPS)
-		log.Println("gortsplib: SPSをWebRTCトラックに送信中") // 初期化時のログ
+		s.logger.Debug("gortsplib: SPSをWebRTCトラックに送信中") // 初期化時のログ
 	}
 	if forma.PPS != nil {
 		initialNALs = append(initialNALs, forma.PPS)
-		log.Println("gortsplib: PPSをWebRTCトラックに送信中") // 初期化時のログ
+		s.logger.Debug("gortsplib: PPSをWebRTCトラックに送信中") // 初期化時のログ
 	}
 	if len(initialNALs) > 0 {
 		// SPS/PPSのような設定NALの場合、期間は厳密には重要ではありません。
 		// ここでは一般的なフレームレートを想定したデフォルト値を使用しています。
-		writeNALsToTracks(initialNALs, time.Second/30) // デフォルトの期間として30 FPSを想定
+		s.writeNALsToTracks(initialNALs, time.Second/30) // デフォルトの期間として30 FPSを想定
 	}
 
 	// 単一メディアをセットアップ (SETUPリクエスト)
-	log.Printf("gortsplib: RTSPメディア %v をセットアップ中", medi) // 初期化時のログ
+	s.logger.Debug("gortsplib: RTSPメディアをセットアップ中", "media", medi.Type) // 初期化時のログ
 	_, err = c.Setup(desc.BaseURL, medi, 0, 0)
 	if err != nil {
-		log.Printf("RTSPメディアのセットアップエラー: %v", err)
+		s.logger.Error("RTSPメディアのセットアップエラー", "error", err)
 		return
 	}
-	log.Println("gortsplib: RTSPメディアのセットアップ完了") // 初期化時のログ
+	s.logger.Info("gortsplib: RTSPメディアのセットアップ完了") // 初期化時のログ
 
 	// フレーム期間の決定。
 	// デフォルトで30 FPSを想定
 	frameDuration := time.Second / 30
-	log.Printf("gortsplib: デフォルトのフレーム期間: %v (30 FPS相当)", frameDuration)
+	s.logger.Debug("gortsplib: デフォルトのフレーム期間 (30 FPS相当)", "frame_duration", frameDuration)
 
 	// SDPのfmtp属性からフレームレートに関連する情報を解析する試み
 	// format.H264 の FMTP() メソッドを使用
@@ -124,17 +139,17 @@ func startGortsplibH264RTSP(props props) {
 			fps, err := strconv.ParseFloat(framerateVal, 64)
 			if err == nil && fps > 0 {
 				frameDuration = time.Duration(float64(time.Second) / fps)
-				log.Printf("gortsplib: SDP FMTPからフレームレート %s FPS を検出。新しいフレーム期間: %v", framerateVal, frameDuration)
+				s.logger.Info("gortsplib: SDP FMTPからフレームレートを検出", "framerate", framerateVal, "frame_duration", frameDuration)
 			} else if err != nil {
-				log.Printf("gortsplib: SDP FMTPのフレームレート値 '%s' の解析エラー: %v。デフォルトのフレーム期間を使用します。", framerateVal, err)
+				s.logger.Warn("gortsplib: SDP FMTPのフレームレート値の解析エラー。デフォルトのフレーム期間を使用します。", "framerate", framerateVal, "error", err)
 			} else {
-				log.Printf("gortsplib: SDP FMTPのフレームレート値 '%s' が無効 (0以下)。デフォルトのフレーム期間を使用します。", framerateVal)
+				s.logger.Warn("gortsplib: SDP FMTPのフレームレート値が無効 (0以下)。デフォルトのフレーム期間を使用します。", "framerate", framerateVal)
 			}
 		} else {
-			log.Println("gortsplib: SDP FMTPに 'framerate' が見つかりません。デフォルトのフレーム期間を使用します。")
+			s.logger.Debug("gortsplib: SDP FMTPに 'framerate' が見つかりません。デフォルトのフレーム期間を使用します。")
 		}
 	} else {
-		log.Println("gortsplib: SDPにFMTP属性が見つかりません。デフォルトのフレーム期間を使用します。")
+		s.logger.Debug("gortsplib: SDPにFMTP属性が見つかりません。デフォルトのフレーム期間を使用します。")
 	}
 
 	// RTPパケットのタイムスタンプ差から動的に計算する方法も考えられますが、
@@ -143,7 +158,9 @@ func startGortsplibH264RTSP(props props) {
 
 	// OnPacketRTP は、RTPパケット到着時に呼び出されるコールバックです。
 	// このコールバック内の処理は、パケット受信ごとに行われるため、効率性が重要です。
+	received := rtpPacketsReceived.with(sourceRTSPClient, s.name)
 	c.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
+		received.Add(1)
 
 		// RTPパケットからアクセスユニット（NALユニット群）を抽出します。
 		// au は [][]byte 型で、1つ以上のNALユニットを含みます。
@@ -153,7 +170,7 @@ func startGortsplibH264RTSP(props props) {
 			// ErrMorePacketsNeeded: パケットが分割されており、アクセスユニットを完成させるにはさらにパケットが必要な場合
 			// これらは必ずしも致命的なエラーではなく、ストリームの特性上発生しうるため、ログレベルを調整するか、特定の条件下では無視することも検討できます。
 			if err != rtph264.ErrNonStartingPacketAndNoPrevious && err != rtph264.ErrMorePacketsNeeded {
-				log.Printf("gortsplib: RTPデコードエラー: %v", err) // エラー発生時のみログ出力
+				warnRateLimited(s.logger, "rtsp-client", "gortsplib: RTPデコードエラー", "error", err) // エラー発生時のみログ出力
 			}
 			return
 		}
@@ -161,29 +178,29 @@ func startGortsplibH264RTSP(props props) {
 		// 抽出されたNALユニットが存在する場合のみ処理
 		if len(au) > 0 {
 			// writeNALsToTracks は、NALユニット群をWebRTCトラックに書き込みます。
-			// この関数は webrtc_handler.go で定義されており、複数のWebRTCクライアントへの配信処理を含みます。
+			// この関数は stream.go で定義されており、複数のWebRTCクライアントへの配信処理を含みます。
 			// この呼び出しがボトルネックになる場合は、webrtc_handler.go側の最適化や、
 			// 非同期処理（ただしNALの順序保証が必要）を検討する必要があります。
-			writeNALsToTracks(au, frameDuration)
+			s.writeNALsToTracks(au, frameDuration)
 		}
 	})
 
 	// 再生開始 (PLAYリクエスト)
 	_, err = c.Play(nil)
 	if err != nil {
-		log.Printf("RTSP再生の開始エラー: %v", err)
+		s.logger.Error("RTSP再生の開始エラー", "error", err)
 		return
 	}
-	log.Println("gortsplib: RTSP再生が開始されました。WebRTCにストリーミング中...") // 初期化時のログ
+	s.logger.Info("gortsplib: RTSP再生が開始されました。WebRTCにストリーミング中...") // 初期化時のログ
 
 	// 致命的なエラーが発生するか、ストリームが終了するまで待機
 	// c.Wait() は通常、エラーが発生した場合にそのエラーを返します。正常終了時は nil を返すこともあります。
-	log.Printf("gortsplib: クライアント処理終了: %v", c.Wait()) // 終了時のログ
+	s.logger.Info("gortsplib: クライアント処理終了", "error", c.Wait()) // 終了時のログ
 }
 
 // --- H.265 RTSP -> H.264 WebRTC (gortsplib + ffmpeg) ---
-func startGortsplibH265toH264RTSP(props props) {
-    log.Println("gortsplib: H.265 to H.264 並列トランスコーディングを開始します")
+func startGortsplibH265toH264RTSP(ctx context.Context, s *stream, props props) {
+    s.logger.Info("gortsplib: H.265 to H.264 並列トランスコーディングを開始します")
 
     c := gortsplib.Client{
         OnResponse: func(res *base.Response) {
@@ -191,43 +208,60 @@ func startGortsplibH265toH264RTSP(props props) {
                 sanitizeContentBase(res)
             }
         },
+        // 欠落したRTPパケットをメトリクスに記録
+        OnPacketsLost: func(lost uint64) {
+            rtpPacketsLost.with(sourceRTSPClient, s.name).Add(lost)
+            warnRateLimited(s.logger, "rtsp-client", "gortsplib: RTPパケットが欠落しました", "lost", lost)
+        },
+    }
+
+    u, err := inputRTSPURL(props)
+    if err != nil {
+        s.logger.Error("gortsplib: 入力URLの解析エラー", "error", err)
+        return
     }
 
-    u, err := base.ParseURL(props.inputURL)
+    // RTSPS入力のTLS設定 (証明書の検証は -input-tls-insecure / -input-tls-ca で指定)
+    c.TLSConfig, err = inputTLSConfig(props)
     if err != nil {
-        log.Printf("gortsplib: 入力URLの解析エラー: %v", err)
+        s.logger.Error("gortsplib: TLS設定エラー", "error", err)
         return
     }
 
     err = c.Start(u.Scheme, u.Host)
     if err != nil {
-        log.Printf("gortsplib: RTSPサーバーへの接続エラー: %v", err)
+        s.logger.Error("gortsplib: RTSPサーバーへの接続エラー", "error", err)
         return
     }
     defer c.Close()
+    // コンテキスト終了時 (オンデマンド入力の停止時) にクライアントを閉じる
+    stop := context.AfterFunc(ctx, c.Close)
+    defer stop()
 
     desc, _, err := c.Describe(u)
     if err != nil {
-        log.Printf("gortsplib: RTSPストリームの記述エラー: %v", err)
+        s.logger.Error("gortsplib: RTSPストリームの記述エラー", "error", err)
         return
     }
 
     var formaH265 *format.H265
     medi := desc.FindFormat(&formaH265)
     if medi == nil {
-        log.Println("gortsplib: H.265メディアが見つかりません")
+        s.logger.Error("gortsplib: H.265メディアが見つかりません")
         return
     }
 
     rtpDec, err := formaH265.CreateDecoder()
     if err != nil {
-        log.Printf("gortsplib: H.265 RTPデコーダーの作成エラー: %v", err)
+        s.logger.Error("gortsplib: H.265 RTPデコーダーの作成エラー", "error", err)
         return
     }
 
     // 並列処理用のチャネル（バッファサイズを調整して遅延を最小化）
     nalChan := make(chan []byte, 100) // バッファサイズ増加
     h264NALChan := make(chan []byte, 100)
+    h265Drops := channelDrops.with(s.name, "h265-transcode-input")
+    h264Drops := channelDrops.with(s.name, "h265-transcode-output")
     
     // FFmpeg設定（さらに最適化）
     ffmpegArgs := []string{
@@ -279,10 +313,24 @@ func startGortsplibH265toH264RTSP(props props) {
         }
     }
 
-    cmd := exec.Command("ffmpeg", ffmpegArgs...)
+    // runIngest による再接続のたびに呼び出されるため、ffmpeg は試行ごとのコンテキストで起動し、
+    // どの経路で戻る場合もRTSPクライアントを閉じてから入力を閉じ、ffmpeg の終了を待つ
+    ffmpegCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    cmd := exec.CommandContext(ffmpegCtx, "ffmpeg", ffmpegArgs...)
     ffmpegIn, _ := cmd.StdinPipe()
     ffmpegOut, _ := cmd.StdoutPipe()
-    cmd.Start()
+    if err := cmd.Start(); err != nil {
+        s.logger.Error("gortsplib: ffmpegの起動に失敗", "error", err)
+        return
+    }
+    s.setIngestProcess(cmd)
+    defer func() {
+        c.Close() // RTPコールバックが nalChan に送信しなくなってから閉じる
+        close(nalChan)
+        cancel()
+        _ = cmd.Wait()
+    }()
 
     // 1. H.265 NAL書き込み用ゴルーチン（高優先度）
     go func() {
@@ -344,6 +392,7 @@ func startGortsplibH265toH264RTSP(props props) {
                 case h264NALChan <- nal.Data:
                 default:
                     // チャネルが満杯の場合はスキップ（遅延防止）
+                    h264Drops.Add(1)
                 }
             }
         }
@@ -362,18 +411,20 @@ func startGortsplibH265toH264RTSP(props props) {
         }
 
         for h264NAL := range h264NALChan {
-            writeNALsToTracks([][]byte{h264NAL}, frameDuration)
+            s.writeNALsToTracks([][]byte{h264NAL}, frameDuration)
         }
     }()
 
     _, err = c.Setup(desc.BaseURL, medi, 0, 0)
     if err != nil {
-        log.Printf("gortsplib: RTSPメディアのセットアップエラー: %v", err)
+        s.logger.Error("gortsplib: RTSPメディアのセットアップエラー", "error", err)
         return
     }
 
     // 4. RTPパケット受信（メインスレッド）- 非ブロッキング処理
+    received := rtpPacketsReceived.with(sourceRTSPClient, s.name)
     c.OnPacketRTP(medi, formaH265, func(pkt *rtp.Packet) {
+        received.Add(1)
         au, err := rtpDec.Decode(pkt)
         if err != nil {
             if err != rtph265.ErrNonStartingPacketAndNoPrevious && err != rtph265.ErrMorePacketsNeeded {
@@ -392,6 +443,7 @@ func startGortsplibH265toH264RTSP(props props) {
                 case nalChan <- nal:
                 default:
                     // チャネルが満杯の場合はスキップ（遅延防止）
+                    h265Drops.Add(1)
                 }
             }
         }
@@ -399,22 +451,21 @@ func startGortsplibH265toH264RTSP(props props) {
 
     _, err = c.Play(nil)
     if err != nil {
-        log.Printf("gortsplib: RTSP再生の開始エラー: %v", err)
+        s.logger.Error("gortsplib: RTSP再生の開始エラー", "error", err)
         return
     }
 
-    log.Println("gortsplib: 並列H.265→H.264変換開始。WebRTCにストリーミング中...")
+    s.logger.Info("gortsplib: 並列H.265→H.264変換開始。WebRTCにストリーミング中...")
 
     clientErr := c.Wait()
-    close(nalChan) // チャネルを閉じてゴルーチンを終了
-    
-    log.Printf("gortsplib: 並列処理完了: %v", clientErr)
+
+    s.logger.Info("gortsplib: 並列処理完了", "error", clientErr)
 }
 
 // --- H.265 RTSP パススルー (gortsplib 版・超低遅延) ---
 // startGortsplibH265RTSP は、指定されたRTSP URLからH.265ストリームを取得し、
-// WebRTCハンドラー (webrtc_handler.go の writeNALsToTracksH265) にNALユニットを渡します。
-func startGortsplibH265RTSP(props props) {
+// ストリーム (stream.go の writeNALsToTracksH265) にNALユニットを渡します。
+func startGortsplibH265RTSP(ctx context.Context, s *stream, props props) {
 	c := gortsplib.Client{
 		// OnResponse は、サーバーからのレスポンス受信時に呼び出されます。
 		// ここでは、Content-Base ヘッダーを正規化するために使用しています。
@@ -423,28 +474,43 @@ func startGortsplibH265RTSP(props props) {
 				sanitizeContentBase(res)
 			}
 		},
+		// 欠落したRTPパケットをメトリクスに記録
+		OnPacketsLost: func(lost uint64) {
+			rtpPacketsLost.with(sourceRTSPClient, s.name).Add(lost)
+			warnRateLimited(s.logger, "rtsp-client", "gortsplib: RTPパケットが欠落しました", "lost", lost)
+		},
+	}
+
+	u, err := inputRTSPURL(props)
+	if err != nil {
+		s.logger.Error("入力URLの解析エラー", "error", err)
+		return
 	}
+	s.logger.Debug("gortsplib: H.265入力URLを解析中", "host", u.Host) // 初期化時のログはパフォーマンスに影響小
 
-	u, err := base.ParseURL(props.inputURL)
-	log.Println("gortsplib: H.265入力URLを解析中:", u.Host) // 初期化時のログはパフォーマンスに影響小
+	// RTSPS入力のTLS設定 (証明書の検証は -input-tls-insecure / -input-tls-ca で指定)
+	c.TLSConfig, err = inputTLSConfig(props)
 	if err != nil {
-		log.Printf("入力URLの解析エラー: %v", err)
+		s.logger.Error("gortsplib: TLS設定エラー", "error", err)
 		return
 	}
 
 	// サーバーに接続
 	err = c.Start(u.Scheme, u.Host)
 	if err != nil {
-		log.Printf("RTSPサーバーへの接続エラー: %v", err)
+		s.logger.Error("RTSPサーバーへの接続エラー", "error", err)
 		return
 	}
 	defer c.Close()
-	log.Println("gortsplib: RTSPサーバーに接続しました (H.265)") // 初期化時のログ
+	// コンテキスト終了時 (オンデマンド入力の停止時) にクライアントを閉じる
+	stop := context.AfterFunc(ctx, c.Close)
+	defer stop()
+	s.logger.Info("gortsplib: RTSPサーバーに接続しました (H.265)") // 初期化時のログ
 
 	// 利用可能なメディアを検索 (DESCRIBEリクエスト)
 	desc, _, err := c.Describe(u)
 	if err != nil {
-		log.Printf("RTSPストリームの記述エラー: %v", err)
+		s.logger.Error("RTSPストリームの記述エラー", "error", err)
 		return
 	}
 
@@ -452,15 +518,15 @@ func startGortsplibH265RTSP(props props) {
 	var forma *format.H265
 	medi := desc.FindFormat(&forma)
 	if medi == nil {
-		log.Println("gortsplib: H.265メディアが見つかりません")
+		s.logger.Error("gortsplib: H.265メディアが見つかりません")
 		return
 	}
-	log.Println("gortsplib: H.265メディアが見つかりました") // 初期化時のログ
+	s.logger.Info("gortsplib: H.265メディアが見つかりました") // 初期化時のログ
 
 	// RTP -> H265デコーダーをセットアップ (gortsplibの場合、これはNALユニットエクストラクタとして機能)
 	rtpDec, err := forma.CreateDecoder()
 	if err != nil {
-		log.Printf("H.265 RTPデコーダーの作成エラー: %v", err)
+		s.logger.Error("H.265 RTPデコーダーの作成エラー", "error", err)
 		return
 	}
 
@@ -469,35 +535,35 @@ func startGortsplibH265RTSP(props props) {
 	initialNALs := [][]byte{}
 	if forma.VPS != nil {
 		initialNALs = append(initialNALs, forma.VPS)
-		log.Println("gortsplib: VPSをWebRTCトラックに送信中") // 初期化時のログ
+		s.logger.Debug("gortsplib: VPSをWebRTCトラックに送信中") // 初期化時のログ
 	}
 	if forma.SPS != nil {
 		initialNALs = append(initialNALs, forma.SPS)
-		log.Println("gortsplib: SPSをWebRTCトラックに送信中") // 初期化時のログ
+		s.logger.Debug("gortsplib: SPSをWebRTCトラックに送信中") // 初期化時のログ
 	}
 	if forma.PPS != nil {
 		initialNALs = append(initialNALs, forma.PPS)
-		log.Println("gortsplib: PPSをWebRTCトラックに送信中") // 初期化時のログ
+		s.logger.Debug("gortsplib: PPSをWebRTCトラックに送信中") // 初期化時のログ
 	}
 	if len(initialNALs) > 0 {
 		// VPS/SPS/PPSのような設定NALの場合、期間は厳密には重要ではありません。
 		// ここでは一般的なフレームレートを想定したデフォルト値を使用しています。
-		writeNALsToTracksH265(initialNALs, time.Second/30) // デフォルトの期間として30 FPSを想定
+		s.writeNALsToTracksH265(initialNALs, time.Second/30) // デフォルトの期間として30 FPSを想定
 	}
 
 	// 単一メディアをセットアップ (SETUPリクエスト)
-	log.Printf("gortsplib: RTSP H.265メディア %v をセットアップ中", medi) // 初期化時のログ
+	s.logger.Debug("gortsplib: RTSP H.265メディアをセットアップ中", "media", medi.Type) // 初期化時のログ
 	_, err = c.Setup(desc.BaseURL, medi, 0, 0)
 	if err != nil {
-		log.Printf("RTSP H.265メディアのセットアップエラー: %v", err)
+		s.logger.Error("RTSP H.265メディアのセットアップエラー", "error", err)
 		return
 	}
-	log.Println("gortsplib: RTSP H.265メディアのセットアップ完了") // 初期化時のログ
+	s.logger.Info("gortsplib: RTSP H.265メディアのセットアップ完了") // 初期化時のログ
 
 	// フレーム期間の決定。
 	// デフォルトで30 FPSを想定
 	frameDuration := time.Second / 30
-	log.Printf("gortsplib: デフォルトのフレーム期間: %v (30 FPS相当)", frameDuration)
+	s.logger.Debug("gortsplib: デフォルトのフレーム期間 (30 FPS相当)", "frame_duration", frameDuration)
 
 	// SDPのfmtp属性からフレームレートに関連する情報を解析する試み
 	// format.H265 の FMTP() メソッドを使用
@@ -507,22 +573,24 @@ func startGortsplibH265RTSP(props props) {
 			fps, err := strconv.ParseFloat(framerateVal, 64)
 			if err == nil && fps > 0 {
 				frameDuration = time.Duration(float64(time.Second) / fps)
-				log.Printf("gortsplib: SDP FMTPからフレームレート %s FPS を検出。新しいフレーム期間: %v", framerateVal, frameDuration)
+				s.logger.Info("gortsplib: SDP FMTPからフレームレートを検出", "framerate", framerateVal, "frame_duration", frameDuration)
 			} else if err != nil {
-				log.Printf("gortsplib: SDP FMTPのフレームレート値 '%s' の解析エラー: %v。デフォルトのフレーム期間を使用します。", framerateVal, err)
+				s.logger.Warn("gortsplib: SDP FMTPのフレームレート値の解析エラー。デフォルトのフレーム期間を使用します。", "framerate", framerateVal, "error", err)
 			} else {
-				log.Printf("gortsplib: SDP FMTPのフレームレート値 '%s' が無効 (0以下)。デフォルトのフレーム期間を使用します。", framerateVal)
+				s.logger.Warn("gortsplib: SDP FMTPのフレームレート値が無効 (0以下)。デフォルトのフレーム期間を使用します。", "framerate", framerateVal)
 			}
 		} else {
-			log.Println("gortsplib: SDP FMTPに 'framerate' が見つかりません。デフォルトのフレーム期間を使用します。")
+			s.logger.Debug("gortsplib: SDP FMTPに 'framerate' が見つかりません。デフォルトのフレーム期間を使用します。")
 		}
 	} else {
-		log.Println("gortsplib: SDPにFMTP属性が見つかりません。デフォルトのフレーム期間を使用します。")
+		s.logger.Debug("gortsplib: SDPにFMTP属性が見つかりません。デフォルトのフレーム期間を使用します。")
 	}
 
 	// OnPacketRTP は、RTPパケット到着時に呼び出されるコールバックです。
 	// このコールバック内の処理は、パケット受信ごとに行われるため、効率性が重要です。
+	received := rtpPacketsReceived.with(sourceRTSPClient, s.name)
 	c.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
+		received.Add(1)
 
 		// RTPパケットからアクセスユニット（NALユニット群）を抽出します。
 		// au は [][]byte 型で、1つ以上のNALユニットを含みます。
@@ -532,7 +600,7 @@ func startGortsplibH265RTSP(props props) {
 			// ErrMorePacketsNeeded: パケットが分割されており、アクセスユニットを完成させるにはさらにパケットが必要な場合
 			// これらは必ずしも致命的なエラーではなく、ストリームの特性上発生しうるため、ログレベルを調整するか、特定の条件下では無視することも検討できます。
 			if err != rtph265.ErrNonStartingPacketAndNoPrevious && err != rtph265.ErrMorePacketsNeeded {
-				log.Printf("gortsplib: H.265 RTPデコードエラー: %v", err) // エラー発生時のみログ出力
+				warnRateLimited(s.logger, "rtsp-client", "gortsplib: H.265 RTPデコードエラー", "error", err) // エラー発生時のみログ出力
 			}
 			return
 		}
@@ -540,22 +608,22 @@ func startGortsplibH265RTSP(props props) {
 		// 抽出されたNALユニットが存在する場合のみ処理
 		if len(au) > 0 {
 			// writeNALsToTracksH265 は、NALユニット群をH.265 WebRTCトラックに書き込みます。
-			// この関数は webrtc_handler.go で定義されており、複数のWebRTCクライアントへの配信処理を含みます。
+			// この関数は stream.go で定義されており、複数のWebRTCクライアントへの配信処理を含みます。
 			// この呼び出しがボトルネックになる場合は、webrtc_handler.go側の最適化や、
 			// 非同期処理（ただしNALの順序保証が必要）を検討する必要があります。
-			writeNALsToTracksH265(au, frameDuration)
+			s.writeNALsToTracksH265(au, frameDuration)
 		}
 	})
 
 	// 再生開始 (PLAYリクエスト)
 	_, err = c.Play(nil)
 	if err != nil {
-		log.Printf("RTSP再生の開始エラー: %v", err)
+		s.logger.Error("RTSP再生の開始エラー", "error", err)
 		return
 	}
-	log.Println("gortsplib: H.265 RTSP再生が開始されました。WebRTCにストリーミング中...") // 初期化時のログ
+	s.logger.Info("gortsplib: H.265 RTSP再生が開始されました。WebRTCにストリーミング中...") // 初期化時のログ
 
 	// 致命的なエラーが発生するか、ストリームが終了するまで待機
 	// c.Wait() は通常、エラーが発生した場合にそのエラーを返します。正常終了時は nil を返すこともあります。
-	log.Printf("gortsplib: H.265クライアント処理終了: %v", c.Wait()) // 終了時のログ
+	s.logger.Info("gortsplib: H.265クライアント処理終了", "error", c.Wait()) // 終了時のログ
 }
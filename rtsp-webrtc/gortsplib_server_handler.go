@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"log"
-	"os/exec"
+	"log/slog"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,530 +16,573 @@ import (
 	"github.com/bluenviron/gortsplib/v4/pkg/format"
 	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
 	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph265"
-	"github.com/pion/webrtc/v3/pkg/media/h264reader"
 )
 
 // RTSPサーバーハンドラー（RTSPクライアントからのPUSHを受けてWebRTC配信）
+// パスごとに複数のパブリッシャーを同時に受け付け、それぞれを個別のストリームとして配信します。
+// また、登録済みのすべてのストリームを rtsp://<host>:<port>/<ストリーム名> でRTSPリーダーに再配信します。
 type serverHandler struct {
-	server    *gortsplib.Server
-	mutex     sync.Mutex
-	publisher *gortsplib.ServerSession
-	media     *description.Media
+	props      props                        // プロセッサ情報など
+	publish    bool                         // パブリッシャー (ANNOUNCE/RECORD) を受け付けるか
+	transports map[gortsplib.Transport]bool // 有効なトランスポート
+	auth       rtspAuth                     // PUSH/再生の認証設定
+	mutex      sync.Mutex
+
+	publishers map[*gortsplib.ServerSession]*serverPublisher // セッションごとのパブリッシャー
+	paths      map[string]*serverPublisher                   // パスごとの現在のパブリッシャー
+	readers    map[*gortsplib.ServerSession]*stream          // PLAY中のリーダーと視聴中のストリーム
+	pushed     map[*stream]*time.Timer                       // PUSHで作成したストリームと削除タイマー (パブリッシャーの接続中は nil)
+}
+
+// pushStreamLinger はパブリッシャーの切断後、PUSHで作成したストリームを削除するまでの猶予です。
+// パブリッシャーが再接続した場合は視聴者を切断せずに配信を再開します。
+const pushStreamLinger = 30 * time.Second
+
+// rtspListener は1つのリスナー (RTSPまたはRTSPS) のハンドラーです。
+// パブリッシャーとリーダーの状態はリスナー間で serverHandler を共有し、
+// 再配信用のServerStreamはリスナーのサーバーごとに作成します。
+type rtspListener struct {
+	*serverHandler
+	server *gortsplib.Server
+}
+
+// serverPublisher は1つのパス (rtsp://host/cam1 など) にPUSHしているパブリッシャーです
+type serverPublisher struct {
+	session *gortsplib.ServerSession
+	path    string
+	stream  *stream // 配信先のストリーム
+	remote  string  // パブリッシャーの接続元アドレス
+	logger  *slog.Logger
+	media   *description.Media
+	codec   string // ANNOUNCEのSDPから検出したコーデック ("h264" または "h265")
 
 	// H.264用フィールド
 	formatH264 *format.H264
 	rtpDecH264 *rtph264.Decoder
 
 	// H.265用フィールド
-	formatH265   *format.H265
-	rtpDecH265   *rtph265.Decoder
-	ffmpegCmd    *exec.Cmd
-	ffmpegStdin  io.WriteCloser
-	h264Reader   *h264reader.H264Reader
-
-	// コーデックタイプ
-	codecType string // "h264" または "h265"
-	props     props  // プロセッサ情報など
+	formatH265 *format.H265
+	rtpDecH265 *rtph265.Decoder
 
 	// 並列処理用フィールド
-	h264NALChan chan [][]byte // H.264 NALユニット処理用チャネル
-	h265NALChan chan [][]byte // H.265 NALユニット処理用チャネル
-	wg          sync.WaitGroup // ゴルーチン完了待機用
-	closeOnce   sync.Once      // チャネルクローズ処理の重複実行防止
+	nalChan   chan [][]byte  // NALユニット処理用チャネル
+	wg        sync.WaitGroup // ゴルーチン完了待機用
+	closeOnce sync.Once      // チャネルクローズ処理の重複実行防止
+}
+
+// streamNameFromPath はRTSPパスからストリーム名を決定します (例: "/cam1" -> "cam1")
+func streamNameFromPath(path string) string {
+	name := strings.Trim(path, "/")
+	if name == "" {
+		return "default"
+	}
+	return name
 }
 
 // 接続が開かれたときに呼び出される
 func (sh *serverHandler) OnConnOpen(ctx *gortsplib.ServerHandlerOnConnOpenCtx) {
-	log.Printf("RTSP server: 接続が開かれました")
+	slog.Debug("RTSP server: 接続が開かれました", "remote", ctx.Conn.NetConn().RemoteAddr())
 }
 
 // 接続が閉じられたときに呼び出される
 func (sh *serverHandler) OnConnClose(ctx *gortsplib.ServerHandlerOnConnCloseCtx) {
-	log.Printf("RTSP server: 接続が閉じられました (%v)", ctx.Error)
+	slog.Debug("RTSP server: 接続が閉じられました", "remote", ctx.Conn.NetConn().RemoteAddr(), "error", ctx.Error)
 }
 
 // セッションが開かれたときに呼び出される
 func (sh *serverHandler) OnSessionOpen(ctx *gortsplib.ServerHandlerOnSessionOpenCtx) {
-	log.Printf("RTSP server: セッションが開かれました")
+	slog.Debug("RTSP server: セッションが開かれました")
 }
 
 // セッションが閉じられたときに呼び出される
 func (sh *serverHandler) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
-	log.Printf("RTSP server: セッションが閉じられました")
-
 	sh.mutex.Lock()
-	defer sh.mutex.Unlock()
-
-	// チャネルをクローズし、処理ゴルーチンが終了するのを待つ
-	sh.closeOnce.Do(func() {
-		if sh.h264NALChan != nil {
-			close(sh.h264NALChan)
-			sh.h264NALChan = nil
-		}
-		if sh.h265NALChan != nil {
-			close(sh.h265NALChan)
-			sh.h265NALChan = nil
+	pub, ok := sh.publishers[ctx.Session]
+	if ok {
+		delete(sh.publishers, ctx.Session)
+		if sh.paths[pub.path] == pub {
+			delete(sh.paths, pub.path)
 		}
-	})
-	sh.wg.Wait() // 処理ゴルーチンの完了を待つ
+	}
+	reader := sh.readers[ctx.Session]
+	delete(sh.readers, ctx.Session)
+	sh.mutex.Unlock()
 
-	// H.265トランスコーディングプロセスのクリーンアップ
-	if sh.ffmpegStdin != nil {
-		sh.ffmpegStdin.Close()
-		sh.ffmpegStdin = nil
+	if reader != nil {
+		reader.logger.Info("RTSP server: リーダーのセッションが閉じられました")
+		reader.removeRTSPReader()
+		return
 	}
-	
-	if sh.ffmpegCmd != nil && sh.ffmpegCmd.Process != nil {
-		log.Printf("RTSP server: H.265トランスコーディングプロセスを終了中")
-		sh.ffmpegCmd.Process.Kill()
-		sh.ffmpegCmd.Wait()
-		sh.ffmpegCmd = nil
+	if !ok {
+		slog.Debug("RTSP server: セッションが閉じられました")
+		return
 	}
-
-	if sh.h264Reader != nil {
-		sh.h264Reader = nil
+	pub.logger.Info("RTSP server: パブリッシャーのセッションが閉じられました")
+	pub.close()
+	sh.schedulePushedStreamRemoval(pub.stream)
+	e := event{Type: eventPublisherDisconnected, Stream: pub.stream.name, Path: pub.path, Remote: pub.remote}
+	if ctx.Error != nil {
+		e.Reason = ctx.Error.Error()
 	}
+	events.publish(e)
+}
 
-	sh.publisher = nil
+// パブリッシャーのRTPパケットの欠落を検出したときに呼び出される
+func (sh *serverHandler) OnPacketsLost(ctx *gortsplib.ServerHandlerOnPacketsLostCtx) {
+	sh.mutex.Lock()
+	pub := sh.publishers[ctx.Session]
+	sh.mutex.Unlock()
+	if pub == nil {
+		return
+	}
+	rtpPacketsLost.with(sourceRTSPServer, pub.stream.name).Add(ctx.Lost)
+	warnRateLimited(pub.logger, pub.path, "RTSP server: RTPパケットが欠落しました", "lost", ctx.Lost)
 }
 
 // ANNOUNCEリクエストを受信したときに呼び出される
 func (sh *serverHandler) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
-	log.Printf("RTSP server: ANNOUNCEリクエストを受信 (期待されるコーデック: %s)", sh.codecType)
-
-	sh.mutex.Lock()
-	defer sh.mutex.Unlock()
-
-	if sh.publisher != nil {
-		sh.publisher.Close()
+	slog.Info("RTSP server: ANNOUNCEリクエストを受信", "path", ctx.Path, "remote", ctx.Conn.NetConn().RemoteAddr())
+	if !sh.publish {
+		return &base.Response{
+			StatusCode: base.StatusForbidden,
+		}, fmt.Errorf("パブリッシャーの受け付けは -input-type server の場合のみ有効です")
+	}
+	if res, err := sh.auth.authorize(ctx.Conn, ctx.Request, ctx.Path, true); err != nil {
+		slog.Warn("RTSP server: パブリッシャーの認証に失敗", "path", ctx.Path, "remote", ctx.Conn.NetConn().RemoteAddr())
+		return res, err
 	}
 
-	// 事前にわかっているコーデックに基づいて効率的に処理
-	switch sh.codecType {
-	case "h264":
-		return sh.setupH264Stream(ctx)
-	case "h265":
-		return sh.setupH265Stream(ctx)
-	default:
-		return &base.Response{
-			StatusCode: base.StatusBadRequest,
-		}, fmt.Errorf("サポートされていないコーデック: %s", sh.codecType)
+	pub := &serverPublisher{
+		session: ctx.Session,
+		path:    ctx.Path,
+		remote:  ctx.Conn.NetConn().RemoteAddr().String(),
 	}
-}
 
-// H.264ストリームのセットアップ（効率化版）
-func (sh *serverHandler) setupH264Stream(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
-	var formatH264 *format.H264
-	mediH264 := ctx.Description.FindFormat(&formatH264)
-	
-	if mediH264 == nil {
+	// ANNOUNCEのSDPからコーデックを検出
+	if medi := ctx.Description.FindFormat(&pub.formatH264); medi != nil {
+		pub.codec = "h264"
+		pub.media = medi
+	} else if medi := ctx.Description.FindFormat(&pub.formatH265); medi != nil {
+		pub.codec = "h265"
+		pub.media = medi
+	} else {
 		return &base.Response{
 			StatusCode: base.StatusBadRequest,
-		}, fmt.Errorf("期待されたH.264メディアが見つかりません")
+		}, fmt.Errorf("H.264またはH.265のメディアが見つかりません")
 	}
 
-	log.Printf("RTSP server: H.264メディアを設定中")
-	
-	rtpDec, err := formatH264.CreateDecoder()
+	var err error
+	switch pub.codec {
+	case "h264":
+		pub.rtpDecH264, err = pub.formatH264.CreateDecoder()
+	case "h265":
+		pub.rtpDecH265, err = pub.formatH265.CreateDecoder()
+	}
 	if err != nil {
-		log.Printf("RTSP server: H264デコーダーの作成に失敗: %v", err)
+		slog.Error("RTSP server: デコーダーの作成に失敗", "path", ctx.Path, "codec", pub.codec, "error", err)
 		return &base.Response{
 			StatusCode: base.StatusBadRequest,
 		}, err
 	}
-	
-	sh.publisher = ctx.Session
-	sh.media = mediH264
-	sh.formatH264 = formatH264
-	sh.rtpDecH264 = rtpDec
 
-	// SPS/PPSが利用可能な場合、WebRTCトラックに初期送信
-	initialNALs := [][]byte{}
-	if formatH264.SPS != nil {
-		initialNALs = append(initialNALs, formatH264.SPS)
-		log.Printf("RTSP server: SPSをWebRTCトラックに送信中")
+	name := streamNameFromPath(ctx.Path)
+	sh.mutex.Lock()
+	s := lookupStream(name)
+	if s != nil && s.hasIngest() {
+		sh.mutex.Unlock()
+		slog.Warn("RTSP server: 入力パイプラインを持つストリームへのPUSHを拒否しました", "path", ctx.Path, "remote", ctx.Conn.NetConn().RemoteAddr())
+		return &base.Response{
+			StatusCode: base.StatusForbidden,
+		}, fmt.Errorf("ストリーム %s は入力パイプラインを持つためPUSHできません", name)
+	}
+	created := s == nil
+	if created {
+		s = newStream(name, sh.props.processor)
+		registerStream(s)
+		sh.pushed[s] = nil
+	} else if t, ok := sh.pushed[s]; ok && t != nil {
+		// 削除の猶予期間中にパブリッシャーが再接続した
+		t.Stop()
+		sh.pushed[s] = nil
 	}
-	if formatH264.PPS != nil {
-		initialNALs = append(initialNALs, formatH264.PPS)
-		log.Printf("RTSP server: PPSをWebRTCトラックに送信中")
+	sh.mutex.Unlock()
+	if created {
+		s.logger.Info("RTSP server: ストリームを作成しました")
+		if sh.props.record {
+			if err := s.startRecording(recording); err != nil {
+				s.logger.Error("RTSP server: 録画を開始できません", "error", err)
+			}
+		}
+		if sh.props.clips {
+			if err := s.startClipper(clipping); err != nil {
+				s.logger.Error("RTSP server: クリップ録画を開始できません", "error", err)
+			}
+		}
+		if sh.props.hls {
+			if err := s.startHLS(hlsOutput); err != nil {
+				s.logger.Error("RTSP server: HLS出力を開始できません", "error", err)
+			}
+		}
 	}
-	if len(initialNALs) > 0 {
-		writeNALsToTracks(initialNALs, time.Second/30)
+	pub.stream = s
+	pub.logger = s.logger.With("path", ctx.Path)
+
+	sh.mutex.Lock()
+	// 同じパスに既存のパブリッシャーがいる場合は置き換える
+	prev := sh.paths[ctx.Path]
+	sh.paths[ctx.Path] = pub
+	sh.publishers[ctx.Session] = pub
+	sh.mutex.Unlock()
+	if prev != nil {
+		pub.logger.Info("RTSP server: 既存パブリッシャーを切断します")
+		prev.session.Close()
 	}
 
-	log.Printf("RTSP server: H.264パブリッシャーのセットアップが完了")
+	s.setCodec(pub.codec)
+	pub.sendParameterSets()
+
+	pub.logger.Info("RTSP server: パブリッシャーのセットアップが完了", "codec", pub.codec)
+	events.publish(event{Type: eventPublisherConnected, Stream: name, Path: ctx.Path, Remote: pub.remote, Codec: pub.codec})
 	return &base.Response{StatusCode: base.StatusOK}, nil
 }
 
-// H.265ストリームのセットアップ（効率化版）
-func (sh *serverHandler) setupH265Stream(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
-	var formatH265 *format.H265
-	mediH265 := ctx.Description.FindFormat(&formatH265)
-	
-	if mediH265 == nil {
-		return &base.Response{
-			StatusCode: base.StatusBadRequest,
-		}, fmt.Errorf("期待されたH.265メディアが見つかりません")
+// schedulePushedStreamRemoval はPUSHで作成したストリームのパブリッシャーがいなくなった場合に、
+// 猶予期間の経過後にストリームを削除します
+func (sh *serverHandler) schedulePushedStreamRemoval(s *stream) {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+	if _, ok := sh.pushed[s]; !ok || sh.publishedLocked(s) {
+		return
+	}
+	if t := sh.pushed[s]; t != nil {
+		t.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(pushStreamLinger, func() {
+		sh.mutex.Lock()
+		if sh.pushed[s] != timer {
+			sh.mutex.Unlock()
+			return // 再接続したパブリッシャーが使用中
+		}
+		delete(sh.pushed, s)
+		// ロックを保持したまま登録を解除し、同じパスへのANNOUNCEが新しいストリームを作成するようにする
+		unregisterStream(s)
+		sh.mutex.Unlock()
+
+		s.close()
+		s.logger.Info("RTSP server: パブリッシャーが再接続しないためストリームを削除しました", "linger", pushStreamLinger)
+		events.publish(event{Type: eventStreamRemoved, Stream: s.name})
+	})
+	sh.pushed[s] = timer
+}
+
+// publishedLocked はストリームにPUSH中のパブリッシャーがいるかを返します (sh.mutex を保持して呼び出す)
+func (sh *serverHandler) publishedLocked(s *stream) bool {
+	for _, pub := range sh.paths {
+		if pub.stream == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sendParameterSets はSDPに含まれるパラメータセットをストリームに送信します
+func (pub *serverPublisher) sendParameterSets() {
+	initialNALs := [][]byte{}
+	switch pub.codec {
+	case "h264":
+		if pub.formatH264.SPS != nil {
+			initialNALs = append(initialNALs, pub.formatH264.SPS)
+		}
+		if pub.formatH264.PPS != nil {
+			initialNALs = append(initialNALs, pub.formatH264.PPS)
+		}
+		if len(initialNALs) > 0 {
+			pub.logger.Debug("RTSP server: SPS/PPSをWebRTCトラックに送信中")
+			pub.stream.writeNALsToTracks(initialNALs, time.Second/30)
+		}
+	case "h265":
+		if pub.formatH265.VPS != nil {
+			initialNALs = append(initialNALs, pub.formatH265.VPS)
+		}
+		if pub.formatH265.SPS != nil {
+			initialNALs = append(initialNALs, pub.formatH265.SPS)
+		}
+		if pub.formatH265.PPS != nil {
+			initialNALs = append(initialNALs, pub.formatH265.PPS)
+		}
+		if len(initialNALs) > 0 {
+			pub.logger.Debug("RTSP server: VPS/SPS/PPSをWebRTCトラックに送信中")
+			pub.stream.writeNALsToTracksH265(initialNALs, time.Second/30)
+		}
+	}
+}
+
+// DESCRIBEリクエストを受信したときに呼び出される
+func (l *rtspListener) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	slog.Debug("RTSP server: DESCRIBEリクエストを受信", "path", ctx.Path)
+	if res, err := l.auth.authorize(ctx.Conn, ctx.Request, ctx.Path, false); err != nil {
+		return res, nil, err
 	}
 
-	log.Printf("RTSP server: H.265メディアを設定中 - H.264へのトランスコーディングを開始")
-	
-	rtpDec, err := formatH265.CreateDecoder()
+	relay, res, err := l.relayForPath(ctx.Path)
 	if err != nil {
-		log.Printf("RTSP server: H265デコーダーの作成に失敗: %v", err)
-		return &base.Response{
-			StatusCode: base.StatusBadRequest,
-		}, err
+		return res, nil, err
 	}
-	
-	sh.publisher = ctx.Session
-	sh.media = mediH265
-	sh.formatH265 = formatH265
-	sh.rtpDecH265 = rtpDec
-	
-	// H.265 -> H.264 ffmpegプロセスをセットアップ
-	err = sh.setupH265ToH264Transcoding()
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, relay.stream, nil
+}
+
+// relayForPath はパスに対応するストリームの再配信用 rtspRelay を返します
+func (l *rtspListener) relayForPath(path string) (*rtspRelay, *base.Response, error) {
+	name := streamNameFromPath(path)
+	s := lookupStream(name)
+	if s == nil {
+		return nil, &base.Response{
+			StatusCode: base.StatusNotFound,
+		}, fmt.Errorf("ストリーム %s が見つかりません", name)
+	}
+	relay, err := s.rtspRelayFor(l.server)
 	if err != nil {
-		log.Printf("RTSP server: H.265トランスコーディングのセットアップに失敗: %v", err)
-		return &base.Response{
-			StatusCode: base.StatusBadRequest,
+		s.logger.Error("RTSP server: 再配信の準備に失敗", "error", err)
+		return nil, &base.Response{
+			StatusCode: base.StatusInternalServerError,
 		}, err
 	}
-
-	log.Printf("RTSP server: H.265パブリッシャーのセットアップが完了")
-	return &base.Response{StatusCode: base.StatusOK}, nil
+	return relay, nil, nil
 }
 
 // SETUPリクエストを受信したときに呼び出される
-func (sh *serverHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
-	// リーダーからのアクセスを防止（パブリッシャーのみ許可）
-	if ctx.Session.State() == gortsplib.ServerSessionStateInitial {
+func (l *rtspListener) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	slog.Debug("RTSP server: SETUPリクエストを受信", "path", ctx.Path, "transport", ctx.Transport)
+
+	// 無効化されたトランスポートを拒否 (UDP/マルチキャストは無効時にリスナー自体を作成しない)
+	if !l.transports[ctx.Transport] {
 		return &base.Response{
-			StatusCode: base.StatusNotImplemented,
+			StatusCode: base.StatusUnsupportedTransport,
 		}, nil, nil
 	}
 
-	log.Printf("RTSP server: SETUPリクエストを受信")
+	// ANNOUNCE済みのセッションはパブリッシャー
+	if ctx.Session.State() == gortsplib.ServerSessionStatePreRecord {
+		return &base.Response{
+			StatusCode: base.StatusOK,
+		}, nil, nil
+	}
+
+	// リーダーにはストリームの再配信用ServerStreamを返す (DESCRIBEを省略するクライアントがあるため再度認証)
+	if res, err := l.auth.authorize(ctx.Conn, ctx.Request, ctx.Path, false); err != nil {
+		return res, nil, err
+	}
+	relay, res, err := l.relayForPath(ctx.Path)
+	if err != nil {
+		return res, nil, err
+	}
+	return &base.Response{
+		StatusCode: base.StatusOK,
+	}, relay.stream, nil
+}
+
+// PLAYリクエストを受信したときに呼び出される
+func (sh *serverHandler) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	name := streamNameFromPath(ctx.Path)
+	s := lookupStream(name)
+	if s == nil {
+		return &base.Response{
+			StatusCode: base.StatusNotFound,
+		}, fmt.Errorf("ストリーム %s が見つかりません", name)
+	}
 
+	sh.mutex.Lock()
+	_, playing := sh.readers[ctx.Session]
+	if !playing {
+		sh.readers[ctx.Session] = s
+	}
+	sh.mutex.Unlock()
+
+	s.logger.Info("RTSP server: PLAYリクエストを受信 - 再配信開始", "remote", ctx.Conn.NetConn().RemoteAddr())
+	if !playing {
+		s.addRTSPReader()
+	}
 	return &base.Response{
 		StatusCode: base.StatusOK,
-	}, nil, nil
+	}, nil
 }
 
 // RECORDリクエストを受信したときに呼び出される
 func (sh *serverHandler) OnRecord(ctx *gortsplib.ServerHandlerOnRecordCtx) (*base.Response, error) {
-	log.Printf("RTSP server: RECORDリクエストを受信 - ストリーミング開始 (コーデック: %s)", sh.codecType)
+	sh.mutex.Lock()
+	pub := sh.publishers[ctx.Session]
+	sh.mutex.Unlock()
+	if pub == nil {
+		return &base.Response{
+			StatusCode: base.StatusBadRequest,
+		}, fmt.Errorf("ANNOUNCEされていないセッションです")
+	}
 
-	// 事前にわかっているコーデックに基づいて効率的に処理
-	switch sh.codecType {
-	case "h264":
-		// H.264 NAL処理チャネルとゴルーチンを初期化
-		if sh.h264NALChan == nil {
-			sh.h264NALChan = make(chan [][]byte, 100) // バッファサイズ増加
-			sh.wg.Add(1)
-			go sh.processH264NALs()
-		}
-		sh.setupH264PacketHandler(ctx)
-	case "h265":
-		// H.265 NAL処理チャネルとゴルーチンを初期化
-		if sh.h265NALChan == nil {
-			sh.h265NALChan = make(chan [][]byte, 100) // バッファサイズ増加
-			sh.wg.Add(1)
-			go sh.processH265NALs()
-		}
-		sh.setupH265PacketHandler(ctx)
+	pub.logger.Info("RTSP server: RECORDリクエストを受信 - ストリーミング開始", "codec", pub.codec)
+
+	// NAL処理チャネルとゴルーチンを初期化
+	if pub.nalChan == nil {
+		pub.nalChan = make(chan [][]byte, 100) // バッファサイズ増加
+		pub.wg.Add(1)
+		go pub.processNALs()
 	}
+	pub.setupPacketHandler()
 
 	return &base.Response{
 		StatusCode: base.StatusOK,
 	}, nil
 }
 
-// H.264パケットハンドラーのセットアップ（効率化版）
-func (sh *serverHandler) setupH264PacketHandler(ctx *gortsplib.ServerHandlerOnRecordCtx) {
-	ctx.Session.OnPacketRTP(sh.media, sh.formatH264, func(pkt *rtp.Packet) {
+// setupPacketHandler はRTPパケットからアクセスユニットを取り出し、処理チャネルへ渡します
+func (pub *serverPublisher) setupPacketHandler() {
+	var forma format.Format = pub.formatH264
+	if pub.codec == "h265" {
+		forma = pub.formatH265
+	}
+
+	received := rtpPacketsReceived.with(sourceRTSPServer, pub.stream.name)
+	drops := channelDrops.with(pub.stream.name, "rtsp-server-nal")
+	pub.session.OnPacketRTP(pub.media, forma, func(pkt *rtp.Packet) {
+		received.Add(1)
 		// パケットのタイムスタンプをデコード
-		_, ok := ctx.Session.PacketPTS2(sh.media, pkt)
+		_, ok := pub.session.PacketPTS2(pub.media, pkt)
 		if !ok {
 			return
 		}
 
-		// RTPパケットからH264アクセスユニットをデコード
-		au, err := sh.rtpDecH264.Decode(pkt)
-		if err != nil {
-			// 特定のエラーは無視、その他はログ出力
-			if err != rtph264.ErrNonStartingPacketAndNoPrevious && err != rtph264.ErrMorePacketsNeeded {
-				log.Printf("RTSP server: RTPデコードエラー: %v", err)
+		// RTPパケットからアクセスユニットをデコード
+		var au [][]byte
+		var err error
+		if pub.codec == "h265" {
+			au, err = pub.rtpDecH265.Decode(pkt)
+			if err != nil && err != rtph265.ErrNonStartingPacketAndNoPrevious && err != rtph265.ErrMorePacketsNeeded {
+				warnRateLimited(pub.logger, pub.path, "RTSP server: H265 RTPデコードエラー", "error", err)
 			}
-			return
-		}
-
-		// アクセスユニットが有効な場合、WebRTCトラックに送信
-		if len(au) > 0 {
-			// フレームレートを30FPSと仮定してdurationを計算
-			// duration := time.Second / 30
-			// writeNALsToTracks関数を呼び出してWebRTCクライアントに配信
-			// writeNALsToTracks(au, duration)
-			if sh.h264NALChan != nil {
-				select {
-				case sh.h264NALChan <- au:
-				default:
-					log.Printf("RTSP server: H.264 NALチャネルがブロックまたはクローズされています")
-				}
+		} else {
+			au, err = pub.rtpDecH264.Decode(pkt)
+			if err != nil && err != rtph264.ErrNonStartingPacketAndNoPrevious && err != rtph264.ErrMorePacketsNeeded {
+				warnRateLimited(pub.logger, pub.path, "RTSP server: RTPデコードエラー", "error", err)
 			}
 		}
-	})
-}
-
-// H.265パケットハンドラーのセットアップ（効率化版）
-func (sh *serverHandler) setupH265PacketHandler(ctx *gortsplib.ServerHandlerOnRecordCtx) {
-	ctx.Session.OnPacketRTP(sh.media, sh.formatH265, func(pkt *rtp.Packet) {
-		// パケットのタイムスタンプをデコード
-		_, ok := ctx.Session.PacketPTS2(sh.media, pkt)
-		if !ok {
-			return
-		}
-
-		// RTPパケットからH265アクセスユニットをデコード
-		au, err := sh.rtpDecH265.Decode(pkt)
 		if err != nil {
-			// 特定のエラーは無視、その他はログ出力
-			if err != rtph265.ErrNonStartingPacketAndNoPrevious && err != rtph265.ErrMorePacketsNeeded {
-				log.Printf("RTSP server: H265 RTPデコードエラー: %v", err)
-			}
 			return
 		}
 
-		// アクセスユニットが有効な場合、ffmpegプロセスに送信
+		// アクセスユニットが有効な場合、処理チャネルに送信
 		if len(au) > 0 {
-			// sh.writeH265ToTranscoder(au)
-			if sh.h265NALChan != nil {
-				select {
-				case sh.h265NALChan <- au:
-				default:
-					log.Printf("RTSP server: H.265 NALチャネルがブロックまたはクローズされています")
-				}
+			select {
+			case pub.nalChan <- au:
+			default:
+				drops.Add(1)
+				warnRateLimited(pub.logger, pub.path, "RTSP server: NALチャネルが満杯です")
 			}
 		}
 	})
 }
 
-// H.264専用RTSPサーバーを起動する関数
-func startGortsplibH264RTSPServer(props props) {
-	log.Printf("RTSP server: H.264専用サーバーを起動中 (ポート: %s)", props.serverPort)
-	
-	// H.264専用サーバーハンドラーを設定
-	h := &serverHandler{
-		props:     props,
-		codecType: "h264", // H.264固定
-	}
-	
-	h.server = &gortsplib.Server{
-		Handler:           h,
-		RTSPAddress:       "0.0.0.0:554",
-		UDPRTPAddress:     "0.0.0.0:8000",
-		UDPRTCPAddress:    "0.0.0.0:8001",
-		MulticastIPRange:  "224.1.0.0/16",
-		MulticastRTPPort:  8002,
-		MulticastRTCPPort: 8003,
-	}
-
-	log.Printf("RTSP server: H.264専用サーバーが %s で準備完了", h.server.RTSPAddress)
-	log.Printf("RTSP server: クライアントは rtsp://0.0.0.0:554/stream でH.264ストリームをPUSHできます")
-	
-	// バックグラウンドでサーバーを実行
-	go func() {
-		if err := h.server.StartAndWait(); err != nil {
-			log.Printf("RTSP server: H.264サーバーエラー: %v", err)
+// processNALs はnalChanからNALユニットを受信し、ストリームに書き込みます
+func (pub *serverPublisher) processNALs() {
+	defer pub.wg.Done()
+	pub.logger.Debug("RTSP server: NAL処理ゴルーチン開始")
+	duration := time.Second / 30 // フレームレートを30FPSと仮定
+
+	for au := range pub.nalChan {
+		if len(au) == 0 {
+			continue
 		}
-	}()
+		if pub.codec == "h265" {
+			pub.stream.writeNALsToTracksH265(au, duration)
+		} else {
+			pub.stream.writeNALsToTracks(au, duration)
+		}
+	}
+	pub.logger.Debug("RTSP server: NAL処理ゴルーチン終了")
 }
 
-// H.265専用RTSPサーバーを起動する関数
-func startGortsplibH265RTSPServer(props props) {
-	log.Printf("RTSP server: H.265専用サーバーを起動中 (ポート: %s, プロセッサ: %s)", props.serverPort, props.processor)
-	
-	// H.265専用サーバーハンドラーを設定
-	h := &serverHandler{
-		props:     props,
-		codecType: "h265", // H.265固定
-	}
-	
-	h.server = &gortsplib.Server{
-		Handler:           h,
-		RTSPAddress:       "0.0.0.0:554",
-		UDPRTPAddress:     "0.0.0.0:8000",
-		UDPRTCPAddress:    "0.0.0.0:8001",
-		MulticastIPRange:  "224.1.0.0/16",
-		MulticastRTPPort:  8002,
-		MulticastRTCPPort: 8003,
-	}
-
-	log.Printf("RTSP server: H.265専用サーバーが %s で準備完了 (H.264トランスコーディング有効)", h.server.RTSPAddress)
-	log.Printf("RTSP server: クライアントは rtsp://0.0.0.0:554/stream でH.265ストリームをPUSHできます")
-	
-	// バックグラウンドでサーバーを実行
-	go func() {
-		if err := h.server.StartAndWait(); err != nil {
-			log.Printf("RTSP server: H.265サーバーエラー: %v", err)
+// close はチャネルをクローズし、処理ゴルーチンが終了するのを待ちます
+func (pub *serverPublisher) close() {
+	pub.closeOnce.Do(func() {
+		if pub.nalChan != nil {
+			close(pub.nalChan)
 		}
-	}()
+	})
+	pub.wg.Wait()
 }
 
-// setupH265ToH264Transcoding はH.265からH.264へのトランスコーディングを設定します
-func (sh *serverHandler) setupH265ToH264Transcoding() error {
-	log.Printf("RTSP server: H.265 -> H.264 トランスコーディングをセットアップ中 (プロセッサ: %s)", sh.props.processor)
-	
-	var args []string
-	if sh.props.processor == "gpu" {
-		// GPU トランスコーディング
-		args = []string{
-			"-hide_banner",
-			"-loglevel", "error",
-			"-f", "hevc",         // 入力フォーマット H.265
-			"-i", "pipe:0",       // 標準入力から読み取り
-			"-c:v", "h264_nvenc", // NVIDIA GPU エンコーダ
-			"-preset", "p1",      // 最高速度プリセット
-			"-tune", "ll",        // 低遅延チューニング
-			"-rc:v", "cbr",       // 固定ビットレート
-			"-b:v", "2M",         // ビットレート
-			"-maxrate", "2M",
-			"-bufsize", "4M",
-			"-g", "30",           // GOPサイズ
-			"-keyint_min", "30",
-			"-bf", "0",           // Bフレームなし
-			"-f", "h264",         // 出力フォーマット
-			"-bsf:v", "h264_mp4toannexb", // Annex-B形式に変換
-			"pipe:1",             // 標準出力へ書き込み
-		}
-	} else {
-		// CPU トランスコーディング
-		args = []string{
-			"-hide_banner",
-			"-loglevel", "error",
-			"-probesize", "250000",
-			"-analyzeduration", "50000", // CPU版ではより大きな値を設定することがあります
-			"-fflags", "nobuffer+genpts", // flush_packets はCPUエンコードでは問題を起こすことがあるため削除
-			"-flags", "low_delay",
-			"-max_delay", "500", // CPU版では少し余裕を持たせることがあります
-	
-			"-f", "hevc",
-			"-i", "pipe:0",
-
-			"-an", // 音声なし
-
-			// --- エンコード設定 (CPU, libx264) ---
-			"-c:v", "libx264",
-			"-preset", "ultrafast",        // エンコード速度優先
-			// "-tune", "zerolatency",        // 低レイテンシ
-			"-x264-params", "rc-lookahead=0:scenecut=0:vbv-maxrate=2000:vbv-bufsize=50", // レート制御パラメータ
-			"-x264-params", "nal-hrd=cbr", // CBR に必要
-			"-b:v", "3M",                  // ビットレート
-			"-maxrate", "3M",              // 最大ビットレート
-			"-bufsize", "5000",              // バッファサイズ
-
-			"-g", "30", // GOP 長
-			"-bf", "0", // B-frames 無効
-
-			// フレームレートとメタデータ
-			"-fps_mode", "passthrough", // 入力フレームレートを維持
-			"-map", "0:v:0",
-			"-f", "h264",
-			"pipe:1",
-		}
-	}
+// startGortsplibRTSPServer はRTSPサーバーを起動し、コンテキストが終了するまでブロックします。
+// publish が true の場合、クライアントは rtsp://<host>:<port>/<ストリーム名> にH.264またはH.265ストリームをPUSHできます。
+// 登録済みのストリームは同じURLでRTSPリーダーに再配信されます。
+func startGortsplibRTSPServer(ctx context.Context, props props, cfg rtspServerConfig, publish bool) {
+	slog.Info("RTSP server: マルチパスサーバーを起動中", "processor", props.processor)
 
-	sh.ffmpegCmd = exec.Command("ffmpeg", args...)
-	
-	// ffmpegプロセスのパイプを設定
-	var err error
-	sh.ffmpegStdin, err = sh.ffmpegCmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("ffmpeg標準入力パイプの作成に失敗: %v", err)
-	}
-	
-	stdout, err := sh.ffmpegCmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("ffmpeg標準出力パイプの作成に失敗: %v", err)
+	if err := cfg.validate(); err != nil {
+		slog.Error("RTSP server: 設定エラー", "error", err)
+		setRTSPListenerState("config", err)
+		return
 	}
-
-	// ffmpegプロセスを開始
-	if err := sh.ffmpegCmd.Start(); err != nil {
-		return fmt.Errorf("ffmpegプロセスの開始に失敗: %v", err)
+	transports, _ := parseRTSPTransports(cfg.transports)
+	h := &serverHandler{
+		props:      props,
+		publish:    publish,
+		transports: transports,
+		auth:       cfg.auth,
+		publishers: make(map[*gortsplib.ServerSession]*serverPublisher),
+		paths:      make(map[string]*serverPublisher),
+		readers:    make(map[*gortsplib.ServerSession]*stream),
+		pushed:     make(map[*stream]*time.Timer),
 	}
 
-	// H.264リーダーを設定
-	sh.h264Reader, err = h264reader.NewReader(stdout)
+	servers, err := newGortsplibServers(cfg, func(server *gortsplib.Server) gortsplib.ServerHandler {
+		return &rtspListener{serverHandler: h, server: server}
+	})
 	if err != nil {
-		return fmt.Errorf("H264リーダーの作成に失敗: %v", err)
-	}
-
-	// H.264出力を読み取り、WebRTCに送信するゴルーチン
-	go func() {
-		defer stdout.Close()
-		sh.streamTranscodedH264()
-	}()
-
-	log.Printf("RTSP server: H.265 -> H.264 トランスコーディングが準備完了")
-	return nil
-}
-
-// writeH265ToTranscoder はH.265 NALユニットをffmpegトランスコーダーに書き込みます
-func (sh *serverHandler) writeH265ToTranscoder(nals [][]byte) {
-	if sh.ffmpegStdin == nil {
+		slog.Error("RTSP server: サーバーの作成に失敗", "error", err)
+		setRTSPListenerState("config", err)
 		return
 	}
 
-	for _, nal := range nals {
-		// Annex-B形式でNALユニットを書き込み
-		annexBData := append([]byte{0x00, 0x00, 0x00, 0x01}, nal...)
-		if _, err := sh.ffmpegStdin.Write(annexBData); err != nil {
-			log.Printf("RTSP server: ffmpegへのH.265データ書き込みエラー: %v", err)
-			return
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		scheme := "rtsp"
+		if server.TLSConfig != nil {
+			scheme = "rtsps"
 		}
-	}
-}
-
-// streamTranscodedH264 はトランスコードされたH.264ストリームを処理します
-func (sh *serverHandler) streamTranscodedH264() {
-	for {
-		nal, err := sh.h264Reader.NextNAL()
-		if err != nil {
-			if err.Error() != "EOF" {
-				log.Printf("RTSP server: トランスコードされたH.264読み取りエラー: %v", err)
-			}
-			break
+		listener := scheme + "://" + server.RTSPAddress
+		if err := server.Start(); err != nil {
+			slog.Error("RTSP server: サーバーの起動に失敗", "scheme", scheme, "addr", server.RTSPAddress, "error", err)
+			setRTSPListenerState(listener, err)
+			continue
 		}
-
-		// NALユニットをWebRTCトラックに送信
-		duration := time.Second / 30 // 30FPS想定
-		writeNALsToTracks([][]byte{nal.Data}, duration)
-	}
-}
-
-// processH264NALs はh264NALChanからNALユニットを受信し処理します
-func (sh *serverHandler) processH264NALs() {
-	defer sh.wg.Done()
-	log.Printf("RTSP server: H.264 NAL処理ゴルーチン開始")
-	duration := time.Second / 30 // フレームレートを30FPSと仮定
-
-	for au := range sh.h264NALChan {
-		if len(au) > 0 {
-			writeNALsToTracks(au, duration)
+		setRTSPListenerState(listener, nil)
+		slog.Info("RTSP server: サーバーの準備完了", "scheme", scheme, "addr", server.RTSPAddress,
+			"transports", cfg.transports, "read_timeout", cfg.readTimeout, "write_timeout", cfg.writeTimeout)
+		if publish {
+			slog.Info(fmt.Sprintf("RTSP server: クライアントは %s://<host>%s/<ストリーム名> でH.264/H.265ストリームをPUSHできます (視聴: /ws?stream=<ストリーム名>)", scheme, portSuffix(server.RTSPAddress)))
 		}
+		slog.Info(fmt.Sprintf("RTSP server: 各ストリームは %s://<host>%s/<ストリーム名> でRTSP再生できます", scheme, portSuffix(server.RTSPAddress)))
+
+		// コンテキストが終了するまでサーバーを実行
+		stop := context.AfterFunc(ctx, server.Close)
+		wg.Add(1)
+		go func(server *gortsplib.Server) {
+			defer wg.Done()
+			defer stop()
+			if err := server.Wait(); err != nil && ctx.Err() == nil {
+				slog.Error("RTSP server: サーバーエラー", "error", err)
+				setRTSPListenerState(listener, err)
+			}
+		}(server)
 	}
-	log.Printf("RTSP server: H.264 NAL処理ゴルーチン終了")
+	wg.Wait()
 }
 
-// processH265NALs はh265NALChanからNALユニットを受信し処理します
-func (sh *serverHandler) processH265NALs() {
-	defer sh.wg.Done()
-	log.Printf("RTSP server: H.265 NAL処理ゴルーチン開始")
-
-	for au := range sh.h265NALChan {
-		if len(au) > 0 {
-			sh.writeH265ToTranscoder(au)
-		}
+// portSuffix はリスニングアドレスからURL用のポート部分 (":8554" など) を返します
+func portSuffix(address string) string {
+	if i := strings.LastIndex(address, ":"); i >= 0 {
+		return address[i:]
 	}
-	log.Printf("RTSP server: H.265 NAL処理ゴルーチン終了")
+	return ""
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- ヘルスチェック (/healthz, /readyz) ---
+
+// readyFrameTimeout は入力が最後に映像を受信してから未準備とみなすまでの時間です (main で設定)
+var readyFrameTimeout = 10 * time.Second
+
+// healthCheck は /readyz の個々の確認項目の結果です
+type healthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthResponse は /healthz と /readyz のレスポンスです
+type healthResponse struct {
+	Status string        `json:"status"` // "ok" または "fail"
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// healthzHandler はプロセスとHTTPサーバーが応答できることを返します (liveness)。
+// 入力の切断は再接続で回復するため、ここでは確認しません。
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthResponse{Status: "ok"})
+}
+
+// readyzHandler は映像を配信できる状態かを返します (readiness)。
+// いずれかの確認項目が失敗している場合は 503 を返します。
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := []healthCheck{{Name: "http", OK: true}}
+	checks = append(checks, rtspServerChecks()...)
+
+	list := allStreams()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	for _, s := range list {
+		checks = append(checks, s.readinessChecks(readyFrameTimeout)...)
+	}
+
+	res := healthResponse{Status: "ok", Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			res.Status = "fail"
+			break
+		}
+	}
+	writeHealth(w, res)
+}
+
+func writeHealth(w http.ResponseWriter, res healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if res.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		slog.Debug("ヘルスチェック: レスポンスの書き込みエラー", "error", err)
+	}
+}
+
+// readinessChecks はストリームの入力とffmpegプロセスの状態を確認します。
+// RTSPサーバーへのPUSH、視聴者がいないため停止中のオンデマンド入力と、末尾に達したファイル入力は対象外です。
+// パブリッシャーの接続を待ち受ける入力は映像の受信を確認しません。
+func (s *stream) readinessChecks(frameTimeout time.Duration) []healthCheck {
+	s.ingestMutex.Lock()
+	configured := s.ingest != nil && s.ingestCancel != nil
+	process := s.ingestProcess
+	started := s.ingestStarted
+	finished := s.ingestState == "finished"
+	s.ingestMutex.Unlock()
+	if !configured || finished {
+		return nil
+	}
+
+	var checks []healthCheck
+	if !waitsForPublisher(s.inputType, s.inputURL) {
+		ingest := healthCheck{Name: "ingest:" + s.name, OK: true}
+		if ns := s.lastIngest.Load(); ns == 0 || time.Since(time.Unix(0, ns)) > frameTimeout {
+			ingest.OK = false
+			if ns == 0 {
+				ingest.Message = fmt.Sprintf("入力から映像を受信していません (開始から %v)", time.Since(started).Round(time.Second))
+			} else {
+				ingest.Message = fmt.Sprintf("最後の映像の受信から %v 経過しています", time.Since(time.Unix(0, ns)).Round(time.Second))
+			}
+		}
+		checks = append(checks, ingest)
+	}
+
+	if process != nil {
+		checks = append(checks, processCheck("ffmpeg:"+s.name, process))
+	}
+	s.mutex.RLock()
+	transcoder := s.transcoder
+	s.mutex.RUnlock()
+	if transcoder != nil && transcoder.cmd.Process != nil {
+		checks = append(checks, processCheck("transcoder:"+s.name, transcoder.cmd.Process))
+	}
+	return checks
+}
+
+// processCheck は子プロセスが終了していないかを確認します
+func processCheck(name string, p *os.Process) healthCheck {
+	if err := p.Signal(syscall.Signal(0)); err != nil {
+		return healthCheck{Name: name, OK: false, Message: fmt.Sprintf("プロセス (PID: %d) が終了しています: %v", p.Pid, err)}
+	}
+	return healthCheck{Name: name, OK: true}
+}
+
+// --- RTSPサーバーのリスナーの状態 ---
+
+var (
+	rtspListenersMutex sync.Mutex
+	rtspListeners      = make(map[string]string) // 名前 (scheme://アドレス) -> エラー (リスニング中の場合は空)
+)
+
+// setRTSPListenerState はRTSPサーバーのリスナーの状態を記録します (err が nil の場合はリスニング中)
+func setRTSPListenerState(name string, err error) {
+	rtspListenersMutex.Lock()
+	defer rtspListenersMutex.Unlock()
+	if err == nil {
+		rtspListeners[name] = ""
+		return
+	}
+	rtspListeners[name] = err.Error()
+}
+
+// expectRTSPListeners はRTSPサーバーの起動前に、設定されたリスナーを起動中として登録します。
+// サーバーの起動は非同期のため、起動が完了するまで /readyz は未準備を返します。
+func expectRTSPListeners(cfg rtspServerConfig) {
+	starting := fmt.Errorf("起動中")
+	if cfg.address != "" {
+		setRTSPListenerState("rtsp://"+cfg.address, starting)
+	}
+	if cfg.rtspsAddress != "" {
+		setRTSPListenerState("rtsps://"+cfg.rtspsAddress, starting)
+	}
+}
+
+func rtspServerChecks() []healthCheck {
+	rtspListenersMutex.Lock()
+	defer rtspListenersMutex.Unlock()
+	checks := make([]healthCheck, 0, len(rtspListeners))
+	for name, errMsg := range rtspListeners {
+		checks = append(checks, healthCheck{Name: "rtsp-server:" + name, OK: errMsg == "", Message: errMsg})
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadinessChecks(t *testing.T) {
+	tests := []struct {
+		name      string
+		inputType string
+		inputURL  string
+		state     string
+		received  bool // 直近に映像を受信した
+		want      []bool
+	}{
+		{name: "RTSP 受信中", inputType: "rtsp", inputURL: "rtsp://camera/stream", received: true, want: []bool{true}},
+		{name: "RTSP 未受信", inputType: "rtsp", inputURL: "rtsp://camera/stream", want: []bool{false}},
+		{name: "RTMPのPUBLISH待ち", inputType: "rtmp-server", inputURL: "rtmp://0.0.0.0:1935/live/cam1", want: nil},
+		{name: "SRT listener の接続待ち", inputType: "srt", inputURL: "srt://0.0.0.0:9000?mode=listener", want: nil},
+		{name: "SRT caller 未受信", inputType: "srt", inputURL: "srt://camera:9000", want: []bool{false}},
+		{name: "ファイル入力 配信中", inputType: "file", inputURL: "demo.mp4", state: "connecting", received: true, want: []bool{true}},
+		{name: "ファイル入力 末尾に達した", inputType: "file", inputURL: "demo.mp4", state: "finished", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStream("health-test", "")
+			s.inputType = tt.inputType
+			s.inputURL = tt.inputURL
+			s.ingest = func(ctx context.Context) {}
+			s.ingestCancel = func() {}
+			s.ingestState = tt.state
+			s.ingestStarted = time.Now()
+			if tt.received {
+				s.lastIngest.Store(time.Now().UnixNano())
+			}
+
+			var got []bool
+			for _, c := range s.readinessChecks(time.Second) {
+				got = append(got, c.OK)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
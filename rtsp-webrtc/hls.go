@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4"
+)
+
+// --- HLS / LL-HLS ---
+
+// hlsConfig はHLS出力の設定です
+type hlsConfig struct {
+	segment  time.Duration // セグメントの長さの目安 (キーフレームで区切る)
+	part     time.Duration // LL-HLSのパーシャルセグメントの長さ
+	segments int           // プレイリストに含めるセグメント数
+}
+
+// hlsOutput はHLS出力の設定です (main でフラグから設定)
+var hlsOutput = hlsConfig{segment: 2 * time.Second, part: 200 * time.Millisecond, segments: 7}
+
+const (
+	hlsQueueSize = 1024
+	// hlsPartSegments はパーシャルセグメントをプレイリストに載せる完了済みセグメントの数です
+	hlsPartSegments = 2
+)
+
+var (
+	hlsRequests = newCounterVec("rtsp2webrtc_hls_requests_total",
+		"HLSのリクエスト数", "stream", "type")
+	hlsBytes = newCounterVec("rtsp2webrtc_hls_bytes_total",
+		"HLSで送信したバイト数", "stream")
+)
+
+func (c hlsConfig) validate() error {
+	if c.part <= 0 || c.segment < c.part {
+		return fmt.Errorf("-hls-part (%v) は0より大きく -hls-segment (%v) 以下である必要があります", c.part, c.segment)
+	}
+	if c.segments < 3 {
+		return fmt.Errorf("-hls-segments は3以上である必要があります")
+	}
+	return nil
+}
+
+// hlsSegment はメディアセグメントです。完了するまではパーシャルセグメントのみを提供します。
+type hlsSegment struct {
+	msn      uint64
+	start    time.Time
+	dts      int64 // 先頭のDTS (fmp4Timescale)
+	ticks    int64 // 長さ (fmp4Timescale)。DASHのSegmentTimelineで使用
+	duration time.Duration
+	parts    []*hlsPart
+	data     []byte // 完了したセグメント全体 (パートの連結)
+}
+
+// hlsPart はパーシャルセグメント (moof + mdat) です。番号はセグメントをまたいで連番です。
+type hlsPart struct {
+	index       uint64
+	duration    time.Duration
+	independent bool // キーフレームから始まる
+	data        []byte
+}
+
+// hlsMuxer はストリームのアクセスユニットからfMP4のセグメントとパーシャルセグメントをメモリ上に作成し、
+// LL-HLSのプレイリストとともに提供します。トランスコードはしません。
+type hlsMuxer struct {
+	name   string
+	cfg    hlsConfig
+	logger *slog.Logger
+	hub    *auHub
+	sub    *auSubscriber
+	done   chan struct{}
+
+	// 以下は run のゴルーチンのみで使用
+	codec        string
+	base         time.Time // DTSの基準時刻
+	waitKey      bool
+	pending      *fmp4.PartSample
+	pendingDTS   int64
+	pendingKey   bool
+	lastDuration int64
+	samples      []*fmp4.PartSample // 組み立て中のパート
+	partDTS      int64
+	partKey      bool
+	segDTS       int64
+
+	mutex    sync.Mutex
+	changed  chan struct{} // 更新のたびに閉じて作り直す (ブロッキングリロードの待機用)
+	closed   bool
+	init     []byte
+	start    time.Time // DTSが0の時刻 (DASHのavailabilityStartTime)
+	codecs   string    // RFC 6381 の codecs (DASHのマニフェスト用)
+	width    int
+	height   int
+	segments []*hlsSegment // 完了したセグメント (最大 cfg.segments)
+	current  *hlsSegment   // 書き込み中のセグメント (nilの場合は次のキーフレームから開始)
+	nextMSN  uint64
+	nextPart uint64
+}
+
+// startHLS はストリームのHLS出力を開始します
+func (s *stream) startHLS(cfg hlsConfig) error {
+	s.mutex.RLock()
+	aus := s.aus
+	s.mutex.RUnlock()
+	if aus == nil {
+		return fmt.Errorf("ストリーム %s は削除されています", s.name)
+	}
+	m := &hlsMuxer{
+		name:    s.name,
+		cfg:     cfg,
+		logger:  s.logger.With("component", "hls"),
+		hub:     aus,
+		sub:     aus.subscribe(hlsQueueSize, channelDrops.with(s.name, "hls")),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+		waitKey: true,
+	}
+	go m.run()
+
+	s.mutex.Lock()
+	prev := s.hls
+	s.hls = m
+	s.mutex.Unlock()
+	if prev != nil {
+		prev.stop()
+	}
+	s.logger.Info("HLS出力を開始しました", "path", "/hls/"+s.name+"/index.m3u8", "segment", cfg.segment, "part", cfg.part)
+	return nil
+}
+
+// stopHLS はHLS出力を終了します。待機中のリクエストには404を返します。
+func (s *stream) stopHLS() {
+	s.mutex.Lock()
+	m := s.hls
+	s.hls = nil
+	s.mutex.Unlock()
+	if m != nil {
+		m.stop()
+	}
+}
+
+// hlsMuxerOf はストリームのHLS出力を返します (無効の場合はnil)
+func (s *stream) hlsMuxerOf() *hlsMuxer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.hls
+}
+
+func (m *hlsMuxer) stop() {
+	m.hub.unsubscribe(m.sub)
+	<-m.done
+}
+
+func (m *hlsMuxer) run() {
+	defer close(m.done)
+	for au := range m.sub.ch {
+		m.writeAU(au)
+	}
+	m.mutex.Lock()
+	m.closed = true
+	m.notifyLocked()
+	m.mutex.Unlock()
+}
+
+func (m *hlsMuxer) notifyLocked() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *hlsMuxer) ticks(d time.Duration) int64 {
+	return int64(d) * fmp4Timescale / int64(time.Second)
+}
+
+func (m *hlsMuxer) writeAU(au accessUnit) {
+	if au.codec != m.codec {
+		// コーデックが変わった場合は初期化セグメントから作り直す
+		m.reset()
+		m.codec = au.codec
+	} else if au.gap {
+		// 欠落したフレームを参照するフレームを送らないよう、セグメントを終えて次のキーフレームを待つ
+		m.flushPending()
+		m.finishSegment()
+		m.waitKey = true
+	}
+	if m.waitKey {
+		if !au.key {
+			return
+		}
+		m.waitKey = false
+	}
+	m.mutex.Lock()
+	hasInit := m.init != nil
+	m.mutex.Unlock()
+	if !hasInit {
+		init, err := fmp4InitSegment(au.codec, au.nals)
+		if err != nil {
+			m.logger.Debug("HLS: 初期化セグメントを作成できません", "error", err)
+			m.waitKey = true
+			return
+		}
+		m.base = au.time
+		codecs, width, height := codecParameters(au.codec, au.nals)
+		m.mutex.Lock()
+		m.init = init
+		m.start = au.time
+		m.codecs, m.width, m.height = codecs, width, height
+		m.mutex.Unlock()
+	}
+
+	dts := m.ticks(au.time.Sub(m.base))
+	if m.pending != nil {
+		// 壁時計のタイムスタンプが前後しても単調増加にする
+		dts = max(dts, m.pendingDTS+1)
+		m.lastDuration = dts - m.pendingDTS
+		m.appendPending()
+	}
+	sample, err := fmp4Sample(au)
+	if err != nil {
+		m.logger.Warn("HLS: サンプルの作成に失敗", "error", err)
+		m.waitKey = true
+		return
+	}
+	m.pending = sample
+	m.pendingDTS = dts
+	m.pendingKey = au.key
+}
+
+// appendPending は長さが確定したサンプルをパートに追加します。
+// キーフレームでセグメントの長さの目安を超えた場合は新しいセグメントを開始します。
+func (m *hlsMuxer) appendPending() {
+	m.pending.Duration = uint32(m.lastDuration)
+	if m.pendingKey && m.current != nil && m.pendingDTS-m.segDTS >= m.ticks(m.cfg.segment) {
+		m.finishPart()
+		m.finishSegment()
+	}
+	if m.current == nil {
+		if !m.pendingKey {
+			m.pending = nil
+			return
+		}
+		m.mutex.Lock()
+		m.current = &hlsSegment{
+			msn:   m.nextMSN,
+			start: m.base.Add(time.Duration(m.pendingDTS) * time.Second / fmp4Timescale),
+			dts:   m.pendingDTS,
+		}
+		m.mutex.Unlock()
+		m.segDTS = m.pendingDTS
+	}
+	if len(m.samples) > 0 && m.pendingDTS+m.lastDuration-m.partDTS > m.ticks(m.cfg.part) {
+		// パートの長さが目安を超えないよう、このサンプルは次のパートに入れる
+		m.finishPart()
+	}
+	if len(m.samples) == 0 {
+		m.partDTS = m.pendingDTS
+		m.partKey = m.pendingKey
+	}
+	m.samples = append(m.samples, m.pending)
+	m.pending = nil
+	if m.pendingDTS+m.lastDuration-m.partDTS >= m.ticks(m.cfg.part) {
+		m.finishPart()
+	}
+}
+
+// flushPending は長さが未確定の最後のサンプルを直前のサンプルと同じ長さで追加します
+func (m *hlsMuxer) flushPending() {
+	if m.pending == nil {
+		return
+	}
+	if m.lastDuration == 0 {
+		m.lastDuration = fmp4Timescale / 30
+	}
+	m.appendPending()
+	m.finishPart()
+}
+
+func (m *hlsMuxer) finishPart() {
+	if len(m.samples) == 0 || m.current == nil {
+		return
+	}
+	var duration int64
+	for _, s := range m.samples {
+		duration += int64(s.Duration)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, err := fmp4Fragment(uint32(m.nextPart+1), uint64(m.partDTS), m.samples)
+	m.samples = nil
+	if err != nil {
+		m.logger.Warn("HLS: パーシャルセグメントの作成に失敗", "error", err)
+		return
+	}
+	m.current.parts = append(m.current.parts, &hlsPart{
+		index:       m.nextPart,
+		duration:    time.Duration(duration) * time.Second / fmp4Timescale,
+		independent: m.partKey,
+		data:        data,
+	})
+	m.current.ticks += duration
+	m.nextPart++
+	m.notifyLocked()
+}
+
+func (m *hlsMuxer) finishSegment() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seg := m.current
+	m.current = nil
+	if seg == nil || len(seg.parts) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	for _, p := range seg.parts {
+		buf.Write(p.data)
+		seg.duration += p.duration
+	}
+	seg.data = buf.Bytes()
+	m.segments = append(m.segments, seg)
+	if len(m.segments) > m.cfg.segments {
+		m.segments = m.segments[len(m.segments)-m.cfg.segments:]
+	}
+	m.nextMSN++
+	m.notifyLocked()
+}
+
+// reset はセグメントと初期化セグメントを破棄します。セグメント・パートの番号は継続します。
+func (m *hlsMuxer) reset() {
+	m.pending = nil
+	m.samples = nil
+	m.waitKey = true
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.current != nil {
+		m.nextMSN++
+	}
+	m.init = nil
+	m.segments = nil
+	m.current = nil
+	m.notifyLocked()
+}
+
+// wait は ready が true になるまで (最大 timeout) 待機します。ready は mutex を保持した状態で呼び出されます。
+func (m *hlsMuxer) wait(r *http.Request, timeout time.Duration, ready func() bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		m.mutex.Lock()
+		ok, closed, changed := ready(), m.closed, m.changed
+		m.mutex.Unlock()
+		if ok {
+			return true
+		}
+		if closed {
+			return false
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
+
+// findPart は番号 index のパーシャルセグメントを返します (mutex を保持して呼び出す)
+func (m *hlsMuxer) findPartLocked(index uint64) *hlsPart {
+	segments := m.segments
+	if m.current != nil {
+		segments = append(segments[:len(segments):len(segments)], m.current)
+	}
+	for _, seg := range segments {
+		for _, p := range seg.parts {
+			if p.index == index {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// playlistLocked はLL-HLSのメディアプレイリストを作成します (mutex を保持して呼び出す)。
+// query は各URIに付加するクエリ (視聴者の認証情報) です。
+func (m *hlsMuxer) playlistLocked(query string) []byte {
+	targetDuration := m.cfg.segment
+	partTarget := m.cfg.part
+	for _, seg := range m.segments {
+		targetDuration = max(targetDuration, seg.duration)
+		for _, p := range seg.parts {
+			partTarget = max(partTarget, p.duration)
+		}
+	}
+	segments := m.segments
+	if m.current != nil {
+		segments = append(segments[:len(segments):len(segments)], m.current)
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n")
+	// EXTINF を四捨五入した値がターゲットデュレーション以下であればよい
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", max(int(math.Round(targetDuration.Seconds())), 1))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].msn)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init.mp4%s\"\n", query)
+	for i, seg := range segments {
+		if i == 0 || segments[i-1].msn+1 != seg.msn {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		}
+		if i >= len(m.segments)-hlsPartSegments {
+			for _, p := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.5f,URI=\"part%d.mp4%s\"", p.duration.Seconds(), p.index, query)
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if seg.data != nil {
+			fmt.Fprintf(&b, "#EXTINF:%.5f,\nseg%d.mp4%s\n", seg.duration.Seconds(), seg.msn, query)
+		}
+	}
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.mp4%s\"\n", m.nextPart, query)
+	return []byte(b.String())
+}
+
+// --- HTTPハンドラー ---
+
+// hlsAuthQuery はプレイリスト内のURIに引き継ぐ視聴者の認証情報のクエリを返します
+func hlsAuthQuery(r *http.Request) string {
+	q := url.Values{}
+	for _, key := range []string{"token", "expires", "sig"} {
+		if v := r.URL.Query().Get(key); v != "" {
+			q.Set(key, v)
+		}
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+// hlsHandler は GET /hls/<ストリーム名>/<ファイル> と GET /dash/<ストリーム名>/<ファイル> を処理します。
+// ファイルは index.m3u8、manifest.mpd、init.mp4、seg<N>.mp4、part<N>.mp4 です。
+// HLSとDASHは同じCMAFのセグメントを参照します。
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	name, file := path[:i], path[i+1:]
+	if _, ok := authorizeViewer(w, r, name); !ok {
+		return
+	}
+	s := lookupStream(name)
+	if s == nil {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	m := s.hlsMuxerOf()
+	if m == nil {
+		http.Error(w, "HLS is not enabled for this stream", http.StatusNotFound)
+		return
+	}
+	// -allowed-origins の検証は authorizeViewer で済んでいるため、他のオリジンのプレーヤーにも応答する
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+
+	switch {
+	case file == "index.m3u8":
+		m.servePlaylist(w, r)
+	case file == "manifest.mpd":
+		m.serveManifest(w, r)
+	case file == "init.mp4":
+		m.mutex.Lock()
+		init := m.init
+		m.mutex.Unlock()
+		m.serveMedia(w, "init", init)
+	case strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".mp4"):
+		msn, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(file, "seg"), ".mp4"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		var data []byte
+		m.mutex.Lock()
+		for _, seg := range m.segments {
+			if seg.msn == msn {
+				data = seg.data
+			}
+		}
+		m.mutex.Unlock()
+		m.serveMedia(w, "segment", data)
+	case strings.HasPrefix(file, "part") && strings.HasSuffix(file, ".mp4"):
+		index, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(file, "part"), ".mp4"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		// プリロードヒントの次のパートは作成されるまで待機する
+		var part *hlsPart
+		m.wait(r, 3*m.cfg.part+time.Second, func() bool {
+			part = m.findPartLocked(index)
+			return part != nil || index != m.nextPart
+		})
+		if part == nil {
+			http.NotFound(w, r)
+			return
+		}
+		m.serveMedia(w, "part", part.data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// servePlaylist はプレイリストを返します。_HLS_msn (と _HLS_part) を指定した場合は、
+// そのセグメント (パート) がプレイリストに含まれるまで待機します (ブロッキングリロード)。
+func (m *hlsMuxer) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ready := func() bool { return len(m.segments) > 0 }
+	if v := q.Get("_HLS_msn"); v != "" {
+		msn, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part := -1
+		if v := q.Get("_HLS_part"); v != "" {
+			if part, err = strconv.Atoi(v); err != nil || part < 0 {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		m.mutex.Lock()
+		tooFar := msn > m.nextMSN+2
+		m.mutex.Unlock()
+		if tooFar {
+			http.Error(w, "_HLS_msn is too far in the future", http.StatusBadRequest)
+			return
+		}
+		ready = func() bool {
+			if len(m.segments) == 0 {
+				return false
+			}
+			if msn < m.nextMSN {
+				return true
+			}
+			return msn == m.nextMSN && part >= 0 && m.current != nil && len(m.current.parts) > part
+		}
+	} else if q.Get("_HLS_part") != "" {
+		http.Error(w, "_HLS_part requires _HLS_msn", http.StatusBadRequest)
+		return
+	}
+	if !m.wait(r, 3*m.cfg.segment, ready) {
+		http.Error(w, "playlist is not ready", http.StatusServiceUnavailable)
+		return
+	}
+	m.mutex.Lock()
+	playlist := m.playlistLocked(hlsAuthQuery(r))
+	m.mutex.Unlock()
+	if playlist == nil {
+		http.Error(w, "playlist is not ready", http.StatusServiceUnavailable)
+		return
+	}
+	hlsRequests.with(m.name, "playlist").Add(1)
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write(playlist)
+}
+
+func (m *hlsMuxer) serveMedia(w http.ResponseWriter, kind string, data []byte) {
+	if data == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	hlsRequests.with(m.name, kind).Add(1)
+	hlsBytes.with(m.name).Add(uint64(len(data)))
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	_, _ = w.Write(data)
+}
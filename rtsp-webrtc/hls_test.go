@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// テスト用のパラメータセット (fMP4の初期化セグメントの生成にはデコード可能なSPSが必要)
+var (
+	testSPS = []byte{
+		0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78,
+		0x02, 0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00,
+		0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60,
+		0xc6, 0x58,
+	}
+	testPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+// hlsTestBase は最初のフレームの時刻です
+var hlsTestBase = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// newTestHLSMuxer はセグメント 400ms、パート 200ms のHLS出力を作成します
+func newTestHLSMuxer() *hlsMuxer {
+	return &hlsMuxer{
+		name:    "hls-test",
+		cfg:     hlsConfig{segment: 400 * time.Millisecond, part: 200 * time.Millisecond, segments: 3},
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		changed: make(chan struct{}),
+		waitKey: true,
+	}
+}
+
+// writeTestFrames は25fpsで10フレームごとにキーフレームとなるフレーム from〜to-1 を書き込みます。
+// 1パートは5フレーム、1セグメントは2パートになります。
+func writeTestFrames(m *hlsMuxer, from, to int) {
+	for i := from; i < to; i++ {
+		au := accessUnit{codec: "h264", time: hlsTestBase.Add(time.Duration(i) * 40 * time.Millisecond)}
+		if i%10 == 0 {
+			au.key = true
+			au.nals = [][]byte{testSPS, testPPS, {0x65, 0x88, 0x84}}
+		} else {
+			au.nals = [][]byte{{0x41, 0x9a}}
+		}
+		m.writeAU(au)
+	}
+}
+
+const hlsTestHeader = "#EXTM3U\n" +
+	"#EXT-X-VERSION:9\n" +
+	"#EXT-X-TARGETDURATION:1\n" +
+	"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.600\n" +
+	"#EXT-X-PART-INF:PART-TARGET=0.200\n"
+
+func TestHLSPlaylist(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames int
+		query  string
+		want   string
+	}{
+		{name: "フレームなし", frames: 0, want: ""},
+		{name: "キーフレームの前のみ", frames: 1, want: ""},
+		{
+			name:   "書き込み中のセグメントのみ",
+			frames: 11,
+			want: hlsTestHeader +
+				"#EXT-X-MEDIA-SEQUENCE:0\n" +
+				"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+				"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:05.000Z\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part0.mp4\",INDEPENDENT=YES\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part1.mp4\"\n" +
+				"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part2.mp4\"\n",
+		},
+		{
+			name:   "古いセグメントのパートは載せない",
+			frames: 42,
+			want: hlsTestHeader +
+				"#EXT-X-MEDIA-SEQUENCE:1\n" +
+				"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+				"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:05.400Z\n" +
+				"#EXTINF:0.40000,\nseg1.mp4\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part4.mp4\",INDEPENDENT=YES\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part5.mp4\"\n" +
+				"#EXTINF:0.40000,\nseg2.mp4\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part6.mp4\",INDEPENDENT=YES\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part7.mp4\"\n" +
+				"#EXTINF:0.40000,\nseg3.mp4\n" +
+				"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part8.mp4\"\n",
+		},
+		{
+			name:   "認証情報のクエリ",
+			frames: 21,
+			query:  "?token=abc",
+			want: hlsTestHeader +
+				"#EXT-X-MEDIA-SEQUENCE:0\n" +
+				"#EXT-X-MAP:URI=\"init.mp4?token=abc\"\n" +
+				"#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:05.000Z\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part0.mp4?token=abc\",INDEPENDENT=YES\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part1.mp4?token=abc\"\n" +
+				"#EXTINF:0.40000,\nseg0.mp4?token=abc\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part2.mp4?token=abc\",INDEPENDENT=YES\n" +
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part3.mp4?token=abc\"\n" +
+				"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part4.mp4?token=abc\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestHLSMuxer()
+			writeTestFrames(m, 0, tt.frames)
+			m.mutex.Lock()
+			got := string(m.playlistLocked(tt.query))
+			m.mutex.Unlock()
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHLSServePlaylist(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "ブロッキングなし", query: "", wantStatus: http.StatusOK},
+		{name: "完了したセグメント", query: "_HLS_msn=3", wantStatus: http.StatusOK},
+		{name: "完了したパート", query: "_HLS_msn=3&_HLS_part=1", wantStatus: http.StatusOK},
+		{name: "_HLS_msn が数値でない", query: "_HLS_msn=abc", wantStatus: http.StatusBadRequest},
+		{name: "_HLS_msn が負", query: "_HLS_msn=-1", wantStatus: http.StatusBadRequest},
+		{name: "_HLS_part が数値でない", query: "_HLS_msn=4&_HLS_part=x", wantStatus: http.StatusBadRequest},
+		{name: "_HLS_part が負", query: "_HLS_msn=4&_HLS_part=-1", wantStatus: http.StatusBadRequest},
+		{name: "_HLS_msn のない _HLS_part", query: "_HLS_part=0", wantStatus: http.StatusBadRequest},
+		{name: "_HLS_msn が先すぎる", query: "_HLS_msn=7", wantStatus: http.StatusBadRequest},
+		// 待機中にリクエストがキャンセルされた
+		{name: "まだないセグメント", query: "_HLS_msn=6", wantStatus: http.StatusServiceUnavailable},
+	}
+
+	m := newTestHLSMuxer()
+	writeTestFrames(m, 0, 42) // 完了したセグメント 1〜3、次のセグメントは4
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			r := httptest.NewRequest("GET", "/hls/hls-test/index.m3u8?"+tt.query, nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+			m.servePlaylist(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK && !strings.HasPrefix(w.Body.String(), "#EXTM3U\n") {
+				t.Errorf("body = %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHLSBlockingReload(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		frames   int    // リクエストに応答するまでに書き込むフレーム数
+		wantPart string // 応答に含まれるパート
+	}{
+		{name: "次のパート", query: "_HLS_msn=4&_HLS_part=0", frames: 4, wantPart: "part8.mp4"},
+		{name: "次のセグメント", query: "_HLS_msn=4", frames: 10, wantPart: "seg4.mp4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestHLSMuxer()
+			writeTestFrames(m, 0, 42)
+
+			r := httptest.NewRequest("GET", "/hls/hls-test/index.m3u8?"+tt.query, nil)
+			w := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				m.servePlaylist(w, r)
+			}()
+
+			// 対象が作成されるまでは応答しない
+			writeTestFrames(m, 42, 42+tt.frames-1)
+			select {
+			case <-done:
+				t.Fatalf("対象が作成される前に応答した: %s", w.Body.String())
+			case <-time.After(50 * time.Millisecond):
+			}
+			writeTestFrames(m, 42+tt.frames-1, 42+tt.frames)
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("応答しない")
+			}
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), tt.wantPart) {
+				t.Errorf("status = %d, body =\n%s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval は証明書ファイルの変更を確認する間隔です
+const certReloadInterval = 10 * time.Second
+
+// certReloader は証明書と秘密鍵のファイルを監視し、変更されたら再起動なしで読み込み直します
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // 最後に読み込んだファイルの更新時刻 (証明書と秘密鍵の新しい方)
+}
+
+// newCertReloader は証明書を読み込み、変更の監視を開始します
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+// latestModTime は証明書と秘密鍵のファイルのうち新しい方の更新時刻を返します
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("証明書の読み込みに失敗: %v", err)
+	}
+	r.mutex.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mutex.Unlock()
+	return nil
+}
+
+// watch は証明書ファイルの更新を定期的に確認します。
+// 読み込みに失敗した場合 (書き換え途中など) は現在の証明書を使い続けます。
+func (r *certReloader) watch() {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		modTime, err := r.latestModTime()
+		if err != nil {
+			slog.Warn("HTTPS: 証明書ファイルの確認に失敗", "error", err)
+			continue
+		}
+		r.mutex.RLock()
+		changed := !modTime.Equal(r.modTime)
+		r.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			slog.Warn("HTTPS: 証明書の再読み込みに失敗 (現在の証明書を継続使用)", "error", err)
+			continue
+		}
+		slog.Info("HTTPS: 証明書を再読み込みしました", "cert", r.certFile)
+	}
+}
+
+// getCertificate は tls.Config.GetCertificate 用に現在の証明書を返します
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// withHSTS はHTTPSのレスポンスに Strict-Transport-Security ヘッダーを付加します
+func withHSTS(next http.Handler, maxAge time.Duration) http.Handler {
+	value := fmt.Sprintf("max-age=%d; includeSubDomains", int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startHTTPSRedirect は addr でHTTPを待ち受け、すべてのリクエストを httpsPort のHTTPSへリダイレクトします
+func startHTTPSRedirect(addr, httpsPort string) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	slog.Info("HTTPS: HTTPからHTTPSへのリダイレクトを開始します", "addr", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		slog.Error("HTTPS: リダイレクトサーバーエラー", "error", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// --- ログ ---
+
+// logLevel は実行時に変更できるログレベルです (-log-level で初期化し、管理APIで変更できます)
+var logLevel = new(slog.LevelVar)
+
+// setupLogging はログの出力形式 ("text" または "json") とレベルを設定します。
+// 標準の log パッケージの出力 (依存ライブラリなど) も同じハンドラーに転送されます。
+func setupLogging(format, level string) error {
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("サポートされていないログ形式: %s。'text' または 'json' を使用してください。", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// setLogLevel はログレベル (debug, info, warn, error) を変更します
+func setLogLevel(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("サポートされていないログレベル: %s。'debug', 'info', 'warn', 'error' を使用してください。", level)
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+// fatal はエラーを出力して終了します
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// --- 繰り返し出力される警告の抑制 ---
+
+// logLimiter は同じ警告が短時間に繰り返し出力されるのを抑制します
+type logLimiter struct {
+	interval time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*logLimiterEntry
+}
+
+type logLimiterEntry struct {
+	last       time.Time
+	suppressed int
+}
+
+// logLimiterPruneSize はエントリーの追加時に古いエントリーを削除し始める数です (接続元ごとのキーで増え続けないように)
+const logLimiterPruneSize = 1024
+
+// warnLimiter はパケットの欠落やチャネルの満杯など、ホットパスの警告に使用します
+var warnLimiter = &logLimiter{interval: 10 * time.Second, entries: make(map[string]*logLimiterEntry)}
+
+// allow は key のログを出力してよいかと、前回の出力以降に抑制した回数を返します
+func (l *logLimiter) allow(key string) (bool, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	e := l.entries[key]
+	if e == nil {
+		if len(l.entries) >= logLimiterPruneSize {
+			for k, old := range l.entries {
+				if now.Sub(old.last) >= l.interval {
+					delete(l.entries, k)
+				}
+			}
+		}
+		l.entries[key] = &logLimiterEntry{last: now}
+		return true, 0
+	}
+	if now.Sub(e.last) < l.interval {
+		e.suppressed++
+		return false, 0
+	}
+	suppressed := e.suppressed
+	e.last = now
+	e.suppressed = 0
+	return true, suppressed
+}
+
+// warnRateLimited は同じ logger・メッセージの警告を一定間隔に1回だけ出力します。
+// 抑制した回数は suppressed フィールドとして次の出力に付加されます。
+func warnRateLimited(logger *slog.Logger, key, msg string, args ...any) {
+	ok, suppressed := warnLimiter.allow(key + "\xff" + msg)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	logger.Warn(msg, args...)
+}
@@ -1,31 +1,87 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // --- トラックリストとミューテックス ---
 var (
-	inputURL       string // RTSP URL または RTP SDP ファイルパス
-	serverPort     string
-	codec          string // "h264" または "h265" (入力コーデック)
-	outputCodec    string // "h264" または "h265" (出力コーデック、H.265入力時のみ使用)
-	processor      string // H.265 トランスコーディング用の "cpu" または "gpu"
-	inputType      string // "rtsp" または "rtp" または "server" または "rtp-server"
-	useGortsplib   string // gortsplib パススルー用の "true" または "false"
-	rtpServerAddr  string // RTP サーバーのリスニングアドレス
+	inputURL            string // RTSP URL または RTP SDP ファイルパス
+	serverPort          string
+	codec               string           // "h264" または "h265" (入力コーデック)
+	outputCodec         string           // "h264" または "h265" (出力コーデック、H.265入力時のみ使用)
+	processor           string           // H.265 トランスコーディング用の "cpu" または "gpu"
+	inputType           string           // "rtsp"、"rtp"、"server"、"rtp-server"、"rtmp-server"、"srt"、"udp-ts" または "file"
+	useGortsplib        string           // gortsplib パススルー用の "true" または "false"
+	rtpServerAddr       string           // RTP サーバーのリスニングアドレス
+	onDemand            bool             // オンデマンド入力を有効にする
+	onDemandLinger      time.Duration    // オンデマンド入力の停止猶予
+	streamsConfig       string           // 追加ストリームのJSON設定ファイル
+	rtspServer          bool             // 取り込んだストリームをRTSPで再配信する
+	rtspConfig          rtspServerConfig // RTSPサーバーのリスニング設定
+	rtspAuthMethods     string           // RTSPサーバーの認証方式
+	rtspAuthFile        string           // パスごとのRTSP認証情報のJSON設定ファイル
+	rtspAuthDefault     rtspCredentials  // 全パス共通のRTSP認証情報
+	inputUser           string           // プル入力の認証ユーザー名
+	inputPass           string           // プル入力の認証パスワード
+	inputTLSInsecure    bool             // RTSPS入力の証明書を検証しない
+	inputTLSCA          string           // RTSPS入力の証明書検証に使用するCA証明書
+	viewerTokens        string           // 視聴者の静的トークンのJSON設定ファイル
+	viewerHMACSecret    string           // 署名付きURLのHMACシークレット
+	viewerJWTSecret     string           // JWT (HS256) の検証用シークレット
+	viewerACL           string           // ストリームごとの視聴者ACLのJSON設定ファイル
+	allowedOrigins      string           // WebSocket接続を許可するOrigin (カンマ区切り)
+	tlsCert             string           // HTTPS/WSSの証明書ファイル
+	tlsKey              string           // HTTPS/WSSの秘密鍵ファイル
+	httpRedirectPort    string           // HTTPからHTTPSへリダイレクトするポート
+	hstsMaxAge          time.Duration    // Strict-Transport-Security の max-age
+	maxViewers          int              // 全体の同時視聴者数の上限
+	maxViewersPerStream int              // ストリームごとの同時視聴者数の上限
+	maxEgressKbps       int              // 全体の推定送信帯域の上限 (kbps)
+	maxStreamEgressKbps int              // ストリームごとの推定送信帯域の上限 (kbps)
+	viewerQueueTimeout  time.Duration    // 上限到達時に視聴者を待機させる最大時間
+	priorityViewers     string           // 上限を無視して受け入れる視聴者の subject (カンマ区切り)
+	adminToken          string           // 管理API (/api/v1) のBearerトークン
+	logFormat           string           // ログの出力形式 ("text" または "json")
+	logLevelName        string           // 起動時のログレベル
+	webhooksConfig      string           // WebhookのJSON設定ファイル
+	record              bool             // 取り込んだストリームを録画する
+	clips               bool             // トリガーによるクリップ録画を有効にする
+	hls                 bool             // HLS / LL-HLS で配信する
+	loop                bool             // file 入力を末尾から先頭に戻って繰り返す
 )
 
 type props struct {
-	codec       string
-	outputCodec string
-	serverPort  string
-	processor   string
-	inputType   string
-	inputURL    string
-	fps         int // 追加: フレームレートを追加
+	name             string // ストリーム名 (シグナリングの stream パラメータで指定)
+	codec            string
+	outputCodec      string
+	serverPort       string
+	processor        string
+	inputType        string
+	inputURL         string
+	useGortsplib     bool
+	rtpServerAddr    string
+	onDemand         bool          // 視聴者がいる間だけ入力に接続する
+	onDemandLinger   time.Duration // 最後の視聴者の退出後、入力を維持する時間
+	fps              int           // 追加: フレームレートを追加
+	inputUser        string        // プル入力の認証情報 (URLに含める代わりに指定)
+	inputPass        string
+	inputTLSInsecure bool   // RTSPS入力の証明書を検証しない
+	inputTLSCA       string // RTSPS入力の証明書検証に使用するCA証明書ファイル
+	maxViewers       int    // 同時視聴者数の上限 (0は無制限)
+	record           bool   // 取り込んだ映像をセグメントファイルに録画する
+	clips            bool   // pre-roll を保持し、トリガーでクリップを録画する
+	hls              bool   // HLS / LL-HLS と DASH で配信する (セグメントは共通)
+	loop             bool   // file 入力を末尾から先頭に戻って繰り返す
 }
 
 func main() {
@@ -34,162 +90,251 @@ func main() {
 	flag.StringVar(&codec, "codec", "h264", "入力に使用するコーデック (h264 または h265)")
 	flag.StringVar(&outputCodec, "output-codec", "h264", "出力コーデック (h264 または h265) - H.265入力時のみ有効")
 	flag.StringVar(&processor, "processor", "cpu", "H.265トランスコーディングに使用するプロセッサ (cpu または gpu)")
-	flag.StringVar(&inputType, "input-type", "rtsp", "入力タイプ (rtsp, rtp, server, rtp-server)")	
+	flag.StringVar(&inputType, "input-type", "rtsp", "入力タイプ (rtsp, rtp, server, rtp-server, rtmp-server, srt, udp-ts, file)")
+	flag.BoolVar(&loop, "loop", false, "file 入力をファイルの末尾から先頭に戻って繰り返す (ストリーム設定の loop で個別に指定可能)")
 	flag.StringVar(&useGortsplib, "use-gortsplib", "false", "RTSPパススルーにgortsplibを使用する (true または false)")
 	flag.StringVar(&rtpServerAddr, "rtp-server-addr", ":5004", "RTPサーバーのリスニングアドレス (rtp-server モード時のみ)")
+	flag.BoolVar(&onDemand, "on-demand", false, "視聴者が接続している間だけ入力に接続する (rtsp, rtp, udp-ts, file のみ)")
+	flag.DurationVar(&onDemandLinger, "on-demand-linger", 10*time.Second, "オンデマンドモードで最後の視聴者が退出してから入力を停止するまでの時間")
+	flag.StringVar(&streamsConfig, "streams", "", "追加ストリームを定義するJSON設定ファイルのパス")
+	flag.BoolVar(&rtspServer, "rtsp-server", false, "取り込んだストリームをRTSPサーバーで再配信する (server モードでは常に有効)")
+	flag.StringVar(&rtspConfig.address, "rtsp-address", "0.0.0.0:554", "RTSPサーバーのリスニングアドレス (空の場合はRTSPSのみ)")
+	flag.StringVar(&rtspConfig.udpRTPAddress, "rtsp-udp-rtp-address", "0.0.0.0:8000", "RTSPサーバーのUDP RTPアドレス (ポートは偶数)")
+	flag.StringVar(&rtspConfig.udpRTCPAddress, "rtsp-udp-rtcp-address", "0.0.0.0:8001", "RTSPサーバーのUDP RTCPアドレス (RTPポート+1)")
+	flag.StringVar(&rtspConfig.multicastIPRange, "rtsp-multicast-ip-range", "224.1.0.0/16", "RTSPサーバーのマルチキャストIPアドレス範囲")
+	flag.IntVar(&rtspConfig.multicastRTPPort, "rtsp-multicast-rtp-port", 8002, "RTSPサーバーのマルチキャストRTPポート")
+	flag.IntVar(&rtspConfig.multicastRTCPPort, "rtsp-multicast-rtcp-port", 8003, "RTSPサーバーのマルチキャストRTCPポート")
+	flag.StringVar(&rtspConfig.transports, "rtsp-transports", "udp,multicast,tcp", "RTSPサーバーで有効にするトランスポート (udp, multicast, tcp のカンマ区切り)")
+	flag.DurationVar(&rtspConfig.readTimeout, "rtsp-read-timeout", 10*time.Second, "RTSPサーバーの読み取りタイムアウト")
+	flag.DurationVar(&rtspConfig.writeTimeout, "rtsp-write-timeout", 10*time.Second, "RTSPサーバーの書き込みタイムアウト")
+	flag.StringVar(&rtspConfig.rtspsAddress, "rtsps-address", "", "RTSPS (TLS) サーバーのリスニングアドレス (例: 0.0.0.0:8322、空の場合は無効)")
+	flag.StringVar(&rtspConfig.tlsCert, "rtsps-cert", "", "RTSPSサーバーの証明書ファイル")
+	flag.StringVar(&rtspConfig.tlsKey, "rtsps-key", "", "RTSPSサーバーの秘密鍵ファイル")
+	flag.StringVar(&rtspAuthMethods, "rtsp-auth-methods", "basic,digest", "RTSPサーバーの認証方式 (basic, digest, digest-sha256 のカンマ区切り)")
+	flag.StringVar(&rtspAuthDefault.PublishUser, "rtsp-publish-user", "", "RTSPサーバーへのPUSHに必要なユーザー名 (空の場合は認証なし)")
+	flag.StringVar(&rtspAuthDefault.PublishPass, "rtsp-publish-pass", "", "RTSPサーバーへのPUSHに必要なパスワード")
+	flag.StringVar(&rtspAuthDefault.ReadUser, "rtsp-read-user", "", "RTSPサーバーからの再生に必要なユーザー名 (空の場合は認証なし)")
+	flag.StringVar(&rtspAuthDefault.ReadPass, "rtsp-read-pass", "", "RTSPサーバーからの再生に必要なパスワード")
+	flag.StringVar(&rtspAuthFile, "rtsp-auth", "", "パスごとのRTSP認証情報を定義するJSON設定ファイルのパス")
+	flag.StringVar(&inputUser, "input-user", "", "入力RTSPの認証ユーザー名 (URLに含める代わりに指定)")
+	flag.StringVar(&inputPass, "input-pass", "", "入力RTSPの認証パスワード")
+	flag.BoolVar(&inputTLSInsecure, "input-tls-insecure", false, "RTSPS入力の証明書を検証しない")
+	flag.StringVar(&inputTLSCA, "input-tls-ca", "", "RTSPS入力の証明書検証に使用するCA証明書ファイル")
+	flag.StringVar(&viewerTokens, "viewer-tokens", "", "視聴者の静的トークンを定義するJSON設定ファイルのパス")
+	flag.StringVar(&viewerHMACSecret, "viewer-hmac-secret", "", "有効期限付き署名URLの検証に使用するHMACシークレット")
+	flag.StringVar(&viewerJWTSecret, "viewer-jwt-secret", "", "視聴者のJWT (HS256) の検証に使用するシークレット")
+	flag.StringVar(&viewerACL, "viewer-acl", "", "ストリームごとに視聴を許可する視聴者を定義するJSON設定ファイルのパス")
+	flag.StringVar(&allowedOrigins, "allowed-origins", "", "WebSocket接続を許可するOrigin (カンマ区切り、空の場合はすべて許可)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "HTTPS/WSSの証明書ファイル (指定すると -port でHTTPSを提供、変更時は自動で再読み込み)")
+	flag.StringVar(&tlsKey, "tls-key", "", "HTTPS/WSSの秘密鍵ファイル")
+	flag.StringVar(&httpRedirectPort, "http-redirect-port", "", "HTTPからHTTPSへリダイレクトするポート (例: 80、空の場合は無効)")
+	flag.DurationVar(&hstsMaxAge, "hsts-max-age", 0, "HTTPSのレスポンスに付加するHSTSのmax-age (例: 8760h、0の場合は無効)")
+	flag.IntVar(&maxViewers, "max-viewers", 0, "全体の同時視聴者数の上限 (0は無制限)")
+	flag.IntVar(&maxViewersPerStream, "max-viewers-per-stream", 0, "ストリームごとの同時視聴者数の上限 (0は無制限、ストリーム設定の max-viewers で上書き可能)")
+	flag.IntVar(&maxEgressKbps, "max-egress-kbps", 0, "全体の推定送信帯域の上限 (kbps、0は無制限)")
+	flag.IntVar(&maxStreamEgressKbps, "max-stream-egress-kbps", 0, "ストリームごとの推定送信帯域の上限 (kbps、0は無制限)")
+	flag.DurationVar(&viewerQueueTimeout, "viewer-queue-timeout", 0, "上限到達時に視聴者を待機キューで待たせる最大時間 (0の場合は即座に拒否)")
+	flag.StringVar(&priorityViewers, "priority-viewers", "", "上限を無視して受け入れる視聴者の subject (カンマ区切り、オペレーター用)")
+	flag.StringVar(&adminToken, "admin-token", "", "管理API (/api/v1) のBearerトークン (空の場合は管理APIを無効化)")
+	flag.StringVar(&logFormat, "log-format", "text", "ログの出力形式 (text または json)")
+	flag.StringVar(&logLevelName, "log-level", "info", "ログレベル (debug, info, warn, error)。管理APIで実行時に変更できます")
+	flag.StringVar(&webhooksConfig, "webhooks", "", "イベントを送信するWebhookを定義するJSON設定ファイルのパス")
+	flag.DurationVar(&stallTimeout, "stall-timeout", 5*time.Second, "映像がこの時間届かない場合にストールとして視聴者に通知し、入力を再接続する (0の場合は無効)")
+	flag.DurationVar(&readyFrameTimeout, "ready-frame-timeout", 10*time.Second, "入力が最後に映像を受信してからこの時間を過ぎると /readyz を未準備にする")
+	flag.BoolVar(&record, "record", false, "取り込んだストリームを録画する (ストリーム設定の record で個別に指定可能)")
+	flag.StringVar(&recording.dir, "record-dir", "recordings", "録画ファイルのルートディレクトリ (<dir>/<ストリーム名>/<日付>/<時刻>.mp4)")
+	flag.StringVar(&recording.format, "record-format", "fmp4", "録画形式 (fmp4 または mpegts)")
+	flag.DurationVar(&recording.segment, "record-segment", time.Minute, "録画セグメントの長さ (キーフレームで区切るため目安)")
+	flag.DurationVar(&recording.retention, "record-retention", 0, "この期間より古い録画セグメントを削除する (例: 168h、0の場合は無期限)")
+	flag.Int64Var(&recording.maxMB, "record-max-mb", 0, "録画ファイルの合計サイズの上限 (MB)。超えた場合は古いセグメントから削除する (0は無制限)")
+	flag.BoolVar(&clips, "clips", false, "pre-roll を保持し、管理APIのトリガーでクリップを録画する (ストリーム設定の clips で個別に指定可能)")
+	flag.StringVar(&clipping.dir, "clip-dir", "clips", "クリップのルートディレクトリ (<dir>/<ストリーム名>/<日付>/<時刻>_<ID>.mp4)")
+	flag.DurationVar(&clipping.preRoll, "clip-pre-roll", 10*time.Second, "クリップに含めるトリガーより前の時間 (キーフレーム単位で遡る)")
+	flag.DurationVar(&clipping.maxDuration, "clip-max-duration", 5*time.Minute, "トリガーからクリップを終了するまでの最大時間")
+	flag.BoolVar(&hls, "hls", false, "HLS / LL-HLS (/hls/<ストリーム名>/index.m3u8) とDASH (/dash/<ストリーム名>/manifest.mpd) で配信する (ストリーム設定の hls で個別に指定可能)")
+	flag.DurationVar(&hlsOutput.segment, "hls-segment", 2*time.Second, "HLSのセグメントの長さ (キーフレームで区切るため目安)")
+	flag.DurationVar(&hlsOutput.part, "hls-part", 200*time.Millisecond, "LL-HLSのパーシャルセグメントの長さ")
+	flag.IntVar(&hlsOutput.segments, "hls-segments", 7, "HLSのプレイリストに含めるセグメント数")
 	flag.Parse()
-	// サーバーモードの場合は入力URLチェックをスキップ
-	if inputType != "server" && inputType != "rtp-server" && inputURL == "" {
-		log.Fatal("入力URL（RTSPまたはRTP SDPファイル）を指定する必要があります。現在の入力タイプ: ", inputType)
+	// 終了シグナルを受け取るとキャンセルされ、入力の停止と録画の確定を行ってから終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := setupLogging(logFormat, logLevelName); err != nil {
+		fatal("ログ設定エラー", "error", err)
 	}
-	
-	// 出力コーデックの妥当性チェック
-	if outputCodec != "h264" && outputCodec != "h265" {
-		log.Fatalf("サポートされていない出力コーデック: %s。'h264' または 'h265' を使用してください。", outputCodec)
+	var err error
+	rtspConfig.auth, err = loadRTSPAuth(rtspAuthMethods, rtspAuthDefault, rtspAuthFile)
+	if err != nil {
+		fatal("RTSP認証設定の読み込みエラー", "error", err)
+	}
+	viewerAuth, err = loadViewerAuth(viewerTokens, viewerHMACSecret, viewerJWTSecret, viewerACL, allowedOrigins)
+	if err != nil {
+		fatal("視聴者認証設定の読み込みエラー", "error", err)
+	}
+	if len(viewerAuth.authenticators) > 0 {
+		slog.Info("視聴者の認証が有効です", "methods", len(viewerAuth.authenticators))
+	}
+	admission = newAdmissionController(maxViewers, maxViewersPerStream, maxEgressKbps, maxStreamEgressKbps, strings.Split(priorityViewers, ","))
+	if webhooksConfig != "" {
+		sinks, err := loadWebhooks(webhooksConfig)
+		if err != nil {
+			fatal("Webhook設定の読み込みエラー", "error", err)
+		}
+		slog.Info("Webhookへのイベント送信を開始しました", "webhooks", len(sinks))
+	}
+	if err := recording.validate(); err != nil {
+		fatal("録画設定エラー", "error", err)
+	}
+	if err := hlsOutput.validate(); err != nil {
+		fatal("HLS設定エラー", "error", err)
+	}
+	// 前回の異常終了で書き込み途中のまま残ったセグメントを復旧してから録画を開始
+	recoverRecordings(recording.dir)
+	recoverRecordings(clipping.dir)
+	if recording.retention > 0 || recording.maxMB > 0 {
+		go startRecordingJanitor(recording, time.Minute)
+	}
+	go startIngestSampler(time.Second)
+	if stallTimeout > 0 {
+		go startStallWatchdog(stallTimeout)
 	}
-	
 	// H.264入力時に出力コーデックがH.265の場合は警告
 	if codec == "h264" && outputCodec == "h265" {
-		log.Printf("警告: H.264入力からH.265出力への変換は現在サポートされていません。出力をH.264に設定します。")
+		slog.Warn("H.264入力からH.265出力への変換は現在サポートされていません。出力をH.264に設定します。")
 		outputCodec = "h264"
 	}
-		if inputType == "server" {
-		log.Printf("入力タイプ: %s, コーデック: %s を使用します (RTSPサーバーモード)", inputType, codec)
+	if inputType == "server" {
+		slog.Info("RTSPサーバーモードで起動します (コーデックはパブリッシャーごとに自動検出)", "input_type", inputType)
 	} else if inputType == "rtp-server" {
-		log.Printf("入力タイプ: %s, コーデック: %s を使用します (RTPサーバーモード、リスニングアドレス: %s)", inputType, codec, rtpServerAddr)
+		slog.Info("RTPサーバーモードで起動します", "input_type", inputType, "codec", codec, "listen", rtpServerAddr)
 	} else {
-		log.Printf("入力URL: %s, 入力タイプ: %s, コーデック: %s を使用します", inputURL, inputType, codec)
+		slog.Info("入力設定", "input_url", redactedInputURL(props{inputURL: inputURL}), "input_type", inputType, "codec", codec)
 	}
-	
+
 	if codec == "h265" {
-		log.Printf("H.265入力 -> %s出力, プロセッサ: %s", outputCodec, processor)
+		slog.Info("H.265入力", "output_codec", outputCodec, "processor", processor)
 	}
-	
+
 	props := props{
-		codec:       codec,
-		outputCodec: outputCodec,
-		serverPort:  serverPort,
-		processor:   processor,
-		inputType:   inputType,
-		inputURL:    inputURL,
-		fps:         30, // デフォルトのフレームレートを設定 (必要に応じて変更可能)
-	}
-	
-	if useGortsplib == "true" {
-		log.Println("RTSPパススルーまたはトランスコーディングにgortsplibベースのハンドラーを使用します")
-		switch inputType {
-		case "server":
-			log.Println("RTSPサーバーモードでgortsplibベースのサーバーを起動します")
-			switch codec {
-			case "h264":
-				go startGortsplibH264RTSPServer(props)
-			case "h265":
-				go startGortsplibH265RTSPServer(props)
-			default:
-				log.Fatalf("サポートされていないコーデック: %s。'h264' または 'h265' を使用してください。", codec)
-			}
-		case "rtp-server":
-			log.Println("RTPサーバーモードで動的SDP受信サーバーを起動します")
-			go startRTPServer(rtpServerAddr)
-		case "rtp":
-			// RTP入力の場合は既存のRTPクライアントを使用
-			log.Printf("RTP入力が検出されました。RTPクライアントを使用します (コーデック: %s)", codec)
-			switch codec {
-			case "h264":
-				setCurrentCodec("h264")
-				go startRTPClient(props.inputURL)
-			case "h265":
-				if outputCodec == "h264" {
-					log.Println("H.265 RTP入力をH.264に変換してWebRTCにストリーミングします（注意: RTPクライアントは直接パススルーのみサポート）")
-					setCurrentCodec("h265") // RTPクライアントはパススルーのみ
-				} else {
-					setCurrentCodec("h265")
-				}				
-				go startRTPClient(props.inputURL)
-			default:
-				log.Fatalf("RTPクライアントは現在H.264およびH.265のみをサポートしています。指定されたコーデック: %s", codec)
-			}
-		default:
-			switch codec {
-			case "h264":
-				setCurrentCodec("h264")
-				go startGortsplibH264RTSP(props)
-			case "h265":
-				// H.265入力時の出力コーデックに基づいて処理を分岐
-				if outputCodec == "h264" {
-					log.Println("gortsplibを使用してH.265をH.264にトランスコードし、WebRTCにストリーミングします")
-					setCurrentCodec("h264")
-					go startGortsplibH265toH264RTSP(props)
-				} else {
-					log.Println("gortsplibを使用してH.265をパススルーし、WebRTCにストリーミングします")
-					setCurrentCodec("h265")
-					go startGortsplibH265RTSP(props)
-				}
-			default:
-				log.Fatalf("gortsplibは現在H.264およびH.265 (->H.264トランスコード) のみをサポートしています。指定されたコーデック: %s", codec)
-			}
+		name:             "default",
+		codec:            codec,
+		outputCodec:      outputCodec,
+		serverPort:       serverPort,
+		processor:        processor,
+		inputType:        inputType,
+		inputURL:         inputURL,
+		useGortsplib:     useGortsplib == "true",
+		rtpServerAddr:    rtpServerAddr,
+		onDemand:         onDemand,
+		onDemandLinger:   onDemandLinger,
+		fps:              30, // デフォルトのフレームレートを設定 (必要に応じて変更可能)
+		inputUser:        inputUser,
+		inputPass:        inputPass,
+		inputTLSInsecure: inputTLSInsecure,
+		inputTLSCA:       inputTLSCA,
+		maxViewers:       maxViewersPerStream,
+		record:           record,
+		clips:            clips,
+		hls:              hls,
+		loop:             loop,
+	}
+
+	if inputType == "server" {
+		// RTSPサーバーモードではパブリッシャーのパスごとにストリームを作成
+		if !props.useGortsplib {
+			fatal("サーバーモードはgortsplibが必要です。-use-gortsplib=true を指定してください")
 		}
+		slog.Info("RTSPサーバーモードでgortsplibベースのサーバーを起動します")
+		expectRTSPListeners(rtspConfig)
+		go startGortsplibRTSPServer(ctx, props, rtspConfig, true)
 	} else {
-		// 既存のffmpegベースのロジック (useGortsplib が "false" の場合)		log.Println("従来のffmpegベースのハンドラーを使用します")
-		switch inputType {
-		case "server":
-			log.Fatal("サーバーモードはgortsplibが必要です。-use-gortsplib=true を指定してください")
-		case "rtp-server":
-			log.Println("RTPサーバーモードで動的SDP受信サーバーを起動します")
-			go startRTPServer(rtpServerAddr)
-		case "rtsp":
-			switch codec {			case "h264":
-				go startFFmpegH264RTSP(props.inputURL)
-			case "h265":
-				switch processor {
-				case "gpu":
-					go startFFmpegH265ToH264NALGPURTSP(props.inputURL)
-				case "cpu":
-					go startFFmpegH265ToH264NALCPURTSP(props.inputURL)
-				default:
-					log.Fatalf("H.265のサポートされていないプロセッサ: %s。'cpu' または 'gpu' を使用してください。", processor)
-				}
-			default:
-				log.Fatalf("RTSPのサポートされていないコーデック: %s", codec)
+		if streamsConfig == "" || inputURL != "" || inputType == "rtp-server" {
+			// -streams のみ指定された場合は、フラグによる既定ストリームを作成しない
+			if _, err := startPipeline(props); err != nil {
+				fatal("ストリームの起動エラー", "stream", props.name, "error", err)
 			}
-		case "rtp":
-			switch codec {
-			case "h264":
-				setCurrentCodec("h264")
-				go startFFmpegH264RTP(inputURL) // ffmpegベースのH.264 RTP処理
-			case "h265":
-				if outputCodec == "h264" {
-					// H.265 -> H.264 トランスコーディング
-					switch processor {
-					case "gpu":
-						go startFFmpegH265ToH264NALGPURTP(inputURL)
-					case "cpu":
-						go startFFmpegH265ToH264NALCPURTP(inputURL)
-					default:
-						log.Fatalf("H.265のサポートされていないプロセッサ: %s。'cpu' または 'gpu' を使用してください。", processor)
-					}
-					setCurrentCodec("h264") // 出力はH.264
-				} else {
-					// H.265パススルー
-					setCurrentCodec("h265")
-					go startFFmpegH265RTP(inputURL) // ffmpegベースのH.265 RTPパススルー
-				}
-			default:
-				log.Fatalf("RTPのサポートされていないコーデック: %s", codec)
+		}
+		if rtspServer {
+			slog.Info("取り込んだストリームをRTSPで再配信するためにgortsplibベースのサーバーを起動します")
+			expectRTSPListeners(rtspConfig)
+			go startGortsplibRTSPServer(ctx, props, rtspConfig, false)
+		}
+	}
+
+	// -streams で指定された追加ストリームを起動
+	if streamsConfig != "" {
+		configs, err := loadStreamsConfig(streamsConfig, props)
+		if err != nil {
+			fatal("ストリーム設定の読み込みエラー", "error", err)
+		}
+		for _, c := range configs {
+			slog.Info("入力設定", "stream", c.name, "input_url", redactedInputURL(c), "input_type", c.inputType, "codec", c.codec)
+			if _, err := startPipeline(c); err != nil {
+				fatal("ストリームの起動エラー", "stream", c.name, "error", err)
 			}
-		default:
-			log.Fatalf("サポートされていない入力タイプ: %s。'rtsp', 'rtp', 'server', または 'rtp-server' を使用してください。", inputType)
 		}
 	}
+
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		signalingHandler(w, r)
 	})
+	http.HandleFunc("/ws/mse", mseHandler)
+	http.HandleFunc("GET /stream/{path...}", rawStreamHandler)
+	http.HandleFunc("GET /hls/{path...}", hlsHandler)
+	http.HandleFunc("GET /dash/{path...}", hlsHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	if adminToken != "" {
+		// 実行時に追加するストリームの省略した項目にはコマンドラインフラグの値を使用
+		http.Handle("/api/v1/", newAdminAPI(adminToken, props))
+		slog.Info("管理API (/api/v1) が有効です")
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "prev.html")
 	})
 	// ローカル外部アクセスを許可するため、ListenAndServeのアドレスを 0.0.0.0 から指定IPに変更可能にします
 	addr := "0.0.0.0:" + serverPort
-	log.Printf("サーバーが %s で起動しました", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
-}
+	server := &http.Server{Addr: addr}
+	serverErr := make(chan error, 1)
+	if tlsCert == "" && tlsKey == "" {
+		slog.Info("サーバーが起動しました", "addr", addr)
+		go func() { serverErr <- server.ListenAndServe() }()
+	} else {
+		// HTTPS/WSS (証明書はファイルの変更時に再起動なしで再読み込み)
+		if tlsCert == "" || tlsKey == "" {
+			fatal("HTTPSには -tls-cert と -tls-key の両方を指定する必要があります")
+		}
+		reloader, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			fatal("HTTPS: 証明書の読み込みエラー", "error", err)
+		}
+		var handler http.Handler = http.DefaultServeMux
+		if hstsMaxAge > 0 {
+			handler = withHSTS(handler, hstsMaxAge)
+		}
+		if httpRedirectPort != "" {
+			go startHTTPSRedirect("0.0.0.0:"+httpRedirectPort, serverPort)
+		}
+		server.Handler = handler
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.getCertificate}
+		slog.Info("サーバーが起動しました (HTTPS/WSS)", "addr", addr)
+		go func() { serverErr <- server.ListenAndServeTLS("", "") }()
+	}
 
+	select {
+	case err := <-serverErr:
+		fatal("HTTPサーバーエラー", "error", err)
+	case <-ctx.Done():
+	}
+	stop()
+	slog.Info("終了シグナルを受信しました。入力を停止し、録画中のセグメントを確定して終了します")
+	for _, s := range allStreams() {
+		s.shutdown()
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("HTTPサーバーの終了エラー", "error", err)
+	}
+}
@@ -0,0 +1,954 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4"
+)
+
+// --- メディアファイルの読み込み (file 入力) ---
+//
+// MP4 (通常・fragmented)、Matroska/WebM、MPEG-TS、Annex-B のエレメンタリーストリームから
+// 映像 (H.264/H.265) のアクセスユニットをデコード順に読み込みます。
+
+const mediaFileMaxBoxSize = 256 * 1024 * 1024 // moov などメモリに読み込むボックスの上限
+
+// fileFrame はファイルから読み込んだ1つのアクセスユニットです
+type fileFrame struct {
+	nals [][]byte      // キーフレームの場合はパラメータセットを含む
+	dts  time.Duration // ファイル内のデコード時刻
+}
+
+// mediaFileReader はメディアファイルからアクセスユニットを順に読み込みます
+type mediaFileReader interface {
+	codec() string
+	next() (fileFrame, error) // 末尾では io.EOF を返す
+	close() error
+}
+
+// openMediaFile はファイルの先頭のデータから形式を判別して開きます。
+// Annex-B のコーデックは拡張子 (.h265、.265、.hevc) から判別し、判別できない場合は defaultCodec を使用します。
+func openMediaFile(path, defaultCodec string, fps int) (mediaFileReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, tsPacketSize+1)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var r mediaFileReader
+	switch {
+	case len(head) >= 4 && binary.BigEndian.Uint32(head) == mkvIDEBML:
+		r, err = newMKVFileReader(f)
+	case len(head) >= 8 && isMP4BoxType(string(head[4:8])):
+		r, err = newMP4FileReader(f)
+	case len(head) > tsPacketSize && head[0] == tsSyncByte && head[tsPacketSize] == tsSyncByte:
+		r, err = newTSFileReader(f)
+	case bytes.HasPrefix(head, []byte{0, 0, 1}) || bytes.HasPrefix(head, []byte{0, 0, 0, 1}):
+		codec := defaultCodec
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".h265", ".265", ".hevc":
+			codec = "h265"
+		case ".h264", ".264", ".avc":
+			codec = "h264"
+		}
+		r = newAnnexBFileReader(f, codec, fps)
+	default:
+		err = fmt.Errorf("形式を判別できません (MP4、Matroska/WebM、MPEG-TS、Annex-B に対応しています)")
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// parameterAssembler はアクセスユニット単位で渡されるNALユニットのうち、
+// パラメータセットを含まないキーフレームに直近のパラメータセットを付加します
+type parameterAssembler struct {
+	asm auAssembler
+}
+
+func (p *parameterAssembler) frame(codec string, nals [][]byte) [][]byte {
+	p.asm.push(codec, nals, time.Time{})
+	if !p.asm.hasSlice() {
+		// パラメータセットのみ (MP4などのデコーダー設定) は次のアクセスユニットに含める
+		return nil
+	}
+	return p.asm.finish().nals
+}
+
+// --- Annex-B ---
+
+// annexBFileReader はAnnex-Bのエレメンタリーストリームを読み込みます。
+// タイムスタンプを持たないため、フレームレート fps で時刻を割り当てます。
+type annexBFileReader struct {
+	f       *os.File
+	vcodec  string
+	frame   time.Duration
+	asm     auAssembler
+	buf     []byte
+	chunk   []byte
+	pos     int
+	eof     bool
+	count   int
+	pending []accessUnit
+}
+
+func newAnnexBFileReader(f *os.File, codec string, fps int) *annexBFileReader {
+	if fps <= 0 {
+		fps = 30
+	}
+	return &annexBFileReader{f: f, vcodec: codec, frame: time.Second / time.Duration(fps)}
+}
+
+func (r *annexBFileReader) codec() string { return r.vcodec }
+
+func (r *annexBFileReader) next() (fileFrame, error) {
+	for len(r.pending) == 0 {
+		nal, err := r.readNAL()
+		if err == io.EOF {
+			if !r.asm.hasSlice() {
+				return fileFrame{}, io.EOF
+			}
+			r.pending = append(r.pending, r.asm.finish())
+			break
+		}
+		if err != nil {
+			return fileFrame{}, err
+		}
+		r.pending = r.asm.push(r.vcodec, [][]byte{nal}, time.Time{})
+	}
+	au := r.pending[0]
+	r.pending = r.pending[1:]
+	frame := fileFrame{nals: au.nals, dts: time.Duration(r.count) * r.frame}
+	r.count++
+	return frame, nil
+}
+
+// readNAL は次のスタートコードまでのNALユニットを返します
+func (r *annexBFileReader) readNAL() ([]byte, error) {
+	for {
+		if i := bytes.Index(r.buf[r.pos:], []byte{0, 0, 1}); i >= 0 {
+			nal := r.buf[r.pos : r.pos+i]
+			r.pos += i + 3
+			// 4バイトのスタートコードの先頭の0を取り除く
+			if nal = bytes.TrimRight(nal, "\x00"); len(nal) > 0 {
+				return append([]byte(nil), nal...), nil
+			}
+			continue
+		}
+		if r.eof {
+			nal := bytes.TrimRight(r.buf[r.pos:], "\x00")
+			r.pos = len(r.buf)
+			if len(nal) > 0 {
+				return append([]byte(nil), nal...), nil
+			}
+			return nil, io.EOF
+		}
+		// 読み込み済みのデータを詰めて続きを読み込む (スタートコードをまたぐ2バイトは残る)
+		r.buf = append(r.buf[:0], r.buf[r.pos:]...)
+		r.pos = 0
+		if r.chunk == nil {
+			r.chunk = make([]byte, 256*1024)
+		}
+		n, err := r.f.Read(r.chunk)
+		r.buf = append(r.buf, r.chunk[:n]...)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *annexBFileReader) close() error { return r.f.Close() }
+
+// --- MPEG-TS ---
+
+// tsFileReader はMPEG-TSファイルを tsDemuxer で読み込みます
+type tsFileReader struct {
+	f       *os.File
+	br      *bufio.Reader
+	demux   *tsDemuxer
+	params  parameterAssembler
+	frames  []fileFrame
+	first   int64 // 最初のDTS (90kHz)
+	prev    int64 // 33ビットの一周を展開し、不連続を詰めた直前のDTS
+	prevRaw int64 // 直前のPESのDTS
+	step    int64 // 直前のフレームの間隔
+	started bool
+}
+
+// tsFileMaxGap はPCRの不連続がなくてもタイムスタンプの不連続とみなすDTSの差です (90kHz)
+const tsFileMaxGap = 10 * 90000
+
+func newTSFileReader(f *os.File) (*tsFileReader, error) {
+	r := &tsFileReader{f: f, br: bufio.NewReaderSize(f, 64*1024)}
+	r.demux = newTSDemuxer(r.onAU, func(string, error) {})
+	// PMTを読み込むまで進めてコーデックを判別する
+	for r.demux.codec == "" {
+		if err := r.readPacket(); err != nil {
+			return nil, fmt.Errorf("映像トラックがありません")
+		}
+	}
+	return r, nil
+}
+
+func (r *tsFileReader) onAU(au tsAccessUnit) {
+	if !r.started {
+		r.first, r.prev, r.step, r.started = au.dts, au.dts, 90000/30, true
+	} else {
+		// 33ビットのタイムスタンプの一周を展開する
+		diff := ((au.dts-r.prevRaw)%(1<<33)+(1<<33)+(1<<32))%(1<<33) - (1 << 32)
+		if au.discontinuity || diff < -tsFileMaxGap || diff > tsFileMaxGap {
+			// 連結したファイルなどでタイムスタンプが不連続になった場合は、直前のフレームの次から続ける
+			// (跳んだ時刻のまま配信すると filePacer がその時刻まで待ち続けるため)
+			diff = r.step
+		} else if diff > 0 {
+			r.step = diff
+		}
+		r.prev += diff
+	}
+	r.prevRaw = au.dts
+	nals := r.params.frame(au.codec, au.nals)
+	if nals == nil {
+		return
+	}
+	r.frames = append(r.frames, fileFrame{nals: nals, dts: time.Duration((r.prev - r.first) * int64(time.Second) / 90000)})
+}
+
+func (r *tsFileReader) readPacket() error {
+	pkt, err := r.br.Peek(tsPacketSize)
+	if err != nil {
+		return err
+	}
+	if pkt[0] != tsSyncByte {
+		_, _ = r.br.Discard(1) // 再同期
+		return nil
+	}
+	r.demux.push(pkt)
+	_, _ = r.br.Discard(tsPacketSize)
+	return nil
+}
+
+func (r *tsFileReader) codec() string { return r.demux.codec }
+
+func (r *tsFileReader) next() (fileFrame, error) {
+	for len(r.frames) == 0 {
+		if err := r.readPacket(); err != nil {
+			// 最後のPESは次のPESの開始で取り出されるため、末尾で取り出す
+			if r.demux.pesActive {
+				r.demux.pesActive = false
+				r.demux.flushPES()
+			}
+			if len(r.frames) == 0 {
+				return fileFrame{}, io.EOF
+			}
+		}
+	}
+	frame := r.frames[0]
+	r.frames = r.frames[1:]
+	return frame, nil
+}
+
+func (r *tsFileReader) close() error { return r.f.Close() }
+
+// --- MP4 ---
+
+// isMP4BoxType はファイルの先頭に現れるMP4のボックスかを返します
+func isMP4BoxType(boxType string) bool {
+	switch boxType {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide", "styp", "moof":
+		return true
+	}
+	return false
+}
+
+// walkMP4Boxes は data に含まれるボックスのタイプと中身 (ヘッダーを除く) を順に fn に渡します
+func walkMP4Boxes(data []byte, fn func(boxType string, body []byte) error) error {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return fmt.Errorf("ボックス %s のヘッダーが不完全です", boxType)
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return fmt.Errorf("ボックス %s のサイズが不正です", boxType)
+		}
+		if err := fn(boxType, data[header:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// mp4Sample は通常のMP4のサンプルテーブルの1サンプルです
+type mp4Sample struct {
+	offset int64
+	size   uint32
+	dts    int64
+}
+
+// mp4FileReader はMP4ファイルの最初の映像トラックを読み込みます。
+// 通常のMP4はサンプルテーブル (stbl) から、fragmented MP4 は moof/mdat から読み込みます。
+type mp4FileReader struct {
+	f          *os.File
+	size       int64
+	vcodec     string
+	trackID    int
+	timescale  int64
+	lengthSize int
+	params     parameterAssembler
+	fragmented bool
+
+	samples []mp4Sample // 通常のMP4
+	index   int
+
+	br     *bufio.Reader // fragmented MP4
+	moof   []byte
+	frames []fileFrame
+}
+
+func newMP4FileReader(f *os.File) (*mp4FileReader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := &mp4FileReader{f: f, size: info.Size()}
+	// トップレベルのボックスをたどって moov を探す (mdat は読み込まない)
+	var offset int64
+	var moovEnd int64
+	for moovEnd == 0 {
+		var header [16]byte
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return nil, fmt.Errorf("moov ボックスがありません")
+		}
+		size := int64(binary.BigEndian.Uint32(header[:]))
+		headerSize := int64(8)
+		if size == 1 {
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+		}
+		if size == 0 || size < headerSize {
+			return nil, fmt.Errorf("moov ボックスがありません")
+		}
+		if string(header[4:8]) == "moov" {
+			if size > mediaFileMaxBoxSize {
+				return nil, fmt.Errorf("moov ボックスが大きすぎます")
+			}
+			moov := make([]byte, size-headerSize)
+			if _, err := f.ReadAt(moov, offset+headerSize); err != nil {
+				return nil, err
+			}
+			if err := r.parseMoov(moov); err != nil {
+				return nil, err
+			}
+			moovEnd = offset + size
+		}
+		offset += size
+	}
+	if r.fragmented {
+		if _, err := f.Seek(moovEnd, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r.br = bufio.NewReader(f)
+	}
+	return r, nil
+}
+
+func (r *mp4FileReader) parseMoov(moov []byte) error {
+	err := walkMP4Boxes(moov, func(boxType string, body []byte) error {
+		switch boxType {
+		case "mvex":
+			r.fragmented = true
+		case "trak":
+			if r.vcodec == "" {
+				return r.parseTrak(body)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if r.vcodec == "" {
+		return fmt.Errorf("H.264/H.265の映像トラックがありません")
+	}
+	return nil
+}
+
+// parseTrak は映像トラックであればコーデックとサンプルテーブルを読み込みます
+func (r *mp4FileReader) parseTrak(trak []byte) error {
+	var tkhd, mdhd, hdlr, stbl []byte
+	_ = walkMP4Boxes(trak, func(boxType string, body []byte) error {
+		switch boxType {
+		case "tkhd":
+			tkhd = body
+		case "mdia":
+			return walkMP4Boxes(body, func(boxType string, body []byte) error {
+				switch boxType {
+				case "mdhd":
+					mdhd = body
+				case "hdlr":
+					hdlr = body
+				case "minf":
+					return walkMP4Boxes(body, func(boxType string, body []byte) error {
+						if boxType == "stbl" {
+							stbl = body
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if len(hdlr) < 12 || string(hdlr[8:12]) != "vide" || tkhd == nil || mdhd == nil || stbl == nil {
+		return nil
+	}
+	// tkhd/mdhd はバージョン1の場合に時刻のフィールドが64ビットになる
+	idPos, scalePos := 12, 12
+	if tkhd[0] == 1 {
+		idPos = 20
+	}
+	if mdhd[0] == 1 {
+		scalePos = 20
+	}
+	if len(tkhd) < idPos+4 || len(mdhd) < scalePos+4 {
+		return fmt.Errorf("トラックヘッダーが不完全です")
+	}
+	trackID := int(binary.BigEndian.Uint32(tkhd[idPos:]))
+	timescale := int64(binary.BigEndian.Uint32(mdhd[scalePos:]))
+	if timescale == 0 {
+		return fmt.Errorf("タイムスケールが0です")
+	}
+
+	var stsd, stts, stsc, stsz, stco []byte
+	co64 := false
+	_ = walkMP4Boxes(stbl, func(boxType string, body []byte) error {
+		switch boxType {
+		case "stsd":
+			stsd = body
+		case "stts":
+			stts = body
+		case "stsc":
+			stsc = body
+		case "stsz":
+			stsz = body
+		case "stco":
+			stco = body
+		case "co64":
+			stco, co64 = body, true
+		}
+		return nil
+	})
+	if len(stsd) < 8 {
+		return fmt.Errorf("サンプル記述 (stsd) がありません")
+	}
+	codec, params, lengthSize, err := parseMP4SampleEntry(stsd[8:])
+	if err != nil || codec == "" {
+		return err // H.264/H.265以外の映像トラックは次のトラックを探す
+	}
+	r.vcodec, r.trackID, r.timescale, r.lengthSize = codec, trackID, timescale, lengthSize
+	r.params.frame(codec, params)
+	if r.fragmented {
+		return nil
+	}
+	r.samples, err = buildMP4SampleTable(stts, stsc, stsz, stco, co64, r.size)
+	return err
+}
+
+// parseMP4SampleEntry は最初のサンプルエントリ (avc1/avc3/hvc1/hev1) のデコーダー設定を読み込みます
+func parseMP4SampleEntry(entries []byte) (codec string, params [][]byte, lengthSize int, err error) {
+	var found bool
+	err = walkMP4Boxes(entries, func(boxType string, body []byte) error {
+		if found {
+			return nil
+		}
+		found = true
+		switch boxType {
+		case "avc1", "avc3":
+			codec = "h264"
+		case "hvc1", "hev1":
+			codec = "h265"
+		default:
+			return nil
+		}
+		// VisualSampleEntry の固定長フィールド (78バイト) の後に avcC/hvcC が続く
+		if len(body) < 78 {
+			return fmt.Errorf("サンプルエントリが不完全です")
+		}
+		configType := "avcC"
+		if codec == "h265" {
+			configType = "hvcC"
+		}
+		return walkMP4Boxes(body[78:], func(boxType string, body []byte) error {
+			if boxType != configType {
+				return nil
+			}
+			var err error
+			params, lengthSize, err = parseDecoderConfig(codec, body)
+			return err
+		})
+	})
+	if err == nil && codec != "" && lengthSize == 0 {
+		err = fmt.Errorf("デコーダー設定 (avcC/hvcC) がありません")
+	}
+	return codec, params, lengthSize, err
+}
+
+// buildMP4SampleTable は stts/stsc/stsz/stco からサンプルの位置・サイズ・DTSを求めます。
+// fileSize はファイルの大きさで、サンプル数の妥当性の確認に使用します。
+func buildMP4SampleTable(stts, stsc, stsz, stco []byte, co64 bool, fileSize int64) ([]mp4Sample, error) {
+	if len(stts) < 8 || len(stsc) < 8 || len(stsz) < 12 || len(stco) < 8 {
+		return nil, fmt.Errorf("サンプルテーブルが不完全です")
+	}
+	count := int(binary.BigEndian.Uint32(stsz[8:]))
+	uniform := binary.BigEndian.Uint32(stsz[4:])
+	if uniform == 0 && len(stsz) < 12+4*count {
+		return nil, fmt.Errorf("サンプルサイズ (stsz) が不完全です")
+	}
+	if uniform != 0 && int64(count)*int64(uniform) > fileSize {
+		// サイズが一定の場合はサンプル数がテーブルの大きさに制限されないため、ファイルに収まるかを確認する
+		return nil, fmt.Errorf("サンプル数 (stsz) が不正です")
+	}
+	samples := make([]mp4Sample, count)
+	for i := range samples {
+		samples[i].size = uniform
+		if uniform == 0 {
+			samples[i].size = binary.BigEndian.Uint32(stsz[12+4*i:])
+		}
+	}
+
+	// stts: (サンプル数, 期間) の繰り返し
+	var dts int64
+	i := 0
+	for e := stts[8:]; len(e) >= 8 && i < count; e = e[8:] {
+		n, delta := int(binary.BigEndian.Uint32(e)), int64(binary.BigEndian.Uint32(e[4:]))
+		for ; n > 0 && i < count; n-- {
+			samples[i].dts = dts
+			dts += delta
+			i++
+		}
+	}
+
+	// stco/co64: チャンクのオフセット
+	chunkCount := int(binary.BigEndian.Uint32(stco[4:]))
+	entrySize := 4
+	if co64 {
+		entrySize = 8
+	}
+	if len(stco) < 8+entrySize*chunkCount {
+		return nil, fmt.Errorf("チャンクオフセットが不完全です")
+	}
+	chunkOffset := func(c int) int64 {
+		if co64 {
+			return int64(binary.BigEndian.Uint64(stco[8+8*c:]))
+		}
+		return int64(binary.BigEndian.Uint32(stco[8+4*c:]))
+	}
+
+	// stsc: (最初のチャンク, チャンクあたりのサンプル数, 記述のインデックス) の繰り返し
+	entries := stsc[8:]
+	entryCount := min(int(binary.BigEndian.Uint32(stsc[4:])), len(entries)/12)
+	i = 0
+	for e := 0; e < entryCount && i < count; e++ {
+		first := int(binary.BigEndian.Uint32(entries[12*e:])) - 1
+		perChunk := int(binary.BigEndian.Uint32(entries[12*e+4:]))
+		last := chunkCount
+		if e+1 < entryCount {
+			last = int(binary.BigEndian.Uint32(entries[12*(e+1):])) - 1
+		}
+		for c := max(first, 0); c < last && c < chunkCount && i < count; c++ {
+			offset := chunkOffset(c)
+			for k := 0; k < perChunk && i < count; k++ {
+				samples[i].offset = offset
+				offset += int64(samples[i].size)
+				i++
+			}
+		}
+	}
+	return samples[:i], nil
+}
+
+func (r *mp4FileReader) codec() string { return r.vcodec }
+
+func (r *mp4FileReader) next() (fileFrame, error) {
+	if r.fragmented {
+		return r.nextFragmented()
+	}
+	for r.index < len(r.samples) {
+		sample := r.samples[r.index]
+		r.index++
+		if sample.size > mediaFileMaxBoxSize {
+			return fileFrame{}, fmt.Errorf("サンプルが大きすぎます")
+		}
+		data := make([]byte, sample.size)
+		if _, err := r.f.ReadAt(data, sample.offset); err != nil {
+			return fileFrame{}, err
+		}
+		nals, err := splitLengthPrefixed(data, r.lengthSize)
+		if err != nil {
+			return fileFrame{}, err
+		}
+		if nals = r.params.frame(r.vcodec, nals); nals != nil {
+			return fileFrame{nals: nals, dts: r.duration(sample.dts)}, nil
+		}
+	}
+	return fileFrame{}, io.EOF
+}
+
+func (r *mp4FileReader) duration(ticks int64) time.Duration {
+	return time.Duration(ticks * int64(time.Second) / r.timescale)
+}
+
+func (r *mp4FileReader) nextFragmented() (fileFrame, error) {
+	for len(r.frames) == 0 {
+		boxType, box, err := readMP4Box(r.br)
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF // 途中で切れたフラグメント
+			}
+			return fileFrame{}, err
+		}
+		switch boxType {
+		case "moof":
+			r.moof = box
+		case "mdat":
+			if r.moof == nil {
+				continue
+			}
+			var parts fmp4.Parts
+			err := parts.Unmarshal(append(r.moof, box...))
+			r.moof = nil
+			if err != nil {
+				return fileFrame{}, err
+			}
+			for _, part := range parts {
+				for _, track := range part.Tracks {
+					if track.ID != r.trackID {
+						continue
+					}
+					dts := int64(track.BaseTime)
+					for _, s := range track.Samples {
+						nals, err := splitLengthPrefixed(s.Payload, r.lengthSize)
+						if err != nil {
+							return fileFrame{}, err
+						}
+						if nals = r.params.frame(r.vcodec, nals); nals != nil {
+							r.frames = append(r.frames, fileFrame{nals: nals, dts: r.duration(dts)})
+						}
+						dts += int64(s.Duration)
+					}
+				}
+			}
+		}
+	}
+	frame := r.frames[0]
+	r.frames = r.frames[1:]
+	return frame, nil
+}
+
+func (r *mp4FileReader) close() error { return r.f.Close() }
+
+// --- Matroska / WebM ---
+
+// Matroska のエレメントID
+const (
+	mkvIDEBML           = 0x1A45DFA3
+	mkvIDSegment        = 0x18538067
+	mkvIDInfo           = 0x1549A966
+	mkvIDTimestampScale = 0x2AD7B1
+	mkvIDTracks         = 0x1654AE6B
+	mkvIDTrackEntry     = 0xAE
+	mkvIDTrackNumber    = 0xD7
+	mkvIDTrackType      = 0x83
+	mkvIDCodecID        = 0x86
+	mkvIDCodecPrivate   = 0x63A2
+	mkvIDCluster        = 0x1F43B675
+	mkvIDTimestamp      = 0xE7
+	mkvIDBlockGroup     = 0xA0
+	mkvIDBlock          = 0xA1
+	mkvIDSimpleBlock    = 0xA3
+)
+
+// mkvFileReader はMatroska/WebMファイルの最初のH.264/H.265トラックを先頭から順に読み込みます。
+// Segment・Cluster はサイズによらず子エレメントを順に読むため、サイズ不定 (ライブ録画) のファイルにも対応します。
+type mkvFileReader struct {
+	f          *os.File
+	br         *bufio.Reader
+	vcodec     string
+	track      uint64
+	lengthSize int
+	params     parameterAssembler
+	scale      int64 // タイムスタンプの単位 (ナノ秒)
+	cluster    int64
+	prevDTS    time.Duration
+}
+
+func newMKVFileReader(f *os.File) (*mkvFileReader, error) {
+	r := &mkvFileReader{f: f, br: bufio.NewReaderSize(f, 64*1024), scale: 1000000}
+	// Tracks を読み込むまで進める
+	for r.vcodec == "" {
+		id, data, err := r.readElement()
+		if err != nil {
+			return nil, fmt.Errorf("H.264/H.265の映像トラックがありません")
+		}
+		switch id {
+		case mkvIDTracks:
+			if err := r.parseTracks(data); err != nil {
+				return nil, err
+			}
+		case mkvIDSimpleBlock, mkvIDBlock:
+			return nil, fmt.Errorf("Tracks より前にブロックがあります")
+		}
+	}
+	return r, nil
+}
+
+// readElement は次のエレメントを読み込みます。Segment・Cluster・BlockGroup は中身を読まずに返し、
+// 続けて子エレメントを読み込みます。
+func (r *mkvFileReader) readElement() (uint64, []byte, error) {
+	for {
+		id, err := readEBMLVint(r.br, true)
+		if err != nil {
+			return 0, nil, err
+		}
+		size, err := readEBMLVint(r.br, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch id {
+		case mkvIDSegment, mkvIDCluster, mkvIDBlockGroup:
+			continue
+		case mkvIDEBML, mkvIDInfo, mkvIDTracks, mkvIDTimestamp, mkvIDSimpleBlock, mkvIDBlock:
+		default:
+			// その他のエレメント (SeekHead、Cues、Tags など) は読み飛ばす
+			if size == ebmlUnknownSize {
+				return 0, nil, fmt.Errorf("サイズ不定のエレメント 0x%X には対応していません", id)
+			}
+			if _, err := r.br.Discard(int(size)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if size > mediaFileMaxBoxSize {
+			return 0, nil, fmt.Errorf("エレメント 0x%X が大きすぎます", id)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r.br, data); err != nil {
+			return 0, nil, err
+		}
+		if id == mkvIDInfo {
+			r.parseInfo(data)
+		}
+		return id, data, nil
+	}
+}
+
+func (r *mkvFileReader) parseInfo(data []byte) {
+	_ = walkEBML(data, func(id uint64, body []byte) error {
+		if id == mkvIDTimestampScale {
+			if v := int64(ebmlUint(body)); v > 0 {
+				r.scale = v
+			}
+		}
+		return nil
+	})
+}
+
+func (r *mkvFileReader) parseTracks(data []byte) error {
+	return walkEBML(data, func(id uint64, entry []byte) error {
+		if id != mkvIDTrackEntry || r.vcodec != "" {
+			return nil
+		}
+		var number, trackType uint64
+		var codecID string
+		var private []byte
+		if err := walkEBML(entry, func(id uint64, body []byte) error {
+			switch id {
+			case mkvIDTrackNumber:
+				number = ebmlUint(body)
+			case mkvIDTrackType:
+				trackType = ebmlUint(body)
+			case mkvIDCodecID:
+				codecID = string(bytes.TrimRight(body, "\x00"))
+			case mkvIDCodecPrivate:
+				private = body
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		var codec string
+		switch {
+		case trackType != 1:
+			return nil
+		case codecID == "V_MPEG4/ISO/AVC":
+			codec = "h264"
+		case codecID == "V_MPEGH/ISO/HEVC":
+			codec = "h265"
+		default:
+			return nil
+		}
+		params, lengthSize, err := parseDecoderConfig(codec, private)
+		if err != nil {
+			return fmt.Errorf("CodecPrivate を解析できません: %w", err)
+		}
+		r.vcodec, r.track, r.lengthSize = codec, number, lengthSize
+		r.params.frame(codec, params)
+		return nil
+	})
+}
+
+func (r *mkvFileReader) codec() string { return r.vcodec }
+
+func (r *mkvFileReader) next() (fileFrame, error) {
+	for {
+		id, data, err := r.readElement()
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			return fileFrame{}, err
+		}
+		switch id {
+		case mkvIDTimestamp:
+			r.cluster = int64(ebmlUint(data))
+		case mkvIDSimpleBlock, mkvIDBlock:
+			frame, ok, err := r.parseBlock(data)
+			if err != nil {
+				return fileFrame{}, err
+			}
+			if ok {
+				return frame, nil
+			}
+		}
+	}
+}
+
+// parseBlock は映像トラックのブロックからアクセスユニットを取り出します
+func (r *mkvFileReader) parseBlock(data []byte) (fileFrame, bool, error) {
+	br := bytes.NewReader(data)
+	track, err := readEBMLVint(br, false)
+	if err != nil || track != r.track {
+		return fileFrame{}, false, nil
+	}
+	header := data[len(data)-br.Len():]
+	if len(header) < 3 {
+		return fileFrame{}, false, fmt.Errorf("ブロックが不完全です")
+	}
+	if header[2]&0x06 != 0 {
+		return fileFrame{}, false, fmt.Errorf("レーシングされた映像ブロックには対応していません")
+	}
+	nals, err := splitLengthPrefixed(header[3:], r.lengthSize)
+	if err != nil {
+		return fileFrame{}, false, err
+	}
+	if nals = r.params.frame(r.vcodec, nals); nals == nil {
+		return fileFrame{}, false, nil
+	}
+	// Matroska のタイムスタンプは表示時刻のため、Bフレームを含む場合はデコード順で逆行しないようにする
+	dts := time.Duration((r.cluster + int64(int16(binary.BigEndian.Uint16(header)))) * r.scale)
+	dts = max(dts, r.prevDTS)
+	r.prevDTS = dts
+	return fileFrame{nals: nals, dts: dts}, true, nil
+}
+
+func (r *mkvFileReader) close() error { return r.f.Close() }
+
+const ebmlUnknownSize = ^uint64(0)
+
+// readEBMLVint は可変長整数を読み込みます。keepMarker が true の場合 (エレメントID) は長さを示すビットを残します。
+// サイズがすべて1の場合は ebmlUnknownSize を返します。
+func readEBMLVint(br io.ByteReader, keepMarker bool) (uint64, error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, fmt.Errorf("EBMLの可変長整数が不正です")
+	}
+	value := uint64(first)
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		value = value<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknownSize, nil
+	}
+	return value, nil
+}
+
+// walkEBML は data に含まれるエレメントのIDと中身を順に fn に渡します
+func walkEBML(data []byte, fn func(id uint64, body []byte) error) error {
+	br := bytes.NewReader(data)
+	for br.Len() > 0 {
+		id, err := readEBMLVint(br, true)
+		if err != nil {
+			return err
+		}
+		size, err := readEBMLVint(br, false)
+		if err != nil {
+			return err
+		}
+		if size > uint64(br.Len()) {
+			return fmt.Errorf("エレメント 0x%X のサイズが不正です", id)
+		}
+		start := len(data) - br.Len()
+		if err := fn(id, data[start:start+int(size)]); err != nil {
+			return err
+		}
+		_, _ = br.Seek(int64(size), io.SeekCurrent)
+	}
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4"
+)
+
+// lengthPrefixed はNALユニットを4バイトの長さフィールド付き (AVCC形式) にします
+func lengthPrefixed(nals ...[]byte) []byte {
+	var b []byte
+	for _, nal := range nals {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(nal)))
+		b = append(b, nal...)
+	}
+	return b
+}
+
+// avcC は AVCDecoderConfigurationRecord を作成します
+func avcC(sps, pps []byte) []byte {
+	b := []byte{1, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(sps)))
+	b = append(b, sps...)
+	b = append(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(pps)))
+	return append(b, pps...)
+}
+
+// openTestMediaFile は data を name のファイルに書き込んで開きます
+func openTestMediaFile(t *testing.T, name string, data []byte) (mediaFileReader, error) {
+	t.Helper()
+	r, err := openMediaFile(writeTempFile(t, name, data), "h264", 25)
+	if err == nil {
+		t.Cleanup(func() { r.close() })
+	}
+	return r, err
+}
+
+// readAllFrames は末尾またはエラーまでフレームを読み込みます
+func readAllFrames(r mediaFileReader) ([]fileFrame, error) {
+	var frames []fileFrame
+	for {
+		frame, err := r.next()
+		if errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func frameTimes(frames []fileFrame) []time.Duration {
+	var out []time.Duration
+	for _, f := range frames {
+		out = append(out, f.dts)
+	}
+	return out
+}
+
+// ticks90k は90kHzのタイムスタンプを時間に変換します
+func ticks90k(v ...int64) []time.Duration {
+	out := make([]time.Duration, len(v))
+	for i, t := range v {
+		out[i] = time.Duration(t * int64(time.Second) / 90000)
+	}
+	return out
+}
+
+func TestOpenMediaFileFormats(t *testing.T) {
+	ts := newTSTestWriter()
+	ts.program(tsStreamTypeH264)
+	ts.pes(testVideoPID, tsPES(9000, -1, tsES1))
+	tsNoVideo := newTSTestWriter()
+	tsNoVideo.psi(0, tsSection(0x00, 1, []byte{0, 1, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF}))
+	tsNoVideo.psi(testPMTPID, tsSection(0x02, 1, []byte{0xE1, 0x01, 0xF0, 0, 0x0F, 0xE1, 0x01, 0xF0, 0}))
+
+	tests := []struct {
+		name      string
+		file      string
+		data      []byte
+		wantCodec string
+		wantErr   bool
+	}{
+		{name: "fragmented MP4", file: "a.mp4", data: testFMP4(t, 1), wantCodec: "h264"},
+		{name: "MP4", file: "a.mp4", data: testMP4([][]byte{tsIDR}), wantCodec: "h264"},
+		{name: "Matroska", file: "a.mkv", data: testMKV(testMKVTrack(1, "V_MPEG4/ISO/AVC", avcC(testSPS, testPPS))), wantCodec: "h264"},
+		{name: "MPEG-TS", file: "a.ts", data: bytes.Join(ts.pkts, nil), wantCodec: "h264"},
+		{name: "Annex-B H.265 (拡張子)", file: "a.hevc", data: annexB(h265VPS, h265IDR), wantCodec: "h265"},
+		{name: "Annex-B 3バイトのスタートコード", file: "a.bin", data: append([]byte{0, 0, 1}, h264IDR...), wantCodec: "h264"},
+		{name: "空のファイル", file: "a.mp4", data: nil, wantErr: true},
+		{name: "不明な形式", file: "a.mp4", data: []byte("not a media file"), wantErr: true},
+		{name: "moovのないMP4", file: "a.mp4", data: concat(mp4Box("ftyp", []byte("isom")), mp4Box("mdat", []byte{1, 2, 3})), wantErr: true},
+		{name: "途中で切れたMP4", file: "a.mp4", data: testMP4([][]byte{tsIDR})[:60], wantErr: true},
+		{name: "サイズ0のボックスで終わるMP4", file: "a.mp4", data: concat(mp4Box("ftyp", []byte("isom")), []byte{0, 0, 0, 0}, []byte("mdat")), wantErr: true},
+		{name: "映像のないMPEG-TS", file: "a.ts", data: bytes.Join(tsNoVideo.pkts, nil), wantErr: true},
+		{name: "Tracksのないファイル", file: "a.mkv", data: concat(ebmlElement(mkvIDEBML, nil), ebmlUnknown(mkvIDSegment)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := openTestMediaFile(t, tt.file, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && r.codec() != tt.wantCodec {
+				t.Errorf("codec = %q, want %q", r.codec(), tt.wantCodec)
+			}
+		})
+	}
+}
+
+// --- Annex-B ---
+
+func TestAnnexBFileReader(t *testing.T) {
+	big := append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x11}, 300*1024)...) // 読み込み単位 (256KiB) をまたぐ
+
+	tests := []struct {
+		name  string
+		data  []byte
+		want  [][][]byte
+		times []time.Duration
+	}{
+		{
+			name: "3バイトと4バイトのスタートコード",
+			data: concat(annexB(h264SPS, h264PPS), []byte{0, 0, 1}, h264IDR, annexB(h264P), []byte{0, 0, 1}, h264P2, []byte{0, 0}),
+			want: [][][]byte{{h264SPS, h264PPS, h264IDR}, {h264P}, {h264P2}},
+			// -fps 25
+			times: []time.Duration{0, 40 * time.Millisecond, 80 * time.Millisecond},
+		},
+		{
+			name:  "読み込み単位をまたぐNAL",
+			data:  annexB(h264SPS, h264PPS, big, h264P),
+			want:  [][][]byte{{h264SPS, h264PPS, big}, {h264P}},
+			times: []time.Duration{0, 40 * time.Millisecond},
+		},
+		{
+			name: "連続したスタートコード",
+			data: concat([]byte{0, 0, 0, 1, 0, 0, 1}, h264IDR, []byte{0, 0, 1, 0, 0, 1}, h264P),
+			want: [][][]byte{{h264IDR}, {h264P}},
+			// 末尾のスライスは末尾で出力される
+			times: []time.Duration{0, 40 * time.Millisecond},
+		},
+		{
+			name: "スライスがない",
+			data: annexB(h264SPS, h264PPS),
+		},
+		{
+			name: "スタートコードのみ",
+			data: []byte{0, 0, 0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := openTestMediaFile(t, "a.h264", tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames, err := readAllFrames(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][][]byte
+			for _, f := range frames {
+				got = append(got, f.nals)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("frames = %d, want %d", len(got), len(tt.want))
+			}
+			if times := frameTimes(frames); !reflect.DeepEqual(times, tt.times) {
+				t.Errorf("dts = %v, want %v", times, tt.times)
+			}
+		})
+	}
+}
+
+// --- MPEG-TS ---
+
+func TestTSFileReaderTimestamps(t *testing.T) {
+	type pes struct {
+		dts           int64
+		discontinuity bool
+	}
+	tests := []struct {
+		name  string
+		pes   []pes
+		junk  bool // パケットの間に同期バイトでないデータを挿入する
+		trunc bool // 末尾に途中で切れたパケットを追加する
+		want  []time.Duration
+	}{
+		{
+			name: "連続",
+			pes:  []pes{{1000, false}, {4000, false}, {7000, false}},
+			want: ticks90k(0, 3000, 6000),
+		},
+		{
+			name: "33ビットの一周",
+			pes:  []pes{{1<<33 - 3000, false}, {0, false}, {3000, false}},
+			want: ticks90k(0, 3000, 6000),
+		},
+		{
+			name: "前方への跳躍",
+			pes:  []pes{{0, false}, {3000, false}, {3000 + 20*90000, false}, {6000 + 20*90000, false}},
+			want: ticks90k(0, 3000, 6000, 9000),
+		},
+		{
+			name: "後方への跳躍",
+			pes:  []pes{{900000, false}, {903000, false}, {0, false}, {3000, false}},
+			want: ticks90k(0, 3000, 6000, 9000),
+		},
+		{
+			name: "discontinuity_indicator",
+			pes:  []pes{{0, false}, {3000, false}, {500, true}, {3500, false}},
+			want: ticks90k(0, 3000, 6000, 9000),
+		},
+		{
+			name: "跳躍の後は直前のフレーム間隔で続ける",
+			pes:  []pes{{0, false}, {1500, false}, {3000, false}, {3000 + 20*90000, false}, {4500 + 20*90000, false}},
+			want: ticks90k(0, 1500, 3000, 4500, 6000),
+		},
+		{
+			name: "同期バイトでないデータ",
+			pes:  []pes{{0, false}, {3000, false}, {6000, false}},
+			junk: true,
+			want: ticks90k(0, 3000, 6000),
+		},
+		{
+			name:  "末尾のパケットが途中で切れた",
+			pes:   []pes{{0, false}, {3000, false}},
+			trunc: true,
+			want:  ticks90k(0, 3000),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTSTestWriter()
+			w.program(tsStreamTypeH264)
+			for i, p := range tt.pes {
+				es := tsES2
+				if i == 0 {
+					es = tsES1
+				}
+				if p.discontinuity {
+					w.cc[testVideoPID] = 0
+					w.packet(testVideoPID, true, []byte{0x80}, tsPES(p.dts, -1, es))
+				} else {
+					w.pes(testVideoPID, tsPES(p.dts, -1, es))
+				}
+				if tt.junk {
+					w.pkts = append(w.pkts, []byte{0, 0, 0, 0, 0, 0, 0})
+				}
+			}
+			if tt.trunc {
+				w.pkts = append(w.pkts, w.pkts[len(w.pkts)-1][:100])
+			}
+
+			f, err := os.Open(writeTempFile(t, "a.ts", bytes.Join(w.pkts, nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := newTSFileReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.close()
+			frames, err := readAllFrames(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := frameTimes(frames); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// --- MP4 ---
+
+// testFMP4 は初期化セグメントと、3サンプルのフラグメントを fragments 個含む fragmented MP4 を作成します
+func testFMP4(t *testing.T, fragments int) []byte {
+	t.Helper()
+	data, err := fmp4InitSegment("h264", [][]byte{testSPS, testPPS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < fragments; i++ {
+		var samples []*fmp4.PartSample
+		for k, nal := range [][]byte{tsIDR, tsP, tsP} {
+			sample, err := fmp4Sample(accessUnit{codec: "h264", nals: [][]byte{nal}, key: k == 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sample.Duration = 3000
+			samples = append(samples, sample)
+		}
+		frag, err := fmp4Fragment(uint32(i+1), uint64(i*9000), samples)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, frag...)
+	}
+	return data
+}
+
+func TestFMP4FileReader(t *testing.T) {
+	full := testFMP4(t, 2)
+	one := len(testFMP4(t, 1))
+
+	tests := []struct {
+		name string
+		data []byte
+		want []time.Duration
+	}{
+		{name: "2フラグメント", data: full, want: ticks90k(0, 3000, 6000, 9000, 12000, 15000)},
+		{name: "途中で切れたフラグメント", data: full[:len(full)-10], want: ticks90k(0, 3000, 6000)},
+		{name: "mdatのヘッダーが途中で切れた", data: full[:one+4], want: ticks90k(0, 3000, 6000)},
+		{name: "初期化セグメントのみ", data: full[:one-len(full)+one], want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := openTestMediaFile(t, "a.mp4", tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames, err := readAllFrames(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := frameTimes(frames); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dts = %v, want %v", got, tt.want)
+			}
+			if len(frames) > 0 && !reflect.DeepEqual(frames[0].nals, [][]byte{testSPS, testPPS, tsIDR}) {
+				t.Errorf("最初のフレームにパラメータセットがない: %v", frames[0].nals)
+			}
+		})
+	}
+}
+
+// mp4FullBoxBody はバージョンとフラグ (4バイト) に続く中身を作成します
+func mp4FullBoxBody(fields ...uint32) []byte {
+	b := []byte{0, 0, 0, 0}
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint32(b, f)
+	}
+	return b
+}
+
+// testAVC1 は avcC を含む avc1 サンプルエントリを作成します
+func testAVC1(config []byte) []byte {
+	return mp4Box("avc1", concat(make([]byte, 78), mp4Box("avcC", config)))
+}
+
+// testMP4 は1つのチャンクにサンプルを格納した通常のMP4 (タイムスケール 90kHz、フレーム間隔 3000) を作成します
+func testMP4(nals [][]byte) []byte {
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	var mdat []byte
+	var sizes []uint32
+	for _, nal := range nals {
+		sample := lengthPrefixed(nal)
+		sizes = append(sizes, uint32(len(sample)))
+		mdat = append(mdat, sample...)
+	}
+	moov := func(offset uint32) []byte {
+		stbl := concat(
+			mp4Box("stsd", concat(mp4FullBoxBody(1), testAVC1(avcC(testSPS, testPPS)))),
+			mp4Box("stts", mp4FullBoxBody(1, uint32(len(nals)), 3000)),
+			mp4Box("stsc", mp4FullBoxBody(1, 1, uint32(len(nals)), 1)),
+			mp4Box("stsz", mp4FullBoxBody(append([]uint32{0, uint32(len(nals))}, sizes...)...)),
+			mp4Box("stco", mp4FullBoxBody(1, offset)),
+		)
+		return mp4Box("moov", mp4Box("trak", concat(
+			mp4Box("tkhd", mp4FullBoxBody(0, 0, 1, 0, 0)),
+			mp4Box("mdia", concat(
+				mp4Box("mdhd", mp4FullBoxBody(0, 0, 90000, 0)),
+				mp4Box("hdlr", concat(mp4FullBoxBody(0), []byte("vide"), make([]byte, 13))),
+				mp4Box("minf", mp4Box("stbl", stbl)),
+			)),
+		)))
+	}
+	offset := uint32(len(ftyp) + len(moov(0)) + 8)
+	return concat(ftyp, moov(offset), mp4Box("mdat", mdat))
+}
+
+func TestMP4FileReader(t *testing.T) {
+	data := testMP4([][]byte{tsIDR, tsP, tsP})
+	r, err := openTestMediaFile(t, "a.mp4", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, err := readAllFrames(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := frameTimes(frames), ticks90k(0, 3000, 6000); !reflect.DeepEqual(got, want) {
+		t.Errorf("dts = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(frames[0].nals, [][]byte{testSPS, testPPS, tsIDR}) {
+		t.Errorf("最初のフレームにパラメータセットがない: %v", frames[0].nals)
+	}
+
+	// mdat が途中で切れた場合は読み込めたサンプルまでで終わる
+	r, err = openTestMediaFile(t, "b.mp4", data[:len(data)-5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, err = readAllFrames(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := frameTimes(frames), ticks90k(0, 3000); !reflect.DeepEqual(got, want) {
+		t.Errorf("途中で切れたファイル: dts = %v, want %v", got, want)
+	}
+}
+
+func TestWalkMP4Boxes(t *testing.T) {
+	type box struct {
+		typ  string
+		size int
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []box
+		wantErr bool
+	}{
+		{name: "空", data: nil},
+		{name: "2つのボックス", data: concat(mp4Box("free", []byte{1}), mp4Box("mdat", []byte{1, 2})), want: []box{{"free", 1}, {"mdat", 2}}},
+		{name: "サイズ0は末尾まで", data: concat([]byte{0, 0, 0, 0}, []byte("mdat"), []byte{1, 2, 3}), want: []box{{"mdat", 3}}},
+		{name: "64ビットのサイズ", data: mp4LargeBox("mdat", []byte{1, 2, 3, 4}), want: []box{{"mdat", 4}}},
+		{name: "64ビットのサイズが途中で切れた", data: concat([]byte{0, 0, 0, 1}, []byte("mdat"), []byte{0}), wantErr: true},
+		{name: "ヘッダーより小さいサイズ", data: concat([]byte{0, 0, 0, 4}, []byte("free")), wantErr: true},
+		{name: "データより大きいサイズ", data: concat([]byte{0, 0, 0, 100}, []byte("free")), wantErr: true},
+		{name: "64ビットのサイズがヘッダーより小さい", data: concat([]byte{0, 0, 0, 1}, []byte("mdat"), make([]byte, 8)), wantErr: true},
+		{name: "末尾の8バイト未満は無視", data: concat(mp4Box("free", nil), []byte{0, 0}), want: []box{{"free", 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []box
+			err := walkMP4Boxes(tt.data, func(boxType string, body []byte) error {
+				got = append(got, box{boxType, len(body)})
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMP4SampleEntry(t *testing.T) {
+	hvcC := concat(make([]byte, 21), []byte{0x03, 1, 0x20, 0, 1}, binary.BigEndian.AppendUint16(nil, uint16(len(h265VPS))), h265VPS)
+
+	tests := []struct {
+		name       string
+		entries    []byte
+		wantCodec  string
+		wantParams [][]byte
+		wantErr    bool
+	}{
+		{name: "avc1", entries: testAVC1(avcC(testSPS, testPPS)), wantCodec: "h264", wantParams: [][]byte{testSPS, testPPS}},
+		{name: "hvc1", entries: mp4Box("hvc1", concat(make([]byte, 78), mp4Box("hvcC", hvcC))), wantCodec: "h265", wantParams: [][]byte{h265VPS}},
+		{name: "H.264/H.265以外", entries: mp4Box("mp4v", make([]byte, 78))},
+		{name: "固定長フィールドが途中で切れた", entries: mp4Box("avc1", make([]byte, 40)), wantErr: true},
+		{name: "avcCがない", entries: mp4Box("avc1", make([]byte, 78)), wantErr: true},
+		{name: "avcCが途中で切れた", entries: testAVC1(avcC(testSPS, testPPS)[:10]), wantErr: true},
+		{name: "サンプルエントリのサイズが不正", entries: testAVC1(avcC(testSPS, testPPS))[:50], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, params, _, err := parseMP4SampleEntry(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if codec != tt.wantCodec || !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("got %q %v, want %q %v", codec, params, tt.wantCodec, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestBuildMP4SampleTable(t *testing.T) {
+	stts := mp4FullBoxBody(1, 3, 3000)
+	stsz := mp4FullBoxBody(0, 3, 10, 20, 30)
+	stco := mp4FullBoxBody(2, 100, 200)
+	co64 := concat(mp4FullBoxBody(2), binary.BigEndian.AppendUint64(nil, 1<<32), binary.BigEndian.AppendUint64(nil, 1<<33))
+
+	tests := []struct {
+		name     string
+		stts     []byte
+		stsc     []byte
+		stsz     []byte
+		stco     []byte
+		co64     bool
+		fileSize int64
+		want     []mp4Sample
+		wantErr  bool
+	}{
+		{
+			name: "チャンクあたり2サンプル",
+			stts: stts, stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: stsz, stco: stco,
+			want: []mp4Sample{{100, 10, 0}, {110, 20, 3000}, {200, 30, 6000}},
+		},
+		{
+			name: "複数のstscエントリ",
+			stts: stts, stsc: mp4FullBoxBody(2, 1, 1, 1, 2, 2, 1), stsz: stsz, stco: stco,
+			want: []mp4Sample{{100, 10, 0}, {200, 20, 3000}, {220, 30, 6000}},
+		},
+		{
+			name: "サイズが一定",
+			stts: stts, stsc: mp4FullBoxBody(1, 1, 3, 1), stsz: mp4FullBoxBody(5, 3), stco: stco, fileSize: 1000,
+			want: []mp4Sample{{100, 5, 0}, {105, 5, 3000}, {110, 5, 6000}},
+		},
+		{
+			name: "co64",
+			stts: stts, stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: stsz, stco: co64, co64: true,
+			want: []mp4Sample{{1 << 32, 10, 0}, {1<<32 + 10, 20, 3000}, {1 << 33, 30, 6000}},
+		},
+		{
+			name: "sttsのエントリが複数",
+			stts: mp4FullBoxBody(2, 1, 3000, 2, 1500), stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: stsz, stco: stco,
+			want: []mp4Sample{{100, 10, 0}, {110, 20, 3000}, {200, 30, 4500}},
+		},
+		{
+			name: "チャンクに収まらないサンプルは除く",
+			stts: stts, stsc: mp4FullBoxBody(1, 1, 1, 1), stsz: stsz, stco: stco,
+			want: []mp4Sample{{100, 10, 0}, {200, 20, 3000}},
+		},
+		{
+			name: "stscの最初のチャンクが0",
+			stts: stts, stsc: mp4FullBoxBody(1, 0, 2, 1), stsz: stsz, stco: stco,
+			want: []mp4Sample{{100, 10, 0}, {110, 20, 3000}, {200, 30, 6000}},
+		},
+		{
+			name: "stscのエントリ数がデータより多い",
+			stts: stts, stsc: mp4FullBoxBody(100, 1, 2, 1), stsz: stsz, stco: stco,
+			want: []mp4Sample{{100, 10, 0}, {110, 20, 3000}, {200, 30, 6000}},
+		},
+		{name: "sttsが途中で切れた", stts: stts[:4], stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: stsz, stco: stco, wantErr: true},
+		{name: "stszが途中で切れた", stts: stts, stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: stsz[:len(stsz)-1], stco: stco, wantErr: true},
+		{name: "stcoが途中で切れた", stts: stts, stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: stsz, stco: stco[:len(stco)-1], wantErr: true},
+		{name: "co64が途中で切れた", stts: stts, stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: stsz, stco: stco, co64: true, wantErr: true},
+		{
+			name: "サイズが一定でサンプル数が過大",
+			stts: stts, stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: mp4FullBoxBody(1, 0xFFFFFFFF), stco: stco, fileSize: 1 << 20,
+			wantErr: true,
+		},
+		{
+			name: "サイズが不定でサンプル数が過大",
+			stts: stts, stsc: mp4FullBoxBody(1, 1, 2, 1), stsz: mp4FullBoxBody(0, 0xFFFFFFFF, 1), stco: stco,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildMP4SampleTable(tt.stts, tt.stsc, tt.stsz, tt.stco, tt.co64, tt.fileSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// --- Matroska / WebM ---
+
+// ebmlID はエレメントIDを長さを示すビットを含むバイト列にします
+func ebmlID(id uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, id)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// ebmlElement は8バイトのサイズを持つエレメントを作成します
+func ebmlElement(id uint64, data []byte) []byte {
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(data)))
+	size[0] = 0x01
+	return concat(ebmlID(id), size, data)
+}
+
+// ebmlUnknown はサイズ不定のエレメントのヘッダーを作成します
+func ebmlUnknown(id uint64) []byte {
+	return concat(ebmlID(id), []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+}
+
+func ebmlUintElement(id, v uint64) []byte {
+	return ebmlElement(id, []byte{byte(v >> 8), byte(v)})
+}
+
+func testMKVTrack(trackType uint64, codecID string, private []byte) []byte {
+	return ebmlElement(mkvIDTracks, ebmlElement(mkvIDTrackEntry, concat(
+		ebmlUintElement(mkvIDTrackNumber, 1),
+		ebmlUintElement(mkvIDTrackType, trackType),
+		ebmlElement(mkvIDCodecID, []byte(codecID)),
+		ebmlElement(mkvIDCodecPrivate, private),
+	)))
+}
+
+// testMKVBlock はトラック1のSimpleBlockを作成します
+func testMKVBlock(timecode int16, flags byte, data []byte) []byte {
+	return ebmlElement(mkvIDSimpleBlock, concat([]byte{0x81, byte(uint16(timecode) >> 8), byte(timecode), flags}, data))
+}
+
+// testMKV はサイズ不定のSegmentとClusterを持つMatroskaファイルを作成します (クラスターの時刻は1秒)
+func testMKV(tracks []byte, blocks ...[]byte) []byte {
+	return concat(
+		ebmlElement(mkvIDEBML, ebmlElement(0x4282, []byte("matroska"))),
+		ebmlUnknown(mkvIDSegment),
+		ebmlElement(mkvIDInfo, ebmlUintElement(mkvIDTimestampScale, 1000)), // 1マイクロ秒
+		tracks,
+		ebmlUnknown(mkvIDCluster),
+		ebmlUintElement(mkvIDTimestamp, 1000000/1000),
+		concat(blocks...),
+	)
+}
+
+func TestMKVFileReader(t *testing.T) {
+	tracks := testMKVTrack(1, "V_MPEG4/ISO/AVC", avcC(testSPS, testPPS))
+	idr := testMKVBlock(0, 0x80, lengthPrefixed(tsIDR))
+	p := testMKVBlock(40, 0, lengthPrefixed(tsP))
+	ms := time.Millisecond
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantOpenErr bool
+		want        []time.Duration
+		wantErr     bool
+	}{
+		{name: "正常", data: testMKV(tracks, idr, p), want: []time.Duration{1 * ms, 1*ms + 40*time.Microsecond}},
+		{
+			name: "Bフレームで表示時刻が逆行",
+			data: testMKV(tracks, idr, testMKVBlock(80, 0, lengthPrefixed(tsP)), p),
+			want: []time.Duration{1 * ms, 1*ms + 80*time.Microsecond, 1*ms + 80*time.Microsecond},
+		},
+		{name: "途中で切れたブロック", data: testMKV(tracks, idr, p)[:len(testMKV(tracks, idr, p))-3], want: []time.Duration{1 * ms}},
+		{name: "途中で切れたエレメントID", data: concat(testMKV(tracks, idr), []byte{0x1F}), want: []time.Duration{1 * ms}},
+		{name: "他のトラックのブロックは無視", data: testMKV(tracks, ebmlElement(mkvIDSimpleBlock, []byte{0x82, 0, 0, 0x80, 1}), idr), want: []time.Duration{1 * ms}},
+		{name: "映像トラックがない", data: testMKV(testMKVTrack(2, "A_AAC", nil), idr), wantOpenErr: true},
+		{name: "H.264/H.265以外", data: testMKV(testMKVTrack(1, "V_VP9", nil), idr), wantOpenErr: true},
+		{name: "CodecPrivateが不正", data: testMKV(testMKVTrack(1, "V_MPEG4/ISO/AVC", []byte{1, 2}), idr), wantOpenErr: true},
+		{name: "TrackEntryのサイズが不正", data: testMKV(ebmlElement(mkvIDTracks, concat(ebmlID(mkvIDTrackEntry), []byte{0x90})), idr), wantOpenErr: true},
+		{name: "レーシング", data: testMKV(tracks, testMKVBlock(0, 0x82, lengthPrefixed(tsIDR))), wantErr: true},
+		{name: "ブロックヘッダーが途中で切れた", data: testMKV(tracks, ebmlElement(mkvIDSimpleBlock, []byte{0x81, 0})), wantErr: true},
+		{name: "NALユニットが途中で切れた", data: testMKV(tracks, testMKVBlock(0, 0x80, lengthPrefixed(tsIDR)[:5])), wantErr: true},
+		{name: "サイズ不定の未対応エレメント", data: testMKV(tracks, idr, ebmlUnknown(0x1254C367)), want: []time.Duration{1 * ms}, wantErr: true},
+		{name: "可変長整数が不正", data: testMKV(tracks, idr, []byte{0x00}), want: []time.Duration{1 * ms}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := openTestMediaFile(t, "a.mkv", tt.data)
+			if (err != nil) != tt.wantOpenErr {
+				t.Fatalf("open err = %v, wantOpenErr %v", err, tt.wantOpenErr)
+			}
+			if err != nil {
+				return
+			}
+			frames, err := readAllFrames(r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := frameTimes(frames); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadEBMLVint(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		keepMarker bool
+		want       uint64
+		wantErr    error
+	}{
+		{name: "1バイト", data: []byte{0x81}, want: 1},
+		{name: "2バイト", data: []byte{0x40, 0x02}, want: 2},
+		{name: "8バイト", data: []byte{0x01, 0, 0, 0, 0, 0, 0x01, 0x00}, want: 256},
+		{name: "エレメントID", data: []byte{0x1A, 0x45, 0xDF, 0xA3}, keepMarker: true, want: mkvIDEBML},
+		{name: "サイズ不定 (1バイト)", data: []byte{0xFF}, want: ebmlUnknownSize},
+		{name: "サイズ不定 (8バイト)", data: []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, want: ebmlUnknownSize},
+		{name: "空", data: nil, wantErr: io.EOF},
+		{name: "途中で切れた", data: []byte{0x40}, wantErr: io.ErrUnexpectedEOF},
+		{name: "長さを示すビットがない", data: []byte{0x00, 0x01}, wantErr: errEBMLInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readEBMLVint(bytes.NewReader(tt.data), tt.keepMarker)
+			switch {
+			case tt.wantErr == errEBMLInvalid:
+				if err == nil {
+					t.Fatal("エラーにならない")
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && got != tt.want {
+				t.Errorf("got %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+// errEBMLInvalid はテストで不正な値のエラーを期待することを示します
+var errEBMLInvalid = errors.New("invalid")
+
+func TestWalkEBML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []uint64
+		wantErr bool
+	}{
+		{name: "空", data: nil},
+		{name: "2つのエレメント", data: concat(ebmlUintElement(mkvIDTrackNumber, 1), ebmlElement(mkvIDCodecID, []byte("V"))), want: []uint64{mkvIDTrackNumber, mkvIDCodecID}},
+		{name: "データより大きいサイズ", data: []byte{0xD7, 0x85, 1}, wantErr: true},
+		{name: "サイズ不定", data: ebmlUnknown(mkvIDTrackEntry), wantErr: true},
+		{name: "サイズがない", data: []byte{0xD7}, wantErr: true},
+		{name: "IDが途中で切れた", data: []byte{0x40}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint64
+			err := walkEBML(tt.data, func(id uint64, body []byte) error {
+				got = append(got, id)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
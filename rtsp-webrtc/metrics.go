@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Prometheus メトリクス (/metrics) ---
+
+// counterVec はラベル付きのカウンターです。
+// ホットパスでは with で取得したカウンターを保持して使用します。
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mutex  sync.RWMutex
+	series map[string]*counterSeries // ラベル値を連結したキー -> 系列
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       atomic.Uint64
+}
+
+// counters は /metrics で出力するカウンターの一覧です
+var counters []*counterVec
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, series: make(map[string]*counterSeries)}
+	counters = append(counters, c)
+	return c
+}
+
+// with はラベル値に対応するカウンターを返します (未作成の場合は作成します)
+func (c *counterVec) with(labelValues ...string) *atomic.Uint64 {
+	key := strings.Join(labelValues, "\xff")
+	c.mutex.RLock()
+	sr := c.series[key]
+	c.mutex.RUnlock()
+	if sr != nil {
+		return &sr.value
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if sr = c.series[key]; sr == nil {
+		sr = &counterSeries{labelValues: labelValues}
+		c.series[key] = sr
+	}
+	return &sr.value
+}
+
+// deleteSeries はラベル label の値が value の系列を削除します
+func (c *counterVec) deleteSeries(label, value string) {
+	i := -1
+	for j, l := range c.labels {
+		if l == label {
+			i = j
+		}
+	}
+	if i < 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, sr := range c.series {
+		if sr.labelValues[i] == value {
+			delete(c.series, key)
+		}
+	}
+}
+
+// deleteStreamMetrics は削除したストリームの系列をすべてのカウンターから削除します。
+// ストリーム名はRTSPのPUSHや管理APIで任意に指定されるため、削除しないと系列が増え続けます。
+func deleteStreamMetrics(name string) {
+	if lookupStream(name) != nil {
+		return // 同じ名前で作成し直されたストリームが使用中
+	}
+	for _, c := range counters {
+		c.deleteSeries("stream", name)
+	}
+}
+
+var (
+	rtpPacketsReceived = newCounterVec("rtsp2webrtc_rtp_packets_received_total",
+		"入力から受信したRTPパケット数", "source", "stream")
+	rtpPacketsLost = newCounterVec("rtsp2webrtc_rtp_packets_lost_total",
+		"入力で欠落したRTPパケット数 (シーケンス番号の欠番)", "source", "stream")
+	nalsWritten = newCounterVec("rtsp2webrtc_nals_written_total",
+		"WebRTCトラックへ書き込んだNALユニット数", "stream", "codec")
+	framesWritten = newCounterVec("rtsp2webrtc_frames_written_total",
+		"WebRTCトラックへ書き込んだフレーム数", "stream", "codec")
+	channelDrops = newCounterVec("rtsp2webrtc_channel_drops_total",
+		"処理チャネルが満杯のため破棄したデータ数", "stream", "channel")
+	egressBytes = newCounterVec("rtsp2webrtc_egress_bytes_total",
+		"WebRTC視聴者へ送信した映像のバイト数", "stream")
+)
+
+// RTPパケットの受信元 (source ラベル)
+const (
+	sourceRTPClient  = "rtp-client"
+	sourceRTSPClient = "rtsp-client"
+	sourceRTSPServer = "rtsp-server"
+)
+
+// rtpLossTracker はRTPシーケンス番号の欠番から欠落パケット数を求めます
+type rtpLossTracker struct {
+	initialized bool
+	lastSeq     uint16
+}
+
+// update は受信したパケットのシーケンス番号から、直前のパケットとの間に欠落したパケット数を返します
+func (t *rtpLossTracker) update(seq uint16) uint64 {
+	if !t.initialized {
+		t.initialized = true
+		t.lastSeq = seq
+		return 0
+	}
+	diff := seq - t.lastSeq
+	if diff == 0 || diff >= 0x8000 {
+		// 重複または順序の入れ替わり
+		return 0
+	}
+	t.lastSeq = seq
+	return uint64(diff - 1)
+}
+
+// metricsHandler はPrometheusのテキスト形式でメトリクスを出力します
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range counters {
+		c.write(w)
+	}
+	writeStreamMetrics(w)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mutex.RLock()
+	series := make([]*counterSeries, 0, len(c.series))
+	for _, sr := range c.series {
+		series = append(series, sr)
+	}
+	c.mutex.RUnlock()
+	sort.Slice(series, func(i, j int) bool {
+		return strings.Join(series[i].labelValues, "\xff") < strings.Join(series[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, sr := range series {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, sr.labelValues), sr.value.Load())
+	}
+}
+
+// writeStreamMetrics はストリームと視聴者の現在の状態から求めるメトリクスを出力します
+func writeStreamMetrics(w io.Writer) {
+	list := allStreams()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	type sample struct {
+		labels []string
+		values []string
+		value  string
+	}
+	metrics := []struct {
+		name, help, typ string
+		samples         []sample
+	}{
+		{name: "rtsp2webrtc_ingest_connected", help: "入力が接続中 (直近に映像を受信) か", typ: "gauge"},
+		{name: "rtsp2webrtc_ingest_last_frame_timestamp_seconds", help: "最後に入力から映像を受信した時刻 (UNIX時刻)", typ: "gauge"},
+		{name: "rtsp2webrtc_ingest_bitrate_kbps", help: "直近の入力ビットレート", typ: "gauge"},
+		{name: "rtsp2webrtc_ingest_fps", help: "直近の入力フレームレート", typ: "gauge"},
+		{name: "rtsp2webrtc_ingest_restarts_total", help: "入力パイプライン (ffmpegなど) の再接続・再起動の回数", typ: "counter"},
+		{name: "rtsp2webrtc_viewers", help: "接続中の視聴者数", typ: "gauge"},
+		{name: "rtsp2webrtc_viewer_egress_bytes_total", help: "視聴者ごとに送信した映像のバイト数", typ: "counter"},
+		{name: "rtsp2webrtc_stream_stalled", help: "入力の映像が停止 (ストール) しているか", typ: "gauge"},
+	}
+	for _, s := range list {
+		state, _, restarts := s.ingestStatus()
+		connected := "0"
+		if state == "connected" {
+			connected = "1"
+		}
+		name := []string{"stream"}
+		value := []string{s.name}
+		last := "0"
+		if ns := s.lastIngest.Load(); ns > 0 {
+			last = fmt.Sprintf("%.3f", float64(ns)/float64(time.Second))
+		}
+		metrics[0].samples = append(metrics[0].samples, sample{name, value, connected})
+		metrics[1].samples = append(metrics[1].samples, sample{name, value, last})
+		metrics[2].samples = append(metrics[2].samples, sample{name, value, fmt.Sprint(s.bitrateKbps())})
+		metrics[3].samples = append(metrics[3].samples, sample{name, value, fmt.Sprint(s.fps.Load())})
+		metrics[4].samples = append(metrics[4].samples, sample{name, value, fmt.Sprint(restarts)})
+		stalled := "0"
+		if s.isStalled() {
+			stalled = "1"
+		}
+		metrics[7].samples = append(metrics[7].samples, sample{name, value, stalled})
+
+		sessions := s.viewerSessions()
+		s.mutex.RLock()
+		readers, rawViewers := s.rtspReaders, s.rawViewers
+		s.mutex.RUnlock()
+		byTransport := map[string]int{"webrtc": 0, "mse": 0, "playback": 0}
+		for _, v := range sessions {
+			byTransport[v.transport]++
+		}
+		viewerLabels := []string{"stream", "type"}
+		metrics[5].samples = append(metrics[5].samples,
+			sample{viewerLabels, []string{s.name, "webrtc"}, fmt.Sprint(byTransport["webrtc"])},
+			sample{viewerLabels, []string{s.name, "mse"}, fmt.Sprint(byTransport["mse"])},
+			sample{viewerLabels, []string{s.name, "playback"}, fmt.Sprint(byTransport["playback"])},
+			sample{viewerLabels, []string{s.name, "rtsp"}, fmt.Sprint(readers)},
+			sample{viewerLabels, []string{s.name, "http"}, fmt.Sprint(rawViewers)})
+		for _, v := range sessions {
+			metrics[6].samples = append(metrics[6].samples,
+				sample{[]string{"stream", "viewer"}, []string{s.name, fmt.Sprint(v.id)}, fmt.Sprint(v.egressBytes())})
+		}
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, sm := range m.samples {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(sm.labels, sm.values), sm.value)
+		}
+	}
+}
+
+// formatLabels はラベルを {name="value",...} の形式にします
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		fmt.Fprintf(&b, `%s="%s"`, name, v)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+)
+
+// --- MPEG-TS デマルチプレクサー ---
+//
+// PAT/PMTから最初の番組の映像 (H.264/H.265) のPIDを求め、PESを組み立ててアクセスユニットを取り出します。
+// UDPのように損失や重複のある入力を想定し、連続性カウンターの不連続や伝送エラーのあるPESは破棄します。
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	tsStreamTypeH264 = 0x1B
+	tsStreamTypeH265 = 0x24
+
+	tsMaxPESSize = 8 * 1024 * 1024 // 組み立て中のPESの上限 (壊れた入力でメモリを使い果たさないため)
+)
+
+// tsAccessUnit はPESから取り出した映像のアクセスユニットです
+type tsAccessUnit struct {
+	codec string
+	pts   int64 // 90kHz
+	dts   int64 // 90kHz (PESにDTSがない場合はPTS)
+	pcr   int64 // 直前に受信したPCR (27MHz)。未受信の場合は -1
+	// discontinuity はこのアクセスユニットの前でタイムスタンプが不連続になった
+	// (アダプテーションフィールドの discontinuity_indicator、またはPCRの逆行・跳躍) ことを示します
+	discontinuity bool
+	nals          [][]byte
+}
+
+// tsDemuxer は188バイトのTSパケットを順に受け取り、映像のアクセスユニットを onAU に渡します
+type tsDemuxer struct {
+	onAU    func(au tsAccessUnit)
+	onError func(kind string, err error) // kind は "cc"、"tei"、"crc"、"scrambled"、"pes" のいずれか
+
+	pmtPID   int // -1 は未検出
+	videoPID int // -1 は未検出
+	pcrPID   int
+	codec    string
+	psi      map[int][]byte // 組み立て中のPSIセクション (PIDごと)
+	lastCC   map[int]int
+
+	pes           []byte
+	pesActive     bool // 欠落がなくPESの先頭から組み立て中か
+	pcr           int64
+	discontinuity bool
+}
+
+func newTSDemuxer(onAU func(au tsAccessUnit), onError func(kind string, err error)) *tsDemuxer {
+	return &tsDemuxer{
+		onAU:     onAU,
+		onError:  onError,
+		pmtPID:   -1,
+		videoPID: -1,
+		pcrPID:   -1,
+		psi:      make(map[int][]byte),
+		lastCC:   make(map[int]int),
+		pcr:      -1,
+	}
+}
+
+// push は1つのTSパケットを処理します
+func (d *tsDemuxer) push(pkt []byte) {
+	if len(pkt) != tsPacketSize || pkt[0] != tsSyncByte {
+		return
+	}
+	pid := int(binary.BigEndian.Uint16(pkt[1:3]) & 0x1FFF)
+	if pkt[1]&0x80 != 0 {
+		// transport_error_indicator: 伝送路でのエラー
+		d.onError("tei", fmt.Errorf("PID %d のパケットに伝送エラーがあります", pid))
+		if pid == d.videoPID {
+			d.pesActive = false
+		}
+		return
+	}
+	if pid == 0x1FFF {
+		return // ヌルパケット
+	}
+	pusi := pkt[1]&0x40 != 0
+	afc := pkt[3] >> 4 & 0x03
+	cc := int(pkt[3] & 0x0F)
+
+	payload := pkt[4:]
+	var af []byte
+	if afc&0x02 != 0 {
+		afLen := int(pkt[4])
+		if afLen > tsPacketSize-5 {
+			d.onError("pes", fmt.Errorf("PID %d のアダプテーションフィールドが不正です", pid))
+			return
+		}
+		af = pkt[5 : 5+afLen]
+		payload = pkt[5+afLen:]
+	}
+	if len(af) > 0 && af[0]&0x80 != 0 {
+		// discontinuity_indicator: 連続性カウンターも不連続になる
+		delete(d.lastCC, pid)
+	}
+	if afc&0x01 == 0 {
+		d.readAdaptationField(pid, af)
+		return // ペイロードなし (連続性カウンターは増えない)
+	}
+	if pkt[3]&0xC0 != 0 {
+		d.onError("scrambled", fmt.Errorf("PID %d はスクランブルされています", pid))
+		d.readAdaptationField(pid, af)
+		return
+	}
+
+	if last, ok := d.lastCC[pid]; ok {
+		if cc == last {
+			return // 重複パケット
+		}
+		if cc != (last+1)&0x0F {
+			d.onError("cc", fmt.Errorf("PID %d の連続性カウンターが不連続です (%d → %d)", pid, last, cc))
+			if pid == d.videoPID {
+				d.pesActive = false
+			}
+			delete(d.psi, pid)
+		}
+	}
+	d.lastCC[pid] = cc
+
+	if pid == d.videoPID && pusi && d.pesActive {
+		// このパケットのPCRと不連続は新しいPESに適用するため、直前のPESを先に出力する
+		d.flushPES()
+		d.pesActive = false
+	}
+	d.readAdaptationField(pid, af)
+
+	switch {
+	case pid == 0 || pid == d.pmtPID:
+		d.readPSI(pid, pusi, payload)
+	case pid == d.videoPID:
+		d.readPES(pusi, payload)
+	}
+}
+
+// readAdaptationField はPCRと discontinuity_indicator を取り出します
+func (d *tsDemuxer) readAdaptationField(pid int, af []byte) {
+	if len(af) == 0 {
+		return
+	}
+	if af[0]&0x80 != 0 {
+		d.discontinuity = true
+	}
+	if pid != d.pcrPID || af[0]&0x10 == 0 || len(af) < 7 {
+		return
+	}
+	base := int64(af[1])<<25 | int64(af[2])<<17 | int64(af[3])<<9 | int64(af[4])<<1 | int64(af[5])>>7
+	ext := int64(af[5]&0x01)<<8 | int64(af[6])
+	pcr := base*300 + ext
+	// PCRは100ms以内の間隔で送信されるため、逆行や1秒を超える跳躍は不連続とみなす
+	if d.pcr >= 0 {
+		if diff := pcr - d.pcr; diff < 0 || diff > 27000000 {
+			d.discontinuity = true
+		}
+	}
+	d.pcr = pcr
+}
+
+// readPSI はPATまたはPMTのセクションを組み立てて解析します
+func (d *tsDemuxer) readPSI(pid int, pusi bool, payload []byte) {
+	if pusi {
+		if len(payload) < 1 || int(payload[0]) >= len(payload) {
+			return
+		}
+		payload = payload[1+int(payload[0]):] // pointer_field
+		d.psi[pid] = append(d.psi[pid][:0], payload...)
+	} else if buf, ok := d.psi[pid]; ok && len(buf) > 0 {
+		d.psi[pid] = append(buf, payload...)
+	} else {
+		return
+	}
+	buf := d.psi[pid]
+	if len(buf) < 3 {
+		return
+	}
+	sectionLen := int(binary.BigEndian.Uint16(buf[1:3]) & 0x0FFF)
+	if len(buf) < 3+sectionLen {
+		return
+	}
+	section := buf[:3+sectionLen]
+	d.psi[pid] = buf[:0]
+	if sectionLen < 9 || section[0] == 0xFF {
+		return
+	}
+	if crc32MPEG2(section[:len(section)-4]) != binary.BigEndian.Uint32(section[len(section)-4:]) {
+		d.onError("crc", fmt.Errorf("PID %d のセクションのCRCが一致しません", pid))
+		return
+	}
+	if section[5]&0x01 == 0 {
+		return // current_next_indicator が 0 (次に有効になるテーブル)
+	}
+	body := section[8 : len(section)-4]
+	switch {
+	case pid == 0 && section[0] == 0x00:
+		d.readPAT(body)
+	case pid == d.pmtPID && section[0] == 0x02:
+		d.readPMT(body)
+	}
+}
+
+// readPAT は最初の番組のPMTのPIDを取り出します
+func (d *tsDemuxer) readPAT(body []byte) {
+	for ; len(body) >= 4; body = body[4:] {
+		program := binary.BigEndian.Uint16(body)
+		if program == 0 {
+			continue // ネットワーク情報テーブル
+		}
+		pmtPID := int(binary.BigEndian.Uint16(body[2:]) & 0x1FFF)
+		if pmtPID != d.pmtPID {
+			d.pmtPID = pmtPID
+			delete(d.psi, pmtPID)
+		}
+		return
+	}
+}
+
+// readPMT は最初のH.264/H.265のエレメンタリーストリームのPIDとPCRのPIDを取り出します
+func (d *tsDemuxer) readPMT(body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	pcrPID := int(binary.BigEndian.Uint16(body) & 0x1FFF)
+	infoLen := int(binary.BigEndian.Uint16(body[2:]) & 0x0FFF)
+	if 4+infoLen > len(body) {
+		return
+	}
+	for es := body[4+infoLen:]; len(es) >= 5; {
+		streamType := es[0]
+		pid := int(binary.BigEndian.Uint16(es[1:]) & 0x1FFF)
+		esInfoLen := int(binary.BigEndian.Uint16(es[3:]) & 0x0FFF)
+		if 5+esInfoLen > len(es) {
+			return
+		}
+		es = es[5+esInfoLen:]
+
+		var codec string
+		switch streamType {
+		case tsStreamTypeH264:
+			codec = "h264"
+		case tsStreamTypeH265:
+			codec = "h265"
+		default:
+			continue
+		}
+		if pid != d.videoPID || codec != d.codec {
+			d.videoPID, d.codec = pid, codec
+			d.pes, d.pesActive = nil, false
+		}
+		d.pcrPID = pcrPID
+		return
+	}
+}
+
+// readPES はPESを組み立て、PES_packet_length に達したときにアクセスユニットを取り出します。
+// 長さが0 (無制限) のPESは、次のPESが始まったときに push で取り出します。
+func (d *tsDemuxer) readPES(pusi bool, payload []byte) {
+	if pusi {
+		d.pes, d.pesActive = append(d.pes[:0], payload...), true
+	} else {
+		if !d.pesActive {
+			return // 欠落後は次のPESの先頭まで待つ
+		}
+		if len(d.pes)+len(payload) > tsMaxPESSize {
+			d.onError("pes", fmt.Errorf("PESが大きすぎます"))
+			d.pesActive = false
+			return
+		}
+		d.pes = append(d.pes, payload...)
+	}
+	if len(d.pes) >= 6 {
+		if n := int(binary.BigEndian.Uint16(d.pes[4:6])); n > 0 && len(d.pes) >= 6+n {
+			d.pes = d.pes[:6+n]
+			d.flushPES()
+			d.pesActive = false
+		}
+	}
+}
+
+func (d *tsDemuxer) flushPES() {
+	pes := d.pes
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		d.onError("pes", fmt.Errorf("PESの開始コードがありません"))
+		return
+	}
+	headerLen := int(pes[8])
+	if 9+headerLen > len(pes) {
+		d.onError("pes", fmt.Errorf("PESヘッダーが不完全です"))
+		return
+	}
+	flags := pes[7] >> 6
+	if flags&0x02 == 0 || headerLen < 5 {
+		d.onError("pes", fmt.Errorf("PESにPTSがありません"))
+		return
+	}
+	pts := tsTimestamp(pes[9:14])
+	dts := pts
+	if flags == 0x03 && headerLen >= 10 {
+		dts = tsTimestamp(pes[14:19])
+	}
+
+	var annexb h264.AnnexB
+	if err := annexb.Unmarshal(pes[9+headerLen:]); err != nil {
+		d.onError("pes", fmt.Errorf("PESのペイロードを解析できません: %w", err))
+		return
+	}
+	nals := make([][]byte, 0, len(annexb))
+	for _, nal := range annexb {
+		if isAccessUnitDelimiter(d.codec, nal) {
+			continue
+		}
+		// PESのバッファは再利用するためコピーする
+		nals = append(nals, append([]byte(nil), nal...))
+	}
+	if len(nals) == 0 {
+		return
+	}
+	au := tsAccessUnit{codec: d.codec, pts: pts, dts: dts, pcr: d.pcr, discontinuity: d.discontinuity, nals: nals}
+	d.discontinuity = false
+	d.onAU(au)
+}
+
+// tsTimestamp はPESヘッダーの5バイトのPTS/DTSを取り出します
+func tsTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+func isAccessUnitDelimiter(codec string, nal []byte) bool {
+	if len(nal) == 0 {
+		return false
+	}
+	if codec == "h265" {
+		return nal[0]>>1&0x3F == 35
+	}
+	return nal[0]&0x1F == 9
+}
+
+// crc32MPEG2 はPSIセクションのCRC (CRC-32/MPEG-2) を計算します
+func crc32MPEG2(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, v := range b {
+		crc ^= uint32(v) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
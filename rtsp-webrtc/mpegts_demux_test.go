@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+const (
+	testPMTPID   = 0x1000
+	testVideoPID = 0x100
+)
+
+// tsTestWriter はテスト用のTSパケット列を作成します
+type tsTestWriter struct {
+	cc   map[int]int
+	pkts [][]byte
+}
+
+func newTSTestWriter() *tsTestWriter {
+	return &tsTestWriter{cc: make(map[int]int)}
+}
+
+// packet はアダプテーションフィールドのスタッフィングで188バイトに揃えたパケットを追加します。
+// payload が nil の場合はアダプテーションフィールドのみのパケットになります。
+func (w *tsTestWriter) packet(pid int, pusi bool, af, payload []byte) []byte {
+	pkt := []byte{tsSyncByte, byte(pid>>8) & 0x1F, byte(pid), 0}
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	afc := byte(0)
+	if payload != nil {
+		afc |= 0x01
+		pkt[3] |= byte(w.cc[pid] & 0x0F)
+		w.cc[pid]++
+	}
+	if rest := tsPacketSize - 4 - len(payload); af != nil || rest > 0 {
+		afc |= 0x02
+		if len(af) == 0 && rest > 1 {
+			af = []byte{0x00}
+		}
+		pkt = append(pkt, byte(rest-1))
+		pkt = append(pkt, af...)
+		for len(pkt) < tsPacketSize-len(payload) {
+			pkt = append(pkt, 0xFF)
+		}
+	}
+	pkt[3] |= afc << 4
+	pkt = append(pkt, payload...)
+	w.pkts = append(w.pkts, pkt)
+	return pkt
+}
+
+// psi はセクションを1つのパケットで追加します
+func (w *tsTestWriter) psi(pid int, section []byte) {
+	w.packet(pid, true, nil, append([]byte{0}, section...))
+}
+
+// pes はPESを184バイトごとのパケットに分割して追加します
+func (w *tsTestWriter) pes(pid int, pes []byte) {
+	w.pesAF(pid, nil, pes)
+}
+
+// pesAF は最初のパケットにアダプテーションフィールド af (スタッフィングなし) を付けてPESを追加します
+func (w *tsTestWriter) pesAF(pid int, af, pes []byte) {
+	size := tsPacketSize - 4
+	if af != nil {
+		size -= 1 + len(af)
+	}
+	for first := true; len(pes) > 0 || first; first = false {
+		n := min(len(pes), size)
+		if first {
+			w.packet(pid, true, af, pes[:n])
+		} else {
+			w.packet(pid, false, nil, pes[:n])
+		}
+		pes = pes[n:]
+		size = tsPacketSize - 4
+	}
+}
+
+// program はPATと映像を1つ含むPMTを追加します
+func (w *tsTestWriter) program(streamType byte) {
+	w.psi(0, tsSection(0x00, 1, []byte{0, 1, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF}))
+	w.psi(testPMTPID, tsSection(0x02, 1, []byte{
+		0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0, // PCR_PID、program_info_length
+		0x0F, 0xE1, 0x01, 0xF0, 0, // AAC (無視される)
+		streamType, 0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0,
+	}))
+}
+
+// tsSection はCRC付きのPSIセクションを作成します
+func tsSection(tableID byte, ext uint16, body []byte) []byte {
+	n := 5 + len(body) + 4
+	s := []byte{tableID, 0xB0 | byte(n>>8), byte(n), byte(ext >> 8), byte(ext), 0xC1, 0, 0}
+	s = append(s, body...)
+	return binary.BigEndian.AppendUint32(s, crc32MPEG2(s))
+}
+
+// tsPES はPTS (dts >= 0 の場合はDTSも) を持つ映像のPESを作成します
+func tsPES(pts, dts int64, es []byte) []byte {
+	pes := []byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0x80, 5}
+	if dts >= 0 {
+		pes[7], pes[8] = 0xC0, 10
+		pes = append(pes, tsPTSBytes(0x3, pts)...)
+		pes = append(pes, tsPTSBytes(0x1, dts)...)
+	} else {
+		pes = append(pes, tsPTSBytes(0x2, pts)...)
+	}
+	return append(pes, es...)
+}
+
+func tsPTSBytes(prefix byte, v int64) []byte {
+	return []byte{
+		prefix<<4 | byte(v>>29)&0x0E | 1,
+		byte(v >> 22),
+		byte(v>>14) | 1,
+		byte(v >> 7),
+		byte(v<<1) | 1,
+	}
+}
+
+// tsPCRField はPCRを含むアダプテーションフィールドを作成します
+func tsPCRField(flags byte, pcr int64) []byte {
+	base, ext := pcr/300, pcr%300
+	return []byte{flags | 0x10, byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1), byte(base<<7) | 0x7E | byte(ext>>8), byte(ext)}
+}
+
+var (
+	tsIDR   = []byte{0x65, 0x88, 0x84}
+	tsP     = []byte{0x41, 0x9A, 0x01}
+	tsAUD   = []byte{0x09, 0xF0}
+	tsES1   = annexB(tsAUD, tsIDR)
+	tsES2   = annexB(tsAUD, tsP)
+	tsBigES = annexB(tsIDR, make([]byte, 400))
+)
+
+func annexB(nals ...[]byte) []byte {
+	var b []byte
+	for _, nal := range nals {
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, nal...)
+	}
+	return b
+}
+
+func TestTSDemuxer(t *testing.T) {
+	tests := []struct {
+		name       string
+		build      func(w *tsTestWriter)
+		want       []tsAccessUnit
+		wantErrors []string
+	}{
+		{
+			name: "H.264",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			// 最後のPESは次のPESの開始まで保持される
+			want: []tsAccessUnit{{codec: "h264", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR}}},
+		},
+		{
+			name: "DTS",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(12000, 9000, tsES1))
+				w.pes(testVideoPID, tsPES(15000, 12000, tsES2))
+			},
+			want: []tsAccessUnit{{codec: "h264", pts: 12000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR}}},
+		},
+		{
+			name: "H.265",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH265)
+				w.pes(testVideoPID, tsPES(9000, -1, annexB([]byte{0x46, 0x01, 0x50}, []byte{0x26, 0x01, 0xAF})))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			want: []tsAccessUnit{{codec: "h265", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{{0x26, 0x01, 0xAF}}}},
+		},
+		{
+			name: "複数パケットに分割されたPES",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(9000, -1, tsBigES))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			want: []tsAccessUnit{{codec: "h264", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR, make([]byte, 400)}}},
+		},
+		{
+			name: "PES_packet_length で即座に出力",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				pes := tsPES(9000, -1, tsES1)
+				binary.BigEndian.PutUint16(pes[4:], uint16(len(pes)-6))
+				w.pes(testVideoPID, pes)
+			},
+			want: []tsAccessUnit{{codec: "h264", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR}}},
+		},
+		{
+			name: "PMTの前の映像は無視",
+			build: func(w *tsTestWriter) {
+				w.pes(testVideoPID, tsPES(3000, -1, tsES1))
+				w.pes(testVideoPID, tsPES(6000, -1, tsES1))
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			want: []tsAccessUnit{{codec: "h264", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR}}},
+		},
+		{
+			name: "映像のないPMT",
+			build: func(w *tsTestWriter) {
+				w.psi(0, tsSection(0x00, 1, []byte{0, 1, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF}))
+				w.psi(testPMTPID, tsSection(0x02, 1, []byte{0xE1, 0x01, 0xF0, 0, 0x0F, 0xE1, 0x01, 0xF0, 0}))
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+		},
+		{
+			name: "PATのCRCが不正",
+			build: func(w *tsTestWriter) {
+				pat := tsSection(0x00, 1, []byte{0, 1, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF})
+				pat[len(pat)-1] ^= 0xFF
+				w.psi(0, pat)
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			wantErrors: []string{"crc"},
+		},
+		{
+			name: "途中で切れたPMT",
+			build: func(w *tsTestWriter) {
+				w.psi(0, tsSection(0x00, 1, []byte{0, 1, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF}))
+				// ES_info_length がセクションを超える
+				w.psi(testPMTPID, tsSection(0x02, 1, []byte{0xE1, 0x00, 0xF0, 0, tsStreamTypeH264, 0xE1, 0x00, 0xF0, 0x20}))
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+		},
+		{
+			name: "連続性カウンターの不連続",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				pes := tsPES(9000, -1, tsBigES)
+				w.packet(testVideoPID, true, nil, pes[:184])
+				w.cc[testVideoPID]++ // 1パケット欠落
+				w.packet(testVideoPID, false, nil, pes[184:368])
+				w.pes(testVideoPID, tsPES(12000, -1, tsES1))
+				w.pes(testVideoPID, tsPES(15000, -1, tsES2))
+			},
+			want:       []tsAccessUnit{{codec: "h264", pts: 12000, dts: 12000, pcr: -1, nals: [][]byte{tsIDR}}},
+			wantErrors: []string{"cc"},
+		},
+		{
+			name: "重複パケットは無視",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.pkts = append(w.pkts, w.pkts[len(w.pkts)-1])
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			want: []tsAccessUnit{{codec: "h264", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR}}},
+		},
+		{
+			name: "伝送エラー",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(9000, -1, tsBigES))
+				w.pkts[len(w.pkts)-1][1] |= 0x80 // PESの最後のパケット
+				w.pes(testVideoPID, tsPES(12000, -1, tsES1))
+				w.pes(testVideoPID, tsPES(15000, -1, tsES2))
+			},
+			want:       []tsAccessUnit{{codec: "h264", pts: 12000, dts: 12000, pcr: -1, nals: [][]byte{tsIDR}}},
+			wantErrors: []string{"tei", "cc"},
+		},
+		{
+			name: "スクランブル",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.pkts[len(w.pkts)-1][3] |= 0x80
+			},
+			wantErrors: []string{"scrambled"},
+		},
+		{
+			name: "アダプテーションフィールドの長さが不正",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				pkt := w.packet(testVideoPID, true, nil, tsPES(9000, -1, tsES1))
+				pkt[4] = 184
+			},
+			wantErrors: []string{"pes"},
+		},
+		{
+			name: "途中で切れたパケットと同期バイトのないパケットは無視",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.pkts = append(w.pkts, w.pkts[len(w.pkts)-1][:100])
+				bad := append([]byte(nil), w.pkts[len(w.pkts)-2]...)
+				bad[0] = 0x00
+				w.pkts = append(w.pkts, bad)
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			want: []tsAccessUnit{{codec: "h264", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR}}},
+		},
+		{
+			name: "開始コードのないPES",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				pes := tsPES(9000, -1, tsES1)
+				pes[2] = 0x02
+				w.pes(testVideoPID, pes)
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			wantErrors: []string{"pes"},
+		},
+		{
+			name: "PTSのないPES",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, append([]byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0x00, 0}, tsES1...))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			wantErrors: []string{"pes"},
+		},
+		{
+			name: "PESヘッダーが途中で切れた",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, []byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0x80, 200, 0x21})
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			wantErrors: []string{"pes"},
+		},
+		{
+			name: "discontinuity_indicator",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.pes(testVideoPID, tsPES(9000, -1, tsES1))
+				w.cc[testVideoPID] += 5 // 不連続を示したパケットの連続性カウンターはエラーにしない
+				w.packet(testVideoPID, true, []byte{0x80}, tsPES(90, -1, tsES2))
+				w.pes(testVideoPID, tsPES(3090, -1, tsES2))
+			},
+			want: []tsAccessUnit{
+				{codec: "h264", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR}},
+				{codec: "h264", pts: 90, dts: 90, pcr: -1, discontinuity: true, nals: [][]byte{tsP}},
+			},
+		},
+		{
+			name: "PCRの逆行",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				w.packet(testVideoPID, true, tsPCRField(0, 27000000), tsPES(9000, -1, tsES1))
+				w.packet(testVideoPID, true, tsPCRField(0, 300), tsPES(90, -1, tsES2))
+				w.pes(testVideoPID, tsPES(3090, -1, tsES2))
+			},
+			want: []tsAccessUnit{
+				{codec: "h264", pts: 9000, dts: 9000, pcr: 27000000, nals: [][]byte{tsIDR}},
+				{codec: "h264", pts: 90, dts: 90, pcr: 300, discontinuity: true, nals: [][]byte{tsP}},
+			},
+		},
+		{
+			name: "途中で切れたPCR",
+			build: func(w *tsTestWriter) {
+				w.program(tsStreamTypeH264)
+				// PCR_flag が立っているがアダプテーションフィールドが短い
+				w.pesAF(testVideoPID, tsPCRField(0, 27000000)[:4], tsPES(9000, -1, tsBigES))
+				w.pes(testVideoPID, tsPES(12000, -1, tsES2))
+			},
+			want: []tsAccessUnit{{codec: "h264", pts: 9000, dts: 9000, pcr: -1, nals: [][]byte{tsIDR, make([]byte, 400)}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTSTestWriter()
+			tt.build(w)
+			var got []tsAccessUnit
+			var errs []string
+			d := newTSDemuxer(
+				func(au tsAccessUnit) { got = append(got, au) },
+				func(kind string, err error) { errs = append(errs, kind) },
+			)
+			for _, pkt := range w.pkts {
+				d.push(pkt)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("access units:\ngot  %+v\nwant %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(errs, tt.wantErrors) {
+				t.Errorf("errors = %v, want %v", errs, tt.wantErrors)
+			}
+		})
+	}
+}
+
+func TestCRC32MPEG2(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint32
+	}{
+		{"空", nil, 0xFFFFFFFF},
+		{"チェック値", []byte("123456789"), 0x0376E6E7},
+		{"PAT", []byte{0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00}, 0x2AB104B2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := crc32MPEG2(tt.data); got != tt.want {
+				t.Errorf("crc32MPEG2() = %#08x, want %#08x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTSTimestamp(t *testing.T) {
+	for _, v := range []int64{0, 1, 90000, 1<<32 + 12345, 1<<33 - 1} {
+		if got := tsTimestamp(tsPTSBytes(0x2, v)); got != v {
+			t.Errorf("tsTimestamp(%d) = %d", v, got)
+		}
+	}
+}
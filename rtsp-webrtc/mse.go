@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4"
+	"github.com/gorilla/websocket"
+)
+
+// --- WebSocket経由のfMP4配信 (MSE) ---
+//
+// WebRTCを使用できないブラウザ向けに、アクセスユニットごとのfMP4フラグメント (moof + mdat) を
+// WebSocketのバイナリメッセージで送信します。ブラウザは Media Source Extensions で再生します。
+// テキストメッセージ (JSON) は init (初期化セグメントの前に送信)・status・queued・error です。
+
+const mseQueueSize = 256
+
+// mseInit はMSEの初期化セグメントの前に送信するメッセージです
+type mseInit struct {
+	Type  string `json:"type"` // "init"
+	Codec string `json:"codec"`
+	Mime  string `json:"mime"` // MediaSource.isTypeSupported / addSourceBuffer に渡すMIMEタイプ
+}
+
+// gopSubscription はGOPキャッシュから始まるアクセスユニットの購読です
+type gopSubscription struct {
+	cached []accessUnit // GOPキャッシュの内容 (キーフレームから始まる)
+	since  time.Time    // これより前の時刻のアクセスユニットはGOPキャッシュに含まれている
+	hub    *auHub
+	sub    *auSubscriber
+}
+
+// subscribeWithGOP はGOPキャッシュの内容をアクセスユニットにまとめ、それ以降のアクセスユニットの購読を開始します
+func (s *stream) subscribeWithGOP(queue int, drops *atomic.Uint64) (*gopSubscription, error) {
+	// 入力の書き込みを止めた状態でキャッシュを取り出し、購読を開始する
+	s.mutex.Lock()
+	if s.aus == nil {
+		s.mutex.Unlock()
+		return nil, fmt.Errorf("ストリーム %s は削除されています", s.name)
+	}
+	codec := s.codec
+	cache := s.gopH264
+	if codec == "h265" {
+		cache = s.gopH265
+	}
+	samples := cache.snapshot()
+	g := &gopSubscription{since: time.Now(), hub: s.aus, sub: s.aus.subscribe(queue, drops)}
+	s.mutex.Unlock()
+
+	var asm auAssembler
+	for _, sample := range samples {
+		g.cached = append(g.cached, asm.push(codec, [][]byte{trimStartCode(sample.Data)}, g.since)...)
+	}
+	if asm.hasSlice() {
+		g.cached = append(g.cached, asm.finish())
+	}
+	return g, nil
+}
+
+func (g *gopSubscription) close() {
+	g.hub.unsubscribe(g.sub)
+}
+
+// liveMaxSampleDuration はサンプルの長さの上限です。入力が停止した後に再開した場合に、
+// 最後のフレームを長時間表示し続けてライブから遅れないようにします。
+const liveMaxSampleDuration = time.Second
+
+// liveSampleDuration は連続するアクセスユニットの時刻からサンプルの長さを決めます。
+// GOPキャッシュのアクセスユニットは同じ時刻のため最短の長さになり、早送りでライブに追いつきます。
+func liveSampleDuration(prev, next time.Time) time.Duration {
+	return min(max(next.Sub(prev), gopPrimeDuration), liveMaxSampleDuration)
+}
+
+// startsPicture はアクセスユニットが新しいピクチャの先頭から始まっているかを返します。
+// NALユニットを1つずつ受け取る入力では、GOPキャッシュの最後のピクチャの続きが購読側に届くことがあります。
+func startsPicture(au accessUnit) bool {
+	for _, nal := range au.nals {
+		if isSlice(au.codec, nal) {
+			return isFirstSlice(au.codec, nal)
+		}
+	}
+	return false
+}
+
+// mseMuxer はアクセスユニットを1つずつfMP4フラグメントにします。
+// サンプルの長さは次のアクセスユニットの時刻から決まるため、1フレーム遅れて送信します。
+type mseMuxer struct {
+	send     func(data []byte) error
+	sendInit func(codec string, params [][]byte, init []byte) error
+
+	codec        string
+	hasInit      bool
+	waitKey      bool
+	seq          uint32
+	pending      *fmp4.PartSample
+	pendingTime  time.Time
+	pendingDTS   int64
+	lastDuration int64
+}
+
+func (m *mseMuxer) ticks(d time.Duration) int64 {
+	return int64(d) * fmp4Timescale / int64(time.Second)
+}
+
+func (m *mseMuxer) writeAU(au accessUnit) error {
+	if au.codec != m.codec {
+		// コーデックが変わった場合は初期化セグメントから送り直す (タイムスタンプは継続)
+		if err := m.flushPending(); err != nil {
+			return err
+		}
+		m.codec = au.codec
+		m.hasInit = false
+		m.waitKey = true
+	} else if au.gap {
+		// 欠落したフレームを参照するフレームを送らないよう、次のキーフレームを待つ。
+		// MSEのバッファに空白ができないよう、タイムスタンプは欠落した分を詰める。
+		if err := m.flushPending(); err != nil {
+			return err
+		}
+		m.waitKey = true
+	}
+	if m.waitKey {
+		if !au.key {
+			return nil
+		}
+		m.waitKey = false
+	}
+	if !m.hasInit {
+		init, err := fmp4InitSegment(au.codec, au.nals)
+		if err != nil {
+			m.waitKey = true
+			return nil
+		}
+		if err := m.sendInit(au.codec, au.nals, init); err != nil {
+			return err
+		}
+		m.hasInit = true
+	}
+
+	sample, err := fmp4Sample(au)
+	if err != nil {
+		m.waitKey = true
+		return nil
+	}
+	if m.pending != nil {
+		m.lastDuration = m.ticks(liveSampleDuration(m.pendingTime, au.time))
+		if err := m.sendPending(); err != nil {
+			return err
+		}
+	}
+	m.pending = sample
+	m.pendingTime = au.time
+	return nil
+}
+
+// flushPending は長さが未確定のサンプルを直前のサンプルと同じ長さで送信します
+func (m *mseMuxer) flushPending() error {
+	if m.pending == nil {
+		return nil
+	}
+	if m.lastDuration == 0 {
+		m.lastDuration = fmp4Timescale / 30
+	}
+	return m.sendPending()
+}
+
+func (m *mseMuxer) sendPending() error {
+	m.pending.Duration = uint32(m.lastDuration)
+	m.seq++
+	data, err := fmp4Fragment(m.seq, uint64(m.pendingDTS), []*fmp4.PartSample{m.pending})
+	m.pending = nil
+	m.pendingDTS += m.lastDuration
+	if err != nil {
+		return err
+	}
+	return m.send(data)
+}
+
+// mseHandler は /ws/mse?stream=<ストリーム名> を処理します。
+// 視聴者の認証・上限は signalingHandler と同じで、GOPキャッシュから送信を開始します。
+func mseHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("stream")
+	if name == "" {
+		name = "default"
+	}
+	viewer, ok := authorizeViewer(w, r, name)
+	if !ok {
+		return
+	}
+	s := lookupStream(name)
+	if s == nil {
+		slog.Warn("存在しないストリームへの接続要求", "stream", name, "remote", r.RemoteAddr)
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	logger := s.logger.With("remote", r.RemoteAddr, "transport", "mse")
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("WebSocketアップグレード失敗", "error", err)
+		return
+	}
+	defer ws.Close()
+	// 視聴者からのメッセージは使用しないが、切断を検出するために読み続ける
+	messages, ctx := readMessages(r, ws, logger)
+
+	release, err := admission.admit(ctx, s, viewer.subject, viewerQueueTimeout, func(position int) {
+		_ = ws.WriteJSON(map[string]interface{}{"type": "queued", "position": position})
+	})
+	if err != nil {
+		logger.Warn("視聴者を受け入れられません", "error", err)
+		rejectViewer(ws, s, r, viewer, err)
+		return
+	}
+	defer release()
+
+	session := newViewerSession(viewer, r, ws)
+	session.transport = "mse"
+	egress := new(atomic.Uint64)
+	session.setMSE(s.currentCodec(), egress)
+	logger = logger.With("viewer", session.id)
+	s.addViewer(session)
+	defer s.removeViewer(session)
+	s.addMSEViewer()
+	defer s.removeMSEViewer()
+
+	g, err := s.subscribeWithGOP(mseQueueSize, channelDrops.with(s.name, "mse"))
+	if err != nil {
+		logger.Warn("MSE: 購読を開始できません", "error", err)
+		return
+	}
+	defer g.close()
+	events.publish(event{Type: eventViewerJoined, Stream: s.name, Remote: session.remoteAddr, ViewerID: session.id, Subject: session.subject})
+	defer func() {
+		_, codec := session.peerConnection()
+		events.publish(event{Type: eventViewerLeft, Stream: s.name, Remote: session.remoteAddr, ViewerID: session.id, Subject: session.subject, Codec: codec})
+	}()
+	if s.isStalled() {
+		_ = session.send(streamStatus{Type: "status", State: "stalled"})
+	}
+	logger.Info("WebSocket接続完了 (MSEモード)", "subject", viewer.subject, "input_codec", s.currentCodec(), "cached", len(g.cached))
+
+	m := &mseMuxer{
+		send: func(data []byte) error {
+			if err := session.sendBinary(data); err != nil {
+				return err
+			}
+			egress.Add(uint64(len(data)))
+			s.egress.Add(uint64(len(data)))
+			return nil
+		},
+		sendInit: func(codec string, params [][]byte, init []byte) error {
+			codecs, _, _ := codecParameters(codec, params)
+			session.setMSE(codec, egress)
+			logger.Info("MSE: 初期化セグメントを送信します", "codec", codec)
+			if err := session.send(mseInit{Type: "init", Codec: codec, Mime: fmt.Sprintf("video/mp4; codecs=%q", codecs)}); err != nil {
+				return err
+			}
+			return session.sendBinary(init)
+		},
+	}
+	for _, au := range g.cached {
+		if err := m.writeAU(au); err != nil {
+			logger.Debug("MSE: 送信エラー", "error", err)
+			return
+		}
+	}
+	// 最初の購読のアクセスユニットは gap が true になるが、GOPキャッシュから続いているため無視する
+	first := true
+	for {
+		select {
+		case au, ok := <-g.sub.ch:
+			if !ok {
+				logger.Info("ストリームが削除されたため切断します")
+				_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "stream removed"), time.Now().Add(time.Second))
+				return
+			}
+			if au.time.Before(g.since) {
+				continue
+			}
+			if first {
+				if !startsPicture(au) {
+					continue
+				}
+				first = false
+				if len(g.cached) > 0 && au.codec == m.codec {
+					au.gap = false
+				}
+			}
+			if err := m.writeAU(au); err != nil {
+				logger.Debug("MSE: 送信エラー", "error", err)
+				return
+			}
+		case _, ok := <-messages:
+			if !ok {
+				logger.Info("WebSocket切断")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+)
+
+// validatePipeline は props の入力設定が起動可能な組み合わせかを検証します
+func validatePipeline(p props) error {
+	if p.name == "" {
+		return fmt.Errorf("ストリーム名を指定する必要があります")
+	}
+	if p.inputType != "rtp-server" && p.inputURL == "" {
+		return fmt.Errorf("入力URL（RTSPまたはRTP SDPファイル）を指定する必要があります。現在の入力タイプ: %s", p.inputType)
+	}
+	if p.outputCodec != "h264" && p.outputCodec != "h265" {
+		return fmt.Errorf("サポートされていない出力コーデック: %s。'h264' または 'h265' を使用してください。", p.outputCodec)
+	}
+	if p.codec != "h264" && p.codec != "h265" {
+		return fmt.Errorf("サポートされていないコーデック: %s。'h264' または 'h265' を使用してください。", p.codec)
+	}
+	if p.codec == "h265" && p.processor != "cpu" && p.processor != "gpu" {
+		return fmt.Errorf("H.265のサポートされていないプロセッサ: %s。'cpu' または 'gpu' を使用してください。", p.processor)
+	}
+	switch p.inputType {
+	case "rtsp":
+		if _, err := base.ParseURL(p.inputURL); err != nil {
+			return fmt.Errorf("RTSPの入力URLが不正です (rtsp:// または rtsps:// を指定してください): %v", err)
+		}
+	case "rtp", "rtp-server":
+	case "rtmp-server":
+		if _, _, _, err := parseRTMPListenURL(p.inputURL); err != nil {
+			return err
+		}
+	case "srt":
+		if err := validateSRTURL(p.inputURL); err != nil {
+			return err
+		}
+	case "udp-ts":
+		if _, _, err := parseUDPTSURL(p.inputURL); err != nil {
+			return err
+		}
+	case "file":
+		if err := validateFileInput(p.inputURL); err != nil {
+			return err
+		}
+	case "server":
+		// RTSPサーバーモードはパスごとにストリームを作成するため、個別のストリームとしては定義できない
+		return fmt.Errorf("入力タイプ 'server' はストリーム単位では指定できません。-input-type server で起動してください")
+	default:
+		return fmt.Errorf("サポートされていない入力タイプ: %s。'rtsp', 'rtp', 'server', 'rtp-server', 'rtmp-server', 'srt', 'udp-ts', または 'file' を使用してください。", p.inputType)
+	}
+	if p.onDemand && (p.inputType == "rtp-server" || p.inputType == "rtmp-server" || p.inputType == "srt") {
+		return fmt.Errorf("オンデマンドモードはプル型の入力 (rtsp, rtp, udp-ts, file) のみ対応しています。現在の入力タイプ: %s", p.inputType)
+	}
+	if p.onDemand && (p.record || p.clips) {
+		return fmt.Errorf("オンデマンドモードでは録画できません (視聴者がいない間は入力が停止するため)")
+	}
+	if p.onDemand && p.hls {
+		return fmt.Errorf("オンデマンドモードではHLSを配信できません (HLSの視聴者は入力の開始に数えられないため)")
+	}
+	return nil
+}
+
+// pipelineCodec は入力パイプラインがストリームに配信するコーデックを返します
+func pipelineCodec(p props) string {
+	if p.codec != "h265" {
+		return "h264"
+	}
+	switch p.inputType {
+	case "rtmp-server", "srt", "udp-ts", "file":
+		return "h265" // 受信するまでの既定値。実際のコーデックは受信したストリームから検出
+	case "rtp":
+		if p.useGortsplib {
+			return "h265" // RTPクライアントはパススルーのみ
+		}
+		return p.outputCodec
+	case "rtsp":
+		if p.useGortsplib {
+			return p.outputCodec
+		}
+		return "h264" // ffmpegベースのRTSPはH.264にトランスコード
+	}
+	return "h264"
+}
+
+// waitsForPublisher は入力がパブリッシャーの接続を待ち受ける (RTMPのPUBLISH、SRTのlistener) かを返します
+func waitsForPublisher(inputType, inputURL string) bool {
+	switch inputType {
+	case "rtmp-server":
+		return true
+	case "srt":
+		u, err := url.Parse(inputURL)
+		return err == nil && u.Query().Get("mode") == "listener"
+	}
+	return false
+}
+
+// restartOnStall は映像の停止を検知したときに入力を再起動するかを返します。
+// 接続を待ち受ける入力は再起動してもパブリッシャーが戻るわけではなく、
+// ファイル入力の停止は末尾に達したことを意味するため再起動しません。
+func restartOnStall(inputType, inputURL string) bool {
+	return inputType != "file" && !waitsForPublisher(inputType, inputURL)
+}
+
+// startPipeline は props からストリームを作成してレジストリに登録し、入力パイプラインを設定します。
+// オンデマンドモードの場合、入力は最初の視聴者の接続時に開始されます。
+func startPipeline(p props) (*stream, error) {
+	if err := validatePipeline(p); err != nil {
+		return nil, err
+	}
+	if lookupStream(p.name) != nil {
+		return nil, fmt.Errorf("ストリーム %s は既に存在します", p.name)
+	}
+	// H.265パススルー時にH.264のみ対応の視聴者へ配信するトランスコーダーは processor を使用
+	s := newStream(p.name, p.processor)
+	s.setCodec(pipelineCodec(p))
+	s.maxViewers = p.maxViewers
+	s.inputType = p.inputType
+	s.inputURL = redactedInputURL(p)
+	if p.record {
+		if err := s.startRecording(recording); err != nil {
+			return nil, fmt.Errorf("録画を開始できません: %v", err)
+		}
+	}
+	if p.clips {
+		if err := s.startClipper(clipping); err != nil {
+			s.stopRecording()
+			return nil, fmt.Errorf("クリップ録画を開始できません: %v", err)
+		}
+	}
+	if p.hls {
+		if err := s.startHLS(hlsOutput); err != nil {
+			s.stopRecording()
+			s.stopClipper()
+			return nil, fmt.Errorf("HLS出力を開始できません: %v", err)
+		}
+	}
+	registerStream(s)
+	s.setIngest(func(ctx context.Context) { runPipeline(ctx, s, p) }, p.onDemand, p.onDemandLinger)
+	return s, nil
+}
+
+// runPipeline は props に従って入力パイプラインを実行し、終了するかコンテキストがキャンセルされるまでブロックします
+func runPipeline(ctx context.Context, s *stream, p props) {
+	// RTMP/SRT/UDP-TS/ファイルはエンコード済みのストリームをパススルーするため、-use-gortsplib によらず同じハンドラーを使用
+	switch p.inputType {
+	case "rtmp-server":
+		startRTMPServer(ctx, s, p)
+		return
+	case "srt":
+		startSRTInput(ctx, s, p)
+		return
+	case "udp-ts":
+		startUDPTSInput(ctx, s, p)
+		return
+	case "file":
+		startFileInput(ctx, s, p)
+		return
+	}
+	if p.useGortsplib {
+		s.logger.Info("RTSPパススルーまたはトランスコーディングにgortsplibベースのハンドラーを使用します")
+		switch p.inputType {
+		case "rtp-server":
+			s.logger.Info("RTPサーバーモードで動的SDP受信サーバーを起動します")
+			startRTPServer(ctx, s, p.rtpServerAddr)
+		case "rtp":
+			// RTP入力の場合は既存のRTPクライアントを使用
+			s.logger.Info("RTP入力が検出されました。RTPクライアントを使用します", "codec", p.codec)
+			if p.codec == "h265" {
+				// RTPクライアントはパススルーのみ。H.264のみ対応の視聴者にはストリーム側でトランスコードして配信
+				s.logger.Info("H.265 RTP入力をパススルーします (H.264のみ対応の視聴者にはトランスコードして配信)")
+			}
+			startRTPClient(ctx, s, p.inputURL)
+		default:
+			switch p.codec {
+			case "h264":
+				startGortsplibH264RTSP(ctx, s, p)
+			case "h265":
+				// H.265入力時の出力コーデックに基づいて処理を分岐
+				if p.outputCodec == "h264" {
+					s.logger.Info("gortsplibを使用してH.265をH.264にトランスコードし、WebRTCにストリーミングします")
+					startGortsplibH265toH264RTSP(ctx, s, p)
+				} else {
+					s.logger.Info("gortsplibを使用してH.265をパススルーし、WebRTCにストリーミングします (H.264のみ対応の視聴者にはトランスコードして配信)")
+					startGortsplibH265RTSP(ctx, s, p)
+				}
+			}
+		}
+		return
+	}
+
+	// 既存のffmpegベースのロジック (useGortsplib が false の場合)
+	s.logger.Info("従来のffmpegベースのハンドラーを使用します")
+	if p.inputTLSCA != "" {
+		s.logger.Warn("ffmpegベースのハンドラーでは -input-tls-ca による証明書の検証は行われません")
+	}
+	// ffmpegは認証情報をURLからのみ受け付ける
+	rtspURL := inputURLWithCredentials(p)
+	switch p.inputType {
+	case "rtp-server":
+		s.logger.Info("RTPサーバーモードで動的SDP受信サーバーを起動します")
+		startRTPServer(ctx, s, p.rtpServerAddr)
+	case "rtsp":
+		switch p.codec {
+		case "h264":
+			startFFmpegH264RTSP(ctx, s, rtspURL)
+		case "h265":
+			switch p.processor {
+			case "gpu":
+				startFFmpegH265ToH264NALGPURTSP(ctx, s, rtspURL)
+			case "cpu":
+				startFFmpegH265ToH264NALCPURTSP(ctx, s, rtspURL)
+			}
+		}
+	case "rtp":
+		switch p.codec {
+		case "h264":
+			startFFmpegH264RTP(ctx, s, p.inputURL) // ffmpegベースのH.264 RTP処理
+		case "h265":
+			if p.outputCodec == "h264" {
+				// H.265 -> H.264 トランスコーディング
+				switch p.processor {
+				case "gpu":
+					startFFmpegH265ToH264NALGPURTP(ctx, s, p.inputURL)
+				case "cpu":
+					startFFmpegH265ToH264NALCPURTP(ctx, s, p.inputURL)
+				}
+			} else {
+				// H.265パススルー
+				startFFmpegH265RTP(ctx, s, p.inputURL) // ffmpegベースのH.265 RTPパススルー
+			}
+		}
+	}
+}
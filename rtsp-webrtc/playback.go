@@ -0,0 +1,946 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// --- 録画の再生 ---
+
+const (
+	playbackStatusInterval = time.Second
+	playbackControlQueue   = 16
+	playbackRangeGap       = 2 * time.Second // これより短い間隔のセグメントは連続した範囲として扱う
+	playbackMaxBoxSize     = 256 << 20
+)
+
+var (
+	playbackSessions = newCounterVec("rtsp2webrtc_playback_sessions_total",
+		"録画の再生セッション数", "stream")
+	playbackBytes = newCounterVec("rtsp2webrtc_playback_bytes_total",
+		"録画の再生で送信した映像のバイト数", "stream")
+)
+
+var errPlaybackEnded = errors.New("再生できる録画がありません")
+
+// playbackSpeeds は指定できる再生速度です。8倍以上はキーフレームのみの早送りでのみ指定できます。
+var playbackSpeeds = map[int]bool{1: true, 2: true, 4: true, 8: true, 16: true}
+
+// playbackControl は再生操作のメッセージです (シグナリングとDataChannelで共通)
+type playbackControl struct {
+	Type      string `json:"type"`                // "seek", "pause", "play", "speed"
+	Time      string `json:"time,omitempty"`      // seek: 再生位置 (RFC 3339)
+	Speed     int    `json:"speed,omitempty"`     // speed: 1, 2, 4 (keyframes の場合は 8, 16 も可)
+	Keyframes bool   `json:"keyframes,omitempty"` // speed: キーフレームのみを送信する
+}
+
+// playbackStatus は再生状態の通知です
+type playbackStatus struct {
+	Type      string    `json:"type"`  // "playback"
+	State     string    `json:"state"` // "playing", "paused", "ended"
+	Position  time.Time `json:"position"`
+	Speed     int       `json:"speed"`
+	Keyframes bool      `json:"keyframes"`
+}
+
+// recordingRange は連続して録画されている時間帯です
+type recordingRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// --- 録画セグメントの一覧 ---
+
+// playbackStream は再生する録画のストリームを返します。
+// 登録済みのストリーム、または録画ディレクトリの直下にディレクトリがある (削除済みのストリームの録画) 場合のみ再生でき、
+// "." や ".." で録画ディレクトリ全体や他のストリームの録画を参照することはできません。
+// 削除済みのストリームは、アドミッション制御で視聴者数を数えるための登録されないストリームを返します。
+func playbackStream(cfg recordingConfig, name string) *stream {
+	if name == "" || name == "." || name == ".." {
+		return nil
+	}
+	if s := lookupStream(name); s != nil {
+		return s
+	}
+	dir := cfg.streamDir(name)
+	if filepath.Dir(dir) != filepath.Clean(cfg.dir) {
+		return nil
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil
+	}
+	recordingOnlyMutex.Lock()
+	defer recordingOnlyMutex.Unlock()
+	s := recordingOnlyStreams[name]
+	if s == nil {
+		s = &stream{name: name, logger: slog.With("stream", name), viewers: make(map[*viewerSession]bool)}
+		recordingOnlyStreams[name] = s
+	}
+	return s
+}
+
+// recordingOnlyStreams は録画のみが残っているストリームの再生の視聴者数を数えるためのストリームです
+var (
+	recordingOnlyMutex   sync.Mutex
+	recordingOnlyStreams = make(map[string]*stream)
+)
+
+// recordedSegment は確定済みの録画セグメントです
+type recordedSegment struct {
+	path  string
+	start time.Time // ファイル名の開始時刻 (秒単位)
+	end   time.Time // 最終更新時刻
+}
+
+// listRecordedSegments はストリームの確定済みの録画セグメントを開始時刻順に返します (書き込み中の .part は含まない)
+func listRecordedSegments(cfg recordingConfig, name string) ([]recordedSegment, error) {
+	var segments []recordedSegment
+	err := filepath.WalkDir(cfg.streamDir(name), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		ext := filepath.Ext(path)
+		if d.IsDir() || (ext != ".mp4" && ext != ".ts") {
+			return nil
+		}
+		base := strings.TrimSuffix(d.Name(), ext)
+		if len(base) < 8 {
+			return nil
+		}
+		// <日付>/<時刻>[-n].<拡張子> (openSegment と同じ形式)
+		date := filepath.Base(filepath.Dir(path))
+		start, err := time.ParseInLocation("2006-01-02 15-04-05", date+" "+base[:8], time.Local)
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		segments = append(segments, recordedSegment{path: path, start: start, end: info.ModTime()})
+		return nil
+	})
+	sort.SliceStable(segments, func(i, j int) bool {
+		if segments[i].start.Equal(segments[j].start) {
+			return segments[i].path < segments[j].path
+		}
+		return segments[i].start.Before(segments[j].start)
+	})
+	return segments, err
+}
+
+// recordingRanges は隣接するセグメントをまとめた録画の時間帯を返します
+func recordingRanges(segments []recordedSegment) []recordingRange {
+	var ranges []recordingRange
+	for _, seg := range segments {
+		if n := len(ranges); n > 0 && !seg.start.After(ranges[n-1].End.Add(playbackRangeGap)) {
+			if seg.end.After(ranges[n-1].End) {
+				ranges[n-1].End = seg.end
+			}
+			continue
+		}
+		ranges = append(ranges, recordingRange{Start: seg.start, End: seg.end})
+	}
+	return ranges
+}
+
+// --- 録画セグメントの読み込み ---
+
+// playbackSample は再生する1フレームです
+type playbackSample struct {
+	data     []byte // Annex-B形式 (キーフレームはパラメータセットを含む)
+	time     time.Time
+	duration time.Duration
+	key      bool
+}
+
+// segmentReader は録画セグメントからフレームを順に読み込みます
+type segmentReader interface {
+	codec() string
+	next() (playbackSample, error) // 末尾では io.EOF を返す
+	close() error
+}
+
+func openSegmentReader(seg recordedSegment) (segmentReader, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	var r segmentReader
+	if filepath.Ext(seg.path) == ".ts" {
+		r, err = newTSReader(f, seg.start)
+	} else {
+		r, err = newFMP4Reader(f, seg.start)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", seg.path, err)
+	}
+	return r, nil
+}
+
+// annexBSample はアクセスユニットをAnnex-B形式に変換します。
+// キーフレームにパラメータセットが含まれない場合は params を先頭に付加します。
+func annexBSample(codec string, nals, params [][]byte) ([]byte, bool, error) {
+	key, hasParams := false, false
+	for _, nal := range nals {
+		_, k, param, _ := classifyNAL(codec, nal)
+		if param {
+			hasParams = true
+		} else if k {
+			key = true
+		}
+	}
+	if key && !hasParams {
+		nals = append(append([][]byte(nil), params...), nals...)
+	}
+	data, err := h264.AnnexB(nals).Marshal()
+	return data, key, err
+}
+
+// fmp4Reader は fragmented MP4 のセグメントをフラグメント単位で読み込みます
+type fmp4Reader struct {
+	f       *os.File
+	br      *bufio.Reader
+	start   time.Time
+	vcodec  string
+	params  [][]byte
+	moof    []byte
+	samples []playbackSample
+}
+
+func newFMP4Reader(f *os.File, start time.Time) (*fmp4Reader, error) {
+	r := &fmp4Reader{f: f, br: bufio.NewReader(f), start: start}
+	var head []byte
+	for {
+		boxType, box, err := readMP4Box(r.br)
+		if err != nil {
+			return nil, fmt.Errorf("初期化セグメントの読み込みエラー: %w", err)
+		}
+		head = append(head, box...)
+		if boxType == "moov" {
+			break
+		}
+	}
+	var init fmp4.Init
+	if err := init.Unmarshal(bytes.NewReader(head)); err != nil {
+		return nil, err
+	}
+	if len(init.Tracks) == 0 {
+		return nil, fmt.Errorf("トラックがありません")
+	}
+	switch c := init.Tracks[0].Codec.(type) {
+	case *fmp4.CodecH264:
+		r.vcodec = "h264"
+		r.params = [][]byte{c.SPS, c.PPS}
+	case *fmp4.CodecH265:
+		r.vcodec = "h265"
+		r.params = [][]byte{c.VPS, c.SPS, c.PPS}
+	default:
+		return nil, fmt.Errorf("未対応のコーデック: %T", c)
+	}
+	return r, nil
+}
+
+// readMP4Box はボックスを1つ (ヘッダーを含めて) 読み込みます
+func readMP4Box(br *bufio.Reader) (string, []byte, error) {
+	header, err := br.Peek(8)
+	if err != nil {
+		return "", nil, err
+	}
+	size := uint64(binary.BigEndian.Uint32(header[:4]))
+	boxType := string(header[4:8])
+	if size == 1 {
+		if header, err = br.Peek(16); err != nil {
+			return "", nil, err
+		}
+		size = binary.BigEndian.Uint64(header[8:16])
+	}
+	if size < 8 || size > playbackMaxBoxSize {
+		return "", nil, fmt.Errorf("無効なボックスサイズ: %s %d", boxType, size)
+	}
+	box := make([]byte, size)
+	if _, err := io.ReadFull(br, box); err != nil {
+		return "", nil, err
+	}
+	return boxType, box, nil
+}
+
+func (r *fmp4Reader) codec() string { return r.vcodec }
+
+func (r *fmp4Reader) next() (playbackSample, error) {
+	for len(r.samples) == 0 {
+		boxType, box, err := readMP4Box(r.br)
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF // 途中で切れたフラグメント
+			}
+			return playbackSample{}, err
+		}
+		switch boxType {
+		case "moof":
+			r.moof = box
+		case "mdat":
+			if r.moof == nil {
+				continue
+			}
+			err := r.parseFragment(append(r.moof, box...))
+			r.moof = nil
+			if err != nil {
+				return playbackSample{}, err
+			}
+		}
+	}
+	sample := r.samples[0]
+	r.samples = r.samples[1:]
+	return sample, nil
+}
+
+func (r *fmp4Reader) parseFragment(fragment []byte) error {
+	var parts fmp4.Parts
+	if err := parts.Unmarshal(fragment); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		for _, track := range part.Tracks {
+			dts := track.BaseTime
+			for _, s := range track.Samples {
+				var nals h264.AVCC
+				if err := nals.Unmarshal(s.Payload); err != nil {
+					return err
+				}
+				data, _, err := annexBSample(r.vcodec, nals, r.params)
+				if err != nil {
+					return err
+				}
+				r.samples = append(r.samples, playbackSample{
+					data:     data,
+					time:     r.start.Add(ticksToDuration(int64(dts))),
+					duration: ticksToDuration(int64(s.Duration)),
+					key:      !s.IsNonSyncSample,
+				})
+				dts += uint64(s.Duration)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *fmp4Reader) close() error { return r.f.Close() }
+
+// tsReader はMPEG-TSのセグメントを読み込みます。
+// フレームの長さは次のフレームとのDTSの差から求めます (最後のフレームは直前のフレームと同じ長さ)。
+type tsReader struct {
+	f       *os.File
+	r       *mpegts.Reader
+	start   time.Time
+	vcodec  string
+	pending *playbackSample
+	lastDTS int64
+	samples []playbackSample
+	err     error
+}
+
+func newTSReader(f *os.File, start time.Time) (*tsReader, error) {
+	r := &tsReader{f: f, start: start, r: &mpegts.Reader{R: bufio.NewReader(f)}}
+	if err := r.r.Initialize(); err != nil {
+		return nil, err
+	}
+	r.r.OnDecodeError(func(err error) {
+		slog.Debug("録画の再生: MPEG-TSのデコードエラー", "file", f.Name(), "error", err)
+	})
+	for _, track := range r.r.Tracks() {
+		switch track.Codec.(type) {
+		case *mpegts.CodecH264:
+			r.vcodec = "h264"
+			r.r.OnDataH264(track, r.onAU)
+		case *mpegts.CodecH265:
+			r.vcodec = "h265"
+			r.r.OnDataH265(track, r.onAU)
+		default:
+			continue
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("映像トラックがありません")
+}
+
+func (r *tsReader) onAU(_ int64, dts int64, au [][]byte) error {
+	data, key, err := annexBSample(r.vcodec, au, nil)
+	if err != nil {
+		return err
+	}
+	if r.pending != nil {
+		r.pending.duration = ticksToDuration(dts - r.lastDTS)
+		r.samples = append(r.samples, *r.pending)
+	}
+	r.pending = &playbackSample{data: data, time: r.start.Add(ticksToDuration(dts - tsTimeOffset)), key: key}
+	r.lastDTS = dts
+	return nil
+}
+
+func (r *tsReader) codec() string { return r.vcodec }
+
+func (r *tsReader) next() (playbackSample, error) {
+	for len(r.samples) == 0 {
+		if r.err != nil {
+			return playbackSample{}, r.err
+		}
+		if err := r.r.Read(); err != nil {
+			// ファイルの末尾 (または途中で切れたパケット)
+			r.err = io.EOF
+			if r.pending != nil {
+				r.pending.duration = r.lastDuration()
+				r.samples = append(r.samples, *r.pending)
+				r.pending = nil
+			}
+		}
+	}
+	sample := r.samples[0]
+	r.samples = r.samples[1:]
+	return sample, nil
+}
+
+func (r *tsReader) lastDuration() time.Duration {
+	if n := len(r.samples); n > 0 {
+		return r.samples[n-1].duration
+	}
+	return 0
+}
+
+func (r *tsReader) close() error { return r.f.Close() }
+
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / fmp4Timescale
+}
+
+// --- プレーヤー ---
+
+// player は録画セグメントを読み込み、タイムスタンプに合わせてWebRTCトラックへ送信します。
+// 再生状態はすべて run のゴルーチンで管理し、操作は controls で受け取ります。
+type player struct {
+	name     string
+	logger   *slog.Logger
+	controls chan playbackControl
+	notify   func(msg interface{})
+
+	egress   *atomic.Uint64 // ストリーム全体の送信バイト数 (録画のみのストリームの場合は nil)
+	sent     *atomic.Uint64 // この再生セッションの送信バイト数 (管理API用)
+	segments []recordedSegment
+	index    int
+	reader   segmentReader
+	codec    string           // 再生中のコーデック (トラックのコーデック)
+	queue    []playbackSample // シーク位置のGOPなど、読み込み済みで未送信のフレーム
+
+	paused    bool
+	ended     bool
+	speed     int
+	keyframes bool
+	position  time.Time
+}
+
+func newPlayer(name string, logger *slog.Logger, segments []recordedSegment, notify func(msg interface{})) *player {
+	return &player{
+		name:     name,
+		logger:   logger,
+		controls: make(chan playbackControl, playbackControlQueue),
+		notify:   notify,
+		segments: segments,
+		speed:    1,
+	}
+}
+
+// control は再生操作を受け付けます。キューが満杯の場合は破棄します。
+func (p *player) control(c playbackControl) {
+	select {
+	case p.controls <- c:
+	default:
+		p.logger.Warn("録画の再生: 操作のキューが満杯のため破棄しました", "type", c.Type)
+	}
+}
+
+// seek は target を含むGOPの先頭 (target 以前の直近のキーフレーム) に再生位置を移動します
+func (p *player) seek(target time.Time) error {
+	p.closeReader()
+	p.queue = nil
+	idx := 0
+	for i, seg := range p.segments {
+		if !seg.start.After(target) {
+			idx = i
+		}
+	}
+	if idx+1 < len(p.segments) && target.After(p.segments[idx].end) {
+		idx++ // 録画されていない時間帯の場合は次のセグメントから
+	}
+	if err := p.openFrom(idx); err != nil {
+		return err
+	}
+	var gop []playbackSample
+	for {
+		s, err := p.reader.next()
+		if err != nil {
+			break // 末尾の場合は最後のGOPから再生
+		}
+		if s.key && (len(gop) == 0 || !s.time.After(target)) {
+			gop = []playbackSample{s}
+		} else if len(gop) > 0 {
+			gop = append(gop, s)
+		}
+		if len(gop) > 0 && !s.time.Before(target) {
+			break
+		}
+	}
+	p.queue = gop
+	p.ended = false
+	if len(gop) > 0 {
+		p.position = gop[0].time
+	}
+	return nil
+}
+
+// openFrom は idx 以降で最初に読み込めるセグメントを開きます。
+// コーデックが再生中のものと異なるセグメントはWebRTCトラックで送信できないため読み飛ばします。
+func (p *player) openFrom(idx int) error {
+	for ; idx < len(p.segments); idx++ {
+		r, err := openSegmentReader(p.segments[idx])
+		if err != nil {
+			p.logger.Warn("録画の再生: セグメントを開けません", "error", err)
+			continue
+		}
+		if p.codec != "" && r.codec() != p.codec {
+			p.logger.Warn("録画の再生: コーデックが異なるセグメントを読み飛ばします", "file", p.segments[idx].path, "codec", r.codec())
+			r.close()
+			continue
+		}
+		p.codec = r.codec()
+		p.reader = r
+		p.index = idx
+		return nil
+	}
+	return errPlaybackEnded
+}
+
+func (p *player) closeReader() {
+	if p.reader != nil {
+		p.reader.close()
+		p.reader = nil
+	}
+}
+
+// read は次に送信するフレームを返します。セグメントの末尾では録画の一覧を更新して次のセグメントに進みます。
+func (p *player) read() (playbackSample, error) {
+	if len(p.queue) > 0 {
+		s := p.queue[0]
+		p.queue = p.queue[1:]
+		return s, nil
+	}
+	for p.reader != nil {
+		s, err := p.reader.next()
+		if err == nil {
+			return s, nil
+		}
+		if err != io.EOF {
+			p.logger.Warn("録画の再生: セグメントの読み込みエラー", "file", p.segments[p.index].path, "error", err)
+		}
+		p.closeReader()
+		current := p.segments[p.index]
+		// 再生中に確定したセグメントを追加
+		if segments, err := listRecordedSegments(recording, p.name); err == nil {
+			p.segments = segments
+		}
+		next := len(p.segments)
+		for i, seg := range p.segments {
+			if seg.start.After(current.start) || (seg.start.Equal(current.start) && seg.path > current.path) {
+				next = i
+				break
+			}
+		}
+		if err := p.openFrom(next); err != nil {
+			return playbackSample{}, err
+		}
+	}
+	return playbackSample{}, errPlaybackEnded
+}
+
+func (p *player) status() playbackStatus {
+	state := "playing"
+	if p.ended {
+		state = "ended"
+	} else if p.paused {
+		state = "paused"
+	}
+	return playbackStatus{Type: "playback", State: state, Position: p.position, Speed: p.speed, Keyframes: p.keyframes}
+}
+
+// run は接続の完了 (connected) 後に再生を開始し、done が閉じられるまで再生操作を処理します
+func (p *player) run(track *webrtc.TrackLocalStaticSample, connected, done <-chan struct{}) {
+	defer p.closeReader()
+	select {
+	case <-connected:
+	case <-done:
+		return
+	}
+	bytesSent := playbackBytes.with(p.name)
+	send := func(s playbackSample, duration time.Duration) {
+		if err := track.WriteSample(media.Sample{Data: s.data, Duration: duration}); err == nil {
+			bytesSent.Add(uint64(len(s.data)))
+			if p.egress != nil {
+				p.egress.Add(uint64(len(s.data)))
+			}
+			if p.sent != nil {
+				p.sent.Add(uint64(len(s.data)))
+			}
+		}
+		p.position = s.time
+	}
+
+	// anchor の時刻から elapsed (録画上の経過時間) の 1/speed が経過したときにフレームを送信する
+	anchor := time.Now()
+	var elapsed, sentAt time.Duration
+	reanchor := func() {
+		anchor = time.Now()
+		elapsed, sentAt = 0, 0
+	}
+	var next *playbackSample
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	ticker := time.NewTicker(playbackStatusInterval)
+	defer ticker.Stop()
+	p.notify(p.status())
+
+	for {
+		for next == nil && !p.paused && !p.ended {
+			s, err := p.read()
+			if err != nil {
+				p.ended = true
+				p.logger.Info("録画の再生: 録画の末尾に達しました", "position", p.position)
+				p.notify(p.status())
+				break
+			}
+			if p.keyframes && !s.key {
+				elapsed += s.duration
+				continue
+			}
+			next = &s
+		}
+		var due <-chan time.Time
+		if next != nil && !p.paused {
+			timer.Reset(time.Until(anchor.Add(elapsed / time.Duration(p.speed))))
+			due = timer.C
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !p.paused && !p.ended {
+				p.notify(p.status())
+			}
+		case <-due:
+			duration := next.duration
+			if p.keyframes {
+				duration = elapsed - sentAt // 直前に送信したキーフレームからの経過時間
+			}
+			send(*next, duration/time.Duration(p.speed))
+			sentAt = elapsed
+			elapsed += next.duration
+			next = nil
+		case c := <-p.controls:
+			switch c.Type {
+			case "pause":
+				p.paused = true
+			case "play":
+				p.paused = false
+				reanchor()
+			case "speed":
+				if !playbackSpeeds[c.Speed] || (c.Speed > 4 && !c.Keyframes) {
+					p.notify(map[string]interface{}{"type": "error", "code": "invalid_speed", "message": "speed must be 1, 2 or 4 (8 or 16 with keyframes)"})
+					continue
+				}
+				p.speed = c.Speed
+				p.keyframes = c.Keyframes
+				if p.keyframes && next != nil && !next.key {
+					next = nil
+				}
+				reanchor()
+			case "seek":
+				target, err := time.Parse(time.RFC3339, c.Time)
+				if err != nil {
+					p.notify(map[string]interface{}{"type": "error", "code": "invalid_time", "message": "time must be RFC 3339"})
+					continue
+				}
+				next = nil
+				if err := p.seek(target); err != nil {
+					p.ended = true
+				} else if p.paused && len(p.queue) > 0 {
+					// 一時停止中はシーク位置のキーフレームだけを表示
+					s := p.queue[0]
+					p.queue = p.queue[1:]
+					send(s, 0)
+				}
+				p.logger.Info("録画の再生: シークしました", "target", target, "position", p.position)
+				reanchor()
+			default:
+				continue
+			}
+			p.notify(p.status())
+		}
+	}
+}
+
+// --- 再生用のシグナリング ---
+
+// playbackHandler は録画の再生セッションのシグナリングを処理します (/ws?stream=<name>&playback=<開始時刻>)。
+// 再生操作はシグナリングのメッセージ、または視聴者が作成したDataChannelで受け付けます。
+func playbackHandler(w http.ResponseWriter, r *http.Request, name string, viewer viewerIdentity) {
+	logger := slog.Default().With("stream", name, "remote", r.RemoteAddr, "component", "playback")
+	s := playbackStream(recording, name)
+	if s == nil {
+		logger.Warn("録画の再生: ストリームが見つかりません")
+		http.Error(w, "recordings not found", http.StatusNotFound)
+		return
+	}
+	segments, err := listRecordedSegments(recording, name)
+	if err != nil || len(segments) == 0 {
+		logger.Warn("録画の再生: 録画がありません", "error", err)
+		http.Error(w, "recordings not found", http.StatusNotFound)
+		return
+	}
+	start := segments[0].start
+	if v := r.URL.Query().Get("playback"); v != "" {
+		if start, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "playback must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("WebSocketアップグレード失敗", "error", err)
+		return
+	}
+	defer ws.Close()
+	messages, ctx := readMessages(r, ws, logger)
+
+	// 再生もライブと同じくPeerConnectionを使用するため、視聴者数・送信帯域の上限の対象にする
+	release, err := admission.admit(ctx, s, viewer.subject, viewerQueueTimeout, func(position int) {
+		_ = ws.WriteJSON(map[string]interface{}{"type": "queued", "position": position})
+	})
+	if err != nil {
+		logger.Warn("視聴者を受け入れられません", "error", err)
+		rejectViewer(ws, s, r, viewer, err)
+		return
+	}
+	defer release()
+
+	session := newViewerSession(viewer, r, ws)
+	session.transport = "playback"
+	sent := new(atomic.Uint64)
+	logger = logger.With("viewer", session.id)
+	s.addViewer(session)
+	defer s.removeViewer(session)
+
+	// 状態はシグナリングと、開いている場合はDataChannelの両方に通知
+	var dcMutex sync.Mutex
+	var dc *webrtc.DataChannel
+	notify := func(msg interface{}) {
+		_ = session.send(msg)
+		dcMutex.Lock()
+		defer dcMutex.Unlock()
+		if dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
+			if data, err := json.Marshal(msg); err == nil {
+				_ = dc.SendText(string(data))
+			}
+		}
+	}
+	p := newPlayer(name, logger, segments, notify)
+	p.egress = s.egress
+	p.sent = sent
+	if err := p.seek(start); err != nil {
+		logger.Warn("録画の再生: 再生できるセグメントがありません", "error", err)
+		_ = session.send(map[string]interface{}{"type": "error", "code": "no_recordings", "message": err.Error()})
+		return
+	}
+	_ = session.send(map[string]interface{}{"type": "recordings", "ranges": recordingRanges(segments)})
+	playbackSessions.with(name).Add(1)
+	logger.Info("録画の再生: 接続しました", "subject", viewer.subject, "start", start, "position", p.position, "codec", p.codec)
+
+	// run は再生位置を更新するため、切断のログは run の終了を待ってから出力する
+	done := make(chan struct{})
+	var stopped chan struct{} // run の終了 (開始していない場合は nil)
+	defer func() {
+		close(done)
+		if stopped != nil {
+			<-stopped
+		}
+		logger.Info("録画の再生: 切断しました", "position", p.position)
+	}()
+	var pc *webrtc.PeerConnection
+	var pendingCandidates []webrtc.ICECandidateInit
+	defer func() {
+		if pc != nil {
+			_ = pc.Close()
+		}
+	}()
+
+	for msg := range messages {
+		var m map[string]interface{}
+		if err := json.Unmarshal(msg, &m); err != nil {
+			logger.Warn("無効なWebSocketメッセージ", "error", err)
+			continue
+		}
+		switch m["type"] {
+		case "offer":
+			sdp, _ := m["sdp"].(string)
+			offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+			if pc == nil {
+				// 録画はトランスコードせずに送信するため、H.265の録画には視聴者の対応が必要
+				if p.codec == "h265" && r.URL.Query().Get("codec") != "h265" && !offerSupportsH265(sdp) {
+					_ = session.send(map[string]interface{}{"type": "error", "code": "unsupported_codec", "message": "this recording is H.265 and the viewer does not support it"})
+					return
+				}
+				var track *webrtc.TrackLocalStaticSample
+				connected := make(chan struct{})
+				pc, track, err = setupPlaybackPeerConnection(p, connected)
+				if err != nil {
+					logger.Error("録画の再生: PeerConnection作成失敗", "error", err)
+					return
+				}
+				session.setPeerConnection(pc, p.codec, sent)
+				pc.OnDataChannel(func(d *webrtc.DataChannel) {
+					dcMutex.Lock()
+					dc = d
+					dcMutex.Unlock()
+					d.OnMessage(func(msg webrtc.DataChannelMessage) {
+						var c playbackControl
+						if err := json.Unmarshal(msg.Data, &c); err != nil {
+							logger.Warn("録画の再生: 無効なDataChannelメッセージ", "error", err)
+							return
+						}
+						p.control(c)
+					})
+				})
+				stopped = make(chan struct{})
+				go func() {
+					defer close(stopped)
+					p.run(track, connected, done)
+				}()
+			}
+			if err := pc.SetRemoteDescription(offer); err != nil {
+				logger.Warn("リモートディスクリプションの設定失敗", "error", err)
+				continue
+			}
+			for _, c := range pendingCandidates {
+				if err := pc.AddICECandidate(c); err != nil {
+					logger.Warn("ICE候補の追加失敗", "error", err, "candidate", c.Candidate)
+				}
+			}
+			pendingCandidates = nil
+			answer, err := pc.CreateAnswer(nil)
+			if err != nil {
+				logger.Warn("アンサーの作成失敗", "error", err)
+				continue
+			}
+			if err := pc.SetLocalDescription(answer); err != nil {
+				logger.Warn("ローカルディスクリプションの設定失敗", "error", err)
+				continue
+			}
+			<-webrtc.GatheringCompletePromise(pc)
+			if err := session.send(map[string]string{"type": "answer", "sdp": pc.LocalDescription().SDP}); err != nil {
+				logger.Warn("アンサーの送信失敗", "error", err)
+			}
+		case "candidate":
+			candidate, ok := parseICECandidate(m, logger)
+			if !ok {
+				continue
+			}
+			if pc == nil || pc.RemoteDescription() == nil {
+				pendingCandidates = append(pendingCandidates, candidate)
+				continue
+			}
+			if err := pc.AddICECandidate(candidate); err != nil {
+				logger.Warn("ICE候補の追加失敗", "error", err, "candidate", candidate.Candidate)
+			}
+		case "seek", "pause", "play", "speed":
+			var c playbackControl
+			if err := json.Unmarshal(msg, &c); err == nil {
+				p.control(c)
+			}
+		}
+	}
+}
+
+// setupPlaybackPeerConnection は録画のコーデックのトラックを持つPeerConnectionを作成します。
+// 接続が完了すると connected を閉じます。
+func setupPlaybackPeerConnection(p *player, connected chan struct{}) (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample, error) {
+	capability := webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "profile-level-id=42e01f;level-asymmetry-allowed=1;packetization-mode=1",
+	}
+	var payloadType webrtc.PayloadType = 96
+	if p.codec == "h265" {
+		capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, SDPFmtpLine: "profile-id=1;level-id=93"}
+		payloadType = 97
+	}
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: capability, PayloadType: payloadType}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: capability.MimeType, ClockRate: 90000}, "video", "playback")
+	if err != nil {
+		_ = pc.Close()
+		return nil, nil, err
+	}
+	rtpSender, err := pc.AddTrack(track)
+	if err != nil {
+		_ = pc.Close()
+		return nil, nil, err
+	}
+	go func() {
+		rtcpBuf := make([]byte, 1500)
+		for {
+			if _, _, err := rtpSender.Read(rtcpBuf); err != nil {
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+	return pc, track, nil
+}
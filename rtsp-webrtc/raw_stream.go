@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
+)
+
+// --- HTTPでのエレメンタリーストリーム / MPEG-TS 配信 ---
+//
+// GET /stream/<ストリーム名>.h264 (.h265) はAnnex-Bのエレメンタリーストリームを、
+// GET /stream/<ストリーム名>.ts はMPEG-TSを、チャンク形式のHTTPレスポンスで送信し続けます。
+// ffplay や VLC、結合テストなどのツールからの視聴に使用します。
+
+const (
+	rawStreamQueueSize    = 256
+	rawStreamWriteTimeout = 5 * time.Second // 1つのアクセスユニットの送信にかかる時間の上限
+)
+
+var rawStreamBytes = newCounterVec("rtsp2webrtc_http_stream_bytes_total",
+	"HTTPストリーミング (.h264/.h265/.ts) で送信したバイト数", "stream", "format")
+
+// errRawStreamCodecChanged は入力のコーデックが変わったためにレスポンスを終えることを示します
+var errRawStreamCodecChanged = errors.New("入力のコーデックが変わりました")
+
+// rawStreamWriter はアクセスユニットをAnnex-BまたはMPEG-TSで書き込みます。
+// キーフレーム (パラメータセットを含む) から書き込みを開始し、欠落後も次のキーフレームまで書き込みません。
+type rawStreamWriter struct {
+	format string // "h264"、"h265" または "ts"
+	codec  string
+	w      io.Writer
+	ts     *mpegts.Writer
+	track  *mpegts.Track
+
+	waitKey  bool
+	dts      int64
+	prevTime time.Time
+}
+
+func newRawStreamWriter(format, codec string, w io.Writer) (*rawStreamWriter, error) {
+	rw := &rawStreamWriter{format: format, codec: codec, w: w, waitKey: true}
+	if format == "ts" {
+		rw.track = &mpegts.Track{Codec: &mpegts.CodecH264{}}
+		if codec == "h265" {
+			rw.track.Codec = &mpegts.CodecH265{}
+		}
+		rw.ts = &mpegts.Writer{W: w, Tracks: []*mpegts.Track{rw.track}}
+		if err := rw.ts.Initialize(); err != nil {
+			return nil, err
+		}
+	}
+	return rw, nil
+}
+
+// writeAU はアクセスユニットを書き込みます。書き込んだ場合は true を返します。
+func (rw *rawStreamWriter) writeAU(au accessUnit) (bool, error) {
+	if au.codec != rw.codec {
+		return false, errRawStreamCodecChanged
+	}
+	if au.gap {
+		rw.waitKey = true
+	}
+	if rw.waitKey {
+		if !au.key {
+			return false, nil
+		}
+		rw.waitKey = false
+	}
+	if rw.ts == nil {
+		nals, err := h264.AnnexB(au.nals).Marshal()
+		if err != nil {
+			return false, err
+		}
+		_, err = rw.w.Write(nals)
+		return err == nil, err
+	}
+
+	// GOPキャッシュのアクセスユニットは最短の間隔で書き込み、プレーヤーを早送りでライブに追いつかせる
+	if !rw.prevTime.IsZero() {
+		rw.dts += int64(liveSampleDuration(rw.prevTime, au.time)) * 90000 / int64(time.Second)
+	}
+	rw.prevTime = au.time
+	var err error
+	if au.codec == "h265" {
+		err = rw.ts.WriteH265(rw.track, rw.dts+tsTimeOffset, rw.dts+tsTimeOffset, au.nals)
+	} else {
+		err = rw.ts.WriteH264(rw.track, rw.dts+tsTimeOffset, rw.dts+tsTimeOffset, au.nals)
+	}
+	return err == nil, err
+}
+
+// rawStreamHandler は GET /stream/<ストリーム名>.<h264|h265|ts> を処理します。
+// 視聴者の認証・上限は signalingHandler と同じで (待機キューは使用しない)、GOPキャッシュから送信を開始します。
+func rawStreamHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.PathValue("path")
+	ext := pathpkg.Ext(path)
+	name, format := strings.TrimSuffix(path, ext), strings.TrimPrefix(ext, ".")
+	if name == "" || (format != "h264" && format != "h265" && format != "ts") {
+		http.NotFound(w, r)
+		return
+	}
+	viewer, ok := authorizeViewer(w, r, name)
+	if !ok {
+		return
+	}
+	s := lookupStream(name)
+	if s == nil {
+		slog.Warn("存在しないストリームへの接続要求", "stream", name, "remote", r.RemoteAddr)
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	codec := s.currentCodec()
+	if format != "ts" && format != codec {
+		http.Error(w, fmt.Sprintf("stream codec is %s; use /stream/%s.%s", codec, name, codec), http.StatusConflict)
+		return
+	}
+	logger := s.logger.With("remote", r.RemoteAddr, "transport", "http", "format", format)
+
+	release, err := admission.admit(r.Context(), s, viewer.subject, 0, nil)
+	if err != nil {
+		logger.Warn("視聴者を受け入れられません", "error", err)
+		events.publish(event{Type: eventViewerRejected, Stream: s.name, Remote: r.RemoteAddr, Subject: viewer.subject, Reason: err.Error()})
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	s.addRawStreamViewer()
+	defer s.removeRawStreamViewer()
+
+	g, err := s.subscribeWithGOP(rawStreamQueueSize, channelDrops.with(s.name, "http-"+format))
+	if err != nil {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	defer g.close()
+	// 管理APIの視聴者一覧には載らないが、イベントの joined/left を対応付けられるよう視聴者IDを割り当てる
+	viewerID := lastViewerSessionID.Add(1)
+	logger = logger.With("viewer", viewerID)
+	events.publish(event{Type: eventViewerJoined, Stream: s.name, Remote: r.RemoteAddr, ViewerID: viewerID, Subject: viewer.subject})
+	defer func() {
+		events.publish(event{Type: eventViewerLeft, Stream: s.name, Remote: r.RemoteAddr, ViewerID: viewerID, Subject: viewer.subject, Codec: codec})
+	}()
+
+	rc := http.NewResponseController(w)
+	out := countingWriter{w: countingWriter{w: w, n: s.egress}, n: rawStreamBytes.with(s.name, format)}
+	rw, err := newRawStreamWriter(format, codec, out)
+	if err != nil {
+		logger.Warn("HTTPストリーミングを開始できません", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contentType := "video/mp2t"
+	if format != "ts" {
+		contentType = "video/" + strings.ToUpper(format)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+	logger.Info("HTTPストリーミングを開始しました", "subject", viewer.subject, "codec", codec, "cached", len(g.cached))
+
+	write := func(au accessUnit) bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(rawStreamWriteTimeout))
+		written, err := rw.writeAU(au)
+		if err == nil && written {
+			err = rc.Flush()
+		}
+		if err != nil {
+			if errors.Is(err, errRawStreamCodecChanged) {
+				logger.Info("入力のコーデックが変わったためHTTPストリーミングを終了します", "codec", au.codec)
+			} else {
+				logger.Debug("HTTPストリーミングの送信エラー", "error", err)
+			}
+			return false
+		}
+		return true
+	}
+	for _, au := range g.cached {
+		if !write(au) {
+			return
+		}
+	}
+	// 最初の購読のアクセスユニットは gap が true になるが、GOPキャッシュから続いているため無視する
+	first := true
+	for {
+		select {
+		case au, ok := <-g.sub.ch:
+			if !ok {
+				return
+			}
+			if au.time.Before(g.since) {
+				continue
+			}
+			if first {
+				if !startsPicture(au) {
+					continue
+				}
+				first = false
+				au.gap = au.gap && len(g.cached) == 0
+			}
+			if !write(au) {
+				return
+			}
+		case <-r.Context().Done():
+			logger.Info("HTTPストリーミングを終了しました")
+			return
+		}
+	}
+}
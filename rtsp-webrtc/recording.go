@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/v2/pkg/formats/mpegts"
+)
+
+// --- 録画 ---
+
+// recordingConfig は録画の設定です
+type recordingConfig struct {
+	dir       string        // 録画ファイルのルートディレクトリ (<dir>/<ストリーム名>/<日付>/<時刻>.mp4)
+	format    string        // "fmp4" または "mpegts"
+	segment   time.Duration // セグメントの長さ (キーフレームで区切るため目安)
+	retention time.Duration // これより古いセグメントを削除 (0の場合は無期限)
+	maxMB     int64         // 録画ファイルの合計サイズの上限 (MB、0の場合は無制限)
+}
+
+// recording は録画の設定です (main でフラグから設定)
+var recording = recordingConfig{dir: "recordings", format: "fmp4", segment: time.Minute}
+
+const (
+	recordFragmentDuration = time.Second // この間隔でファイルに書き出す (異常終了時に失われる範囲)
+	recordPartSuffix       = ".part"     // 書き込み中のセグメントの拡張子
+	recordQueueSize        = 1024
+	tsTimeOffset           = 90000 // MPEG-TSのタイムスタンプの開始値 (PCRがDTSより前になるため)
+)
+
+var (
+	recordingSegments = newCounterVec("rtsp2webrtc_recording_segments_total",
+		"完了した録画セグメント数", "stream")
+	recordingBytes = newCounterVec("rtsp2webrtc_recording_bytes_total",
+		"録画ファイルに書き込んだバイト数", "stream")
+	recordingDeleted = newCounterVec("rtsp2webrtc_recording_deleted_total",
+		"保持期間・容量の上限により削除した録画セグメント数", "reason")
+)
+
+func (c recordingConfig) validate() error {
+	if c.dir == "" {
+		return fmt.Errorf("録画ディレクトリを指定する必要があります")
+	}
+	if c.format != "fmp4" && c.format != "mpegts" {
+		return fmt.Errorf("サポートされていない録画形式: %s。'fmp4' または 'mpegts' を使用してください。", c.format)
+	}
+	if c.segment < time.Second {
+		return fmt.Errorf("録画セグメントの長さは1秒以上を指定してください: %v", c.segment)
+	}
+	return nil
+}
+
+// extension はセグメントファイルの拡張子を返します
+func (c recordingConfig) extension() string {
+	if c.format == "mpegts" {
+		return ".ts"
+	}
+	return ".mp4"
+}
+
+// streamDir はストリームの録画ディレクトリを返します
+func (c recordingConfig) streamDir(name string) string {
+	return filepath.Join(c.dir, url.PathEscape(name))
+}
+
+// startRecording はストリームの録画を開始します
+func (s *stream) startRecording(cfg recordingConfig) error {
+	s.mutex.RLock()
+	aus := s.aus
+	s.mutex.RUnlock()
+	if aus == nil {
+		return fmt.Errorf("ストリーム %s は削除されています", s.name)
+	}
+	r, err := newRecorder(s.name, cfg, s.logger, aus)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	prev := s.recorder
+	s.recorder = r
+	s.mutex.Unlock()
+	if prev != nil {
+		prev.stop()
+	}
+	s.logger.Info("録画を開始しました", "dir", cfg.streamDir(s.name), "format", cfg.format, "segment", cfg.segment)
+	return nil
+}
+
+// stopRecording は録画を停止し、書き込み中のセグメントを確定します
+func (s *stream) stopRecording() {
+	s.mutex.Lock()
+	r := s.recorder
+	s.recorder = nil
+	s.mutex.Unlock()
+	if r != nil {
+		r.stop()
+	}
+}
+
+// recordingFile は書き込み中のセグメントのパスを返します (録画していない場合は空)
+func (s *stream) recordingFile() string {
+	s.mutex.RLock()
+	r := s.recorder
+	s.mutex.RUnlock()
+	if r == nil {
+		return ""
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+// --- レコーダー ---
+
+// recorder はストリームのアクセスユニットを再エンコードせずにセグメントファイルへ書き込みます。
+// セグメントはキーフレームから開始し、書き込み中は .part の拡張子を付けて完了時に名前を変更します。
+type recorder struct {
+	name   string
+	cfg    recordingConfig
+	logger *slog.Logger
+	hub    *auHub
+	sub    *auSubscriber
+	done   chan struct{}
+	bytes  *atomic.Uint64
+
+	mutex   sync.Mutex
+	current string // 書き込み中のセグメント (管理API用)
+
+	// 以下は run のゴルーチンのみで使用
+	waitKey  bool
+	file     *os.File
+	seg      segmentWriter
+	segPath  string
+	segStart time.Time
+	segCodec string
+}
+
+func newRecorder(name string, cfg recordingConfig, logger *slog.Logger, hub *auHub) (*recorder, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.streamDir(name), 0o755); err != nil {
+		return nil, err
+	}
+	r := &recorder{
+		name:   name,
+		cfg:    cfg,
+		logger: logger.With("component", "recorder"),
+		hub:    hub,
+		sub:    hub.subscribe(recordQueueSize, channelDrops.with(name, "recorder")),
+		done:   make(chan struct{}),
+		bytes:  recordingBytes.with(name),
+	}
+	go r.run()
+	return r, nil
+}
+
+// stop はキューに残ったアクセスユニットを書き込んでから録画を終了します
+func (r *recorder) stop() {
+	r.hub.unsubscribe(r.sub)
+	<-r.done
+}
+
+func (r *recorder) run() {
+	defer close(r.done)
+	for au := range r.sub.ch {
+		if au.gap {
+			// 欠落したフレームを参照するため、次のキーフレームまで書き込まない
+			r.waitKey = true
+		}
+		r.writeAU(au)
+	}
+	r.closeSegment()
+}
+
+func (r *recorder) writeAU(au accessUnit) {
+	if r.seg != nil && (au.codec != r.segCodec || (au.key && au.time.Sub(r.segStart) >= r.cfg.segment)) {
+		r.closeSegment()
+	}
+	if r.waitKey || r.seg == nil {
+		// セグメントと欠落後の書き込みはキーフレームから開始
+		if !au.key {
+			return
+		}
+		r.waitKey = false
+	}
+	if r.seg == nil {
+		if err := r.openSegment(au); err != nil {
+			warnRateLimited(r.logger, "recording-open:"+r.name, "録画: セグメントの作成に失敗", "error", err)
+			return
+		}
+	}
+	if err := r.seg.writeAU(au, au.time.Sub(r.segStart)); err != nil {
+		warnRateLimited(r.logger, "recording-write:"+r.name, "録画: セグメントの書き込みに失敗", "file", r.segPath, "error", err)
+		r.closeSegment()
+	}
+}
+
+// openSegment はキーフレーム au から始まる新しいセグメントを作成します
+func (r *recorder) openSegment(au accessUnit) error {
+	dir := filepath.Join(r.cfg.streamDir(r.name), au.time.Format("2006-01-02"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	base := filepath.Join(dir, au.time.Format("15-04-05"))
+	path := base + r.cfg.extension()
+	for i := 1; fileExists(path) || fileExists(path+recordPartSuffix); i++ {
+		path = fmt.Sprintf("%s-%d%s", base, i, r.cfg.extension())
+	}
+	f, err := os.OpenFile(path+recordPartSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	w := countingWriter{w: f, n: r.bytes}
+	var seg segmentWriter
+	if r.cfg.format == "mpegts" {
+		seg, err = newTSSegment(w, au.codec)
+	} else {
+		seg, err = newFMP4Segment(w, au)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	r.file = f
+	r.seg = seg
+	r.segPath = path
+	r.segStart = au.time
+	r.segCodec = au.codec
+	r.mutex.Lock()
+	r.current = path
+	r.mutex.Unlock()
+	r.logger.Debug("録画: セグメントを開始しました", "file", path)
+	return nil
+}
+
+// closeSegment は書き込み中のセグメントを確定します。
+// 書き込みに失敗した場合は、起動時の復旧と同様に最後の完全なフラグメントまで切り詰めます。
+func (r *recorder) closeSegment() {
+	if r.seg == nil {
+		return
+	}
+	err := r.seg.close()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	part := r.segPath + recordPartSuffix
+	r.seg = nil
+	r.file = nil
+	r.mutex.Lock()
+	r.current = ""
+	r.mutex.Unlock()
+
+	if err != nil {
+		r.logger.Warn("録画: セグメントの書き込みに失敗したため、書き込み済みの範囲で確定します", "file", r.segPath, "error", err)
+		recoverSegment(part)
+		return
+	}
+	if err := os.Rename(part, r.segPath); err != nil {
+		r.logger.Warn("録画: セグメントの確定に失敗", "file", part, "error", err)
+		return
+	}
+	recordingSegments.with(r.name).Add(1)
+	r.logger.Debug("録画: セグメントを確定しました", "file", r.segPath, "duration", time.Since(r.segStart).Round(time.Second))
+	events.publish(event{Type: eventRecordingSegment, Stream: r.name, File: r.segPath})
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// countingWriter は書き込んだバイト数をメトリクスに加えます
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+// --- セグメントの形式 ---
+
+// segmentWriter はアクセスユニットを1つのセグメントファイルの形式で書き込みます。
+// dts はセグメントの開始 (最初のキーフレームの受信時刻) からの経過時間です。
+type segmentWriter interface {
+	writeAU(au accessUnit, dts time.Duration) error
+	close() error
+}
+
+// fmp4Segment は初期化セグメントと、約 recordFragmentDuration ごとのフラグメント (moof + mdat) を書き込みます。
+// サンプルの期間は次のアクセスユニットの受信時刻で決まるため、最後のサンプルは1つ遅れて書き込まれます。
+type fmp4Segment struct {
+	w            io.Writer
+	seq          uint32
+	samples      []*fmp4.PartSample
+	baseTime     int64 // samples の最初のサンプルのDTS (90kHz)
+	pending      *fmp4.PartSample
+	pendingDTS   int64
+	lastDuration uint32
+}
+
+func newFMP4Segment(w io.Writer, au accessUnit) (*fmp4Segment, error) {
+	init, err := fmp4InitSegment(au.codec, au.nals)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(init); err != nil {
+		return nil, err
+	}
+	return &fmp4Segment{w: w, seq: 1, lastDuration: fmp4Timescale / 30}, nil
+}
+
+func (s *fmp4Segment) writeAU(au accessUnit, dts time.Duration) error {
+	ticks := int64(dts) * fmp4Timescale / int64(time.Second)
+	if s.pending != nil {
+		// 壁時計のタイムスタンプが前後しても単調増加にする
+		ticks = max(ticks, s.pendingDTS+1)
+		s.lastDuration = uint32(ticks - s.pendingDTS)
+		s.appendPending(s.lastDuration)
+	}
+	if len(s.samples) > 0 && (au.key || ticks-s.baseTime >= int64(recordFragmentDuration)*fmp4Timescale/int64(time.Second)) {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	sample, err := fmp4Sample(au)
+	if err != nil {
+		return err
+	}
+	s.pending = sample
+	s.pendingDTS = ticks
+	return nil
+}
+
+func (s *fmp4Segment) appendPending(duration uint32) {
+	s.pending.Duration = duration
+	if len(s.samples) == 0 {
+		s.baseTime = s.pendingDTS
+	}
+	s.samples = append(s.samples, s.pending)
+	s.pending = nil
+}
+
+func (s *fmp4Segment) flush() error {
+	data, err := fmp4Fragment(s.seq, uint64(s.baseTime), s.samples)
+	s.seq++
+	s.samples = nil
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(data)
+	return err
+}
+
+func (s *fmp4Segment) close() error {
+	if s.pending != nil {
+		// 最後のサンプルの期間は直前のサンプルと同じとみなす
+		s.appendPending(s.lastDuration)
+	}
+	if len(s.samples) == 0 {
+		return nil
+	}
+	return s.flush()
+}
+
+// tsSegment はMPEG-TSでアクセスユニットを書き込みます。
+// キーフレームごと、または約 recordFragmentDuration ごとにファイルへ書き出します。
+type tsSegment struct {
+	bw        *bufio.Writer
+	w         *mpegts.Writer
+	track     *mpegts.Track
+	lastDTS   int64
+	flushedAt time.Duration
+}
+
+func newTSSegment(w io.Writer, codec string) (*tsSegment, error) {
+	track := &mpegts.Track{Codec: &mpegts.CodecH264{}}
+	if codec == "h265" {
+		track.Codec = &mpegts.CodecH265{}
+	}
+	bw := bufio.NewWriter(w)
+	mw := &mpegts.Writer{W: bw, Tracks: []*mpegts.Track{track}}
+	if err := mw.Initialize(); err != nil {
+		return nil, err
+	}
+	return &tsSegment{bw: bw, w: mw, track: track, lastDTS: -1}, nil
+}
+
+func (s *tsSegment) writeAU(au accessUnit, dts time.Duration) error {
+	ticks := max(int64(dts)*90000/int64(time.Second)+tsTimeOffset, s.lastDTS+1)
+	s.lastDTS = ticks
+	var err error
+	if au.codec == "h265" {
+		err = s.w.WriteH265(s.track, ticks, ticks, au.nals)
+	} else {
+		err = s.w.WriteH264(s.track, ticks, ticks, au.nals)
+	}
+	if err != nil {
+		return err
+	}
+	if au.key || dts-s.flushedAt >= recordFragmentDuration {
+		s.flushedAt = dts
+		return s.bw.Flush()
+	}
+	return nil
+}
+
+func (s *tsSegment) close() error {
+	return s.bw.Flush()
+}
+
+// --- 異常終了時の復旧 ---
+
+// recoverRecordings は前回の異常終了で書き込み途中のまま残ったセグメント (*.part) を復旧します
+func recoverRecordings(dir string) {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(path, recordPartSuffix) {
+			recoverSegment(path)
+		}
+		return nil
+	})
+}
+
+// recoverSegment は書き込み途中のセグメントを最後の完全なフラグメントまで切り詰めて確定し、
+// 確定したファイルが存在するかを返します。完全なフラグメントを含まない場合は削除します。
+func recoverSegment(part string) bool {
+	final := strings.TrimSuffix(part, recordPartSuffix)
+	var size int64
+	var err error
+	if strings.HasSuffix(final, ".ts") {
+		size, err = validTSLength(part)
+	} else {
+		size, err = validFMP4Length(part)
+	}
+	if err != nil {
+		slog.Warn("録画: 書き込み途中のセグメントの確認に失敗", "file", part, "error", err)
+		return false
+	}
+	if size == 0 {
+		if err := os.Remove(part); err != nil {
+			slog.Warn("録画: 書き込み途中のセグメントの削除に失敗", "file", part, "error", err)
+			return false
+		}
+		slog.Info("録画: 完全なフラグメントがないため書き込み途中のセグメントを削除しました", "file", part)
+		return false
+	}
+	if err := os.Truncate(part, size); err != nil {
+		slog.Warn("録画: 書き込み途中のセグメントの切り詰めに失敗", "file", part, "error", err)
+		return false
+	}
+	if err := os.Rename(part, final); err != nil {
+		slog.Warn("録画: 書き込み途中のセグメントの確定に失敗", "file", part, "error", err)
+		return false
+	}
+	slog.Info("録画: 書き込み途中のセグメントを復旧しました", "file", final, "bytes", size)
+	return true
+}
+
+// validFMP4Length は初期化セグメントの後に続く、完全なフラグメント (moof + mdat) の末尾までの長さを返します
+func validFMP4Length(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	total := info.Size()
+
+	var off, valid int64
+	hasInit, inMoof := false, false
+	header := make([]byte, 16)
+	for off+8 <= total {
+		if _, err := f.ReadAt(header[:8], off); err != nil {
+			return 0, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		if size == 1 {
+			// 64ビットのサイズ
+			if off+16 > total {
+				break
+			}
+			if _, err := f.ReadAt(header[8:16], off+8); err != nil {
+				return 0, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 || off+size > total {
+			// サイズ0 (ファイル末尾まで) と途中で切れたボックスは書き込み途中とみなす
+			break
+		}
+		switch boxType {
+		case "moov":
+			hasInit = true
+		case "moof":
+			inMoof = true
+		case "mdat":
+			if hasInit && inMoof {
+				valid = off + size
+			}
+			inMoof = false
+		}
+		off += size
+	}
+	return valid, nil
+}
+
+// validTSLength はMPEG-TSのパケット (188バイト) 単位に切り詰めた長さを返します
+func validTSLength(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size() - info.Size()%188, nil
+}
+
+// --- 保持期間と容量の上限 ---
+
+// startRecordingJanitor は保持期間と容量の上限を超えた古い録画セグメントを定期的に削除します
+func startRecordingJanitor(cfg recordingConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cleanRecordings(cfg)
+		<-ticker.C
+	}
+}
+
+// cleanRecordings は保持期間を過ぎたセグメントと、合計サイズが上限を超えた分の古いセグメントを削除します。
+// 書き込み中のセグメント (*.part) は合計サイズには含めますが、削除しません。
+func cleanRecordings(cfg recordingConfig) {
+	type segmentFile struct {
+		path    string
+		modTime time.Time
+		size    int64
+	}
+	var files []segmentFile
+	var total int64
+	_ = filepath.WalkDir(cfg.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		if ext := filepath.Ext(path); ext == ".mp4" || ext == ".ts" {
+			files = append(files, segmentFile{path: path, modTime: info.ModTime(), size: info.Size()})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	maxBytes := cfg.maxMB * 1024 * 1024
+	deleted := 0
+	for _, f := range files {
+		var reason string
+		switch {
+		case cfg.retention > 0 && time.Since(f.modTime) > cfg.retention:
+			reason = "retention"
+		case maxBytes > 0 && total > maxBytes:
+			reason = "quota"
+		default:
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			slog.Warn("録画: セグメントの削除に失敗", "file", f.path, "error", err)
+			continue
+		}
+		total -= f.size
+		deleted++
+		recordingDeleted.with(reason).Add(1)
+		// 空になった日付ディレクトリを削除 (空でない場合は失敗するため無視)
+		_ = os.Remove(filepath.Dir(f.path))
+		slog.Debug("録画: セグメントを削除しました", "file", f.path, "reason", reason)
+	}
+	if deleted > 0 {
+		slog.Info("録画: 保持期間・容量の上限により古いセグメントを削除しました", "segments", deleted, "total_bytes", total)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mp4Box はテスト用のMP4ボックスを作成します
+func mp4Box(boxType string, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	b = append(b, boxType...)
+	return append(b, payload...)
+}
+
+// mp4LargeBox は64ビットのサイズを持つボックスを作成します
+func mp4LargeBox(boxType string, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 1)
+	b = append(b, boxType...)
+	b = binary.BigEndian.AppendUint64(b, uint64(16+len(payload)))
+	return append(b, payload...)
+}
+
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidFMP4Length(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	moov := mp4Box("moov", bytes.Repeat([]byte{0}, 32))
+	moof := mp4Box("moof", bytes.Repeat([]byte{1}, 24))
+	mdat := mp4Box("mdat", bytes.Repeat([]byte{2}, 100))
+	init := concat(ftyp, moov)
+	fragment := concat(moof, mdat)
+
+	tests := []struct {
+		name string
+		data []byte
+		want int64
+	}{
+		{name: "空", data: nil, want: 0},
+		{name: "初期化セグメントのみ", data: init, want: 0},
+		{name: "完全なフラグメント", data: concat(init, fragment, fragment), want: int64(len(init) + 2*len(fragment))},
+		{name: "mdatが途中で切れた", data: concat(init, fragment, moof, mdat[:50]), want: int64(len(init) + len(fragment))},
+		{name: "ボックスヘッダーが途中で切れた", data: concat(init, fragment, moof[:5]), want: int64(len(init) + len(fragment))},
+		{name: "moofの後にmdatがない", data: concat(init, fragment, moof), want: int64(len(init) + len(fragment))},
+		{name: "moovがない", data: concat(ftyp, fragment), want: 0},
+		{name: "moofのないmdat", data: concat(init, fragment, mdat), want: int64(len(init) + len(fragment))},
+		{name: "サイズ0のボックス", data: concat(init, fragment, []byte{0, 0, 0, 0}, []byte("mdat"), fragment), want: int64(len(init) + len(fragment))},
+		{name: "サイズが8未満", data: concat(init, []byte{0, 0, 0, 4}, []byte("moof"), fragment), want: 0},
+		{
+			name: "64ビットのサイズ",
+			data: concat(init, moof, mp4LargeBox("mdat", bytes.Repeat([]byte{3}, 40))),
+			want: int64(len(init) + len(moof) + 16 + 40),
+		},
+		{name: "64ビットのサイズが途中で切れた", data: concat(init, fragment, []byte{0, 0, 0, 1}, []byte("mdat"), []byte{0, 0}), want: int64(len(init) + len(fragment))},
+		{name: "サイズがファイルより大きい", data: concat(init, fragment, []byte{0x7f, 0xff, 0xff, 0xff}, []byte("mdat")), want: int64(len(init) + len(fragment))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validFMP4Length(writeTempFile(t, "seg.mp4.part", tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("validFMP4Length() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := validFMP4Length(filepath.Join(t.TempDir(), "missing.mp4.part")); err == nil {
+		t.Error("存在しないファイルでエラーにならない")
+	}
+}
+
+func TestValidTSLength(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want int64
+	}{
+		{"空", 0, 0},
+		{"1パケット未満", 100, 0},
+		{"パケット境界", 188 * 3, 188 * 3},
+		{"途中で切れたパケット", 188*3 + 50, 188 * 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validTSLength(writeTempFile(t, "seg.ts.part", make([]byte, tt.size)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("validTSLength() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoverSegment(t *testing.T) {
+	init := concat(mp4Box("ftyp", nil), mp4Box("moov", nil))
+	fragment := concat(mp4Box("moof", nil), mp4Box("mdat", []byte{1, 2, 3}))
+
+	t.Run("切り詰めて確定", func(t *testing.T) {
+		part := writeTempFile(t, "seg.mp4"+recordPartSuffix, concat(init, fragment, fragment[:10]))
+		if !recoverSegment(part) {
+			t.Error("recoverSegment() = false, want true")
+		}
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(part), "seg.mp4"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := concat(init, fragment); !bytes.Equal(data, want) {
+			t.Errorf("復旧したセグメントの長さ = %d, want %d", len(data), len(want))
+		}
+	})
+	t.Run("完全なフラグメントがない", func(t *testing.T) {
+		part := writeTempFile(t, "seg.mp4"+recordPartSuffix, init)
+		if recoverSegment(part) {
+			t.Error("recoverSegment() = true, want false")
+		}
+		if _, err := os.Stat(part); !os.IsNotExist(err) {
+			t.Error("書き込み途中のセグメントが削除されていない")
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(part), "seg.mp4")); !os.IsNotExist(err) {
+			t.Error("空のセグメントが確定された")
+		}
+	})
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- RTMP 入力 (rtmp-server) ---
+//
+// エンコーダーやOBSからのRTMPのPUBLISHを受け付け、FLVの映像タグ (H.264、Enhanced RTMPのH.265) を
+// アクセスユニットとしてストリームに渡します。音声 (AAC) は解析のみで配信しません。
+// -input-url rtmp://0.0.0.0:1935/<アプリ>/<ストリームキー> でリスニングアドレスと受け付けるパスを指定します。
+
+const (
+	rtmpHandshakeSize  = 1536
+	rtmpOutChunkSize   = 4096
+	rtmpWindowAckSize  = 2500000
+	rtmpReadTimeout    = 10 * time.Second
+	rtmpWriteTimeout   = 5 * time.Second
+	rtmpMaxMessageSize = 16 * 1024 * 1024
+	rtmpStreamID       = 1 // createStream で返すメッセージストリームID
+)
+
+// RTMPのメッセージタイプ
+const (
+	rtmpTypeSetChunkSize     = 1
+	rtmpTypeAbort            = 2
+	rtmpTypeAck              = 3
+	rtmpTypeUserControl      = 4
+	rtmpTypeWindowAckSize    = 5
+	rtmpTypeSetPeerBandwidth = 6
+	rtmpTypeAudio            = 8
+	rtmpTypeVideo            = 9
+	rtmpTypeDataAMF3         = 15
+	rtmpTypeCommandAMF3      = 17
+	rtmpTypeDataAMF0         = 18
+	rtmpTypeCommandAMF0      = 20
+)
+
+// parseRTMPListenURL は rtmp://<ホスト>:<ポート>/<アプリ>/<ストリームキー> を解析します。
+// アプリ・ストリームキーを省略した場合は任意のパスへのPUBLISHを受け付けます。
+func parseRTMPListenURL(raw string) (addr, app, key string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", "", fmt.Errorf("RTMPのURLを解析できません: %v", err)
+	}
+	if u.Scheme != "rtmp" {
+		return "", "", "", fmt.Errorf("rtmp-server の入力URLは rtmp://<ホスト>:<ポート>/<アプリ>/<ストリームキー> の形式で指定してください: %s", raw)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "1935"
+	}
+	app, key, _ = strings.Cut(strings.Trim(u.Path, "/"), "/")
+	return net.JoinHostPort(u.Hostname(), port), app, key, nil
+}
+
+// rtmpServer は1つのストリームへのRTMPのPUBLISHを受け付けます。
+// 新しいパブリッシャーが接続した場合は既存のパブリッシャーを切断して置き換えます。
+type rtmpServer struct {
+	stream *stream
+	app    string
+	key    string
+	logger *slog.Logger
+
+	mutex     sync.Mutex
+	conns     map[*rtmpConn]bool
+	publisher *rtmpConn
+}
+
+// startRTMPServer はRTMPのリスナーを起動し、コンテキストがキャンセルされるまでブロックします
+func startRTMPServer(ctx context.Context, s *stream, p props) {
+	addr, app, key, err := parseRTMPListenURL(p.inputURL)
+	if err != nil {
+		s.logger.Error("RTMP server: 入力URLが不正です", "error", err)
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	// 再起動の直後は以前のパイプラインがリスナーを閉じるまで待つ
+	for i := 0; i < 10 && errors.Is(err, syscall.EADDRINUSE) && ctx.Err() == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		s.logger.Error("RTMP server: リスニングを開始できません", "addr", addr, "error", err)
+		return
+	}
+	srv := &rtmpServer{stream: s, app: app, key: key, logger: s.logger.With("component", "rtmp"), conns: make(map[*rtmpConn]bool)}
+	srv.logger.Info("RTMP server: PUBLISHの待ち受けを開始しました", "addr", addr, "app", app)
+
+	var wg sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+		srv.closeAll()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				srv.logger.Error("RTMP server: 接続の受け付けに失敗", "error", err)
+				_ = ln.Close()
+				srv.closeAll()
+			}
+			break
+		}
+		in := &rtmpCountingReader{r: conn}
+		c := &rtmpConn{
+			server:      srv,
+			conn:        conn,
+			in:          in,
+			br:          bufio.NewReader(in),
+			bw:          bufio.NewWriter(conn),
+			remote:      conn.RemoteAddr().String(),
+			logger:      srv.logger.With("remote", conn.RemoteAddr().String()),
+			inChunkSize: 128,
+			outChunk:    128,
+			streams:     make(map[uint32]*rtmpChunkStream),
+			timer:       frameTimer{clockRate: 1000, wrap: 1 << 32},
+		}
+		srv.mutex.Lock()
+		srv.conns[c] = true
+		srv.mutex.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.run()
+		}()
+	}
+	wg.Wait()
+}
+
+func (srv *rtmpServer) closeAll() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for c := range srv.conns {
+		_ = c.conn.Close()
+	}
+}
+
+// setPublisher は c をパブリッシャーにし、既存のパブリッシャーを切断します
+func (srv *rtmpServer) setPublisher(c *rtmpConn) {
+	srv.mutex.Lock()
+	prev := srv.publisher
+	srv.publisher = c
+	srv.mutex.Unlock()
+	if prev != nil {
+		prev.logger.Info("RTMP server: 既存パブリッシャーを切断します")
+		_ = prev.conn.Close()
+	}
+}
+
+func (srv *rtmpServer) remove(c *rtmpConn) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	delete(srv.conns, c)
+	if srv.publisher == c {
+		srv.publisher = nil
+	}
+}
+
+// rtmpCountingReader は受信したバイト数を数えます (Acknowledgement の送信に使用)
+type rtmpCountingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *rtmpCountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// rtmpChunkStream はチャンクストリームごとの直前のヘッダーと組み立て中のメッセージです
+type rtmpChunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    uint8
+	streamID  uint32
+	extended  bool
+	buf       []byte
+}
+
+type rtmpMessage struct {
+	typeID    uint8
+	streamID  uint32
+	timestamp uint32 // ミリ秒
+	payload   []byte
+}
+
+// rtmpConn は1つのRTMP接続です
+type rtmpConn struct {
+	server *rtmpServer
+	conn   net.Conn
+	in     *rtmpCountingReader
+	br     *bufio.Reader
+	bw     *bufio.Writer
+	remote string
+	logger *slog.Logger
+
+	inChunkSize uint32
+	outChunk    uint32
+	streams     map[uint32]*rtmpChunkStream
+	ackWindow   uint32
+	lastAck     uint64
+
+	app        string
+	path       string // PUBLISHされた /<アプリ>/<ストリームキー> (ログ・イベント用)
+	publishing bool
+
+	codec         string // 映像のシーケンスヘッダーで決定
+	nalLengthSize int
+	timer         frameTimer
+	audioLogged   bool
+}
+
+func (c *rtmpConn) run() {
+	defer c.server.remove(c)
+	defer c.conn.Close()
+	err := func() (err error) {
+		// 不正なデータによるパニックでプロセス全体が終了しないよう、この接続のみを切断する
+		defer func() {
+			if r := recover(); r != nil {
+				c.logger.Error("RTMP server: 接続の処理中にパニックが発生しました", "panic", r, "stack", string(debug.Stack()))
+				err = fmt.Errorf("パニックが発生しました: %v", r)
+			}
+		}()
+		return c.serve()
+	}()
+	if !c.publishing {
+		c.logger.Debug("RTMP server: 接続が終了しました", "error", err)
+		return
+	}
+	c.logger.Info("RTMP server: パブリッシャーの接続が終了しました", "error", err)
+	e := event{Type: eventPublisherDisconnected, Stream: c.server.stream.name, Path: c.path, Remote: c.remote}
+	if err != nil && !errors.Is(err, io.EOF) {
+		e.Reason = err.Error()
+	}
+	events.publish(e)
+}
+
+func (c *rtmpConn) serve() error {
+	_ = c.conn.SetDeadline(time.Now().Add(rtmpReadTimeout))
+	if err := c.handshake(); err != nil {
+		return fmt.Errorf("ハンドシェイクに失敗: %w", err)
+	}
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(rtmpReadTimeout))
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if err := c.handleMessage(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handshake はシンプルハンドシェイク (C0/C1/C2、S0/S1/S2) を行います
+func (c *rtmpConn) handshake() error {
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.br, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("サポートされていないRTMPバージョン %d", c0c1[0])
+	}
+	s0s1s2 := make([]byte, 1+2*rtmpHandshakeSize)
+	s0s1s2[0] = 3
+	// S1: 時刻 (4バイト)、0 (4バイト)、ランダムなデータ
+	binary.BigEndian.PutUint32(s0s1s2[1:], uint32(time.Now().Unix()))
+	_, _ = rand.Read(s0s1s2[9 : 1+rtmpHandshakeSize])
+	// S2: C1のエコー
+	copy(s0s1s2[1+rtmpHandshakeSize:], c0c1[1:])
+	if _, err := c.bw.Write(s0s1s2); err != nil {
+		return err
+	}
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	c2 := make([]byte, rtmpHandshakeSize)
+	_, err := io.ReadFull(c.br, c2)
+	return err
+}
+
+// readMessage はチャンクを読み取り、完成したメッセージを返します
+func (c *rtmpConn) readMessage() (*rtmpMessage, error) {
+	for {
+		b0, err := c.br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		format := b0 >> 6
+		csid := uint32(b0 & 0x3F)
+		switch csid {
+		case 0:
+			b, err := c.br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b)
+		case 1:
+			var b [2]byte
+			if _, err := io.ReadFull(c.br, b[:]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b[0]) + uint32(b[1])*256
+		}
+		cs := c.streams[csid]
+		if cs == nil {
+			if format != 0 {
+				return nil, fmt.Errorf("チャンクストリーム %d の最初のチャンクの形式が %d です", csid, format)
+			}
+			cs = &rtmpChunkStream{}
+			c.streams[csid] = cs
+		}
+
+		var hdr [11]byte
+		headerSize := [4]int{11, 7, 3, 0}[format]
+		if _, err := io.ReadFull(c.br, hdr[:headerSize]); err != nil {
+			return nil, err
+		}
+		starting := len(cs.buf) == 0
+		if format <= 2 {
+			ts := uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+			cs.extended = ts == 0xFFFFFF
+			if format <= 1 {
+				cs.length = uint32(hdr[3])<<16 | uint32(hdr[4])<<8 | uint32(hdr[5])
+				cs.typeID = hdr[6]
+			}
+			if format == 0 {
+				cs.streamID = binary.LittleEndian.Uint32(hdr[7:11])
+			}
+			if cs.extended {
+				if ts, err = c.readUint32(); err != nil {
+					return nil, err
+				}
+			}
+			if format == 0 {
+				cs.timestamp, cs.delta = ts, 0
+			} else {
+				cs.delta = ts
+				cs.timestamp += ts
+			}
+		} else {
+			if cs.extended {
+				if _, err := c.readUint32(); err != nil {
+					return nil, err
+				}
+			}
+			if starting {
+				cs.timestamp += cs.delta
+			}
+		}
+		if cs.length > rtmpMaxMessageSize {
+			return nil, fmt.Errorf("メッセージが大きすぎます (%d バイト)", cs.length)
+		}
+
+		n := min(c.inChunkSize, cs.length-uint32(len(cs.buf)))
+		start := len(cs.buf)
+		cs.buf = append(cs.buf, make([]byte, n)...)
+		if _, err := io.ReadFull(c.br, cs.buf[start:]); err != nil {
+			return nil, err
+		}
+		if err := c.acknowledge(); err != nil {
+			return nil, err
+		}
+		if uint32(len(cs.buf)) < cs.length {
+			continue
+		}
+		msg := &rtmpMessage{typeID: cs.typeID, streamID: cs.streamID, timestamp: cs.timestamp, payload: cs.buf}
+		cs.buf = nil
+		return msg, nil
+	}
+}
+
+func (c *rtmpConn) readUint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(c.br, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// acknowledge はパブリッシャーが指定したウィンドウサイズごとに受信バイト数を通知します
+func (c *rtmpConn) acknowledge() error {
+	received := c.received()
+	if c.ackWindow == 0 || received-c.lastAck < uint64(c.ackWindow) {
+		return nil
+	}
+	c.lastAck = received
+	return c.writeMessage(2, rtmpTypeAck, 0, binary.BigEndian.AppendUint32(nil, uint32(received)))
+}
+
+// received はバッファ済みで未読のデータを除いた受信バイト数を返します
+func (c *rtmpConn) received() uint64 {
+	return c.in.n - uint64(c.br.Buffered())
+}
+
+// writeMessage はメッセージをチャンクに分割して送信します
+func (c *rtmpConn) writeMessage(csid uint32, typeID uint8, streamID uint32, payload []byte) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(rtmpWriteTimeout))
+	hdr := []byte{byte(csid), 0, 0, 0, byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typeID}
+	hdr = binary.LittleEndian.AppendUint32(hdr, streamID)
+	if _, err := c.bw.Write(hdr); err != nil {
+		return err
+	}
+	for i := 0; i < len(payload); i += int(c.outChunk) {
+		if i > 0 {
+			if err := c.bw.WriteByte(0xC0 | byte(csid)); err != nil {
+				return err
+			}
+		}
+		if _, err := c.bw.Write(payload[i:min(i+int(c.outChunk), len(payload))]); err != nil {
+			return err
+		}
+	}
+	return c.bw.Flush()
+}
+
+func (c *rtmpConn) writeCommand(csid, streamID uint32, values ...interface{}) error {
+	return c.writeMessage(csid, rtmpTypeCommandAMF0, streamID, amf0Encode(values...))
+}
+
+func (c *rtmpConn) handleMessage(msg *rtmpMessage) error {
+	switch msg.typeID {
+	case rtmpTypeSetChunkSize:
+		if len(msg.payload) < 4 {
+			return fmt.Errorf("Set Chunk Size が不完全です")
+		}
+		size := binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF
+		if size < 1 || size > rtmpMaxMessageSize {
+			return fmt.Errorf("不正なチャンクサイズ %d", size)
+		}
+		c.inChunkSize = size
+	case rtmpTypeAbort:
+		if len(msg.payload) >= 4 {
+			if cs := c.streams[binary.BigEndian.Uint32(msg.payload)]; cs != nil {
+				cs.buf = nil
+			}
+		}
+	case rtmpTypeWindowAckSize:
+		if len(msg.payload) >= 4 {
+			c.ackWindow = binary.BigEndian.Uint32(msg.payload)
+		}
+	case rtmpTypeUserControl:
+		// Ping Request (6) には Ping Response (7) で応答する
+		if len(msg.payload) >= 6 && binary.BigEndian.Uint16(msg.payload) == 6 {
+			return c.writeMessage(2, rtmpTypeUserControl, 0, append([]byte{0, 7}, msg.payload[2:6]...))
+		}
+	case rtmpTypeCommandAMF0, rtmpTypeCommandAMF3:
+		payload := msg.payload
+		if msg.typeID == rtmpTypeCommandAMF3 && len(payload) > 0 {
+			payload = payload[1:] // AMF3コマンドも先頭の1バイトの後はAMF0でエンコードされる
+		}
+		values, err := amf0Decode(payload)
+		if err != nil {
+			return fmt.Errorf("コマンドを解析できません: %w", err)
+		}
+		if len(values) < 2 {
+			return fmt.Errorf("コマンドにコマンド名とトランザクションIDがありません")
+		}
+		return c.handleCommand(values)
+	case rtmpTypeDataAMF0, rtmpTypeDataAMF3:
+		if values, _ := amf0Decode(msg.payload); len(values) > 0 {
+			c.logger.Debug("RTMP server: メタデータを受信しました", "data", values)
+		}
+	case rtmpTypeVideo:
+		if c.publishing {
+			return c.handleVideo(msg)
+		}
+	case rtmpTypeAudio:
+		if c.publishing && !c.audioLogged && len(msg.payload) > 0 {
+			c.audioLogged = true
+			// SoundFormat 10 はAAC
+			c.logger.Info("RTMP server: 音声は配信しません (映像のみ)", "aac", msg.payload[0]>>4 == 10)
+		}
+	}
+	return nil
+}
+
+func (c *rtmpConn) handleCommand(values []interface{}) error {
+	name, _ := values[0].(string)
+	txid, _ := values[1].(float64)
+	switch name {
+	case "connect":
+		if len(values) > 2 {
+			if obj, ok := values[2].(map[string]interface{}); ok {
+				app, _ := obj["app"].(string)
+				// OBSなどはアプリ名にクエリを付加することがある
+				app, _, _ = strings.Cut(strings.Trim(app, "/"), "?")
+				c.app = app
+			}
+		}
+		if err := c.writeMessage(2, rtmpTypeWindowAckSize, 0, binary.BigEndian.AppendUint32(nil, rtmpWindowAckSize)); err != nil {
+			return err
+		}
+		if err := c.writeMessage(2, rtmpTypeSetPeerBandwidth, 0, append(binary.BigEndian.AppendUint32(nil, rtmpWindowAckSize), 2)); err != nil {
+			return err
+		}
+		if err := c.writeMessage(2, rtmpTypeSetChunkSize, 0, binary.BigEndian.AppendUint32(nil, rtmpOutChunkSize)); err != nil {
+			return err
+		}
+		c.outChunk = rtmpOutChunkSize
+		return c.writeCommand(3, 0, "_result", txid,
+			amf0Properties{{"fmsVer", "FMS/3,0,1,123"}, {"capabilities", 31}},
+			amf0Properties{{"level", "status"}, {"code", "NetConnection.Connect.Success"}, {"description", "Connection succeeded."}, {"objectEncoding", 0}})
+	case "releaseStream", "FCPublish":
+		return c.writeCommand(3, 0, "_result", txid, nil)
+	case "createStream":
+		return c.writeCommand(3, 0, "_result", txid, nil, rtmpStreamID)
+	case "publish":
+		key := ""
+		if len(values) > 3 {
+			key, _ = values[3].(string)
+		}
+		key, _, _ = strings.Cut(key, "?")
+		c.path = "/" + c.app + "/" + key
+		if (c.server.app != "" && c.app != c.server.app) || (c.server.key != "" && key != c.server.key) {
+			c.logger.Warn("RTMP server: 受け付けないパスへのPUBLISHを拒否しました", "path", c.path)
+			_ = c.writeCommand(5, rtmpStreamID, "onStatus", 0, nil,
+				amf0Properties{{"level", "error"}, {"code", "NetStream.Publish.BadName"}, {"description", "Invalid stream key."}})
+			return fmt.Errorf("受け付けないパス %s", c.path)
+		}
+		// User Control: Stream Begin
+		if err := c.writeMessage(2, rtmpTypeUserControl, 0, binary.BigEndian.AppendUint32([]byte{0, 0}, rtmpStreamID)); err != nil {
+			return err
+		}
+		if err := c.writeCommand(5, rtmpStreamID, "onStatus", 0, nil,
+			amf0Properties{{"level", "status"}, {"code", "NetStream.Publish.Start"}, {"description", "Start publishing."}}); err != nil {
+			return err
+		}
+		c.publishing = true
+		c.logger = c.logger.With("path", c.path)
+		c.server.setPublisher(c)
+		c.logger.Info("RTMP server: PUBLISHを開始しました")
+		events.publish(event{Type: eventPublisherConnected, Stream: c.server.stream.name, Path: c.path, Remote: c.remote})
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return io.EOF
+	}
+	return nil
+}
+
+// warnKey は警告の抑制に使用するキーです (ストリームと接続元ごと)
+func (c *rtmpConn) warnKey() string {
+	return "rtmp:" + c.server.stream.name + ":" + c.remote
+}
+
+// handleVideo はFLVの映像タグを解析します。
+// 従来の形式 (CodecID 7: AVC、12: HEVC) と Enhanced RTMP (FourCC avc1/hvc1) に対応します。
+func (c *rtmpConn) handleVideo(msg *rtmpMessage) error {
+	p := msg.payload
+	if len(p) < 5 {
+		return nil
+	}
+	var codec string
+	var config bool
+	var body []byte
+	if p[0]&0x80 != 0 {
+		// Enhanced RTMP: IsExHeader | FrameType (3ビット) | PacketType (4ビット) | FourCC
+		switch string(p[1:5]) {
+		case "avc1":
+			codec = "h264"
+		case "hvc1":
+			codec = "h265"
+		default:
+			warnRateLimited(c.logger, c.warnKey(), "RTMP server: サポートされていない映像コーデック", "fourcc", string(p[1:5]))
+			return nil
+		}
+		switch p[0] & 0x0F {
+		case 0: // SequenceStart
+			config, body = true, p[5:]
+		case 1: // CodedFrames (コンポジション時間 3バイトの後にデータ)
+			if len(p) < 8 {
+				return nil
+			}
+			body = p[8:]
+		case 3: // CodedFramesX (コンポジション時間なし)
+			body = p[5:]
+		default:
+			return nil
+		}
+	} else {
+		// FrameType (4ビット) | CodecID (4ビット) | AVCPacketType | コンポジション時間 (3バイト)
+		switch p[0] & 0x0F {
+		case 7:
+			codec = "h264"
+		case 12:
+			codec = "h265"
+		default:
+			warnRateLimited(c.logger, c.warnKey(), "RTMP server: サポートされていない映像コーデック", "codec_id", p[0]&0x0F)
+			return nil
+		}
+		switch p[1] {
+		case 0:
+			config, body = true, p[5:]
+		case 1:
+			body = p[5:]
+		default:
+			return nil
+		}
+	}
+
+	s := c.server.stream
+	if config {
+		params, lengthSize, err := parseDecoderConfig(codec, body)
+		if err != nil {
+			c.logger.Warn("RTMP server: シーケンスヘッダーを解析できません", "codec", codec, "error", err)
+			return nil
+		}
+		c.logger.Info("RTMP server: 映像のシーケンスヘッダーを受信しました", "codec", codec)
+		c.codec, c.nalLengthSize = codec, lengthSize
+		if s.currentCodec() != codec {
+			s.setCodec(codec)
+		}
+		c.writeNALs(params, defaultFrameDuration)
+		return nil
+	}
+	if codec != c.codec {
+		return nil // シーケンスヘッダーを受信するまで待つ
+	}
+	nals, err := splitLengthPrefixed(body, c.nalLengthSize)
+	if err != nil {
+		warnRateLimited(c.logger, c.warnKey(), "RTMP server: 映像データを解析できません", "error", err)
+		return nil
+	}
+	c.writeNALs(nals, c.timer.next(int64(msg.timestamp)))
+	return nil
+}
+
+func (c *rtmpConn) writeNALs(nals [][]byte, duration time.Duration) {
+	if len(nals) == 0 {
+		return
+	}
+	if c.codec == "h265" {
+		c.server.stream.writeNALsToTracksH265(nals, duration)
+	} else {
+		c.server.stream.writeNALsToTracks(nals, duration)
+	}
+}
+
+// parseDecoderConfig は AVCDecoderConfigurationRecord または HEVCDecoderConfigurationRecord から
+// パラメータセットとNALユニットの長さフィールドのバイト数を取り出します
+func parseDecoderConfig(codec string, b []byte) ([][]byte, int, error) {
+	var params [][]byte
+	readNALs := func(b []byte, count int) ([]byte, error) {
+		for i := 0; i < count; i++ {
+			if len(b) < 2 {
+				return nil, fmt.Errorf("パラメータセットが不完全です")
+			}
+			n := int(binary.BigEndian.Uint16(b))
+			if len(b)-2 < n {
+				return nil, fmt.Errorf("パラメータセットが不完全です")
+			}
+			params = append(params, append([]byte(nil), b[2:2+n]...))
+			b = b[2+n:]
+		}
+		return b, nil
+	}
+	if codec == "h265" {
+		if len(b) < 23 {
+			return nil, 0, fmt.Errorf("HEVCDecoderConfigurationRecord が短すぎます")
+		}
+		lengthSize := int(b[21]&0x03) + 1
+		arrays := int(b[22])
+		b = b[23:]
+		for i := 0; i < arrays; i++ {
+			if len(b) < 3 {
+				return nil, 0, fmt.Errorf("HEVCDecoderConfigurationRecord が不完全です")
+			}
+			count := int(binary.BigEndian.Uint16(b[1:3]))
+			var err error
+			if b, err = readNALs(b[3:], count); err != nil {
+				return nil, 0, err
+			}
+		}
+		return params, lengthSize, nil
+	}
+	if len(b) < 6 {
+		return nil, 0, fmt.Errorf("AVCDecoderConfigurationRecord が短すぎます")
+	}
+	lengthSize := int(b[4]&0x03) + 1
+	rest, err := readNALs(b[6:], int(b[5]&0x1F))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(rest) < 1 {
+		return nil, 0, fmt.Errorf("AVCDecoderConfigurationRecord にPPSがありません")
+	}
+	if _, err := readNALs(rest[1:], int(rest[0])); err != nil {
+		return nil, 0, err
+	}
+	return params, lengthSize, nil
+}
+
+// splitLengthPrefixed は長さフィールド付きのNALユニット列 (AVCC形式) を分割します
+func splitLengthPrefixed(b []byte, lengthSize int) ([][]byte, error) {
+	var nals [][]byte
+	for len(b) > 0 {
+		if len(b) < lengthSize {
+			return nil, fmt.Errorf("NALユニットの長さが不完全です")
+		}
+		var n int
+		for _, v := range b[:lengthSize] {
+			n = n<<8 | int(v)
+		}
+		b = b[lengthSize:]
+		if n > len(b) {
+			return nil, fmt.Errorf("NALユニットが不完全です (%d > %d)", n, len(b))
+		}
+		if n > 0 {
+			nals = append(nals, b[:n])
+		}
+		b = b[n:]
+	}
+	return nals, nil
+}
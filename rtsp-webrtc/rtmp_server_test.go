@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestRTMPConn は data を受信データとする rtmpConn を作成します (送信を伴わない処理のテスト用)
+func newTestRTMPConn(data []byte) *rtmpConn {
+	in := &rtmpCountingReader{r: bytes.NewReader(data)}
+	return &rtmpConn{
+		server:      &rtmpServer{stream: newStream("rtmp-test", "")},
+		in:          in,
+		br:          bufio.NewReader(in),
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		inChunkSize: 128,
+		outChunk:    128,
+		streams:     make(map[uint32]*rtmpChunkStream),
+		timer:       frameTimer{clockRate: 1000, wrap: 1 << 32},
+	}
+}
+
+// rtmpChunk0 は形式0 (フルヘッダー) のチャンクヘッダーを作成します
+func rtmpChunk0(csid byte, timestamp uint32, length int, typeID uint8, streamID uint32) []byte {
+	return []byte{
+		csid,
+		byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp),
+		byte(length >> 16), byte(length >> 8), byte(length),
+		typeID,
+		byte(streamID), byte(streamID >> 8), byte(streamID >> 16), byte(streamID >> 24),
+	}
+}
+
+func TestRTMPReadMessage(t *testing.T) {
+	payload200 := bytes.Repeat([]byte{0xAB}, 200)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []rtmpMessage
+		wantErr bool // io.EOF 以外のエラーで終了する
+	}{
+		{name: "空", data: nil},
+		{
+			name: "1チャンク",
+			data: concat(rtmpChunk0(3, 100, 3, rtmpTypeCommandAMF0, 0), []byte{1, 2, 3}),
+			want: []rtmpMessage{{typeID: rtmpTypeCommandAMF0, timestamp: 100, payload: []byte{1, 2, 3}}},
+		},
+		{
+			name: "複数チャンクに分割",
+			data: concat(rtmpChunk0(4, 0, 200, rtmpTypeVideo, 1), payload200[:128], []byte{0xC4}, payload200[128:]),
+			want: []rtmpMessage{{typeID: rtmpTypeVideo, streamID: 1, payload: payload200}},
+		},
+		{
+			name: "拡張タイムスタンプ",
+			data: concat(rtmpChunk0(4, 0xFFFFFF, 1, rtmpTypeVideo, 1), []byte{0x01, 0x00, 0x00, 0x00}, []byte{9}),
+			want: []rtmpMessage{{typeID: rtmpTypeVideo, streamID: 1, timestamp: 0x01000000, payload: []byte{9}}},
+		},
+		{
+			name: "形式1・2・3のタイムスタンプ差分",
+			data: concat(
+				rtmpChunk0(4, 1000, 1, rtmpTypeVideo, 1), []byte{1},
+				[]byte{0x44, 0, 0, 40, 0, 0, 2, rtmpTypeAudio}, []byte{2, 2}, // 形式1: 差分40、長さと種類を変更
+				[]byte{0x84, 0, 0, 20}, []byte{3, 3}, // 形式2: 差分20
+				[]byte{0xC4}, []byte{4, 4}, // 形式3: 直前の差分を繰り返す
+			),
+			want: []rtmpMessage{
+				{typeID: rtmpTypeVideo, streamID: 1, timestamp: 1000, payload: []byte{1}},
+				{typeID: rtmpTypeAudio, streamID: 1, timestamp: 1040, payload: []byte{2, 2}},
+				{typeID: rtmpTypeAudio, streamID: 1, timestamp: 1060, payload: []byte{3, 3}},
+				{typeID: rtmpTypeAudio, streamID: 1, timestamp: 1080, payload: []byte{4, 4}},
+			},
+		},
+		{
+			name: "2バイトのチャンクストリームID",
+			data: concat([]byte{0x00, 10}, rtmpChunk0(0, 5, 1, rtmpTypeVideo, 1)[1:], []byte{7}),
+			want: []rtmpMessage{{typeID: rtmpTypeVideo, streamID: 1, timestamp: 5, payload: []byte{7}}},
+		},
+		{
+			name: "3バイトのチャンクストリームID",
+			data: concat([]byte{0x01, 10, 1}, rtmpChunk0(0, 5, 1, rtmpTypeVideo, 1)[1:], []byte{7}),
+			want: []rtmpMessage{{typeID: rtmpTypeVideo, streamID: 1, timestamp: 5, payload: []byte{7}}},
+		},
+		{
+			name:    "最初のチャンクがフルヘッダーでない",
+			data:    []byte{0x43, 0, 0, 0, 0, 0, 1, rtmpTypeVideo, 1},
+			wantErr: true,
+		},
+		{
+			name:    "ヘッダーが途中で切れた",
+			data:    rtmpChunk0(3, 0, 3, rtmpTypeCommandAMF0, 0)[:6],
+			wantErr: true,
+		},
+		{
+			name:    "拡張タイムスタンプが途中で切れた",
+			data:    concat(rtmpChunk0(3, 0xFFFFFF, 3, rtmpTypeCommandAMF0, 0), []byte{0, 0}),
+			wantErr: true,
+		},
+		{
+			name:    "ペイロードが途中で切れた",
+			data:    concat(rtmpChunk0(3, 0, 3, rtmpTypeCommandAMF0, 0), []byte{1}),
+			wantErr: true,
+		},
+		{
+			name:    "チャンクストリームIDが途中で切れた",
+			data:    []byte{0x01, 10},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestRTMPConn(tt.data)
+			var got []rtmpMessage
+			var err error
+			for {
+				var msg *rtmpMessage
+				if msg, err = c.readMessage(); err != nil {
+					break
+				}
+				got = append(got, *msg)
+			}
+			if gotErr := !errors.Is(err, io.EOF); gotErr != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRTMPHandleMalformedMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     rtmpMessage
+		wantErr bool
+	}{
+		{name: "空のコマンド", msg: rtmpMessage{typeID: rtmpTypeCommandAMF0}, wantErr: true},
+		{name: "コマンド名のみ", msg: rtmpMessage{typeID: rtmpTypeCommandAMF0, payload: amf0Encode("connect")}, wantErr: true},
+		{name: "トランザクションIDのみ", msg: rtmpMessage{typeID: rtmpTypeCommandAMF0, payload: amf0Encode(1)}, wantErr: true},
+		{name: "途中で切れたコマンド", msg: rtmpMessage{typeID: rtmpTypeCommandAMF0, payload: amf0Encode("connect", 1)[:12]}, wantErr: true},
+		{name: "空のAMF3コマンド", msg: rtmpMessage{typeID: rtmpTypeCommandAMF3}, wantErr: true},
+		{name: "AMF3コマンドの先頭のみ", msg: rtmpMessage{typeID: rtmpTypeCommandAMF3, payload: []byte{0}}, wantErr: true},
+		{name: "入れ子が深すぎるコマンド", msg: rtmpMessage{typeID: rtmpTypeCommandAMF0, payload: nestedAMF0Arrays(100000)}, wantErr: true},
+		{name: "不明なコマンド", msg: rtmpMessage{typeID: rtmpTypeCommandAMF0, payload: amf0Encode("unknown", 1)}},
+		{name: "Set Chunk Size が不完全", msg: rtmpMessage{typeID: rtmpTypeSetChunkSize, payload: []byte{0, 0}}, wantErr: true},
+		{name: "チャンクサイズが0", msg: rtmpMessage{typeID: rtmpTypeSetChunkSize, payload: []byte{0, 0, 0, 0}}, wantErr: true},
+		{name: "Abort が不完全", msg: rtmpMessage{typeID: rtmpTypeAbort, payload: []byte{0}}},
+		{name: "Window Acknowledgement Size が不完全", msg: rtmpMessage{typeID: rtmpTypeWindowAckSize, payload: []byte{0}}},
+		{name: "User Control が不完全", msg: rtmpMessage{typeID: rtmpTypeUserControl, payload: []byte{0, 6}}},
+		{name: "不正なメタデータ", msg: rtmpMessage{typeID: rtmpTypeDataAMF0, payload: []byte{0xFF}}},
+		{name: "PUBLISH前の映像", msg: rtmpMessage{typeID: rtmpTypeVideo, payload: []byte{0x17, 0, 0, 0, 0, 0xFF}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestRTMPConn(nil)
+			msg := tt.msg
+			if err := c.handleMessage(&msg); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestRTMPConnShortCommand はハンドシェイク後に引数の不足したコマンドを受信した接続が
+// パニックせずに切断されることを確認します
+func TestRTMPConnShortCommand(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := newTestRTMPConn(nil)
+	c.conn = server
+	c.in = &rtmpCountingReader{r: server}
+	c.br = bufio.NewReader(c.in)
+	c.bw = bufio.NewWriter(server)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.run()
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	c0c1[0] = 3
+	if _, err := client.Write(c0c1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 1+2*rtmpHandshakeSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(make([]byte, rtmpHandshakeSize)); err != nil {
+		t.Fatal(err)
+	}
+	cmd := amf0Encode("connect")
+	if _, err := client.Write(concat(rtmpChunk0(3, 0, len(cmd), rtmpTypeCommandAMF0, 0), cmd)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("接続が切断されない")
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("接続が閉じられていない")
+	}
+}
+
+func TestRTMPHandleMalformedVideo(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"空", nil},
+		{"ヘッダーが途中で切れた", []byte{0x17, 0x00}},
+		{"サポートされていないコーデック", []byte{0x12, 0, 0, 0, 0}},
+		{"サポートされていないFourCC", []byte{0x90, 'a', 'v', '0', '1'}},
+		{"AVCのシーケンスヘッダーが不完全", []byte{0x17, 0, 0, 0, 0, 1, 0x64}},
+		{"HEVCのシーケンスヘッダーが不完全", []byte{0x90, 'h', 'v', 'c', '1', 1}},
+		{"Enhanced RTMPのコンポジション時間が途中で切れた", []byte{0x91, 'a', 'v', 'c', '1', 0}},
+		{"シーケンスヘッダーの前の映像", []byte{0x17, 1, 0, 0, 0, 0, 0, 0, 1, 0x65}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestRTMPConn(nil)
+			c.publishing = true
+			if err := c.handleVideo(&rtmpMessage{typeID: rtmpTypeVideo, payload: tt.payload}); err != nil {
+				t.Errorf("err = %v", err)
+			}
+			if c.codec != "" {
+				t.Errorf("codec = %q, want \"\"", c.codec)
+			}
+		})
+	}
+}
+
+func TestParseDecoderConfig(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0x00, 0x1f}
+	pps := []byte{0x68, 0xce}
+	avcc := concat([]byte{1, 0x42, 0x00, 0x1f, 0xFF, 0xE1, 0, 4}, sps, []byte{1, 0, 2}, pps)
+
+	vps := []byte{0x40, 0x01}
+	hvcc := concat(make([]byte, 21), []byte{0x03, 1, 0x20, 0, 1, 0, 2}, vps)
+
+	tests := []struct {
+		name           string
+		codec          string
+		data           []byte
+		wantParams     [][]byte
+		wantLengthSize int
+		wantErr        bool
+	}{
+		{name: "AVC", codec: "h264", data: avcc, wantParams: [][]byte{sps, pps}, wantLengthSize: 4},
+		{name: "AVCが短すぎる", codec: "h264", data: avcc[:5], wantErr: true},
+		{name: "SPSが途中で切れた", codec: "h264", data: avcc[:10], wantErr: true},
+		{name: "PPSの数がない", codec: "h264", data: avcc[:12], wantErr: true},
+		{name: "PPSが途中で切れた", codec: "h264", data: avcc[:len(avcc)-1], wantErr: true},
+		{name: "HEVC", codec: "h265", data: hvcc, wantParams: [][]byte{vps}, wantLengthSize: 4},
+		{name: "HEVCが短すぎる", codec: "h265", data: hvcc[:22], wantErr: true},
+		{name: "HEVCの配列が途中で切れた", codec: "h265", data: hvcc[:24], wantErr: true},
+		{name: "HEVCのパラメータセットが途中で切れた", codec: "h265", data: hvcc[:len(hvcc)-1], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, lengthSize, err := parseDecoderConfig(tt.codec, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) || lengthSize != tt.wantLengthSize {
+				t.Errorf("got %v, %d; want %v, %d", params, lengthSize, tt.wantParams, tt.wantLengthSize)
+			}
+		})
+	}
+}
+
+func TestSplitLengthPrefixed(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		lengthSize int
+		want       [][]byte
+		wantErr    bool
+	}{
+		{name: "空", data: nil, lengthSize: 4},
+		{name: "4バイトの長さ", data: []byte{0, 0, 0, 2, 0x65, 1, 0, 0, 0, 1, 0x41}, lengthSize: 4, want: [][]byte{{0x65, 1}, {0x41}}},
+		{name: "1バイトの長さ", data: []byte{1, 0x41, 2, 0x41, 2}, lengthSize: 1, want: [][]byte{{0x41}, {0x41, 2}}},
+		{name: "長さ0のNALは無視", data: []byte{0, 0, 0, 1, 0x41}, lengthSize: 2, want: [][]byte{{0x41}}},
+		{name: "長さが途中で切れた", data: []byte{0, 0, 0, 1, 0x41, 0, 0}, lengthSize: 4, wantErr: true},
+		{name: "NALが途中で切れた", data: []byte{0, 0, 0, 5, 0x41}, lengthSize: 4, wantErr: true},
+		{name: "長さの上限", data: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x41}, lengthSize: 4, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitLengthPrefixed(tt.data, tt.lengthSize)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
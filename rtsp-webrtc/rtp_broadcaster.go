@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strconv"
@@ -24,6 +26,8 @@ type SDPInfo struct {
 
 // RTPClient はRTP接続を管理するクライアント構造体
 type RTPClient struct {
+	stream       *stream // 配信先のストリーム
+	logger       *slog.Logger
 	conn         *net.UDPConn
 	sdpInfo      *SDPInfo
 	isRunning    bool
@@ -34,8 +38,10 @@ type RTPClient struct {
 }
 
 // NewRTPClient は新しいRTPクライアントを作成
-func NewRTPClient() *RTPClient {
+func NewRTPClient(s *stream) *RTPClient {
 	return &RTPClient{
+		stream:      s,
+		logger:      s.logger.With("component", "rtp-client"),
 		packetChan:  make(chan []byte, 100),
 		nalChan:     make(chan [][]byte, 50),
 		sdpReceived: false,
@@ -96,8 +102,7 @@ func ParseSDP(sdpContent string) (*SDPInfo, error) {
 		return nil, fmt.Errorf("SDP解析エラー: ホストまたはポートが見つかりません")
 	}
 	
-	log.Printf("RTP Client: SDP解析完了 - Host: %s, Port: %d, Codec: %s, PayloadType: %d", 
-		info.Host, info.Port, info.CodecName, info.PayloadType)
+	slog.Debug("RTP Client: SDP解析完了", "host", info.Host, "port", info.Port, "codec", info.CodecName, "payload_type", info.PayloadType)
 		return info, nil
 }
 
@@ -165,8 +170,7 @@ func (client *RTPClient) ParseSDPFromRTPPacket(packet []byte) (*SDPInfo, error)
 		info.FmtpLine = fmt.Sprintf("%d profile-id=1;level-id=93;tier-flag=0", payloadType)
 	}
 	
-	log.Printf("RTP Client: パケットからSDP情報を推測 - Codec: %s, PayloadType: %d", 
-		codecName, payloadType)
+	client.logger.Info("RTP Client: パケットからSDP情報を推測", "codec", codecName, "payload_type", payloadType)
 	
 	return info, nil
 }
@@ -193,8 +197,8 @@ func (client *RTPClient) Connect(sdpContent string) error {
 	}
 	
 	client.conn = conn
-	log.Printf("RTP Client: %s:%d に接続しました (Codec: %s)", sdpInfo.Host, sdpInfo.Port, sdpInfo.CodecName)
-	log.Printf("RTP Client: ローカルアドレス: %s, リモートアドレス: %s", conn.LocalAddr(), conn.RemoteAddr())
+	client.logger.Info("RTP Client: 接続しました", "host", sdpInfo.Host, "port", sdpInfo.Port, "codec", sdpInfo.CodecName,
+		"local", conn.LocalAddr(), "remote", conn.RemoteAddr())
 	
 	return nil
 }
@@ -216,7 +220,7 @@ func (client *RTPClient) ConnectAsServer(listenAddr string) error {
 	client.conn = conn
 	client.waitingSDP = true
 	
-	log.Printf("RTP Client: %s でUDPサーバーを開始しました（SDP情報を待機中）", listenAddr)
+	client.logger.Info("RTP Client: UDPサーバーを開始しました（SDP情報を待機中）", "addr", listenAddr)
 	
 	return nil
 }
@@ -238,13 +242,17 @@ func (client *RTPClient) StartReceiving() error {
 	// WebRTC配信ゴルーチン
 	go client.streamToWebRTC()
 	
-	log.Printf("RTP Client: パケット受信を開始しました")
+	client.logger.Info("RTP Client: パケット受信を開始しました")
 	return nil
 }
 
 // receiveRTPPackets はUDPソケットからRTPパケットを受信
 func (client *RTPClient) receiveRTPPackets() {
 	buffer := make([]byte, 1500) // MTU考慮
+	received := rtpPacketsReceived.with(sourceRTPClient, client.stream.name)
+	lost := rtpPacketsLost.with(sourceRTPClient, client.stream.name)
+	drops := channelDrops.with(client.stream.name, "rtp-client-packet")
+	var loss rtpLossTracker
 	
 	for client.isRunning {
 		client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
@@ -263,16 +271,16 @@ func (client *RTPClient) receiveRTPPackets() {
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				if client.sdpInfo != nil {
-					log.Printf("RTP Client: 受信タイムアウト（5秒） - 送信側 %s からのパケットを待機中...", client.sdpInfo.Host)
+					warnRateLimited(client.logger, client.stream.name, "RTP Client: 受信タイムアウト（5秒） - 送信側からのパケットを待機中...", "host", client.sdpInfo.Host)
 				} else {
-					log.Printf("RTP Client: 受信タイムアウト（5秒） - RTPパケットを待機中...")
+					warnRateLimited(client.logger, client.stream.name, "RTP Client: 受信タイムアウト（5秒） - RTPパケットを待機中...")
 				}
 				continue // タイムアウトは無視
 			}
 			if !client.isRunning {
 				break
 			}
-			log.Printf("RTP Client: パケット受信エラー: %v", err)
+			warnRateLimited(client.logger, client.stream.name, "RTP Client: パケット受信エラー", "error", err)
 			continue
 		}
 		
@@ -285,7 +293,7 @@ func (client *RTPClient) receiveRTPPackets() {
 			if client.waitingSDP && !client.sdpReceived {
 				sdpInfo, err := client.ParseSDPFromRTPPacket(packet)
 				if err != nil {
-					log.Printf("RTP Client: パケットからのSDP解析エラー: %v", err)
+					warnRateLimited(client.logger, client.stream.name, "RTP Client: パケットからのSDP解析エラー", "error", err)
 					continue
 				}
 				
@@ -302,19 +310,22 @@ func (client *RTPClient) receiveRTPPackets() {
 				client.waitingSDP = false
 				
 				// 適切なコーデックモードを設定
-				setCurrentCodec(strings.ToLower(client.sdpInfo.CodecName))
+				client.stream.setCodec(strings.ToLower(client.sdpInfo.CodecName))
 				
-				log.Printf("RTP Client: SDP情報を受信しました - Host: %s, Port: %d, Codec: %s, PayloadType: %d", 
-					sdpInfo.Host, sdpInfo.Port, sdpInfo.CodecName, sdpInfo.PayloadType)
+				client.logger.Info("RTP Client: SDP情報を受信しました", "host", sdpInfo.Host, "port", sdpInfo.Port,
+					"codec", sdpInfo.CodecName, "payload_type", sdpInfo.PayloadType)
 			}
 			
 			// SDP情報が設定されている場合のみパケットを処理
 			if client.sdpReceived {
+				received.Add(1)
+				lost.Add(loss.update(binary.BigEndian.Uint16(packet[2:4])))
 				select {
 				case client.packetChan <- packet:
 				default:
 					// チャネルが満杯の場合は古いパケットを破棄
-					log.Printf("RTP Client: パケットチャネルが満杯です")
+					drops.Add(1)
+					warnRateLimited(client.logger, client.stream.name, "RTP Client: パケットチャネルが満杯です")
 				}
 			}
 		}
@@ -323,6 +334,7 @@ func (client *RTPClient) receiveRTPPackets() {
 
 // processRTPPackets はRTPパケットを処理してNALユニットを抽出
 func (client *RTPClient) processRTPPackets() {
+	drops := channelDrops.with(client.stream.name, "rtp-client-nal")
 	for client.isRunning {
 		select {
 		case packet := <-client.packetChan:
@@ -331,7 +343,8 @@ func (client *RTPClient) processRTPPackets() {
 				select {
 				case client.nalChan <- nals:
 				default:
-					log.Printf("RTP Client: NALチャネルが満杯です")
+					drops.Add(1)
+					warnRateLimited(client.logger, client.stream.name, "RTP Client: NALチャネルが満杯です")
 				}
 			}
 		case <-time.After(1 * time.Second):
@@ -355,13 +368,13 @@ func (client *RTPClient) extractNALUnits(packet []byte) [][]byte {
 	marker := (packet[1] >> 7) & 0x01
 	payloadType := packet[1] & 0x7F
 		if version != 2 {
-		log.Printf("RTP Client: 無効なRTPバージョン: %d", version)
+		warnRateLimited(client.logger, client.stream.name, "RTP Client: 無効なRTPバージョン", "version", version)
 		return nil
 	}
 	
 	// sdpInfoがまだ設定されていない場合は、ペイロードタイプのチェックをスキップ
 	if client.sdpInfo != nil && int(payloadType) != client.sdpInfo.PayloadType {
-		log.Printf("RTP Client: 予期しないペイロードタイプ: %d (期待値: %d)", payloadType, client.sdpInfo.PayloadType)
+		warnRateLimited(client.logger, client.stream.name, "RTP Client: 予期しないペイロードタイプ", "payload_type", payloadType, "expected", client.sdpInfo.PayloadType)
 		return nil
 	}
 	
@@ -407,7 +420,7 @@ func (client *RTPClient) extractNALUnits(packet []byte) [][]byte {
 	case "H265":
 		return client.extractH265NALs(payload, marker == 1)
 	default:
-		log.Printf("RTP Client: サポートされていないコーデック: %s", codecName)
+		warnRateLimited(client.logger, client.stream.name, "RTP Client: サポートされていないコーデック", "codec", codecName)
 		return nil
 	}
 }
@@ -583,18 +596,18 @@ func (client *RTPClient) streamToWebRTC() {
 			if len(nals) > 0 {
 				// sdpInfoが設定されていない場合はスキップ
 				if client.sdpInfo == nil {
-					log.Printf("RTP Client: SDP情報が未設定のため、NALユニットをスキップします")
+					warnRateLimited(client.logger, client.stream.name, "RTP Client: SDP情報が未設定のため、NALユニットをスキップします")
 					continue
 				}
 				
 				// 現在のコーデックに応じて適切な関数を呼び出し
 				switch client.sdpInfo.CodecName {
 				case "H264":
-					writeNALsToTracks(nals, frameDuration)
+					client.stream.writeNALsToTracks(nals, frameDuration)
 				case "H265":
-					writeNALsToTracksH265(nals, frameDuration)
+					client.stream.writeNALsToTracksH265(nals, frameDuration)
 				default:
-					log.Printf("RTP Client: サポートされていないコーデック: %s", client.sdpInfo.CodecName)
+					warnRateLimited(client.logger, client.stream.name, "RTP Client: サポートされていないコーデック", "codec", client.sdpInfo.CodecName)
 				}
 			}
 		case <-time.After(1 * time.Second):
@@ -612,33 +625,33 @@ func (client *RTPClient) Stop() {
 		client.conn = nil
 	}
 	
-	close(client.packetChan)
-	close(client.nalChan)
+	// 受信・処理ゴルーチンは isRunning で終了するため、チャネルはクローズしない
+	// (受信中のゴルーチンがクローズ済みチャネルへ送信するのを防ぐ)
 	
-	log.Printf("RTP Client: 停止しました")
+	client.logger.Info("RTP Client: 停止しました")
 }
 
 // startRTPClient はRTP接続を開始する関数（既存のハンドラーと統合用）
-func startRTPClient(inputURL string) {
-	log.Printf("RTP Client: %s への接続を開始します", inputURL)
+func startRTPClient(ctx context.Context, s *stream, inputURL string) {
+	logger := s.logger.With("component", "rtp-client")
+	logger.Info("RTP Client: 接続を開始します", "input", inputURL)
 	
 	// 接続テストを実行
 	if strings.HasPrefix(inputURL, "rtp://") {
 		address := strings.TrimPrefix(inputURL, "rtp://")
-		log.Printf("RTP Client: 接続テストを実行中... (%s)", address)
+		logger.Info("RTP Client: 接続テストを実行中...", "addr", address)
 		
 		// 非ブロッキングでテストを実行
 		go func() {
 			if err := TestRTPConnection(address); err != nil {
-				log.Printf("RTP Client: 接続テスト失敗: %v", err)
-				log.Printf("RTP Client: 送信側が %s にRTPパケットを送信していることを確認してください", address)
+				logger.Warn("RTP Client: 接続テスト失敗 (送信側がRTPパケットを送信していることを確認してください)", "addr", address, "error", err)
 			} else {
-				log.Printf("RTP Client: 接続テスト成功！")
+				logger.Info("RTP Client: 接続テスト成功！")
 			}
 		}()
 	}
 	
-	client := NewRTPClient()
+	client := NewRTPClient(s)
 	defer client.Stop()
 		// inputURLがSDPファイルパスの場合、ファイルから読み込み
 	var sdpContent string
@@ -646,7 +659,7 @@ func startRTPClient(inputURL string) {
 		// SDPファイルから読み込み
 		file, err := os.Open(inputURL)
 		if err != nil {
-			log.Printf("RTP Client: SDPファイル読み込みエラー: %v", err)
+			logger.Error("RTP Client: SDPファイル読み込みエラー", "error", err)
 			return
 		}
 		defer file.Close()
@@ -656,7 +669,7 @@ func startRTPClient(inputURL string) {
 		for {
 			line, err := reader.ReadString('\n')
 			if err != nil && err != io.EOF {
-				log.Printf("RTP Client: SDPファイル読み込みエラー: %v", err)
+				logger.Error("RTP Client: SDPファイル読み込みエラー", "error", err)
 				return
 			}
 			if line != "" {
@@ -667,7 +680,7 @@ func startRTPClient(inputURL string) {
 			}
 		}
 		sdpContent = strings.Join(lines, "\r\n")
-		log.Printf("RTP Client: SDPファイル読み込み完了: %s", inputURL)
+		logger.Info("RTP Client: SDPファイル読み込み完了", "path", inputURL)
 	} else {
 		// RTP URLから動的にSDP生成（既存のgenerateSDPContent関数を使用）
 		codecName := "H264" // デフォルト
@@ -677,56 +690,56 @@ func startRTPClient(inputURL string) {
 				var err error
 		sdpContent, err = generateSDPContent(inputURL, codecName)
 		if err != nil {
-			log.Printf("RTP Client: SDP生成エラー: %v", err)
+			logger.Error("RTP Client: SDP生成エラー", "error", err)
 			return
 		}
-		log.Printf("RTP Client: 動的SDP生成完了:\n%s", sdpContent)
+		logger.Debug("RTP Client: 動的SDP生成完了", "sdp", sdpContent)
 	}
 	
 	// RTP接続を確立
 	if err := client.Connect(sdpContent); err != nil {
-		log.Printf("RTP Client: 接続エラー: %v", err)
+		logger.Error("RTP Client: 接続エラー", "error", err)
 		return
 	}
 	
 	// 適切なコーデックモードを設定
-	setCurrentCodec(strings.ToLower(client.sdpInfo.CodecName))
+	client.stream.setCodec(strings.ToLower(client.sdpInfo.CodecName))
 	
 	// パケット受信を開始
 	if err := client.StartReceiving(); err != nil {
-		log.Printf("RTP Client: 受信開始エラー: %v", err)
+		logger.Error("RTP Client: 受信開始エラー", "error", err)
 		return
 	}
-		// サーバーが動作している間は待機
-	select {}
+	// コンテキスト (オンデマンド入力の停止) が終了するまで待機
+	<-ctx.Done()
 }
 
 // startRTPServer はRTPサーバーとして動作し、最初のパケットでSDP情報を受信する
-func startRTPServer(listenAddr string) {
-	log.Printf("RTP Server: %s でRTPサーバーを開始します（SDP情報を動的受信）", listenAddr)
+func startRTPServer(ctx context.Context, s *stream, listenAddr string) {
+	s.logger.Info("RTP Server: RTPサーバーを開始します（SDP情報を動的受信）", "addr", listenAddr)
 	
-	client := NewRTPClient()
+	client := NewRTPClient(s)
 	defer client.Stop()
 	
 	// UDPサーバーとして接続を確立
 	if err := client.ConnectAsServer(listenAddr); err != nil {
-		log.Printf("RTP Server: サーバー開始エラー: %v", err)
+		s.logger.Error("RTP Server: サーバー開始エラー", "error", err)
 		return
 	}
 	
 	// パケット受信を開始
 	if err := client.StartReceiving(); err != nil {
-		log.Printf("RTP Server: 受信開始エラー: %v", err)
+		s.logger.Error("RTP Server: 受信開始エラー", "error", err)
 		return
 	}
 	
-	// サーバーが動作している間は待機
-	select {}
+	// コンテキストが終了するまで待機
+	<-ctx.Done()
 }
 
 // TestRTPConnection はRTP接続をテストする関数
 func TestRTPConnection(address string) error {
-	log.Printf("RTP Client: 接続テスト開始 - %s", address)
+	slog.Debug("RTP Client: 接続テスト開始", "addr", address)
 	
 	// UDPアドレスを解決
 	udpAddr, err := net.ResolveUDPAddr("udp", address)
@@ -741,7 +754,7 @@ func TestRTPConnection(address string) error {
 	}
 	defer conn.Close()
 	
-	log.Printf("RTP Client: %s でUDPパケット待機中...", address)
+	slog.Debug("RTP Client: UDPパケット待機中...", "addr", address)
 	
 	// タイムアウト付きでパケット受信を試行
 	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
@@ -755,7 +768,7 @@ func TestRTPConnection(address string) error {
 		return fmt.Errorf("パケット受信エラー: %v", err)
 	}
 	
-	log.Printf("RTP Client: パケット受信成功！送信者: %s, サイズ: %d bytes", remoteAddr.String(), n)
+	slog.Info("RTP Client: パケット受信成功！", "sender", remoteAddr.String(), "bytes", n)
 	
 	// RTPパケットの基本検証
 	if n < 12 {
@@ -768,7 +781,7 @@ func TestRTPConnection(address string) error {
 	}
 	
 	payloadType := buffer[1] & 0x7F
-	log.Printf("RTP Client: 有効なRTPパケットを検出 - PayloadType: %d", payloadType)
+	slog.Info("RTP Client: 有効なRTPパケットを検出", "payload_type", payloadType)
 	
 	return nil
 }
\ No newline at end of file
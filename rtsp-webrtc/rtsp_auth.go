@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/auth"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/liberrors"
+)
+
+// --- RTSPサーバーの認証 ---
+
+// rtspCredentials はパスごとのPUSH/再生用の認証情報です。
+// ユーザー名が空の操作は認証なしで許可されます。
+type rtspCredentials struct {
+	Path        string `json:"path"` // ストリーム名 ("*" は既定値)
+	PublishUser string `json:"publish-user,omitempty"`
+	PublishPass string `json:"publish-pass,omitempty"`
+	ReadUser    string `json:"read-user,omitempty"`
+	ReadPass    string `json:"read-pass,omitempty"`
+}
+
+// rtspAuth はRTSPサーバーの認証設定です
+type rtspAuth struct {
+	methods []auth.VerifyMethod
+	paths   map[string]rtspCredentials // ストリーム名ごとの認証情報
+}
+
+// rtspAuthConfigFile は -rtsp-auth で指定するJSON設定ファイルの形式です
+type rtspAuthConfigFile struct {
+	Paths []rtspCredentials `json:"paths"`
+}
+
+// parseRTSPAuthMethods はカンマ区切りの認証方式 (basic, digest, digest-sha256) を解析します
+func parseRTSPAuthMethods(s string) ([]auth.VerifyMethod, error) {
+	var methods []auth.VerifyMethod
+	for _, m := range strings.Split(s, ",") {
+		switch strings.TrimSpace(strings.ToLower(m)) {
+		case "basic":
+			methods = append(methods, auth.VerifyMethodBasic)
+		case "digest":
+			methods = append(methods, auth.VerifyMethodDigestMD5)
+		case "digest-sha256":
+			methods = append(methods, auth.VerifyMethodDigestSHA256)
+		case "":
+		default:
+			return nil, fmt.Errorf("サポートされていないRTSP認証方式: %s。'basic', 'digest', 'digest-sha256' を使用してください。", m)
+		}
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("RTSP認証方式を1つ以上指定する必要があります")
+	}
+	return methods, nil
+}
+
+// loadRTSPAuth は認証設定を作成します。
+// defaults はフラグで指定された全パス共通の認証情報で、path が空でなければ
+// JSON設定ファイルのパスごとの認証情報で上書きされます。
+func loadRTSPAuth(methods string, defaults rtspCredentials, path string) (rtspAuth, error) {
+	a := rtspAuth{paths: make(map[string]rtspCredentials)}
+	var err error
+	a.methods, err = parseRTSPAuthMethods(methods)
+	if err != nil {
+		return a, err
+	}
+	defaults.Path = "*"
+	a.paths["*"] = defaults
+
+	if path == "" {
+		return a, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return a, err
+	}
+	var file rtspAuthConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return a, fmt.Errorf("JSONの解析エラー: %v", err)
+	}
+	for _, c := range file.Paths {
+		if c.Path == "" {
+			return a, fmt.Errorf("認証設定に path が指定されていません")
+		}
+		name := c.Path
+		if name != "*" {
+			name = streamNameFromPath(name)
+		}
+		a.paths[name] = c
+	}
+	return a, nil
+}
+
+// credentials はストリームに対する操作 (publish または read) に必要な認証情報を返します
+func (a rtspAuth) credentials(name string, publish bool) (user, pass string) {
+	c, ok := a.paths[name]
+	if !ok {
+		c = a.paths["*"]
+	}
+	if publish {
+		return c.PublishUser, c.PublishPass
+	}
+	return c.ReadUser, c.ReadPass
+}
+
+// authorize はリクエストの認証情報を検証します。
+// 認証に失敗した場合は401レスポンスを返し、gortsplibがWWW-Authenticateヘッダーを付加します。
+func (a rtspAuth) authorize(conn *gortsplib.ServerConn, req *base.Request, path string, publish bool) (*base.Response, error) {
+	user, pass := a.credentials(streamNameFromPath(path), publish)
+	if user == "" {
+		return nil, nil
+	}
+	if !conn.VerifyCredentials(req, user, pass) {
+		return &base.Response{
+			StatusCode: base.StatusUnauthorized,
+		}, liberrors.ErrServerAuth{}
+	}
+	return nil, nil
+}
+
+// --- プル入力の認証・TLS設定 ---
+
+// inputRTSPURL は入力URLを解析し、-input-user/-input-pass で指定された認証情報を付加します
+func inputRTSPURL(p props) (*base.URL, error) {
+	u, err := base.ParseURL(p.inputURL)
+	if err != nil {
+		return nil, err
+	}
+	if p.inputUser != "" {
+		u.User = url.UserPassword(p.inputUser, p.inputPass)
+	}
+	return u, nil
+}
+
+// inputURLWithCredentials はffmpegに渡す入力URLを返します (ffmpegは認証情報をURLからのみ受け付けるため)
+func inputURLWithCredentials(p props) string {
+	if p.inputUser == "" {
+		return p.inputURL
+	}
+	u, err := url.Parse(p.inputURL)
+	if err != nil {
+		return p.inputURL
+	}
+	u.User = url.UserPassword(p.inputUser, p.inputPass)
+	return u.String()
+}
+
+// redactedInputURL は認証情報を取り除いた入力URLを返します (ログや管理APIでの表示用)。
+// SRTの passphrase クエリも伏せます。解析できないURLは認証情報を含む可能性があるため表示しません。
+func redactedInputURL(p props) string {
+	u, err := url.Parse(p.inputURL)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	q := u.Query()
+	if u.User == nil && !q.Has("passphrase") {
+		return p.inputURL
+	}
+	u.User = nil
+	if q.Has("passphrase") {
+		q.Set("passphrase", "redacted")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// inputTLSConfig はRTSPS入力に使用するTLS設定を返します
+func inputTLSConfig(p props) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: p.inputTLSInsecure}
+	if p.inputTLSCA != "" {
+		pem, err := os.ReadFile(p.inputTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("CA証明書の読み込みに失敗: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA証明書の解析に失敗: %s", p.inputTLSCA)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph265"
+	"github.com/pion/rtp"
+)
+
+// rtspRelay はストリームの映像をRTSPで再配信するための gortsplib.ServerStream を保持します。
+// 入力の種類 (プル、PUSH、RTP) に関わらず、ブラウザと同じ映像をNVRやVLCから視聴できます。
+type rtspRelay struct {
+	codec  string // 再配信するコーデック (ストリームの入力コーデック)
+	stream *gortsplib.ServerStream
+	media  *description.Media
+
+	mutex      sync.Mutex
+	formatH264 *format.H264
+	encH264    *rtph264.Encoder
+	formatH265 *format.H265
+	encH265    *rtph265.Encoder
+	asm        auAssembler // NALユニットをアクセスユニットにまとめる
+	start      time.Time   // RTPタイムスタンプの基準時刻
+}
+
+// newRTSPRelay は server 上に codec の映像を配信する ServerStream を作成します。
+// params にはSDPに含めるパラメータセット (VPS/SPS/PPS) を渡します。
+func newRTSPRelay(server *gortsplib.Server, codec string, params [][]byte) (*rtspRelay, error) {
+	r := &rtspRelay{
+		codec: codec,
+		start: time.Now(),
+	}
+
+	var forma format.Format
+	var err error
+	if codec == "h265" {
+		r.formatH265 = &format.H265{PayloadTyp: 96}
+		for _, ps := range params {
+			r.setParameterSet(ps)
+		}
+		r.encH265, err = r.formatH265.CreateEncoder()
+		forma = r.formatH265
+	} else {
+		r.formatH264 = &format.H264{PayloadTyp: 96, PacketizationMode: 1}
+		for _, ps := range params {
+			r.setParameterSet(ps)
+		}
+		r.encH264, err = r.formatH264.CreateEncoder()
+		forma = r.formatH264
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s RTPエンコーダーの作成に失敗: %v", codec, err)
+	}
+
+	r.media = &description.Media{
+		Type:    description.MediaTypeVideo,
+		Formats: []format.Format{forma},
+	}
+	r.stream = &gortsplib.ServerStream{
+		Server: server,
+		Desc:   &description.Session{Medias: []*description.Media{r.media}},
+	}
+	if err := r.stream.Initialize(); err != nil {
+		return nil, fmt.Errorf("ServerStreamの初期化に失敗: %v", err)
+	}
+	return r, nil
+}
+
+// setParameterSet はパラメータセットをSDP用のフォーマットに反映します
+func (r *rtspRelay) setParameterSet(nal []byte) {
+	nalType, _, param, _ := classifyNAL(r.codec, nal)
+	if !param {
+		return
+	}
+	if r.codec == "h265" {
+		vps, sps, pps := r.formatH265.SafeParams()
+		switch nalType {
+		case 32:
+			vps = nal
+		case 33:
+			sps = nal
+		case 34:
+			pps = nal
+		}
+		r.formatH265.SafeSetParams(vps, sps, pps)
+		return
+	}
+	sps, pps := r.formatH264.SafeParams()
+	if nalType == 7 {
+		sps = nal
+	} else {
+		pps = nal
+	}
+	r.formatH264.SafeSetParams(sps, pps)
+}
+
+// writeNALs はNALユニット (スタートコードなし) をアクセスユニットにまとめてRTSPリーダーに配信します。
+// 入力ごとにNALの渡し方 (1NALずつ、またはアクセスユニット単位) が異なるため、アクセスユニットは
+// 境界 (次のピクチャの先頭スライス、AUD、パラメータセット) を受け取った時点で送信します。
+func (r *rtspRelay) writeNALs(nals [][]byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copied := make([][]byte, 0, len(nals))
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		_, _, param, _ := classifyNAL(r.codec, nal)
+		if param {
+			r.setParameterSet(nal)
+		}
+		// 次の境界まで保持するためコピーする (入力によってはバッファを再利用する)
+		copied = append(copied, append([]byte(nil), nal...))
+	}
+	for _, au := range r.asm.push(r.codec, copied, time.Now()) {
+		r.writeAU(au)
+	}
+}
+
+// writeAU はアクセスユニットをRTPパケットにしてリーダーに書き込みます
+func (r *rtspRelay) writeAU(au accessUnit) {
+	var pkts []*rtp.Packet
+	var err error
+	if r.codec == "h265" {
+		pkts, err = r.encH265.Encode(au.nals)
+	} else {
+		pkts, err = r.encH264.Encode(au.nals)
+	}
+	if err != nil {
+		warnRateLimited(slog.Default(), "rtsp-relay", "RTSPリレー: RTPエンコードエラー", "error", err)
+		return
+	}
+
+	// 入力ごとのフレーム期間は正確でないため、アクセスユニットの最初のNALを受け取った壁時計の時刻から
+	// タイムスタンプを生成する (アクセスユニット内のパケットはすべて同じタイムスタンプ)
+	ts := uint32(au.time.Sub(r.start) * 90000 / time.Second)
+	for _, pkt := range pkts {
+		pkt.Timestamp = ts
+		if err := r.stream.WritePacketRTP(r.media, pkt); err != nil {
+			return
+		}
+	}
+}
+
+// close はServerStreamを閉じ、接続中のリーダーを切断します
+func (r *rtspRelay) close() {
+	r.stream.Close()
+}
+
+// isSlice はNALユニットが映像のスライス (VCL NAL) かを返します
+func isSlice(codec string, nal []byte) bool {
+	if codec == "h265" {
+		return len(nal) >= 2 && (nal[0]>>1)&0x3F < 32
+	}
+	t := nal[0] & 0x1F
+	return t >= 1 && t <= 5
+}
+
+// isFirstSlice はNALユニットがピクチャの先頭スライスかを返します
+func isFirstSlice(codec string, nal []byte) bool {
+	if !isSlice(codec, nal) {
+		return false
+	}
+	if codec == "h265" {
+		// first_slice_segment_in_pic_flag
+		return len(nal) >= 3 && nal[2]&0x80 != 0
+	}
+	// first_mb_in_slice == 0 (ue(v) の "1")
+	return len(nal) >= 2 && nal[1]&0x80 != 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+)
+
+// rtspServerConfig はRTSPサーバーのリスニングアドレス、トランスポート、タイムアウトの設定です
+type rtspServerConfig struct {
+	address           string // RTSPのリスニングアドレス (空の場合はRTSPSのみ)
+	udpRTPAddress     string // UDPユニキャストのRTPアドレス (ポートは偶数)
+	udpRTCPAddress    string // UDPユニキャストのRTCPアドレス (RTPポート+1)
+	multicastIPRange  string // マルチキャストで使用するIPアドレス範囲
+	multicastRTPPort  int
+	multicastRTCPPort int
+	transports        string // 有効なトランスポート (カンマ区切り: udp, multicast, tcp)
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	auth              rtspAuth // PUSH/再生の認証設定
+
+	// RTSPS (TLS) リスナー (TCPのみ対応)
+	rtspsAddress string // 空の場合は無効
+	tlsCert      string
+	tlsKey       string
+}
+
+// parseRTSPTransports はカンマ区切りのトランスポート指定を解析します
+func parseRTSPTransports(s string) (map[gortsplib.Transport]bool, error) {
+	transports := make(map[gortsplib.Transport]bool)
+	for _, t := range strings.Split(s, ",") {
+		switch strings.TrimSpace(strings.ToLower(t)) {
+		case "udp":
+			transports[gortsplib.TransportUDP] = true
+		case "multicast":
+			transports[gortsplib.TransportUDPMulticast] = true
+		case "tcp":
+			transports[gortsplib.TransportTCP] = true
+		case "":
+		default:
+			return nil, fmt.Errorf("サポートされていないRTSPトランスポート: %s。'udp', 'multicast', 'tcp' を使用してください。", t)
+		}
+	}
+	if len(transports) == 0 {
+		return nil, fmt.Errorf("RTSPトランスポートを1つ以上指定する必要があります")
+	}
+	return transports, nil
+}
+
+// validate は設定が起動可能な組み合わせかを検証します
+func (c rtspServerConfig) validate() error {
+	transports, err := parseRTSPTransports(c.transports)
+	if err != nil {
+		return err
+	}
+	if c.address == "" && c.rtspsAddress == "" {
+		return fmt.Errorf("RTSPまたはRTSPSのリスニングアドレスを指定する必要があります")
+	}
+	if c.rtspsAddress != "" {
+		if c.tlsCert == "" || c.tlsKey == "" {
+			return fmt.Errorf("RTSPSには証明書と秘密鍵のファイルを指定する必要があります")
+		}
+		if !transports[gortsplib.TransportTCP] {
+			return fmt.Errorf("RTSPSはTCPトランスポートのみ対応しています。トランスポートに 'tcp' を含めてください")
+		}
+	}
+	return nil
+}
+
+// newGortsplibServers は設定に従ってRTSPおよびRTSPSのサーバーを作成します (未設定のリスナーは作成しません)
+func newGortsplibServers(c rtspServerConfig, handler func(server *gortsplib.Server) gortsplib.ServerHandler) ([]*gortsplib.Server, error) {
+	transports, err := parseRTSPTransports(c.transports)
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []*gortsplib.Server
+	if c.address != "" {
+		s := &gortsplib.Server{
+			RTSPAddress:  c.address,
+			ReadTimeout:  c.readTimeout,
+			WriteTimeout: c.writeTimeout,
+			AuthMethods:  c.auth.methods,
+		}
+		if transports[gortsplib.TransportUDP] {
+			s.UDPRTPAddress = c.udpRTPAddress
+			s.UDPRTCPAddress = c.udpRTCPAddress
+		}
+		if transports[gortsplib.TransportUDPMulticast] {
+			s.MulticastIPRange = c.multicastIPRange
+			s.MulticastRTPPort = c.multicastRTPPort
+			s.MulticastRTCPPort = c.multicastRTCPPort
+		}
+		s.Handler = handler(s)
+		servers = append(servers, s)
+	}
+
+	if c.rtspsAddress != "" {
+		cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("RTSPS証明書の読み込みに失敗: %v", err)
+		}
+		// TLSではUDPを使用できないため、RTSPSリスナーはTCP (インターリーブ) のみ
+		s := &gortsplib.Server{
+			RTSPAddress:  c.rtspsAddress,
+			ReadTimeout:  c.readTimeout,
+			WriteTimeout: c.writeTimeout,
+			AuthMethods:  c.auth.methods,
+			TLSConfig:    &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+		s.Handler = handler(s)
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+)
+
+// --- SRT 入力 ---
+
+// validateSRTURL は srt://host:port?mode=listener|caller の形式かを検証します
+func validateSRTURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("SRTのURLを解析できません: %v", err)
+	}
+	if u.Scheme != "srt" || u.Port() == "" {
+		return fmt.Errorf("SRTのURLは srt://<ホスト>:<ポート> の形式で指定してください: %s", raw)
+	}
+	switch mode := u.Query().Get("mode"); mode {
+	case "", "caller", "listener":
+	default:
+		return fmt.Errorf("SRTの mode は caller または listener を指定してください: %s", mode)
+	}
+	return nil
+}
+
+// startSRTInput はffmpegでSRTを受信し (listener) または接続し (caller)、
+// 伝送されるMPEG-TSをそのまま標準出力で受け取り、デマルチプレクサーで映像を取り出してストリームに渡します。
+// トランスコードはせず、アクセスユニットのタイミングはTSのDTSから求めます。
+func startSRTInput(ctx context.Context, s *stream, p props) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-loglevel", "error",
+		"-fflags", "+nobuffer", "-flags", "low_delay",
+		"-i", p.inputURL,
+		"-map", "0:v:0", "-c", "copy",
+		"-flush_packets", "1",
+		"-f", "mpegts", "pipe:1",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.logger.Error("SRT: ffmpegの起動に失敗", "error", err)
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		s.logger.Error("SRT: ffmpegの起動に失敗", "error", err)
+		return
+	}
+	go logFFmpegStderr(s.logger, stderr)
+	if err := cmd.Start(); err != nil {
+		s.logger.Error("SRT: ffmpegの起動に失敗", "error", err)
+		return
+	}
+	s.setIngestProcess(cmd)
+	s.logger.Info("FFmpeg (SRT 受信) 開始", "pid", cmd.Process.Pid, "input_url", redactedInputURL(p))
+
+	err = readTSStream(s, "srt", stdout)
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+	if ctx.Err() == nil {
+		s.logger.Warn("SRT: 入力が終了しました", "error", err)
+	}
+}
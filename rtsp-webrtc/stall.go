@@ -0,0 +1,111 @@
+package main
+
+import (
+	"time"
+)
+
+// --- 映像の停止 (ストール) の検知 ---
+
+// stallTimeout は映像が届かない状態をストールとみなすまでの時間です (main で設定)
+var stallTimeout = 5 * time.Second
+
+// maxStallRetryInterval はストール中に入力を再接続する間隔の上限です
+const maxStallRetryInterval = time.Minute
+
+var streamStalls = newCounterVec("rtsp2webrtc_stream_stalls_total",
+	"入力の映像が停止 (ストール) した回数", "stream")
+
+// streamStatus はシグナリングで視聴者に通知する配信状態です ({"type":"status","state":"stalled"} など)
+type streamStatus struct {
+	Type  string `json:"type"`  // 常に "status"
+	State string `json:"state"` // "stalled" または "live"
+}
+
+// startStallWatchdog は全ストリームの映像の受信を監視し、timeout を超えて映像が届かない場合は
+// 視聴者に通知して入力を再接続します
+func startStallWatchdog(timeout time.Duration) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, s := range allStreams() {
+			s.checkStall(timeout)
+		}
+	}
+}
+
+// checkStall は最後に映像を受信してからの経過時間でストールの発生と復旧を判定します
+func (s *stream) checkStall(timeout time.Duration) {
+	last := s.lastIngest.Load()
+	if last == 0 {
+		// まだ映像を受信していない (初回接続の失敗は /readyz で検知)
+		return
+	}
+	since := time.Since(time.Unix(0, last))
+
+	s.ingestMutex.Lock()
+	if s.ingest != nil && s.ingestCancel == nil {
+		// 視聴者がいないため停止中のオンデマンド入力
+		s.stalled = false
+		s.ingestMutex.Unlock()
+		return
+	}
+	var notify string
+	reconnect := false
+	restartable := s.ingest != nil && restartOnStall(s.inputType, s.inputURL)
+	switch {
+	case since <= timeout:
+		if s.stalled {
+			s.stalled = false
+			notify = "live"
+		}
+	case !s.stalled:
+		s.stalled = true
+		s.stallRetry = timeout
+		s.stallRetryAt = time.Now()
+		notify = "stalled"
+		reconnect = restartable
+	case restartable && time.Now().After(s.stallRetryAt.Add(s.stallRetry)):
+		// 再接続後も映像が届かない場合は間隔を広げて再試行
+		s.stallRetry = min(s.stallRetry*2, maxStallRetryInterval)
+		s.stallRetryAt = time.Now()
+		reconnect = true
+	}
+	s.ingestMutex.Unlock()
+
+	switch notify {
+	case "stalled":
+		streamStalls.with(s.name).Add(1)
+		s.logger.Warn("入力の映像が停止しました", "since", since.Round(time.Second))
+		s.notifyViewers(streamStatus{Type: "status", State: "stalled"})
+		events.publish(event{Type: eventStreamStalled, Stream: s.name})
+	case "live":
+		s.logger.Info("入力の映像が復旧しました")
+		s.notifyViewers(streamStatus{Type: "status", State: "live"})
+		events.publish(event{Type: eventStreamLive, Stream: s.name})
+	}
+	if reconnect {
+		s.logger.Info("映像が停止しているため入力を再接続します")
+		if err := s.restartIngest(); err != nil {
+			s.logger.Warn("入力の再接続に失敗", "error", err)
+		}
+	}
+}
+
+// isStalled は入力の映像が停止しているかを返します
+func (s *stream) isStalled() bool {
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+	return s.stalled
+}
+
+// notifyViewers はストリームのすべてのWebRTC視聴者にシグナリングでメッセージを送信します (録画の再生は除く)
+func (s *stream) notifyViewers(msg interface{}) {
+	for _, v := range s.viewerSessions() {
+		if v.transport == "playback" {
+			continue
+		}
+		if err := v.send(msg); err != nil {
+			s.logger.Debug("視聴者への通知に失敗", "viewer", v.id, "error", err)
+		}
+	}
+}
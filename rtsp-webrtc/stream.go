@@ -0,0 +1,885 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// stream は1系統の入力映像と、それを視聴するWebRTCトラック群を管理します。
+// H.265入力の場合はパススルー用のH.265トラックと、H.264トランスコード用のトラックを
+// 並行して保持し、H.264のみ対応の視聴者が接続している間だけトランスコーダーを起動します。
+type stream struct {
+	name      string
+	processor string       // フォールバック用トランスコーダーのプロセッサ ("cpu" または "gpu")
+	logger    *slog.Logger // stream フィールド付きのロガー
+
+	mutex      sync.RWMutex
+	codec      string // 入力側から配信されるコーデック ("h264" または "h265")
+	tracksH264 []*webrtc.TrackLocalStaticSample
+	tracksH265 []*webrtc.TrackLocalStaticSample
+	// 接続完了前のトラック (接続完了時にGOPキャッシュを送信してから配信対象にする)
+	pending map[*webrtc.TrackLocalStaticSample]bool
+
+	// H.265 -> H.264 フォールバック用
+	transcoder *h265Transcoder
+
+	// GOPキャッシュ (新規視聴者の起動高速化用)
+	gopH264 *gopCache
+	gopH265 *gopCache
+
+	// アクセスユニットの配信 (録画・クリップ・HLS用、ストリームの削除後はnil)
+	aus *auHub
+	// 録画 (recording.go、録画しない場合はnil)
+	recorder *recorder
+	// クリップ録画 (clips.go、無効の場合はnil)
+	clipper *clipper
+	// HLS出力 (hls.go、無効の場合はnil)
+	hls *hlsMuxer
+
+	// RTSPでの再配信用 (リスナーのサーバーごとに、最初のRTSPリーダーの接続時に作成)
+	relays      map[*gortsplib.Server]*rtspRelay
+	rtspReaders int
+	mseViewers  int // WebSocket (MSE) の視聴者数
+	rawViewers  int // HTTPストリーミング (.h264/.h265/.ts) の視聴者数
+
+	// アドミッション制御用
+	maxViewers  int           // 同時視聴者数の上限 (0の場合は全体の既定値)
+	ingestBytes atomic.Uint64 // 入力から受け取った映像のバイト数
+	bitrate     atomic.Int64  // 直近の入力ビットレート (kbps)
+
+	// 入力の統計 (管理API用)
+	inputType    string        // 入力タイプ (RTSPサーバーへのPUSHの場合は空)
+	inputURL     string        // 入力URL (認証情報は除く)
+	ingestFrames atomic.Uint64 // 入力から受け取ったフレーム数
+	fps          atomic.Int64  // 直近の入力フレームレート
+	lastIngest   atomic.Int64  // 最後に入力から映像を受け取った時刻 (UnixNano)
+
+	// WebRTC視聴者 (管理API用)
+	viewers map[*viewerSession]bool
+
+	// メトリクス (ホットパスで使用するカウンターを保持)
+	trackBytes      map[*webrtc.TrackLocalStaticSample]*atomic.Uint64 // トラックごとの送信バイト数
+	egress          *atomic.Uint64
+	nalsH264        *atomic.Uint64
+	nalsH265        *atomic.Uint64
+	framesH264      *atomic.Uint64
+	framesH265      *atomic.Uint64
+	transcoderDrops *atomic.Uint64
+
+	// 入力パイプラインの実行・オンデマンド制御用
+	ingestMutex    sync.Mutex
+	ingest         func(ctx context.Context) // 入力パイプライン (終了するまでブロック)
+	onDemand       bool
+	linger         time.Duration // 最後の視聴者が退出してから入力を停止するまでの猶予
+	ingestCancel   context.CancelFunc
+	lingerTimer    *time.Timer
+	ingestState    string      // "idle", "connecting", "reconnecting", "finished"
+	ingestStarted  time.Time   // 現在の接続試行の開始時刻
+	ingestProcess  *os.Process // 入力に使用しているffmpegのプロセス (使用していない場合はnil)
+	ingestRestarts int         // 入力の再接続・再起動の回数
+	stalled        bool        // 入力の映像が停止している (stall.go)
+	stallRetry     time.Duration
+	stallRetryAt   time.Time // ストール中に最後に入力を再接続した時刻
+	closed         bool      // ストリームが削除された
+}
+
+// --- ストリームレジストリ ---
+var (
+	streams      = make(map[string]*stream)
+	streamsMutex sync.RWMutex
+)
+
+// registerStream はストリームをレジストリに登録します
+func registerStream(s *stream) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	streams[s.name] = s
+}
+
+// lookupStream は名前からストリームを検索します
+func lookupStream(name string) *stream {
+	streamsMutex.RLock()
+	defer streamsMutex.RUnlock()
+	return streams[name]
+}
+
+// unregisterStream はストリームをレジストリから削除します
+func unregisterStream(s *stream) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	if streams[s.name] == s {
+		delete(streams, s.name)
+	}
+}
+
+// allStreams は登録済みのストリームを返します
+func allStreams() []*stream {
+	streamsMutex.RLock()
+	defer streamsMutex.RUnlock()
+	result := make([]*stream, 0, len(streams))
+	for _, s := range streams {
+		result = append(result, s)
+	}
+	return result
+}
+
+// newStream は新しいストリームを作成します
+func newStream(name, processor string) *stream {
+	return &stream{
+		name:            name,
+		processor:       processor,
+		logger:          slog.With("stream", name),
+		codec:           "h264",
+		tracksH264:      make([]*webrtc.TrackLocalStaticSample, 0),
+		tracksH265:      make([]*webrtc.TrackLocalStaticSample, 0),
+		pending:         make(map[*webrtc.TrackLocalStaticSample]bool),
+		gopH264:         newGOPCache("h264"),
+		gopH265:         newGOPCache("h265"),
+		aus:             newAUHub(name),
+		relays:          make(map[*gortsplib.Server]*rtspRelay),
+		viewers:         make(map[*viewerSession]bool),
+		trackBytes:      make(map[*webrtc.TrackLocalStaticSample]*atomic.Uint64),
+		egress:          egressBytes.with(name),
+		nalsH264:        nalsWritten.with(name, "h264"),
+		nalsH265:        nalsWritten.with(name, "h265"),
+		framesH264:      framesWritten.with(name, "h264"),
+		framesH265:      framesWritten.with(name, "h265"),
+		transcoderDrops: channelDrops.with(name, "transcoder"),
+	}
+}
+
+// setCodec は入力側から配信されるコーデックを設定します。
+// H.265を設定した場合、H.264視聴者にはトランスコードされた映像が配信されます。
+func (s *stream) setCodec(codec string) {
+	s.mutex.Lock()
+	prev := s.codec
+	s.codec = codec
+	var stopped *h265Transcoder
+	var start bool
+	// コーデックが変わった場合、RTSPリーダーは再接続してSDPを取り直す必要がある
+	var relays []*rtspRelay
+	for server, r := range s.relays {
+		if r.codec != codec {
+			relays = append(relays, r)
+			delete(s.relays, server)
+		}
+	}
+	if codec == "h265" && prev != "h265" {
+		start = len(s.tracksH264) > 0
+	} else if codec != "h265" {
+		stopped = s.transcoder
+		s.transcoder = nil
+	}
+	s.mutex.Unlock()
+
+	if stopped != nil {
+		stopped.stop()
+	}
+	for _, r := range relays {
+		r.close()
+	}
+	if start {
+		s.startTranscoder()
+	}
+	s.logger.Info("入力コーデックを設定しました", "codec", codec)
+}
+
+// currentCodec は入力側から配信されるコーデックを返します
+func (s *stream) currentCodec() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.codec
+}
+
+// viewerCount は現在の視聴者数を返します
+func (s *stream) viewerCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.tracksH264) + len(s.tracksH265) + s.rtspReaders + s.mseViewers + s.rawViewers
+}
+
+// --- トラック管理 (WebRTC用) ---
+func (s *stream) registerTrack(t *webrtc.TrackLocalStaticSample) {
+	s.mutex.Lock()
+	s.tracksH264 = append(s.tracksH264, t)
+	s.pending[t] = true
+	s.trackBytes[t] = new(atomic.Uint64)
+	start := s.codec == "h265" && s.transcoder == nil
+	s.mutex.Unlock()
+
+	if start {
+		s.startTranscoder()
+	}
+	s.updateOnDemand()
+}
+
+func (s *stream) unregisterTrack(t *webrtc.TrackLocalStaticSample) {
+	s.mutex.Lock()
+	for i, tr := range s.tracksH264 {
+		if tr == t {
+			s.tracksH264 = append(s.tracksH264[:i], s.tracksH264[i+1:]...)
+			break
+		}
+	}
+	delete(s.pending, t)
+	delete(s.trackBytes, t)
+	// 最後のH.264視聴者が退出したらトランスコーダーを停止
+	var stopped *h265Transcoder
+	if len(s.tracksH264) == 0 && s.transcoder != nil {
+		stopped = s.transcoder
+		s.transcoder = nil
+	}
+	s.mutex.Unlock()
+
+	// 停止処理はトランスコーダーの出力ゴルーチンの終了を待つため、ロック外で行う
+	if stopped != nil {
+		s.logger.Info("H.264視聴者がいなくなったため、フォールバック用トランスコーダーを停止します")
+		stopped.stop()
+	}
+	s.updateOnDemand()
+}
+
+// --- H.265トラック管理 (WebRTC用) ---
+func (s *stream) registerTrackH265(t *webrtc.TrackLocalStaticSample) {
+	s.mutex.Lock()
+	s.tracksH265 = append(s.tracksH265, t)
+	s.pending[t] = true
+	s.trackBytes[t] = new(atomic.Uint64)
+	s.mutex.Unlock()
+
+	s.updateOnDemand()
+}
+
+func (s *stream) unregisterTrackH265(t *webrtc.TrackLocalStaticSample) {
+	s.mutex.Lock()
+	for i, tr := range s.tracksH265 {
+		if tr == t {
+			s.tracksH265 = append(s.tracksH265[:i], s.tracksH265[i+1:]...)
+			break
+		}
+	}
+	delete(s.pending, t)
+	delete(s.trackBytes, t)
+	s.mutex.Unlock()
+
+	s.updateOnDemand()
+}
+
+// --- 視聴者セッション管理 (管理API用) ---
+func (s *stream) addViewer(v *viewerSession) {
+	s.mutex.Lock()
+	s.viewers[v] = true
+	s.mutex.Unlock()
+}
+
+func (s *stream) removeViewer(v *viewerSession) {
+	s.mutex.Lock()
+	delete(s.viewers, v)
+	s.mutex.Unlock()
+}
+
+// viewerSessions は接続中のWebRTC視聴者を接続順に返します
+func (s *stream) viewerSessions() []*viewerSession {
+	s.mutex.RLock()
+	result := make([]*viewerSession, 0, len(s.viewers))
+	for v := range s.viewers {
+		result = append(result, v)
+	}
+	s.mutex.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
+
+// --- RTSPリーダー管理 ---
+
+// rtspRelayFor は server 上でこのストリームを再配信する rtspRelay を返します (未作成の場合は作成します)
+func (s *stream) rtspRelayFor(server *gortsplib.Server) (*rtspRelay, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r := s.relays[server]; r != nil && r.codec == s.codec {
+		return r, nil
+	}
+	cache := s.gopH264
+	if s.codec == "h265" {
+		cache = s.gopH265
+	}
+	r, err := newRTSPRelay(server, s.codec, cache.parameterSets())
+	if err != nil {
+		return nil, err
+	}
+	if prev := s.relays[server]; prev != nil {
+		prev.close()
+	}
+	s.relays[server] = r
+	s.logger.Info("RTSP再配信を開始しました", "codec", s.codec)
+	return r, nil
+}
+
+// addRTSPReader はRTSPリーダーを視聴者として数えます (オンデマンド入力の開始に使用)
+func (s *stream) addRTSPReader() {
+	s.mutex.Lock()
+	s.rtspReaders++
+	s.mutex.Unlock()
+
+	s.updateOnDemand()
+}
+
+func (s *stream) removeRTSPReader() {
+	s.mutex.Lock()
+	if s.rtspReaders > 0 {
+		s.rtspReaders--
+	}
+	s.mutex.Unlock()
+
+	s.updateOnDemand()
+}
+
+// addMSEViewer はWebSocket (MSE) の視聴者を数えます (オンデマンド入力の開始に使用)
+func (s *stream) addMSEViewer() {
+	s.mutex.Lock()
+	s.mseViewers++
+	s.mutex.Unlock()
+
+	s.updateOnDemand()
+}
+
+func (s *stream) removeMSEViewer() {
+	s.mutex.Lock()
+	if s.mseViewers > 0 {
+		s.mseViewers--
+	}
+	s.mutex.Unlock()
+
+	s.updateOnDemand()
+}
+
+// addRawStreamViewer はHTTPストリーミングの視聴者を数えます (オンデマンド入力の開始に使用)
+func (s *stream) addRawStreamViewer() {
+	s.mutex.Lock()
+	s.rawViewers++
+	s.mutex.Unlock()
+
+	s.updateOnDemand()
+}
+
+func (s *stream) removeRawStreamViewer() {
+	s.mutex.Lock()
+	if s.rawViewers > 0 {
+		s.rawViewers--
+	}
+	s.mutex.Unlock()
+
+	s.updateOnDemand()
+}
+
+// trackEgress はトラックの送信バイト数のカウンターを返します
+func (s *stream) trackEgress(t *webrtc.TrackLocalStaticSample) *atomic.Uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.trackBytes[t]
+}
+
+// countEgress はトラックへの送信をメトリクスに加えます (s.mutex を保持して呼び出す)
+func (s *stream) countEgress(t *webrtc.TrackLocalStaticSample, n int) {
+	if c := s.trackBytes[t]; c != nil {
+		c.Add(uint64(n))
+	}
+	s.egress.Add(uint64(n))
+}
+
+// primeTrack は接続が完了したトラックにGOPキャッシュを送信し、ライブ配信の対象にします。
+// GOP全体の送信中はロックを保持せず (入力や他の視聴者を止めないため)、
+// その間に追加されたサンプルのみロックを保持して送信してからライブ配信に切り替えます。
+func (s *stream) primeTrack(t *webrtc.TrackLocalStaticSample) {
+	s.mutex.RLock()
+	if !s.pending[t] {
+		s.mutex.RUnlock()
+		return
+	}
+	cache := s.gopH264
+	for _, tr := range s.tracksH265 {
+		if tr == t {
+			cache = s.gopH265
+			break
+		}
+	}
+	counter := s.trackBytes[t]
+	s.mutex.RUnlock()
+
+	samples, seq := cache.snapshotSince(0)
+	sent := s.writePrimeSamples(t, counter, samples)
+	if sent == 0 {
+		seq = 0 // 送信できていなければ、追いつき分ではなくGOP全体を送信する
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.pending[t] {
+		return // 送信中に切断された
+	}
+	rest, _ := cache.snapshotSince(seq)
+	sent += s.writePrimeSamples(t, counter, rest)
+	delete(s.pending, t)
+	s.logger.Debug("GOPキャッシュを新規視聴者に送信しました", "samples", sent)
+}
+
+// writePrimeSamples はGOPキャッシュのサンプルをトラックに書き込み、書き込めた数を返します
+func (s *stream) writePrimeSamples(t *webrtc.TrackLocalStaticSample, counter *atomic.Uint64, samples []media.Sample) int {
+	for i, sample := range samples {
+		if err := t.WriteSample(sample); err != nil {
+			return i
+		}
+		if counter != nil {
+			counter.Add(uint64(len(sample.Data)))
+		}
+		s.egress.Add(uint64(len(sample.Data)))
+	}
+	return len(samples)
+}
+
+// startTranscoder はH.264視聴者向けのフォールバック用トランスコーダーを起動します
+func (s *stream) startTranscoder() {
+	s.mutex.Lock()
+	if s.transcoder != nil || s.codec != "h265" || len(s.tracksH264) == 0 {
+		s.mutex.Unlock()
+		return
+	}
+	s.mutex.Unlock()
+
+	s.logger.Info("H.264視聴者が接続したため、フォールバック用トランスコーダーを起動します", "processor", s.processor)
+	tr, err := startH265Transcoder(s.logger, s.processor, s.gopH265.parameterSets(), s.writeNALsToTracks)
+	if err != nil {
+		s.logger.Error("フォールバック用トランスコーダーの起動に失敗", "error", err)
+		return
+	}
+
+	s.mutex.Lock()
+	// 起動中に視聴者が退出した、または別のトランスコーダーが起動していた場合は破棄
+	if s.transcoder != nil || s.codec != "h265" || len(s.tracksH264) == 0 {
+		s.mutex.Unlock()
+		tr.stop()
+		return
+	}
+	s.transcoder = tr
+	s.mutex.Unlock()
+}
+
+// trimNALs はNALユニットからスタートコードを取り除き、空のNALユニットを除きます
+func trimNALs(nals [][]byte) [][]byte {
+	out := make([][]byte, 0, len(nals))
+	for _, nal := range nals {
+		if nal = trimStartCode(nal); len(nal) > 0 {
+			out = append(out, nal)
+		}
+	}
+	return out
+}
+
+// sampleDuration は n 個のNALユニットのうち i 番目のサンプルの期間を返します。
+// pion のパケタイザーはサンプルごとにRTPタイムスタンプを進めるため (パケットを出力しないSPS/PPSでも)、
+// アクセスユニットの期間は最後のNALユニットにのみ設定し、他は0にします。
+func sampleDuration(i, n int, duration time.Duration) time.Duration {
+	if i == n-1 {
+		return duration
+	}
+	return 0
+}
+
+// writeNALsToTracks はNALユニット（[][]byteとして）をすべてのアクティブなH.264 WebRTCトラックに書き込みます。
+// nals は1つのアクセスユニット (またはその一部) で、duration はその期間です。
+func (s *stream) writeNALsToTracks(nals [][]byte, duration time.Duration) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	relayNALs := trimNALs(nals)
+	for i, nalData := range relayNALs {
+		if s.codec == "h264" {
+			// トランスコーダーの出力は入力ビットレートに含めない
+			s.countIngest("h264", nalData)
+		}
+		// 各NALユニットにAnnex-Bスタートコード（0x00000001）を付加
+		sample := media.Sample{
+			Data:     append([]byte{0x00, 0x00, 0x00, 0x01}, nalData...),
+			Duration: sampleDuration(i, len(relayNALs), duration),
+		}
+		s.gopH264.add(nalData, sample)
+		s.nalsH264.Add(1)
+		if isFirstSlice("h264", nalData) {
+			s.framesH264.Add(1)
+		}
+		for _, t := range s.tracksH264 {
+			if s.pending[t] {
+				continue
+			}
+			if err := t.WriteSample(sample); err != nil {
+				// 切断処理中のトラックへの書き込みエラーは無視
+				continue
+			}
+			s.countEgress(t, len(sample.Data))
+		}
+	}
+	// トランスコーダーの出力 (H.265入力時) はRTSPでの再配信と録画の対象外
+	if s.codec != "h264" {
+		return
+	}
+	for _, r := range s.relays {
+		if r.codec == "h264" {
+			r.writeNALs(relayNALs)
+		}
+	}
+	if s.aus != nil {
+		s.aus.write("h264", relayNALs)
+	}
+}
+
+// writeNALsToTracksH265 はH.265 NALユニットをすべてのアクティブなH.265 WebRTCトラックに書き込み、
+// フォールバック用トランスコーダーが起動中であればそちらにも渡します。nals と duration は writeNALsToTracks と同じです。
+func (s *stream) writeNALsToTracksH265(nals [][]byte, duration time.Duration) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.transcoder != nil && !s.transcoder.writeNALs(nals) {
+		s.transcoderDrops.Add(1)
+	}
+	relayNALs := trimNALs(nals)
+	for i, nalData := range relayNALs {
+		s.countIngest("h265", nalData)
+		sample := media.Sample{
+			Data:     append([]byte{0x00, 0x00, 0x00, 0x01}, nalData...),
+			Duration: sampleDuration(i, len(relayNALs), duration),
+		}
+		s.gopH265.add(nalData, sample)
+		s.nalsH265.Add(1)
+		if isFirstSlice("h265", nalData) {
+			s.framesH265.Add(1)
+		}
+		for _, t := range s.tracksH265 {
+			if s.pending[t] {
+				continue
+			}
+			if err := t.WriteSample(sample); err != nil {
+				// 切断処理中のトラックへの書き込みエラーは無視
+				continue
+			}
+			s.countEgress(t, len(sample.Data))
+		}
+	}
+	for _, r := range s.relays {
+		if r.codec == "h265" {
+			r.writeNALs(relayNALs)
+		}
+	}
+	if s.aus != nil {
+		s.aus.write("h265", relayNALs)
+	}
+}
+
+// --- ビットレート・フレームレート計測 ---
+
+// countIngest は入力から受け取ったNALユニットを統計に加えます
+func (s *stream) countIngest(codec string, nal []byte) {
+	s.ingestBytes.Add(uint64(len(nal)))
+	if isFirstSlice(codec, nal) {
+		s.ingestFrames.Add(1)
+	}
+	s.lastIngest.Store(time.Now().UnixNano())
+}
+
+// bitrateKbps は直近の入力ビットレート (kbps) を返します
+func (s *stream) bitrateKbps() int {
+	return int(s.bitrate.Load())
+}
+
+// startIngestSampler は全ストリームの入力ビットレートとフレームレートを定期的に計測します
+func startIngestSampler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastBytes := make(map[*stream]uint64)
+	lastFrames := make(map[*stream]uint64)
+	for range ticker.C {
+		current := allStreams()
+		// 削除されたストリームの計測値を破棄
+		if len(lastBytes) > len(current) {
+			lastBytes = make(map[*stream]uint64)
+			lastFrames = make(map[*stream]uint64)
+		}
+		for _, s := range current {
+			total := s.ingestBytes.Load()
+			kbps := int64(float64(total-lastBytes[s]) * 8 / 1000 / interval.Seconds())
+			lastBytes[s] = total
+			// 急な変動を抑えるため指数移動平均で平滑化
+			prev := s.bitrate.Load()
+			if prev > 0 {
+				kbps = (prev*3 + kbps) / 4
+			}
+			s.bitrate.Store(kbps)
+
+			frames := s.ingestFrames.Load()
+			s.fps.Store(int64(float64(frames-lastFrames[s])/interval.Seconds() + 0.5))
+			lastFrames[s] = frames
+		}
+	}
+}
+
+// --- オンデマンド入力 ---
+
+// hasIngest は入力パイプラインを持つか (RTSPサーバーへのPUSHではないか) を返します
+func (s *stream) hasIngest() bool {
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+	return s.ingest != nil
+}
+
+// setIngest は入力パイプラインを設定します。
+// onDemand が false の場合は即座に起動し、true の場合は最初の視聴者の接続時に起動します。
+func (s *stream) setIngest(ingest func(ctx context.Context), onDemand bool, linger time.Duration) {
+	s.ingestMutex.Lock()
+	s.ingest = ingest
+	s.onDemand = onDemand
+	s.linger = linger
+	s.ingestMutex.Unlock()
+
+	if onDemand {
+		s.logger.Info("オンデマンドモード (最初の視聴者の接続時に入力を開始し、最後の視聴者の退出後に停止)", "linger", linger)
+		return
+	}
+	s.ingestMutex.Lock()
+	s.startIngestLocked()
+	s.ingestMutex.Unlock()
+}
+
+// startIngestLocked は入力パイプラインを起動します (ingestMutex を保持して呼び出す)
+func (s *stream) startIngestLocked() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.ingestCancel = cancel
+	go s.runIngest(ctx, s.ingest)
+}
+
+// stopIngestLocked は入力パイプラインを停止します (ingestMutex を保持して呼び出す)
+func (s *stream) stopIngestLocked() {
+	if s.lingerTimer != nil {
+		s.lingerTimer.Stop()
+		s.lingerTimer = nil
+	}
+	if s.ingestCancel != nil {
+		s.ingestCancel()
+		s.ingestCancel = nil
+	}
+	s.ingestState = "idle"
+	s.ingestProcess = nil
+}
+
+// updateOnDemand は視聴者数の変化に応じてオンデマンド入力を開始・停止します
+func (s *stream) updateOnDemand() {
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+	if !s.onDemand || s.ingest == nil {
+		return
+	}
+
+	if s.viewerCount() > 0 {
+		if s.lingerTimer != nil {
+			s.lingerTimer.Stop()
+			s.lingerTimer = nil
+		}
+		if s.ingestCancel == nil && !s.closed {
+			s.logger.Info("視聴者が接続したため入力を開始します")
+			s.startIngestLocked()
+		}
+		return
+	}
+
+	if s.ingestCancel != nil && s.lingerTimer == nil {
+		// timer は ingestMutex を取得してから参照する (AfterFunc から戻る前に発火しても代入後になる)
+		var timer *time.Timer
+		timer = time.AfterFunc(s.linger, func() {
+			s.ingestMutex.Lock()
+			defer s.ingestMutex.Unlock()
+			s.stopIdleIngestLocked(timer)
+		})
+		s.lingerTimer = timer
+	}
+}
+
+// runIngest はキャンセルされるまで入力パイプラインを実行し、異常終了時は再接続します
+func (s *stream) runIngest(ctx context.Context, ingest func(ctx context.Context)) {
+	for {
+		s.setIngestState(ctx, "connecting")
+		ingest(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn("入力が終了しました。2秒後に再接続します")
+		events.publish(event{Type: eventIngestFailed, Stream: s.name, Reason: "入力が終了しました"})
+		s.setIngestState(ctx, "reconnecting")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// setIngestState は入力の状態を更新します (キャンセル済みの入力からの更新は無視)
+func (s *stream) setIngestState(ctx context.Context, state string) {
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	switch state {
+	case "connecting":
+		if s.ingestState == "reconnecting" {
+			s.ingestRestarts++
+		}
+		s.ingestStarted = time.Now()
+	case "reconnecting":
+		s.ingestProcess = nil
+	}
+	s.ingestState = state
+}
+
+// ingestStatus は入力の状態、ffmpegのPID、再接続・再起動の回数を返します。
+// 状態は "idle" (停止中)、"connecting"、"connected"、"reconnecting"、"finished" (ファイル入力が末尾に達した) のいずれかです。
+func (s *stream) ingestStatus() (state string, pid, restarts int) {
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+	last := time.Unix(0, s.lastIngest.Load())
+	if s.ingest == nil {
+		// RTSPサーバーへのPUSHは直近に映像を受け取っていれば接続中とみなす
+		if time.Since(last) < 5*time.Second {
+			return "connected", 0, 0
+		}
+		return "idle", 0, 0
+	}
+	state = s.ingestState
+	if state == "" {
+		state = "idle"
+	}
+	if state == "connecting" && last.After(s.ingestStarted) {
+		state = "connected"
+	}
+	if s.ingestProcess != nil {
+		pid = s.ingestProcess.Pid
+	}
+	return state, pid, s.ingestRestarts
+}
+
+// setIngestProcess は入力に使用しているffmpegのプロセスを記録します
+func (s *stream) setIngestProcess(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	s.ingestMutex.Lock()
+	s.ingestProcess = cmd.Process
+	s.ingestMutex.Unlock()
+}
+
+// restartIngest は入力パイプラインを再起動します。
+// オンデマンドで視聴者がいない場合は停止したままにします。
+func (s *stream) restartIngest() error {
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+	if s.ingest == nil {
+		return fmt.Errorf("ストリーム %s は入力パイプラインを持ちません (RTSPサーバーへのPUSH)", s.name)
+	}
+	if s.closed {
+		return fmt.Errorf("ストリーム %s は削除されています", s.name)
+	}
+	s.logger.Info("入力パイプラインを再起動します")
+	s.stopIngestLocked()
+	s.gopH264.reset()
+	s.gopH265.reset()
+	if !s.onDemand || s.viewerCount() > 0 {
+		s.ingestRestarts++
+		s.startIngestLocked()
+	}
+	return nil
+}
+
+// close は入力パイプラインを停止し、すべての視聴者とRTSPリーダーを切断して、メトリクスの系列を削除します (ストリームの削除時に使用)
+func (s *stream) close() {
+	s.ingestMutex.Lock()
+	s.closed = true
+	s.stopIngestLocked()
+	s.ingestMutex.Unlock()
+
+	s.mutex.Lock()
+	viewers := make([]*viewerSession, 0, len(s.viewers))
+	for v := range s.viewers {
+		viewers = append(viewers, v)
+	}
+	relays := make([]*rtspRelay, 0, len(s.relays))
+	for server, r := range s.relays {
+		relays = append(relays, r)
+		delete(s.relays, server)
+	}
+	s.mutex.Unlock()
+
+	for _, v := range viewers {
+		v.kick("stream removed")
+	}
+	for _, r := range relays {
+		r.close()
+	}
+	s.stopRecording()
+	s.stopClipper()
+	s.stopHLS()
+	s.mutex.Lock()
+	aus := s.aus
+	s.aus = nil
+	s.mutex.Unlock()
+	if aus != nil {
+		aus.close()
+	}
+	deleteStreamMetrics(s.name)
+}
+
+// shutdown はプロセスの終了時に入力を停止し、書き込み中の録画とクリップを確定します
+func (s *stream) shutdown() {
+	s.ingestMutex.Lock()
+	s.closed = true
+	s.stopIngestLocked()
+	s.ingestMutex.Unlock()
+	s.stopRecording()
+	s.stopClipper()
+}
+
+// stopIdleIngestLocked は猶予期間が経過しても視聴者がいない場合に入力を停止します (ingestMutex を保持して呼び出す)。
+// timer が既に取り消されている (停止後に別のタイマーが設定された) 場合は何もしません。
+func (s *stream) stopIdleIngestLocked(timer *time.Timer) {
+	if s.lingerTimer != timer {
+		return
+	}
+	s.lingerTimer = nil
+	if s.viewerCount() > 0 || s.ingestCancel == nil {
+		return
+	}
+	s.logger.Info("視聴者がいないため入力を停止します")
+	s.stopIngestLocked()
+	// 停止後のキャッシュは古くなるため破棄
+	s.gopH264.reset()
+	s.gopH265.reset()
+}
+
+// trimStartCode はNALユニット先頭のAnnex-Bスタートコードを取り除きます
+func trimStartCode(nal []byte) []byte {
+	switch {
+	case len(nal) >= 4 && nal[0] == 0x00 && nal[1] == 0x00 && nal[2] == 0x00 && nal[3] == 0x01:
+		return nal[4:]
+	case len(nal) >= 3 && nal[0] == 0x00 && nal[1] == 0x00 && nal[2] == 0x01:
+		return nal[3:]
+	}
+	return nal
+}
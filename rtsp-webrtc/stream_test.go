@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// rtpCapture はトラックが送信したRTPパケットのタイムスタンプを記録します
+type rtpCapture struct {
+	mutex      sync.Mutex
+	timestamps []uint32
+}
+
+func (c *rtpCapture) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.timestamps = append(c.timestamps, header.Timestamp)
+	return len(payload), nil
+}
+
+func (c *rtpCapture) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// take は記録したタイムスタンプを返して記録を空にします
+func (c *rtpCapture) take() []uint32 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ts := c.timestamps
+	c.timestamps = nil
+	return ts
+}
+
+// testTrackContext はPeerConnectionなしでトラックをバインドするための TrackLocalContext です
+type testTrackContext struct {
+	codec webrtc.RTPCodecParameters
+	w     *rtpCapture
+}
+
+func (c *testTrackContext) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{c.codec}
+}
+func (c *testTrackContext) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (c *testTrackContext) SSRC() webrtc.SSRC                                      { return 1 }
+func (c *testTrackContext) WriteStream() webrtc.TrackLocalWriter                   { return c.w }
+func (c *testTrackContext) ID() string                                             { return "test" }
+func (c *testTrackContext) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+// addCapturedTrack は送信したRTPパケットを記録するH.264トラックをストリームのライブ配信の対象に追加します
+func addCapturedTrack(t *testing.T, s *stream) *rtpCapture {
+	t.Helper()
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}
+	track, err := webrtc.NewTrackLocalStaticSample(capability, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture := &rtpCapture{}
+	ctx := &testTrackContext{codec: webrtc.RTPCodecParameters{RTPCodecCapability: capability, PayloadType: 96}, w: capture}
+	if _, err := track.Bind(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.mutex.Lock()
+	s.tracksH264 = append(s.tracksH264, track)
+	s.mutex.Unlock()
+	return capture
+}
+
+// checkRTPTimestampSteps はアクセスユニットごとのパケットが同じタイムスタンプを持ち、
+// アクセスユニットごとに step ずつ進むことを確認します
+func checkRTPTimestampSteps(t *testing.T, perAU [][]uint32, step uint32) {
+	t.Helper()
+	for i, ts := range perAU {
+		if len(ts) == 0 {
+			t.Fatalf("アクセスユニット %d のパケットがない", i)
+		}
+		for _, v := range ts {
+			if v != ts[0] {
+				t.Errorf("アクセスユニット %d のタイムスタンプが一致しない: %v", i, ts)
+				break
+			}
+		}
+		if i > 0 {
+			if d := ts[0] - perAU[i-1][0]; d != step {
+				t.Errorf("アクセスユニット %d のタイムスタンプの差 = %d, want %d", i, d, step)
+			}
+		}
+	}
+}
+
+func TestWriteNALsRTPTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		aus  [][][]byte
+	}{
+		{
+			name: "SEIとスライス",
+			aus:  [][][]byte{{h264SEI, h264IDR}, {h264SEI, h264P}, {h264SEI, h264P2}},
+		},
+		{
+			name: "パラメータセットとIDR",
+			aus:  [][][]byte{{h264SPS, h264PPS, h264IDR}, {h264P}, {h264SPS, h264PPS, h264IDR}, {h264P2}},
+		},
+		{
+			name: "複数スライス",
+			aus:  [][][]byte{{h264IDR, h264IDRNext, h264IDRNext}, {h264P, h264P2}},
+		},
+		{
+			name: "AUDとスライス",
+			aus:  [][][]byte{{h264AUD, h264IDR}, {h264AUD, h264P}},
+		},
+		{
+			name: "スタートコード付きと空のNALユニット",
+			aus:  [][][]byte{{annexB(h264SEI), h264IDR, {}}, {h264P, {0, 0, 0, 1}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStream("stream-test", "")
+			capture := addCapturedTrack(t, s)
+			var perAU [][]uint32
+			for _, au := range tt.aus {
+				s.writeNALsToTracks(au, 40*time.Millisecond)
+				perAU = append(perAU, capture.take())
+			}
+			checkRTPTimestampSteps(t, perAU, 3600)
+		})
+	}
+}
+
+func TestStopIdleIngestStaleTimer(t *testing.T) {
+	s := newStream("stream-test", "")
+	s.onDemand = true
+	s.ingest = func(ctx context.Context) { <-ctx.Done() }
+	stale := time.NewTimer(time.Hour)
+	current := time.NewTimer(time.Hour)
+	defer stale.Stop()
+	defer current.Stop()
+
+	s.ingestMutex.Lock()
+	defer s.ingestMutex.Unlock()
+	s.startIngestLocked()
+	s.lingerTimer = current
+
+	// 取り消されたタイマーの発火は現在のタイマーと入力に影響しない
+	s.stopIdleIngestLocked(stale)
+	if s.lingerTimer != current || s.ingestCancel == nil {
+		t.Fatalf("取り消されたタイマーで状態が変わった (lingerTimer = %p, ingestCancel = %v)", s.lingerTimer, s.ingestCancel != nil)
+	}
+	s.stopIdleIngestLocked(current)
+	if s.lingerTimer != nil || s.ingestCancel != nil {
+		t.Errorf("現在のタイマーで入力が停止しない (lingerTimer = %p, ingestCancel = %v)", s.lingerTimer, s.ingestCancel != nil)
+	}
+}
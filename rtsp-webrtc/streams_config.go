@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// streamConfig は -streams で指定するJSON設定ファイルの1ストリーム分の設定です。
+// 省略した項目にはコマンドラインフラグの値が使用されます。
+type streamConfig struct {
+	Name             string `json:"name"`
+	InputURL         string `json:"input-url"`
+	InputType        string `json:"input-type,omitempty"`
+	Codec            string `json:"codec,omitempty"`
+	OutputCodec      string `json:"output-codec,omitempty"`
+	Processor        string `json:"processor,omitempty"`
+	UseGortsplib     *bool  `json:"use-gortsplib,omitempty"`
+	OnDemand         *bool  `json:"on-demand,omitempty"`
+	OnDemandLinger   string `json:"on-demand-linger,omitempty"` // 例: "30s"
+	InputUser        string `json:"input-user,omitempty"`
+	InputPass        string `json:"input-pass,omitempty"`
+	InputTLSInsecure *bool  `json:"input-tls-insecure,omitempty"`
+	InputTLSCA       string `json:"input-tls-ca,omitempty"`
+	MaxViewers       *int   `json:"max-viewers,omitempty"`
+	Record           *bool  `json:"record,omitempty"`
+	Clips            *bool  `json:"clips,omitempty"`
+	HLS              *bool  `json:"hls,omitempty"`
+	Loop             *bool  `json:"loop,omitempty"`
+}
+
+// toProps は設定を defaults で補完して props に変換します
+func (c streamConfig) toProps(defaults props) (props, error) {
+	p := defaults
+	p.name = c.Name
+	p.inputURL = c.InputURL
+	if c.InputType != "" {
+		p.inputType = c.InputType
+	}
+	if c.Codec != "" {
+		p.codec = c.Codec
+	}
+	if c.OutputCodec != "" {
+		p.outputCodec = c.OutputCodec
+	}
+	if p.codec == "h264" {
+		p.outputCodec = "h264"
+	}
+	if c.Processor != "" {
+		p.processor = c.Processor
+	}
+	if c.UseGortsplib != nil {
+		p.useGortsplib = *c.UseGortsplib
+	}
+	if c.OnDemand != nil {
+		p.onDemand = *c.OnDemand
+	}
+	if c.InputUser != "" {
+		p.inputUser = c.InputUser
+		p.inputPass = c.InputPass
+	}
+	if c.InputTLSInsecure != nil {
+		p.inputTLSInsecure = *c.InputTLSInsecure
+	}
+	if c.InputTLSCA != "" {
+		p.inputTLSCA = c.InputTLSCA
+	}
+	if c.MaxViewers != nil {
+		p.maxViewers = *c.MaxViewers
+	}
+	if c.Record != nil {
+		p.record = *c.Record
+	}
+	if c.Clips != nil {
+		p.clips = *c.Clips
+	}
+	if c.HLS != nil {
+		p.hls = *c.HLS
+	}
+	if c.Loop != nil {
+		p.loop = *c.Loop
+	}
+	if c.OnDemandLinger != "" {
+		d, err := time.ParseDuration(c.OnDemandLinger)
+		if err != nil {
+			return p, fmt.Errorf("stream %s: on-demand-linger の解析エラー: %v", c.Name, err)
+		}
+		p.onDemandLinger = d
+	}
+	return p, nil
+}
+
+// loadStreamsConfig はJSON設定ファイルからストリーム設定の一覧を読み込みます
+func loadStreamsConfig(path string, defaults props) ([]props, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []streamConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("JSONの解析エラー: %v", err)
+	}
+	result := make([]props, 0, len(configs))
+	for _, c := range configs {
+		p, err := c.toProps(defaults)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+// h265Transcoder はH.265 NALユニットを受け取り、ffmpegでH.264に変換して出力先へ渡します。
+// H.265パススルー配信中にH.264のみ対応の視聴者へ映像を届けるために使用します。
+type h265Transcoder struct {
+	cmd     *exec.Cmd
+	logger  *slog.Logger
+	stdin   io.WriteCloser
+	nalChan chan [][]byte
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// h265ToH264TranscodeArgs はH.265 (Annex-B) を標準入力から受け取り、H.264 (Annex-B) を標準出力へ書き出すffmpeg引数を返します
+func h265ToH264TranscodeArgs(processor string) []string {
+	if processor == "gpu" {
+		return []string{
+			"-hide_banner",
+			"-loglevel", "error",
+			"-hwaccel", "auto",
+			"-c:v", "hevc_cuvid",
+			"-f", "hevc",
+			"-i", "pipe:0",
+			"-an",
+			"-c:v", "h264_nvenc",
+			"-preset", "p1",
+			"-tune", "ll",
+			"-delay", "0",
+			"-rc", "cbr",
+			"-b:v", "2M",
+			"-maxrate", "2M",
+			"-bufsize", "200k",
+			"-g", "30",
+			"-bf", "0",
+			"-forced-idr", "1",
+			"-bsf:v", "h264_mp4toannexb",
+			"-f", "h264",
+			"pipe:1",
+		}
+	}
+	return []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "hevc",
+		"-fflags", "+genpts+igndts+nobuffer",
+		"-probesize", "32768",
+		"-analyzeduration", "0",
+		"-i", "pipe:0",
+		"-an",
+		"-c:v", "libx264",
+		"-preset", "ultrafast",
+		"-tune", "zerolatency",
+		"-x264-params", "nal-hrd=cbr:rc-lookahead=0:bframes=0:repeat-headers=1",
+		"-b:v", "2M",
+		"-maxrate", "2M",
+		"-bufsize", "200k",
+		"-g", "30",
+		"-bf", "0",
+		"-flush_packets", "1",
+		"-f", "h264",
+		"pipe:1",
+	}
+}
+
+// startH265Transcoder はffmpegトランスコーダーを起動します。
+// params には起動直後に送信するVPS/SPS/PPSを渡します (nil要素は無視されます)。
+// 変換されたH.264 NALユニットは output に渡されます。
+func startH265Transcoder(logger *slog.Logger, processor string, params [][]byte, output func(nals [][]byte, duration time.Duration)) (*h265Transcoder, error) {
+	t := &h265Transcoder{
+		cmd:     exec.Command("ffmpeg", h265ToH264TranscodeArgs(processor)...),
+		logger:  logger.With("component", "transcoder"),
+		nalChan: make(chan [][]byte, 100),
+	}
+
+	var err error
+	t.stdin, err = t.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg標準入力パイプの作成に失敗: %v", err)
+	}
+	stdout, err := t.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg標準出力パイプの作成に失敗: %v", err)
+	}
+	stderr, err := t.cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg標準エラーパイプの作成に失敗: %v", err)
+	}
+	if err := t.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ffmpegプロセスの開始に失敗: %v", err)
+	}
+	go logFFmpegStderr(t.logger, stderr)
+
+	// H.265 NAL書き込み用ゴルーチン
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer t.stdin.Close()
+		if err := writeAnnexB(t.stdin, params); err != nil {
+			return
+		}
+		for nals := range t.nalChan {
+			if err := writeAnnexB(t.stdin, nals); err != nil {
+				t.logger.Warn("ffmpegへのH.265データ書き込みエラー", "error", err)
+				// 残りのNALは読み捨ててチャネルのクローズを待つ
+				for range t.nalChan {
+				}
+				return
+			}
+		}
+	}()
+
+	// H.264 NAL読み取り用ゴルーチン
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		h264r, err := h264reader.NewReader(stdout)
+		if err != nil {
+			t.logger.Error("H264リーダーの作成に失敗", "error", err)
+			return
+		}
+		duration := time.Second / 30 // 30FPS想定
+		for {
+			nal, err := h264r.NextNAL()
+			if err != nil {
+				break
+			}
+			if len(nal.Data) > 0 {
+				output([][]byte{nal.Data}, duration)
+			}
+		}
+	}()
+
+	t.logger.Info("H.265 -> H.264 フォールバックを開始しました", "pid", t.cmd.Process.Pid)
+	return t, nil
+}
+
+// writeNALs はH.265 NALユニットをトランスコーダーに渡します。
+// 呼び出し元の配信処理を遅延させないよう、キューが満杯の場合は破棄して false を返します。
+func (t *h265Transcoder) writeNALs(nals [][]byte) bool {
+	select {
+	case t.nalChan <- nals:
+		return true
+	default:
+		// チャネルが満杯の場合はスキップ（遅延防止）
+		return false
+	}
+}
+
+// stop はトランスコーダーを停止し、関連するゴルーチンの終了を待ちます
+func (t *h265Transcoder) stop() {
+	t.once.Do(func() {
+		close(t.nalChan)
+		if t.cmd.Process != nil {
+			_ = t.cmd.Process.Kill()
+		}
+		t.wg.Wait()
+		_ = t.cmd.Wait()
+		t.logger.Info("H.265 -> H.264 フォールバックを停止しました")
+	})
+}
+
+// writeAnnexB はNALユニットをAnnex-B形式で書き込みます
+func writeAnnexB(w io.Writer, nals [][]byte) error {
+	for _, nal := range nals {
+		nal = trimStartCode(nal)
+		if len(nal) == 0 {
+			continue
+		}
+		if _, err := w.Write(append([]byte{0x00, 0x00, 0x00, 0x01}, nal...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
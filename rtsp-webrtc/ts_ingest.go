@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// --- MPEG-TS 入力 ---
+
+const defaultFrameDuration = time.Second / 30 // タイムスタンプから求められない場合のフレーム期間
+
+var mpegtsErrors = newCounterVec("rtsp2webrtc_mpegts_errors_total",
+	"MPEG-TS入力で検出したエラー数", "stream", "type")
+
+// frameTimer は入力のタイムスタンプ (DTS) の差からアクセスユニットごとのフレーム期間を求めます
+type frameTimer struct {
+	clockRate int64 // タイムスタンプの単位 (1秒あたり)
+	wrap      int64 // タイムスタンプが一周する値 (0の場合は一周しない)
+	prev      int64
+	started   bool
+	last      time.Duration
+}
+
+// next はタイムスタンプ ts のアクセスユニットのフレーム期間を返します。
+// 1秒を超える差や逆行は不連続とみなし、直前のフレーム期間を使用します。
+func (t *frameTimer) next(ts int64) time.Duration {
+	if t.last == 0 {
+		t.last = defaultFrameDuration
+	}
+	if t.started {
+		diff := ts - t.prev
+		if t.wrap > 0 {
+			diff = (diff%t.wrap + t.wrap) % t.wrap
+		}
+		if d := time.Duration(diff * int64(time.Second) / t.clockRate); d > 0 && d <= time.Second {
+			t.last = d
+		}
+	}
+	t.prev = ts
+	t.started = true
+	return t.last
+}
+
+// tsIngest はデマルチプレクサーが取り出したアクセスユニットをストリームに渡します。
+// タイミングはDTSの差から求め、PCRの不連続 (エンコーダーの再起動など) の後は計測し直します。
+type tsIngest struct {
+	stream *stream
+	source string // ログ・メトリクス用の入力の種類 ("srt"、"udp-ts")
+	demux  *tsDemuxer
+	timer  frameTimer
+	logged bool
+}
+
+func newTSIngest(s *stream, source string) *tsIngest {
+	in := &tsIngest{stream: s, source: source, timer: frameTimer{clockRate: 90000, wrap: 1 << 33}}
+	in.demux = newTSDemuxer(in.writeAU, func(kind string, err error) {
+		mpegtsErrors.with(s.name, kind).Add(1)
+		warnRateLimited(s.logger, source+":"+s.name+":"+kind, "MPEG-TS: 入力にエラーがあります", "source", source, "error", err)
+	})
+	return in
+}
+
+func (in *tsIngest) writeAU(au tsAccessUnit) {
+	s := in.stream
+	if !in.logged {
+		in.logged = true
+		args := []any{"source", in.source, "codec", au.codec, "pid", in.demux.videoPID}
+		if au.pcr >= 0 {
+			// PTSとPCRの差はエンコーダー側のバッファ遅延の目安
+			args = append(args, "pts_pcr_delay", time.Duration((au.pts-au.pcr/300)*int64(time.Second)/90000).Round(time.Millisecond))
+		}
+		s.logger.Info("MPEG-TS: 映像を検出しました", args...)
+	}
+	if s.currentCodec() != au.codec {
+		s.setCodec(au.codec)
+	}
+	if au.discontinuity {
+		in.timer.started = false
+	}
+	if au.codec == "h265" {
+		s.writeNALsToTracksH265(au.nals, in.timer.next(au.dts))
+	} else {
+		s.writeNALsToTracks(au.nals, in.timer.next(au.dts))
+	}
+}
+
+// push はTSパケットを含むバッファ (UDPのデータグラムなど) を処理します。
+// RTPでカプセル化されたTS (RFC 2250) はRTPヘッダーを取り除きます。
+func (in *tsIngest) push(b []byte) {
+	if len(b) >= 12 && b[0] != tsSyncByte && b[0]>>6 == 2 {
+		b = stripRTPHeader(b)
+	}
+	for ; len(b) >= tsPacketSize; b = b[tsPacketSize:] {
+		in.demux.push(b[:tsPacketSize])
+	}
+}
+
+// readTSStream はMPEG-TSのバイトストリームから映像のアクセスユニットを取り出し、ストリームに渡します。
+// 同期バイトを見失った場合は再同期します。r の読み取りが終了するまでブロックします。
+func readTSStream(s *stream, source string, r io.Reader) error {
+	in := newTSIngest(s, source)
+	br := bufio.NewReaderSize(r, 64*1024)
+	pkt := make([]byte, tsPacketSize)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] != tsSyncByte {
+			_, _ = br.Discard(1)
+			continue
+		}
+		if _, err := io.ReadFull(br, pkt); err != nil {
+			return err
+		}
+		in.demux.push(pkt)
+	}
+}
+
+// stripRTPHeader はRTPヘッダー (CSRC、拡張ヘッダーを含む) を取り除いたペイロードを返します
+func stripRTPHeader(b []byte) []byte {
+	n := 12 + 4*int(b[0]&0x0F)
+	if b[0]&0x10 != 0 && len(b) >= n+4 {
+		n += 4 + 4*int(binary.BigEndian.Uint16(b[n+2:]))
+	}
+	if n > len(b) {
+		return nil
+	}
+	return b[n:]
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// --- MPEG-TS over UDP 入力 (udp-ts) ---
+//
+// -input-url udp://<アドレス>:<ポート> で受信します。アドレスがマルチキャストの場合はグループに参加し、
+// ?iface=<インターフェース名またはIPアドレス> で参加するインターフェースを指定できます。
+// RTPでカプセル化されたTSもそのまま受信できます。
+
+const udpTSReadBuffer = 4 * 1024 * 1024 // ソケットの受信バッファ (ビットレートの高い放送機器の瞬間的なバーストを吸収するため)
+
+// parseUDPTSURL は udp://[@]<アドレス>:<ポート>[?iface=<インターフェース>] を解析します
+func parseUDPTSURL(raw string) (*net.UDPAddr, *net.Interface, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("UDPのURLを解析できません: %v", err)
+	}
+	if u.Scheme != "udp" || u.Port() == "" {
+		return nil, nil, fmt.Errorf("udp-ts の入力URLは udp://<アドレス>:<ポート> の形式で指定してください: %s", raw)
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("UDPのアドレスを解決できません: %v", err)
+	}
+	name := u.Query().Get("iface")
+	if name == "" {
+		return addr, nil, nil
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, nil, fmt.Errorf("iface はマルチキャストアドレスの場合のみ指定できます: %s", raw)
+	}
+	ifi, err := lookupInterface(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, ifi, nil
+}
+
+// lookupInterface は名前またはインターフェースに割り当てられたIPアドレスからインターフェースを探します
+func lookupInterface(name string) (*net.Interface, error) {
+	if ifi, err := net.InterfaceByName(name); err == nil {
+		return ifi, nil
+	}
+	ip := net.ParseIP(name)
+	if ip == nil {
+		return nil, fmt.Errorf("インターフェース %s が見つかりません", name)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("インターフェースの一覧を取得できません: %v", err)
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("アドレス %s を持つインターフェースが見つかりません", name)
+}
+
+// startUDPTSInput はUDPでMPEG-TSを受信し、コンテキストがキャンセルされるか受信エラーが発生するまでブロックします
+func startUDPTSInput(ctx context.Context, s *stream, p props) {
+	addr, ifi, err := parseUDPTSURL(p.inputURL)
+	if err != nil {
+		s.logger.Error("UDP-TS: 入力URLが不正です", "error", err)
+		return
+	}
+	var conn *net.UDPConn
+	if addr.IP.IsMulticast() {
+		// グループアドレスにバインドし、指定したインターフェース (nil の場合はシステムの既定) で参加する
+		conn, err = net.ListenMulticastUDP("udp", ifi, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		s.logger.Error("UDP-TS: 受信を開始できません", "addr", addr.String(), "error", err)
+		return
+	}
+	defer conn.Close()
+	if err := conn.SetReadBuffer(udpTSReadBuffer); err != nil {
+		s.logger.Warn("UDP-TS: 受信バッファを設定できません", "error", err)
+	}
+	args := []any{"addr", addr.String(), "multicast", addr.IP.IsMulticast()}
+	if ifi != nil {
+		args = append(args, "iface", ifi.Name)
+	}
+	s.logger.Info("UDP-TS: 受信を開始しました", args...)
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	in := newTSIngest(s, "udp-ts")
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Warn("UDP-TS: 受信エラー", "error", err)
+			}
+			return
+		}
+		in.push(buf[:n])
+	}
+}
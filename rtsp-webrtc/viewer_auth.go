@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- 視聴者の認証・認可 (シグナリング用) ---
+
+var (
+	errViewerUnauthenticated = errors.New("認証情報がないか無効です")
+	errViewerForbidden       = errors.New("このストリームの視聴は許可されていません")
+)
+
+// viewerIdentity は認証された視聴者です
+type viewerIdentity struct {
+	subject    string   // トークン名、JWTの sub など (匿名の場合は空)
+	streams    []string // 視聴を許可されたストリーム ("*" を含む場合はすべて)
+	restricted bool     // streams で視聴できるストリームを制限する (false の場合はすべて)
+}
+
+// allows はトークン自体が stream の視聴を許可しているかを返します。
+// 明示的に空のストリームの一覧を指定したトークンはどのストリームも視聴できません。
+func (id viewerIdentity) allows(stream string) bool {
+	if !id.restricted {
+		return true
+	}
+	for _, s := range id.streams {
+		if s == "*" || s == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// viewerAuthenticator はリクエストから視聴者を認証します。
+// 認証情報が自分の方式でない場合は ok=false を返し、次の方式に委ねます。
+type viewerAuthenticator interface {
+	authenticate(r *http.Request, stream string) (id viewerIdentity, ok bool, err error)
+}
+
+// viewerAuthConfig は有効な認証方式、ストリームごとのACL、許可するOriginの設定です
+type viewerAuthConfig struct {
+	authenticators []viewerAuthenticator
+	acl            map[string][]string // ストリーム名 -> 許可する subject ("*" は認証済みの全視聴者)
+	origins        map[string]bool     // 空の場合はすべて許可
+}
+
+// viewerAuth はシグナリングエンドポイントで使用する認証設定です (main で初期化)
+var viewerAuth = &viewerAuthConfig{}
+
+// authorize は stream を視聴しようとしているリクエストを認証・認可します
+func (c *viewerAuthConfig) authorize(r *http.Request, stream string) (viewerIdentity, error) {
+	var id viewerIdentity
+	if len(c.authenticators) > 0 {
+		authenticated := false
+		for _, a := range c.authenticators {
+			got, ok, err := a.authenticate(r, stream)
+			if err != nil {
+				return id, err
+			}
+			if ok {
+				id = got
+				authenticated = true
+				break
+			}
+		}
+		if !authenticated {
+			return id, errViewerUnauthenticated
+		}
+	}
+	if !id.allows(stream) {
+		return id, errViewerForbidden
+	}
+	if allowed, ok := c.acl[stream]; ok {
+		for _, subject := range allowed {
+			if subject == id.subject || (subject == "*" && len(c.authenticators) > 0) {
+				return id, nil
+			}
+		}
+		return id, errViewerForbidden
+	}
+	return id, nil
+}
+
+// checkOrigin はWebSocket接続のOriginが許可リストに含まれるかを判定します。
+// Originヘッダーのないブラウザ以外のクライアントは許可します。
+func (c *viewerAuthConfig) checkOrigin(r *http.Request) bool {
+	if len(c.origins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	return origin == "" || c.origins[strings.TrimRight(origin, "/")]
+}
+
+// authorizeViewer は認証・認可に失敗した場合にエラーレスポンスを書き込み、false を返します。
+// PeerConnectionを作成する前 (WebSocketのアップグレード前) に呼び出します。
+func authorizeViewer(w http.ResponseWriter, r *http.Request, stream string) (viewerIdentity, bool) {
+	if !viewerAuth.checkOrigin(r) {
+		slog.Warn("許可されていないOriginからの接続要求", "stream", stream, "origin", r.Header.Get("Origin"), "remote", r.RemoteAddr)
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return viewerIdentity{}, false
+	}
+	id, err := viewerAuth.authorize(r, stream)
+	switch {
+	case errors.Is(err, errViewerUnauthenticated):
+		slog.Warn("視聴者の認証に失敗", "stream", stream, "remote", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return id, false
+	case err != nil:
+		slog.Warn("視聴者はストリームの視聴を許可されていません", "stream", stream, "subject", id.subject, "remote", r.RemoteAddr, "error", err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return id, false
+	}
+	return id, true
+}
+
+// viewerToken はクエリパラメータ token または Authorization: Bearer ヘッダーからトークンを取り出します
+func viewerToken(r *http.Request) string {
+	if t := r.URL.Query().Get("token"); t != "" {
+		return t
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
+
+// --- 静的トークン ---
+
+// staticTokenAuth は設定ファイルで定義した固定トークンで認証します
+type staticTokenAuth struct {
+	tokens map[string]viewerIdentity
+}
+
+// staticTokensFile は -viewer-tokens で指定するJSON設定ファイルの形式です
+type staticTokensFile struct {
+	Tokens []struct {
+		Token   string   `json:"token"`
+		Name    string   `json:"name"`
+		Streams []string `json:"streams,omitempty"`
+	} `json:"tokens"`
+}
+
+func loadStaticTokenAuth(path string) (*staticTokenAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file staticTokensFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("JSONの解析エラー: %v", err)
+	}
+	a := &staticTokenAuth{tokens: make(map[string]viewerIdentity)}
+	for _, t := range file.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("空のトークンは指定できません")
+		}
+		a.tokens[t.Token] = viewerIdentity{subject: t.Name, streams: t.Streams, restricted: t.Streams != nil}
+	}
+	return a, nil
+}
+
+func (a *staticTokenAuth) authenticate(r *http.Request, stream string) (viewerIdentity, bool, error) {
+	token := viewerToken(r)
+	if token == "" {
+		return viewerIdentity{}, false, nil
+	}
+	for t, id := range a.tokens {
+		if hmac.Equal([]byte(t), []byte(token)) {
+			return id, true, nil
+		}
+	}
+	return viewerIdentity{}, false, nil
+}
+
+// --- HMAC署名付きURL ---
+
+// signedURLAuth は有効期限付きの署名URL (?stream=<名前>&expires=<UNIX時刻>&sig=<署名>) で認証します。
+// 署名は HMAC-SHA256(secret, "<ストリーム名>:<expires>") の16進表記です。
+type signedURLAuth struct {
+	secret []byte
+}
+
+// signStreamURL はストリームと有効期限に対する署名を返します
+func signStreamURL(secret []byte, stream string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s:%d", stream, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *signedURLAuth) authenticate(r *http.Request, stream string) (viewerIdentity, bool, error) {
+	q := r.URL.Query()
+	sig := q.Get("sig")
+	if sig == "" {
+		return viewerIdentity{}, false, nil
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+	if time.Now().Unix() > expires {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+	if !hmac.Equal([]byte(sig), []byte(signStreamURL(a.secret, stream, expires))) {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+	// 署名はストリーム名を含むため、他のストリームには流用できない
+	return viewerIdentity{subject: "signed-url", streams: []string{stream}, restricted: true}, true, nil
+}
+
+// --- JWT (HS256) ---
+
+// jwtAuth はHS256で署名されたJWTで認証します。有効期限 (exp) のないトークンは受け付けません。
+// クレーム streams (または stream) で視聴できるストリームを制限できます。
+type jwtAuth struct {
+	secret []byte
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Stream    *string         `json:"stream"`
+	Streams   json.RawMessage `json:"streams"`
+}
+
+func (a *jwtAuth) authenticate(r *http.Request, stream string) (viewerIdentity, bool, error) {
+	token := viewerToken(r)
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		// JWTでないトークンは他の方式に委ねる
+		return viewerIdentity{}, false, nil
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt == nil || now > *claims.ExpiresAt {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return viewerIdentity{}, false, errViewerUnauthenticated
+	}
+
+	id := viewerIdentity{subject: claims.Subject}
+	if claims.Stream != nil {
+		id.streams = append(id.streams, *claims.Stream)
+		id.restricted = true
+	}
+	if len(claims.Streams) > 0 && string(claims.Streams) != "null" {
+		// streams は文字列または文字列の配列
+		var list []string
+		if err := json.Unmarshal(claims.Streams, &list); err != nil {
+			var single string
+			if err := json.Unmarshal(claims.Streams, &single); err != nil {
+				return viewerIdentity{}, false, errViewerUnauthenticated
+			}
+			list = []string{single}
+		}
+		id.streams = append(id.streams, list...)
+		id.restricted = true
+	}
+	return id, true, nil
+}
+
+// --- 設定の読み込み ---
+
+// loadViewerAuth はフラグの値から視聴者の認証設定を作成します。
+// いずれかの認証方式が設定されている場合、シグナリングには認証が必須になります。
+func loadViewerAuth(tokensPath, hmacSecret, jwtSecret, aclPath, origins string) (*viewerAuthConfig, error) {
+	c := &viewerAuthConfig{
+		acl:     make(map[string][]string),
+		origins: make(map[string]bool),
+	}
+	if tokensPath != "" {
+		a, err := loadStaticTokenAuth(tokensPath)
+		if err != nil {
+			return nil, fmt.Errorf("トークン設定の読み込みエラー: %v", err)
+		}
+		c.authenticators = append(c.authenticators, a)
+	}
+	if jwtSecret != "" {
+		c.authenticators = append(c.authenticators, &jwtAuth{secret: []byte(jwtSecret)})
+	}
+	if hmacSecret != "" {
+		c.authenticators = append(c.authenticators, &signedURLAuth{secret: []byte(hmacSecret)})
+	}
+	if aclPath != "" {
+		data, err := os.ReadFile(aclPath)
+		if err != nil {
+			return nil, fmt.Errorf("ACL設定の読み込みエラー: %v", err)
+		}
+		if err := json.Unmarshal(data, &c.acl); err != nil {
+			return nil, fmt.Errorf("ACL設定のJSON解析エラー: %v", err)
+		}
+	}
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			c.origins[o] = true
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT はテスト用にHS256のJWTを作成します
+func signJWT(secret, header, payload string) string {
+	h := base64.RawURLEncoding.EncodeToString([]byte(header))
+	p := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(h + "." + p))
+	return h + "." + p + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	const secret = "secret"
+	const hs256 = `{"alg":"HS256","typ":"JWT"}`
+	now := time.Now().Unix()
+	future := now + 3600
+	past := now - 3600
+	exp := `"exp":` + itoa(future)
+
+	tests := []struct {
+		name       string
+		token      string
+		ok         bool
+		err        error
+		streams    []string
+		restricted bool
+	}{
+		{name: "トークンなし", token: ""},
+		{name: "JWTでない", token: "static-token"},
+		{name: "区切りが多い", token: "a.b.c.d"},
+		{
+			name:       "有効",
+			token:      signJWT(secret, hs256, `{"sub":"alice","stream":"cam1",`+exp+`}`),
+			ok:         true,
+			streams:    []string{"cam1"},
+			restricted: true,
+		},
+		{
+			name:       "streams が配列",
+			token:      signJWT(secret, hs256, `{"sub":"alice","streams":["cam1","cam2"],`+exp+`}`),
+			ok:         true,
+			streams:    []string{"cam1", "cam2"},
+			restricted: true,
+		},
+		{
+			name:       "streams が文字列",
+			token:      signJWT(secret, hs256, `{"sub":"alice","streams":"cam2",`+exp+`}`),
+			ok:         true,
+			streams:    []string{"cam2"},
+			restricted: true,
+		},
+		{
+			name:       "streams が空の配列",
+			token:      signJWT(secret, hs256, `{"sub":"alice","streams":[],`+exp+`}`),
+			ok:         true,
+			restricted: true,
+		},
+		{
+			name:       "stream が空",
+			token:      signJWT(secret, hs256, `{"sub":"alice","stream":"",`+exp+`}`),
+			ok:         true,
+			streams:    []string{""},
+			restricted: true,
+		},
+		{
+			name:  "streams が null",
+			token: signJWT(secret, hs256, `{"sub":"alice","streams":null,`+exp+`}`),
+			ok:    true,
+		},
+		{
+			name:  "有効期限内",
+			token: signJWT(secret, hs256, `{"sub":"alice",`+exp+`}`),
+			ok:    true,
+		},
+		{
+			name:  "有効期限切れ",
+			token: signJWT(secret, hs256, `{"sub":"alice","exp":`+itoa(past)+`}`),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "exp なし",
+			token: signJWT(secret, hs256, `{"sub":"alice"}`),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "nbf より前",
+			token: signJWT(secret, hs256, `{"sub":"alice","nbf":`+itoa(future)+`,`+exp+`}`),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "秘密鍵が異なる",
+			token: signJWT("other", hs256, `{"sub":"alice"}`),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "alg が none",
+			token: signJWT(secret, `{"alg":"none"}`, `{"sub":"alice"}`),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "ヘッダーがJSONでない",
+			token: signJWT(secret, `not json`, `{"sub":"alice"}`),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "ヘッダーのbase64が不正",
+			token: "!!!.e30.sig",
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "署名のbase64が不正",
+			token: trimSignature(signJWT(secret, hs256, `{"sub":"alice"}`)) + "!!!",
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "署名が空",
+			token: trimSignature(signJWT(secret, hs256, `{"sub":"alice"}`)),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "ペイロードがJSONでない",
+			token: signJWT(secret, hs256, `{"sub":`),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "streams の型が不正",
+			token: signJWT(secret, hs256, `{"sub":"alice","streams":123,`+exp+`}`),
+			err:   errViewerUnauthenticated,
+		},
+		{
+			name:  "exp の型が不正",
+			token: signJWT(secret, hs256, `{"sub":"alice","exp":"tomorrow"}`),
+			err:   errViewerUnauthenticated,
+		},
+	}
+
+	a := &jwtAuth{secret: []byte(secret)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			id, ok, err := a.authenticate(r, "cam1")
+			if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && (!reflect.DeepEqual(id.streams, tt.streams) || id.restricted != tt.restricted) {
+				t.Errorf("streams = %v (restricted %v), want %v (restricted %v)", id.streams, id.restricted, tt.streams, tt.restricted)
+			}
+		})
+	}
+}
+
+func TestSignedURLAuthenticate(t *testing.T) {
+	secret := []byte("secret")
+	future := time.Now().Unix() + 3600
+	past := time.Now().Unix() - 3600
+
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+		err   error
+	}{
+		{name: "署名なし", query: ""},
+		{name: "有効", query: "expires=" + itoa(future) + "&sig=" + signStreamURL(secret, "cam1", future), ok: true},
+		{name: "期限切れ", query: "expires=" + itoa(past) + "&sig=" + signStreamURL(secret, "cam1", past), err: errViewerUnauthenticated},
+		{name: "expires が不正", query: "expires=abc&sig=00", err: errViewerUnauthenticated},
+		{name: "他のストリームの署名", query: "expires=" + itoa(future) + "&sig=" + signStreamURL(secret, "cam2", future), err: errViewerUnauthenticated},
+	}
+
+	a := &signedURLAuth{secret: secret}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+			_, ok, err := a.authenticate(r, "cam1")
+			if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestViewerIdentityAllows(t *testing.T) {
+	tests := []struct {
+		name string
+		id   viewerIdentity
+		want bool
+	}{
+		{name: "制限なし", id: viewerIdentity{}, want: true},
+		{name: "許可されたストリーム", id: viewerIdentity{streams: []string{"cam2", "cam1"}, restricted: true}, want: true},
+		{name: "許可されていないストリーム", id: viewerIdentity{streams: []string{"cam2"}, restricted: true}, want: false},
+		{name: "ワイルドカード", id: viewerIdentity{streams: []string{"*"}, restricted: true}, want: true},
+		{name: "空の一覧", id: viewerIdentity{streams: []string{}, restricted: true}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.id.allows("cam1"); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadStaticTokenAuthStreams(t *testing.T) {
+	path := writeTempFile(t, "tokens.json", []byte(`{"tokens": [
+		{"token": "all", "name": "alice"},
+		{"token": "none", "name": "bob", "streams": []},
+		{"token": "cam1", "name": "carol", "streams": ["cam1"]}
+	]}`))
+	a, err := loadStaticTokenAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"all": true, "none": false, "cam1": true}
+	for token, allowed := range want {
+		if got := a.tokens[token].allows("cam1"); got != allowed {
+			t.Errorf("トークン %s: allows() = %v, want %v", token, got, allowed)
+		}
+	}
+}
+
+// trimSignature はJWTの署名部分を空にします
+func trimSignature(token string) string {
+	return token[:strings.LastIndex(token, ".")+1]
+}
+
+// itoa はUNIX時刻をクレーム用の文字列にします
+func itoa(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// --- Webhook ---
+
+// webhooksFile は -webhooks で指定するJSON設定ファイルの形式です
+type webhooksFile struct {
+	Webhooks []struct {
+		Name       string   `json:"name"`        // メトリクスとログで使用する名前 (省略時はURLのホスト)
+		URL        string   `json:"url"`         // イベントをPOSTするURL
+		Secret     string   `json:"secret"`      // 署名に使用するHMACシークレット (空の場合は署名しない)
+		Events     []string `json:"events"`      // 送信するイベントの種類 ("viewer.*" など、空の場合はすべて)
+		MaxRetries *int     `json:"max-retries"` // 失敗時の再送回数 (既定: 5)
+		Timeout    string   `json:"timeout"`     // 1回の送信のタイムアウト (既定: 5s)
+	} `json:"webhooks"`
+}
+
+var webhookDeliveries = newCounterVec("rtsp2webrtc_webhook_deliveries_total",
+	"Webhookの送信結果 (success, failed, dropped)", "webhook", "result")
+
+// webhookSink はイベントを1つのURLに順番に送信します。
+// 送信に失敗した場合は指数バックオフで再送し、その間に届いたイベントはキューで待機します。
+type webhookSink struct {
+	name       string
+	url        string
+	secret     []byte
+	maxRetries int
+	client     *http.Client
+	logger     *slog.Logger
+	sub        *eventSubscriber
+}
+
+// loadWebhooks は設定ファイルからWebhookを読み込み、イベントの送信を開始します
+func loadWebhooks(path string) ([]*webhookSink, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file webhooksFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("JSONの解析エラー: %v", err)
+	}
+	sinks := make([]*webhookSink, 0, len(file.Webhooks))
+	for _, c := range file.Webhooks {
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("無効なWebhook URL: %q", c.URL)
+		}
+		w := &webhookSink{name: c.Name, url: c.URL, secret: []byte(c.Secret), maxRetries: 5}
+		if w.name == "" {
+			w.name = u.Host
+		}
+		if c.MaxRetries != nil {
+			w.maxRetries = *c.MaxRetries
+		}
+		timeout := 5 * time.Second
+		if c.Timeout != "" {
+			if timeout, err = time.ParseDuration(c.Timeout); err != nil {
+				return nil, fmt.Errorf("Webhook %s の timeout の解析エラー: %v", w.name, err)
+			}
+		}
+		w.client = &http.Client{Timeout: timeout}
+		w.logger = slog.With("webhook", w.name)
+		dropped := webhookDeliveries.with(w.name, "dropped")
+		w.sub = events.subscribe(c.Events, 256, 0, func() {
+			dropped.Add(1)
+			warnRateLimited(w.logger, w.name, "Webhook: 送信キューが満杯のためイベントを破棄しました")
+		})
+		sinks = append(sinks, w)
+	}
+	for _, w := range sinks {
+		go w.run()
+	}
+	return sinks, nil
+}
+
+func (w *webhookSink) run() {
+	for e := range w.sub.ch {
+		w.deliver(e)
+	}
+}
+
+// deliver はイベントを送信し、失敗した場合は最大 maxRetries 回まで再送します
+func (w *webhookSink) deliver(e event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		w.logger.Error("Webhook: イベントのエンコードに失敗", "error", err)
+		return
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(e, body)
+		if err == nil {
+			webhookDeliveries.with(w.name, "success").Add(1)
+			return
+		}
+		if !retry || attempt >= w.maxRetries {
+			webhookDeliveries.with(w.name, "failed").Add(1)
+			w.logger.Warn("Webhook: イベントの送信に失敗", "event", e.Type, "id", e.ID, "attempts", attempt+1, "error", err)
+			return
+		}
+		w.logger.Debug("Webhook: イベントの送信に失敗したため再送します", "event", e.Type, "id", e.ID, "retry_in", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// post はイベントを1回送信します。再送しても成功しないエラー (4xx) の場合は retry=false を返します。
+func (w *webhookSink) post(e event, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rtsp2webrtc-webhook")
+	req.Header.Set("X-Rtsp2webrtc-Event", string(e.Type))
+	req.Header.Set("X-Rtsp2webrtc-Delivery", strconv.FormatUint(e.ID, 10))
+	req.Header.Set("X-Rtsp2webrtc-Timestamp", timestamp)
+	if len(w.secret) > 0 {
+		req.Header.Set("X-Rtsp2webrtc-Signature", "sha256="+signWebhook(w.secret, timestamp, body))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("HTTPステータス %d", res.StatusCode)
+	default:
+		return false, fmt.Errorf("HTTPステータス %d", res.StatusCode)
+	}
+}
+
+// signWebhook はWebhookの署名 HMAC-SHA256(secret, "<timestamp>.<body>") の16進表記を返します。
+// 受信側はタイムスタンプが古すぎないことも確認することで、再送攻撃を防げます。
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -1,85 +1,225 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/pion/webrtc/v3/pkg/media/h264reader"
 )
 
 // --- WebSocketアップグレーダー ---
-var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+// Originの検証は -allowed-origins で設定した許可リストに従います (未設定の場合はすべて許可)
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return viewerAuth.checkOrigin(r) }}
+
+// --- 視聴者セッション ---
+
+// viewerSession は管理APIから参照・切断できるWebRTC視聴者の接続です
+type viewerSession struct {
+	id          uint64
+	subject     string // 認証された視聴者 (匿名の場合は空)
+	remoteAddr  string // シグナリングの接続元アドレス
+	connectedAt time.Time
+	transport   string // "webrtc" または "mse" (WebSocketでfMP4を送信)
+	ws          *websocket.Conn
+	wsMutex     sync.Mutex // シグナリングハンドラー以外 (ストールの通知など) からの書き込みと排他
+
+	mutex  sync.Mutex
+	pc     *webrtc.PeerConnection // オファーの受信後に作成
+	codec  string
+	egress *atomic.Uint64 // 送信した映像のバイト数
+}
+
+var lastViewerSessionID atomic.Uint64
 
-// --- コーデック設定関数 ---
-func setCurrentCodec(codec string) {
-	currentCodec = codec
-	log.Printf("WebRTC出力コーデックを %s に設定しました", codec)
+func newViewerSession(viewer viewerIdentity, r *http.Request, ws *websocket.Conn) *viewerSession {
+	return &viewerSession{
+		id:          lastViewerSessionID.Add(1),
+		subject:     viewer.subject,
+		remoteAddr:  r.RemoteAddr,
+		connectedAt: time.Now(),
+		transport:   "webrtc",
+		ws:          ws,
+	}
 }
 
-// --- トラックリストとミューテックス (WebRTC用) ---
-var (
-	tracksSample     = make([]*webrtc.TrackLocalStaticSample, 0)
-	tracksSampleH265 = make([]*webrtc.TrackLocalStaticSample, 0)
-	trackMutex       sync.RWMutex
-	currentCodec     string = "h264" // デフォルトはH.264
-)
+func (v *viewerSession) setPeerConnection(pc *webrtc.PeerConnection, codec string, egress *atomic.Uint64) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.pc = pc
+	v.codec = codec
+	v.egress = egress
+}
+
+// setMSE はMSEの視聴者の配信コーデックと送信バイト数のカウンターを設定します
+func (v *viewerSession) setMSE(codec string, egress *atomic.Uint64) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.codec = codec
+	v.egress = egress
+}
+
+func (v *viewerSession) peerConnection() (*webrtc.PeerConnection, string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.pc, v.codec
+}
+
+// egressBytes は視聴者に送信した映像のバイト数を返します
+func (v *viewerSession) egressBytes() uint64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.egress == nil {
+		return 0
+	}
+	return v.egress.Load()
+}
+
+// send はシグナリングのWebSocketでメッセージを送信します
+func (v *viewerSession) send(msg interface{}) error {
+	v.wsMutex.Lock()
+	defer v.wsMutex.Unlock()
+	_ = v.ws.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	defer v.ws.SetWriteDeadline(time.Time{})
+	return v.ws.WriteJSON(msg)
+}
+
+// sendBinary はWebSocketでバイナリメッセージを送信します (MSEのセグメント)
+func (v *viewerSession) sendBinary(data []byte) error {
+	v.wsMutex.Lock()
+	defer v.wsMutex.Unlock()
+	_ = v.ws.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	defer v.ws.SetWriteDeadline(time.Time{})
+	return v.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// kick はWebSocketを閉じて視聴者を切断します (PeerConnectionはシグナリングハンドラーの終了時に閉じられます)
+func (v *viewerSession) kick(reason string) {
+	// WriteControl と Close はシグナリングハンドラーの読み書きと並行して呼び出せる
+	_ = v.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(time.Second))
+	_ = v.ws.Close()
+}
+
+// readMessages はWebSocketのメッセージを読み続けてチャネルに渡します。
+// 待機キューにいる間も切断を検出できるよう、受け入れの判定前から読み始めます。
+// 切断されるとチャネルを閉じ、返したコンテキストをキャンセルします。
+func readMessages(r *http.Request, ws *websocket.Conn, logger *slog.Logger) (<-chan []byte, context.Context) {
+	ctx, cancel := context.WithCancel(r.Context())
+	messages := make(chan []byte, 16)
+	go func() {
+		defer cancel()
+		defer close(messages)
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				logger.Debug("WebSocket読み取りエラー", "error", err)
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, ctx
+}
 
 // --- WebSocketシグナリングハンドラー ---
 func signalingHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract room parameter for per-room signaling
-	room := r.URL.Query().Get("room")
+	// stream パラメータで視聴するストリームを指定 (互換のため room も受け付ける)
+	room := r.URL.Query().Get("stream")
+	if room == "" {
+		room = r.URL.Query().Get("room")
+	}
 	if room == "" {
 		room = "default"
 	}
-	log.Printf("WebSocket接続 (room: %s, codec: %s)", room, currentCodec)
+	// PeerConnectionの作成前に視聴者の認証・認可を行う (ストリームの有無も認可後にのみ応答)
+	viewer, ok := authorizeViewer(w, r, room)
+	if !ok {
+		return
+	}
+	// playback パラメータを指定した場合は録画を再生 (値は開始時刻、空の場合は最も古い録画から)
+	if r.URL.Query().Has("playback") {
+		playbackHandler(w, r, room, viewer)
+		return
+	}
+	s := lookupStream(room)
+	if s == nil {
+		slog.Warn("存在しないストリームへの接続要求", "stream", room, "remote", r.RemoteAddr)
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	// codec パラメータで視聴者側のコーデックを明示できます (未指定時はオファーSDPから判定)
+	preferredCodec := r.URL.Query().Get("codec")
+	logger := s.logger.With("remote", r.RemoteAddr)
+	logger.Info("WebSocket接続", "input_codec", s.currentCodec())
 
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocketアップグレード失敗: %v", err)
+		logger.Warn("WebSocketアップグレード失敗", "error", err)
 		return
 	}
 	defer ws.Close()
-	
-	var pc *webrtc.PeerConnection
-	var track *webrtc.TrackLocalStaticSample
-	
-	// 現在のコーデックに応じて適切なPeerConnectionとトラックを設定
-	if currentCodec == "h265" {
-		pc, track = setupPeerConnectionH265()
-	} else {
-		pc, track = setupPeerConnection()
-	}
-	
-	if pc == nil || track == nil {
+	messages, ctx := readMessages(r, ws, logger)
+
+	// 視聴者数・送信帯域の上限を確認 (PeerConnectionの作成前)
+	release, err := admission.admit(ctx, s, viewer.subject, viewerQueueTimeout, func(position int) {
+		_ = ws.WriteJSON(map[string]interface{}{"type": "queued", "position": position})
+	})
+	if err != nil {
+		logger.Warn("視聴者を受け入れられません", "error", err)
+		rejectViewer(ws, s, r, viewer, err)
 		return
 	}
+	defer release()
+
+	session := newViewerSession(viewer, r, ws)
+	logger = logger.With("viewer", session.id)
+	s.addViewer(session)
+	defer s.removeViewer(session)
+	events.publish(event{Type: eventViewerJoined, Stream: s.name, Remote: session.remoteAddr, ViewerID: session.id, Subject: session.subject})
+	defer func() {
+		_, codec := session.peerConnection()
+		events.publish(event{Type: eventViewerLeft, Stream: s.name, Remote: session.remoteAddr, ViewerID: session.id, Subject: session.subject, Codec: codec})
+	}()
+	if s.isStalled() {
+		_ = session.send(streamStatus{Type: "status", State: "stalled"})
+	}
+
+	var pc *webrtc.PeerConnection
+	var track *webrtc.TrackLocalStaticSample
+	var viewerCodec string
+	// オファー受信前に届いたICE候補 (PeerConnectionはオファーのコーデックを見てから作成する)
+	var pendingCandidates []webrtc.ICECandidateInit
 	
 	defer func() {
+		if pc == nil {
+			return
+		}
 		_ = pc.Close()
-		if currentCodec == "h265" {
-			unregisterTrackH265(track)
+		if viewerCodec == "h265" {
+			s.unregisterTrackH265(track)
 		} else {
-			unregisterTrack(track)
+			s.unregisterTrack(track)
 		}
 	}()
 
-	log.Printf("WebSocket接続完了 (WebRTCモード - %s)", currentCodec)
+	logger.Info("WebSocket接続完了 (WebRTCモード)", "subject", viewer.subject, "input_codec", s.currentCodec())
 
-	for {
-		_, msg, err := ws.ReadMessage()
-		if err != nil {
-			log.Printf("WebSocket読み取りエラー: %v", err)
-			break
-		}
+	for msg := range messages {
 		var p map[string]interface{}
 		if err := json.Unmarshal(msg, &p); err != nil {
-			log.Printf("無効なWebSocketメッセージ: %v", err)
+			logger.Warn("無効なWebSocketメッセージ", "error", err)
 			continue
 		}
 		switch p["type"] {
@@ -88,18 +228,39 @@ func signalingHandler(w http.ResponseWriter, r *http.Request) {
 				Type: webrtc.SDPTypeOffer,
 				SDP:  p["sdp"].(string),
 			}
+			if pc == nil {
+				// H.265入力かつ視聴者がH.265に対応している場合のみパススルー、それ以外はH.264
+				viewerCodec = selectViewerCodec(s.currentCodec(), preferredCodec, offer.SDP)
+				if viewerCodec == "h265" {
+					pc, track = setupPeerConnectionH265(s, logger)
+				} else {
+					pc, track = setupPeerConnection(s, logger)
+				}
+				if pc == nil || track == nil {
+					pc = nil
+					return
+				}
+				session.setPeerConnection(pc, viewerCodec, s.trackEgress(track))
+				logger.Info("視聴者コーデックを決定しました", "codec", viewerCodec, "input_codec", s.currentCodec())
+			}
 			if err := pc.SetRemoteDescription(offer); err != nil {
-				log.Printf("リモートディスクリプションの設定失敗: %v", err)
+				logger.Warn("リモートディスクリプションの設定失敗", "error", err)
 				continue
 			}
+			for _, c := range pendingCandidates {
+				if err := pc.AddICECandidate(c); err != nil {
+					logger.Warn("ICE候補の追加失敗", "error", err, "candidate", c.Candidate)
+				}
+			}
+			pendingCandidates = nil
 
 			answer, err := pc.CreateAnswer(nil)
 			if err != nil {
-				log.Printf("アンサーの作成失敗: %v", err)
+				logger.Warn("アンサーの作成失敗", "error", err)
 				continue
 			}
 			if err := pc.SetLocalDescription(answer); err != nil {
-				log.Printf("ローカルディスクリプションの設定失敗: %v", err)
+				logger.Warn("ローカルディスクリプションの設定失敗", "error", err)
 				continue
 			}
 
@@ -108,72 +269,118 @@ func signalingHandler(w http.ResponseWriter, r *http.Request) {
 
 			// クライアントにアンサーを送信
 			response := map[string]string{"type": "answer", "sdp": pc.LocalDescription().SDP}
-			if err := ws.WriteJSON(response); err != nil {
-				log.Printf("アンサーの送信失敗: %v", err)
+			if err := session.send(response); err != nil {
+				logger.Warn("アンサーの送信失敗", "error", err)
 			}
 		case "candidate":
-			// ICE候補の型チェックと処理を改善
-			candidateData, exists := p["candidate"]
-			if !exists {
-				log.Printf("ICE候補メッセージに候補データが存在しません")
+			candidate, ok := parseICECandidate(p, logger)
+			if !ok {
 				continue
 			}
-
-			// candidateがnilの場合（end-of-candidates）
-			if candidateData == nil {
-				log.Printf("End-of-candidates signal received")
+			if pc == nil || pc.RemoteDescription() == nil {
+				pendingCandidates = append(pendingCandidates, candidate)
 				continue
 			}
-
-			candidateMap, ok := candidateData.(map[string]interface{})
-			if !ok {
-				log.Printf("無効な候補形式: %T", candidateData)
-				continue
+			if err := pc.AddICECandidate(candidate); err != nil {
+				logger.Warn("ICE候補の追加失敗", "error", err, "candidate", candidate.Candidate)
+			} else {
+				logger.Debug("ICE候補を正常に追加しました", "candidate", candidate.Candidate)
 			}
+		}
+	}
+	logger.Info("WebSocket切断")
+}
 
-			// 必要なフィールドの存在確認
-			candidateStr, ok1 := candidateMap["candidate"].(string)
-			sdpMidInterface, ok2 := candidateMap["sdpMid"]
-			sdpMLineIndexInterface, ok3 := candidateMap["sdpMLineIndex"]
+// rejectViewer は上限を超えたため受け入れられない視聴者にエラーを送信して切断します
+func rejectViewer(ws *websocket.Conn, s *stream, r *http.Request, viewer viewerIdentity, err error) {
+	events.publish(event{Type: eventViewerRejected, Stream: s.name, Remote: r.RemoteAddr, Subject: viewer.subject, Reason: err.Error()})
+	msg := map[string]interface{}{"type": "error", "code": "capacity_exceeded", "message": err.Error()}
+	if ce, ok := err.(*capacityError); ok {
+		msg["scope"] = ce.Scope
+		msg["limit"] = ce.Limit
+		msg["max"] = ce.Max
+	}
+	_ = ws.WriteJSON(msg)
+	_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "capacity exceeded"))
+}
 
-			if !ok1 || !ok2 || !ok3 {
-				log.Printf("ICE候補に必要なフィールドが不足: candidate=%v, sdpMid=%v, sdpMLineIndex=%v", ok1, ok2, ok3)
-				continue
-			}
+// parseICECandidate はシグナリングの candidate メッセージからICE候補を取り出します
+func parseICECandidate(p map[string]interface{}, logger *slog.Logger) (webrtc.ICECandidateInit, bool) {
+	candidateData, exists := p["candidate"]
+	if !exists {
+		logger.Debug("ICE候補メッセージに候補データが存在しません")
+		return webrtc.ICECandidateInit{}, false
+	}
 
-			var sdpMid *string
-			if sdpMidVal := sdpMidInterface; sdpMidVal != nil {
-				if sdpMidStr, ok := sdpMidVal.(string); ok {
-					sdpMid = &sdpMidStr
-				}
-			}
+	// candidateがnilの場合（end-of-candidates）
+	if candidateData == nil {
+		logger.Debug("End-of-candidates signal received")
+		return webrtc.ICECandidateInit{}, false
+	}
 
-			var sdpMLineIndex *uint16
-			if sdpMLineIndexVal := sdpMLineIndexInterface; sdpMLineIndexVal != nil {
-				if idx, ok := sdpMLineIndexVal.(float64); ok {
-					val := uint16(idx)
-					sdpMLineIndex = &val
-				}
-			}
+	candidateMap, ok := candidateData.(map[string]interface{})
+	if !ok {
+		logger.Warn("無効な候補形式", "type", fmt.Sprintf("%T", candidateData))
+		return webrtc.ICECandidateInit{}, false
+	}
 
-			candidate := webrtc.ICECandidateInit{
-				Candidate:     candidateStr,
-				SDPMid:        sdpMid,
-				SDPMLineIndex: sdpMLineIndex,
-			}
+	// 必要なフィールドの存在確認
+	candidateStr, ok1 := candidateMap["candidate"].(string)
+	sdpMidInterface, ok2 := candidateMap["sdpMid"]
+	sdpMLineIndexInterface, ok3 := candidateMap["sdpMLineIndex"]
 
-			if err := pc.AddICECandidate(candidate); err != nil {
-				log.Printf("ICE候補の追加失敗: %v, candidate: %+v", err, candidate)
-			} else {
-				log.Printf("ICE候補を正常に追加しました: %s", candidateStr)
-			}
+	if !ok1 || !ok2 || !ok3 {
+		logger.Warn("ICE候補に必要なフィールドが不足", "candidate", ok1, "sdpMid", ok2, "sdpMLineIndex", ok3)
+		return webrtc.ICECandidateInit{}, false
+	}
+
+	var sdpMid *string
+	if sdpMidVal := sdpMidInterface; sdpMidVal != nil {
+		if sdpMidStr, ok := sdpMidVal.(string); ok {
+			sdpMid = &sdpMidStr
 		}
 	}
-	log.Println("WebSocket切断")
+
+	var sdpMLineIndex *uint16
+	if sdpMLineIndexVal := sdpMLineIndexInterface; sdpMLineIndexVal != nil {
+		if idx, ok := sdpMLineIndexVal.(float64); ok {
+			val := uint16(idx)
+			sdpMLineIndex = &val
+		}
+	}
+
+	candidate := webrtc.ICECandidateInit{
+		Candidate:     candidateStr,
+		SDPMid:        sdpMid,
+		SDPMLineIndex: sdpMLineIndex,
+	}
+	return candidate, true
+}
+
+// selectViewerCodec は入力コーデックと視聴者の対応状況から配信コーデックを決定します
+func selectViewerCodec(inputCodec, preferred, offerSDP string) string {
+	if inputCodec != "h265" || preferred == "h264" {
+		return "h264"
+	}
+	if preferred == "h265" || offerSupportsH265(offerSDP) {
+		return "h265"
+	}
+	return "h264"
+}
+
+// offerSupportsH265 はオファーSDPにH.265のrtpmapが含まれているかを判定します
+func offerSupportsH265(offerSDP string) bool {
+	for _, line := range strings.Split(offerSDP, "\n") {
+		line = strings.ToUpper(strings.TrimSpace(line))
+		if strings.HasPrefix(line, "A=RTPMAP:") && (strings.Contains(line, " H265/") || strings.Contains(line, " HEVC/")) {
+			return true
+		}
+	}
+	return false
 }
 
 // --- PeerConnectionとトラックのセットアップ (WebRTC用) ---
-func setupPeerConnection() (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample) {
+func setupPeerConnection(s *stream, logger *slog.Logger) (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample) {
 	m := &webrtc.MediaEngine{}
 	_ = m.RegisterCodec(webrtc.RTPCodecParameters{
 		RTPCodecCapability: webrtc.RTPCodecCapability{
@@ -189,7 +396,7 @@ func setupPeerConnection() (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSamp
 		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	})
 	if err != nil {
-		log.Printf("PeerConnection作成失敗: %v", err)
+		logger.Error("PeerConnection作成失敗", "error", err)
 		return nil, nil
 	}
 
@@ -212,13 +419,19 @@ func setupPeerConnection() (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSamp
 			}
 		}
 	}()
+	// 接続完了時にGOPキャッシュを送信して配信を開始
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			s.primeTrack(track)
+		}
+	})
 
-	registerTrack(track)
+	s.registerTrack(track)
 	return pc, track
 }
 
 // --- PeerConnectionとH.265トラックのセットアップ (WebRTC用) ---
-func setupPeerConnectionH265() (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample) {
+func setupPeerConnectionH265(s *stream, logger *slog.Logger) (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample) {
 	m := &webrtc.MediaEngine{}
 	// H.265コーデックの登録 - より適切なfmtpLineを使用
 	err := m.RegisterCodec(webrtc.RTPCodecParameters{		RTPCodecCapability: webrtc.RTPCodecCapability{
@@ -229,7 +442,7 @@ func setupPeerConnectionH265() (*webrtc.PeerConnection, *webrtc.TrackLocalStatic
 		PayloadType: 97,
 	}, webrtc.RTPCodecTypeVideo)
 	if err != nil {
-		log.Printf("H.265コーデック登録失敗: %v", err)
+		logger.Error("H.265コーデック登録失敗", "error", err)
 		return nil, nil
 	}
 	
@@ -239,25 +452,25 @@ func setupPeerConnectionH265() (*webrtc.PeerConnection, *webrtc.TrackLocalStatic
 		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
 	})
 	if err != nil {
-		log.Printf("H.265 PeerConnection作成失敗: %v", err)
+		logger.Error("H.265 PeerConnection作成失敗", "error", err)
 		return nil, nil
 	}
 
 	// トラックを作成してからPeerConnectionに追加
 	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000}, "video", "pion")
 	if err != nil {
-		log.Printf("H.265トラック作成失敗: %v", err)
+		logger.Error("H.265トラック作成失敗", "error", err)
 		_ = pc.Close()
 		return nil, nil
 	}
 
 	// 先にトラックを登録
-	registerTrackH265(track)
+	s.registerTrackH265(track)
 
 	rtpSender, err := pc.AddTrack(track)
 	if err != nil {
-		log.Printf("H.265トラック追加失敗: %v", err)
-		unregisterTrackH265(track)
+		logger.Error("H.265トラック追加失敗", "error", err)
+		s.unregisterTrackH265(track)
 		_ = pc.Close()
 		return nil, nil
 	}
@@ -270,129 +483,27 @@ func setupPeerConnectionH265() (*webrtc.PeerConnection, *webrtc.TrackLocalStatic
 			}
 		}
 	}()
-
-	return pc, track
-}
-
-// --- トラック管理 (WebRTC用) ---
-func registerTrack(t *webrtc.TrackLocalStaticSample) {
-	trackMutex.Lock()
-	defer trackMutex.Unlock()
-	tracksSample = append(tracksSample, t)
-}
-func unregisterTrack(t *webrtc.TrackLocalStaticSample) {
-	trackMutex.Lock()
-	defer trackMutex.Unlock()
-	for i, tr := range tracksSample {
-		if tr == t {
-			tracksSample = append(tracksSample[:i], tracksSample[i+1:]...)
-			break
-		}
-	}
-}
-
-// --- H.265トラック管理 (WebRTC用) ---
-func registerTrackH265(t *webrtc.TrackLocalStaticSample) {
-	trackMutex.Lock()
-	defer trackMutex.Unlock()
-	tracksSampleH265 = append(tracksSampleH265, t)
-}
-func unregisterTrackH265(t *webrtc.TrackLocalStaticSample) {
-	trackMutex.Lock()
-	defer trackMutex.Unlock()
-	for i, tr := range tracksSampleH265 {
-		if tr == t {
-			tracksSampleH265 = append(tracksSampleH265[:i], tracksSampleH265[i+1:]...)
-			break
-		}
-	}
-}
-
-// NALユニット（[][]byteとして）をすべてのアクティブなWebRTCトラックに書き込む関数
-// この関数はgortsplib_handlerから呼び出されます
-func writeNALsToTracks(nals [][]byte, duration time.Duration) {
-	// WebRTCクライアントへの送信
-	trackMutex.RLock()
-	activeWebRTCTracks := len(tracksSample) > 0
-	trackMutex.RUnlock()
-
-	if activeWebRTCTracks {
-		for  _, nalData := range nals {
-			if len(nalData) == 0 {
-				continue // 空のNALユニットをスキップ
-			}
-			// 各NALユニットにAnnex-Bスタートコード（0x00000001）を付加
-			sample := media.Sample{
-				Data:     append([]byte{0x00, 0x00, 0x00, 0x01}, nalData...),
-				Duration: duration,
-			}
-
-			trackMutex.RLock()
-			for _, t := range tracksSample {
-				if err := t.WriteSample(sample); err != nil {
-					// エラー処理: log.Printf("WebRTCトラックへのサンプル書き込みエラー: %v", err)
-				}
-			}
-			trackMutex.RUnlock()
+	// 接続完了時にGOPキャッシュを送信して配信を開始
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			s.primeTrack(track)
 		}
-	}
-}
-
-// H.265 NALユニット（[][]byteとして）をすべてのアクティブなH.265 WebRTCトラックに書き込む関数
-// この関数はgortsplib_handlerのH.265パススルー機能から呼び出されます
-func writeNALsToTracksH265(nals [][]byte, duration time.Duration) {
-	// H.265 WebRTCクライアントへの送信
-	trackMutex.RLock()
-	activeWebRTCTracks := len(tracksSampleH265) > 0
-	trackMutex.RUnlock()
-
-	if activeWebRTCTracks {
-		for  _, nalData := range nals {
-			if len(nalData) == 0 {
-				continue // 空のNALユニットをスキップ
-			}
-			// 各NALユニットにAnnex-Bスタートコード（0x00000001）を付加
-			sample := media.Sample{
-				Data:     append([]byte{0x00, 0x00, 0x00, 0x01}, nalData...),
-				Duration: duration,
-			}
+	})
 
-			trackMutex.RLock()
-			for _, t := range tracksSampleH265 {
-				if err := t.WriteSample(sample); err != nil {
-					// エラー処理: log.Printf("H.265 WebRTCトラックへのサンプル書き込みエラー: %v", err)
-				}
-			}
-			trackMutex.RUnlock()
-		}
-	}
+	return pc, track
 }
 
 // --- NALストリーミングループ (ffmpegベースのハンドラー用) ---
-func streamNAL(h264r *h264reader.H264Reader, dur time.Duration) {
+func (s *stream) streamNAL(h264r *h264reader.H264Reader, dur time.Duration) {
 	for {
 		nal, err := h264r.NextNAL()
 		if err != nil {
 			if err.Error() != "EOF" { // io.EOF から文字列比較に変更し、より広範な互換性を確保
-				log.Printf("H264リーダーからのNAL読み取りエラー: %v", err)
+				s.logger.Warn("H264リーダーからのNAL読み取りエラー", "error", err)
 			}
 			break
 		}
 
-		sample := media.Sample{
-			Data:     append([]byte{0x00, 0x00, 0x00, 0x01}, nal.Data...), // Annex-B
-			Duration: dur,
-		}
-		trackMutex.RLock()
-		if len(tracksSample) > 0 {
-			for _, t := range tracksSample {
-				if err := t.WriteSample(sample); err != nil {
-					// log.Printf("WebRTCトラックへのサンプル書き込みエラー: %v", err)
-				}
-			}
-		}
-		trackMutex.RUnlock()
+		s.writeNALsToTracks([][]byte{nal.Data}, dur)
 	}
 }
-
-